@@ -0,0 +1,620 @@
+// Package config resolves the settings the server needs before it can open the database.
+// Values come from built-in defaults, then an optional YAML or JSON config file, then
+// environment variables. config.example.yaml documents every option.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"myfeed/logging"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	// Port is the port the HTTP server listens on
+	Port int `json:"port"`
+	// BaseURL is where the app is reached when a reverse proxy serves it under a sub-path,
+	// either the path like "/myfeed" or the full URL. Empty serves it at the root.
+	BaseURL string `json:"base_url"`
+	// Database selects PostgreSQL instead of the SQLite database in DataDir
+	Database DatabaseConfig `json:"database"`
+	// Auth configures logins and the tokens of the endpoints outside the login
+	Auth AuthConfig `json:"auth"`
+	// Fetch tunes how feeds are refreshed
+	Fetch FetchConfig `json:"fetch"`
+	// Log sets the level and format of the log output
+	Log LogConfig `json:"log"`
+	// Notifications limits the push services users may send notifications to
+	Notifications NotificationConfig `json:"notifications"`
+	// DataDir holds the SQLite database and any other state written at runtime
+	DataDir string `json:"data_dir"`
+	// StaticDir holds the frontend assets served under /static/. When empty, the assets
+	// embedded in the binary are served; set it to work on the frontend without rebuilding.
+	StaticDir string `json:"static_dir"`
+	// BackupDir holds database backups; defaults to <DataDir>/backups
+	BackupDir string `json:"backup_dir"`
+	// EnclosureDir holds the downloaded enclosures of feeds that cache them; defaults to
+	// <DataDir>/enclosures
+	EnclosureDir string `json:"enclosure_dir"`
+	// SMTP is the mail server used for email digests
+	SMTP SMTPConfig `json:"smtp"`
+	// Bookmarks is the bookmark manager that saved articles are posted to
+	Bookmarks BookmarkConfig `json:"bookmarks"`
+	// Podcasts holds the credentials of the podcast directories searched for shows
+	Podcasts PodcastConfig `json:"podcasts"`
+	// Server limits how long clients may take, so slow connections cannot pile up
+	Server ServerConfig `json:"server"`
+	// Health sets the thresholds of the readiness checks
+	Health HealthConfig `json:"health"`
+	// Hooks run for new articles. They can only be set here and through HOOK_COMMAND or
+	// HOOK_URL, never through the API, because they execute commands on the host.
+	Hooks []HookConfig `json:"hooks"`
+}
+
+// DatabaseConfig selects the database. SQLite in the data directory is used while URL is
+// empty.
+type DatabaseConfig struct {
+	URL          string `json:"url"`           // PostgreSQL connection string
+	QueryTimeout string `json:"query_timeout"` // ceiling of every query (Go duration)
+	Retries      int    `json:"retries"`       // retries of a query after a transient error
+}
+
+// Timeout returns the parsed QueryTimeout, which Load has validated
+func (d DatabaseConfig) Timeout() time.Duration {
+	timeout, _ := time.ParseDuration(d.QueryTimeout)
+	return timeout
+}
+
+// AuthConfig configures logins. The admin account is created, or has its password reset,
+// at every start. Disabled skips the login entirely and is only meant for debugging.
+type AuthConfig struct {
+	Disabled      bool   `json:"disabled"`
+	SessionSecret string `json:"session_secret"`
+	AdminUsername string `json:"admin_username"`
+	AdminPassword string `json:"admin_password"`
+	// MetricsToken protects /metrics; empty leaves it open
+	MetricsToken string `json:"metrics_token"`
+	// StatusToken enables /api/status; empty disables it
+	StatusToken string `json:"status_token"`
+}
+
+// FetchConfig tunes feed refreshing. The max_concurrent_refreshes setting overrides
+// MaxConcurrentRefreshes at runtime.
+type FetchConfig struct {
+	MaxConcurrentRefreshes int `json:"max_concurrent_refreshes"` // 0 for a CPU-based default
+}
+
+// LogConfig sets the minimum level (logging.Levels) and the format (text or json) of logs
+type LogConfig struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+// NotificationConfig limits the push providers. Targets of other providers cannot be
+// created and are not sent to.
+type NotificationConfig struct {
+	Providers  []string `json:"providers"`   // empty allows all
+	NtfyServer string   `json:"ntfy_server"` // default server of ntfy targets
+}
+
+// SMTP connection security modes
+const (
+	SMTPStartTLS = "starttls" // plain connection upgraded with STARTTLS, usually port 587
+	SMTPTLS      = "tls"      // TLS from the first byte, usually port 465
+	SMTPNoTLS    = "none"     // unencrypted, only for local relays
+)
+
+// SMTPConfig describes the outgoing mail server. Mail is disabled while Host is empty.
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	TLS      string `json:"tls"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
+// Enabled reports whether a mail server is configured
+func (s SMTPConfig) Enabled() bool {
+	return s.Host != ""
+}
+
+// Supported bookmark managers
+const (
+	BookmarkLinkding = "linkding"
+	BookmarkShaarli  = "shaarli"
+)
+
+// BookmarkConfig describes the bookmark manager saved articles are posted to. Posting is
+// disabled while Service is empty. Token is the linkding API token or the Shaarli API secret.
+type BookmarkConfig struct {
+	Service string   `json:"service"`
+	URL     string   `json:"url"`
+	Token   string   `json:"token"`
+	Tags    []string `json:"tags"` // added to every bookmark
+}
+
+// Enabled reports whether a bookmark manager is configured
+func (b BookmarkConfig) Enabled() bool {
+	return b.Service != "" && b.URL != ""
+}
+
+// PodcastConfig holds the Podcast Index API credentials, free at api.podcastindex.org.
+// Without them, podcasts are searched in the iTunes directory only.
+type PodcastConfig struct {
+	PodcastIndexKey    string `json:"podcast_index_key"`
+	PodcastIndexSecret string `json:"podcast_index_secret"`
+}
+
+// PodcastIndexEnabled reports whether Podcast Index credentials are configured
+func (p PodcastConfig) PodcastIndexEnabled() bool {
+	return p.PodcastIndexKey != "" && p.PodcastIndexSecret != ""
+}
+
+// ServerConfig holds the timeouts (Go durations, "0" for none) and size limits of the HTTP
+// server
+type ServerConfig struct {
+	ReadHeaderTimeout string `json:"read_header_timeout"`
+	ReadTimeout       string `json:"read_timeout"` // includes uploading the request body
+	WriteTimeout      string `json:"write_timeout"`
+	IdleTimeout       string `json:"idle_timeout"`    // between requests on a keep-alive connection
+	HandlerTimeout    string `json:"handler_timeout"` // how long an API handler may run
+	MaxHeaderBytes    int    `json:"max_header_bytes"`
+	MaxBodyBytes      int    `json:"max_body_bytes"` // of API request bodies
+	// ShutdownTimeout is how long requests and jobs get to finish after SIGTERM
+	ShutdownTimeout string `json:"shutdown_timeout"`
+	// ReusePort binds the port with SO_REUSEPORT once startup completes, so a new process
+	// can start next to the old one and take over without dropping connections
+	ReusePort bool `json:"reuse_port"`
+	// Listen lists the addresses the app is served on: "host:port", ":port" or
+	// "unix:/path/to.sock". Empty listens on Port on every interface.
+	Listen []string `json:"listen"`
+	// AdminListen lists addresses, in the same form, that serve the admin API and /metrics
+	// besides the app. When set, those routes are not served on the Listen addresses.
+	AdminListen []string `json:"admin_listen"`
+	// SocketMode is the file mode of Unix sockets (octal), which controls who may connect
+	SocketMode string `json:"socket_mode"`
+}
+
+// SocketFileMode returns the parsed SocketMode, which Load has validated
+func (s ServerConfig) SocketFileMode() os.FileMode {
+	mode, _ := strconv.ParseUint(s.SocketMode, 8, 32)
+	return os.FileMode(mode)
+}
+
+// Timeouts returns the parsed read header, read, write and idle timeouts. They have been
+// validated by Load.
+func (s ServerConfig) Timeouts() (readHeader, read, write, idle time.Duration) {
+	readHeader, _ = time.ParseDuration(s.ReadHeaderTimeout)
+	read, _ = time.ParseDuration(s.ReadTimeout)
+	write, _ = time.ParseDuration(s.WriteTimeout)
+	idle, _ = time.ParseDuration(s.IdleTimeout)
+	return
+}
+
+// ShutdownDuration returns the parsed ShutdownTimeout, which Load has validated
+func (s ServerConfig) ShutdownDuration() time.Duration {
+	timeout, _ := time.ParseDuration(s.ShutdownTimeout)
+	return timeout
+}
+
+// Limits returns the parsed handler timeout and the request body limit of the API, which
+// some routes raise or lift in main.go
+func (s ServerConfig) Limits() (handlerTimeout time.Duration, maxBodyBytes int64) {
+	handlerTimeout, _ = time.ParseDuration(s.HandlerTimeout)
+	return handlerTimeout, int64(s.MaxBodyBytes)
+}
+
+// validate rejects timeouts that are not durations
+func (s ServerConfig) validate() error {
+	timeouts := map[string]string{
+		"read_header_timeout": s.ReadHeaderTimeout,
+		"read_timeout":        s.ReadTimeout,
+		"write_timeout":       s.WriteTimeout,
+		"idle_timeout":        s.IdleTimeout,
+		"handler_timeout":     s.HandlerTimeout,
+		"shutdown_timeout":    s.ShutdownTimeout,
+	}
+	for name, value := range timeouts {
+		if timeout, err := time.ParseDuration(value); err != nil || timeout < 0 {
+			return fmt.Errorf("invalid server %s %q", name, value)
+		}
+	}
+	if s.MaxHeaderBytes <= 0 {
+		return fmt.Errorf("invalid server max_header_bytes %d", s.MaxHeaderBytes)
+	}
+	if s.MaxBodyBytes <= 0 {
+		return fmt.Errorf("invalid server max_body_bytes %d", s.MaxBodyBytes)
+	}
+	if mode, err := strconv.ParseUint(s.SocketMode, 8, 32); err != nil || mode > 0777 {
+		return fmt.Errorf("invalid server socket_mode %q", s.SocketMode)
+	}
+	if len(s.Listen) == 0 {
+		return fmt.Errorf("server listen needs at least one address")
+	}
+	for _, addr := range append(append([]string{}, s.Listen...), s.AdminListen...) {
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			if path == "" {
+				return fmt.Errorf("invalid server listen address %q: the socket path is missing", addr)
+			}
+			continue
+		}
+		if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+			return fmt.Errorf("invalid server listen address %q", addr)
+		}
+	}
+	return nil
+}
+
+// HealthConfig holds the thresholds below which /api/health/ready reports degraded
+type HealthConfig struct {
+	MinFreeMB int `json:"min_free_mb"` // free space required in the data directory
+	// MaxRefreshAge is how long ago the last successful feed refresh may be (Go duration).
+	// Empty derives it from the refresh_max_interval setting.
+	MaxRefreshAge string `json:"max_refresh_age"`
+}
+
+// RefreshAge returns the parsed MaxRefreshAge, or 0 if it is not set
+func (h HealthConfig) RefreshAge() time.Duration {
+	age, _ := time.ParseDuration(h.MaxRefreshAge)
+	return age
+}
+
+// defaultHookTimeout bounds a hook run when the hook sets no timeout
+const defaultHookTimeout = "30s"
+
+// HookConfig passes the JSON of every new article matching its filters to an external
+// command on stdin, or POSTs it to a URL. Exactly one of Command and URL is set. Articles
+// must be in one of FeedIDs, in FolderID (including subfolders) and contain one of
+// Keywords, for each filter that is set.
+type HookConfig struct {
+	Name     string   `json:"name"`
+	Command  []string `json:"command"` // program and arguments, run without a shell
+	URL      string   `json:"url"`
+	FeedIDs  []int    `json:"feed_ids"`
+	FolderID *int     `json:"folder_id"`
+	Keywords []string `json:"keywords"`
+	Timeout  string   `json:"timeout"` // Go duration, default 30s
+}
+
+// validateHooks fills in hook defaults and rejects incomplete or ambiguous hooks
+func (c *Config) validateHooks() error {
+	names := make(map[string]bool, len(c.Hooks))
+	for i := range c.Hooks {
+		hook := &c.Hooks[i]
+		if hook.Name == "" {
+			hook.Name = fmt.Sprintf("hook-%d", i+1)
+		}
+		if names[hook.Name] {
+			return fmt.Errorf("duplicate hook name %q", hook.Name)
+		}
+		names[hook.Name] = true
+
+		if (len(hook.Command) == 0) == (hook.URL == "") {
+			return fmt.Errorf("hook %q needs either a command or a url", hook.Name)
+		}
+		if hook.Timeout == "" {
+			hook.Timeout = defaultHookTimeout
+		}
+		if timeout, err := time.ParseDuration(hook.Timeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("hook %q has an invalid timeout %q", hook.Name, hook.Timeout)
+		}
+	}
+	return nil
+}
+
+func defaults() *Config {
+	return &Config{
+		Port:    8080,
+		DataDir: "./data",
+		Database: DatabaseConfig{
+			QueryTimeout: "30s",
+			Retries:      3,
+		},
+		Auth: AuthConfig{
+			AdminUsername: "admin",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: logging.FormatText,
+		},
+		Notifications: NotificationConfig{
+			NtfyServer: "https://ntfy.sh",
+		},
+		SMTP: SMTPConfig{
+			Port: 587,
+			TLS:  SMTPStartTLS,
+		},
+		Server: ServerConfig{
+			ReadHeaderTimeout: "10s",
+			ReadTimeout:       "60s",
+			WriteTimeout:      "60s",
+			IdleTimeout:       "120s",
+			HandlerTimeout:    "30s",
+			ShutdownTimeout:   "30s",
+			MaxHeaderBytes:    64 << 10,
+			MaxBodyBytes:      1 << 20,
+			SocketMode:        "0660",
+		},
+		Health: HealthConfig{
+			MinFreeMB: 100,
+		},
+	}
+}
+
+// Load builds the configuration. path may be empty, in which case only defaults and
+// environment variables are used. Every option has an environment variable, listed in
+// config.example.yaml.
+func Load(path string) (*Config, error) {
+	cfg := defaults()
+
+	if path != "" {
+		if err := cfg.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := overrideIntFromEnv(&cfg.Port, "PORT"); err != nil {
+		return nil, err
+	}
+	overrideFromEnv(&cfg.BaseURL, "BASE_URL")
+	if _, err := parseBasePath(cfg.BaseURL); err != nil {
+		return nil, err
+	}
+	overrideFromEnv(&cfg.Database.URL, "DATABASE_URL")
+	overrideFromEnv(&cfg.Database.QueryTimeout, "DB_QUERY_TIMEOUT")
+	if timeout, err := time.ParseDuration(cfg.Database.QueryTimeout); err != nil || timeout <= 0 {
+		return nil, fmt.Errorf("invalid database query_timeout %q", cfg.Database.QueryTimeout)
+	}
+	if err := overrideIntFromEnv(&cfg.Database.Retries, "DB_RETRIES"); err != nil {
+		return nil, err
+	}
+	if cfg.Database.Retries < 0 {
+		return nil, fmt.Errorf("invalid database retries %d", cfg.Database.Retries)
+	}
+
+	if value := os.Getenv("DISABLE_AUTH"); value != "" {
+		cfg.Auth.Disabled = value == "true"
+	}
+	overrideFromEnv(&cfg.Auth.SessionSecret, "SESSION_SECRET")
+	overrideFromEnv(&cfg.Auth.AdminUsername, "ADMIN_USERNAME")
+	overrideFromEnv(&cfg.Auth.AdminPassword, "ADMIN_PASSWORD")
+	overrideFromEnv(&cfg.Auth.MetricsToken, "METRICS_TOKEN")
+	overrideFromEnv(&cfg.Auth.StatusToken, "STATUS_TOKEN")
+
+	if err := overrideIntFromEnv(&cfg.Fetch.MaxConcurrentRefreshes, "MAX_CONCURRENT_REFRESHES"); err != nil {
+		return nil, err
+	}
+	if cfg.Fetch.MaxConcurrentRefreshes < 0 {
+		return nil, fmt.Errorf("invalid fetch max_concurrent_refreshes %d", cfg.Fetch.MaxConcurrentRefreshes)
+	}
+
+	overrideFromEnv(&cfg.Log.Level, "LOG_LEVEL")
+	overrideFromEnv(&cfg.Log.Format, "LOG_FORMAT")
+	if _, err := logging.ParseLevel(cfg.Log.Level); err != nil {
+		return nil, err
+	}
+
+	if value := os.Getenv("NOTIFICATION_PROVIDERS"); value != "" {
+		cfg.Notifications.Providers = splitList(value)
+	}
+	overrideFromEnv(&cfg.Notifications.NtfyServer, "NTFY_SERVER")
+
+	overrideFromEnv(&cfg.DataDir, "DATA_DIR")
+	overrideFromEnv(&cfg.StaticDir, "STATIC_DIR")
+	overrideFromEnv(&cfg.BackupDir, "BACKUP_DIR")
+	overrideFromEnv(&cfg.EnclosureDir, "ENCLOSURE_DIR")
+	overrideFromEnv(&cfg.SMTP.Host, "SMTP_HOST")
+	overrideFromEnv(&cfg.SMTP.TLS, "SMTP_TLS")
+	overrideFromEnv(&cfg.SMTP.Username, "SMTP_USERNAME")
+	overrideFromEnv(&cfg.SMTP.Password, "SMTP_PASSWORD")
+	overrideFromEnv(&cfg.SMTP.From, "SMTP_FROM")
+	if value := os.Getenv("SMTP_PORT"); value != "" {
+		if port, err := strconv.Atoi(value); err == nil && port > 0 {
+			cfg.SMTP.Port = port
+		} else {
+			logging.For("config").Warn("Invalid SMTP_PORT, using the default", "value", value, "port", cfg.SMTP.Port)
+		}
+	}
+	if cfg.SMTP.From == "" {
+		cfg.SMTP.From = cfg.SMTP.Username
+	}
+	overrideFromEnv(&cfg.Bookmarks.Service, "BOOKMARK_SERVICE")
+	overrideFromEnv(&cfg.Bookmarks.URL, "BOOKMARK_URL")
+	overrideFromEnv(&cfg.Bookmarks.Token, "BOOKMARK_TOKEN")
+	if value := os.Getenv("BOOKMARK_TAGS"); value != "" {
+		cfg.Bookmarks.Tags = splitList(value)
+	}
+	switch cfg.Bookmarks.Service {
+	case "", BookmarkLinkding, BookmarkShaarli:
+	default:
+		return nil, fmt.Errorf("unknown bookmark service %q", cfg.Bookmarks.Service)
+	}
+	overrideFromEnv(&cfg.Podcasts.PodcastIndexKey, "PODCAST_INDEX_KEY")
+	overrideFromEnv(&cfg.Podcasts.PodcastIndexSecret, "PODCAST_INDEX_SECRET")
+	if (cfg.Podcasts.PodcastIndexKey == "") != (cfg.Podcasts.PodcastIndexSecret == "") {
+		return nil, fmt.Errorf("podcasts podcast_index_key and podcast_index_secret must be set together")
+	}
+
+	overrideFromEnv(&cfg.Server.ReadHeaderTimeout, "HTTP_READ_HEADER_TIMEOUT")
+	overrideFromEnv(&cfg.Server.ReadTimeout, "HTTP_READ_TIMEOUT")
+	overrideFromEnv(&cfg.Server.WriteTimeout, "HTTP_WRITE_TIMEOUT")
+	overrideFromEnv(&cfg.Server.IdleTimeout, "HTTP_IDLE_TIMEOUT")
+	overrideFromEnv(&cfg.Server.HandlerTimeout, "HTTP_HANDLER_TIMEOUT")
+	overrideFromEnv(&cfg.Server.ShutdownTimeout, "HTTP_SHUTDOWN_TIMEOUT")
+	if value := os.Getenv("HTTP_REUSE_PORT"); value != "" {
+		cfg.Server.ReusePort = value == "true"
+	}
+	if err := overrideIntFromEnv(&cfg.Server.MaxHeaderBytes, "HTTP_MAX_HEADER_BYTES"); err != nil {
+		return nil, err
+	}
+	if err := overrideIntFromEnv(&cfg.Server.MaxBodyBytes, "HTTP_MAX_BODY_BYTES"); err != nil {
+		return nil, err
+	}
+	if value := os.Getenv("HTTP_LISTEN"); value != "" {
+		cfg.Server.Listen = splitList(value)
+	}
+	if value := os.Getenv("HTTP_ADMIN_LISTEN"); value != "" {
+		cfg.Server.AdminListen = splitList(value)
+	}
+	overrideFromEnv(&cfg.Server.SocketMode, "HTTP_SOCKET_MODE")
+	if len(cfg.Server.Listen) == 0 {
+		cfg.Server.Listen = []string{":" + strconv.Itoa(cfg.Port)}
+	}
+	if err := cfg.Server.validate(); err != nil {
+		return nil, err
+	}
+
+	overrideFromEnv(&cfg.Health.MaxRefreshAge, "HEALTH_MAX_REFRESH_AGE")
+	if err := overrideIntFromEnv(&cfg.Health.MinFreeMB, "HEALTH_MIN_FREE_MB"); err != nil {
+		return nil, err
+	}
+	if cfg.Health.MinFreeMB < 0 {
+		return nil, fmt.Errorf("invalid health min_free_mb %d", cfg.Health.MinFreeMB)
+	}
+	if cfg.Health.MaxRefreshAge != "" {
+		if age, err := time.ParseDuration(cfg.Health.MaxRefreshAge); err != nil || age <= 0 {
+			return nil, fmt.Errorf("invalid health max_refresh_age %q", cfg.Health.MaxRefreshAge)
+		}
+	}
+
+	if cfg.BackupDir == "" {
+		cfg.BackupDir = filepath.Join(cfg.DataDir, "backups")
+	}
+	if cfg.EnclosureDir == "" {
+		cfg.EnclosureDir = filepath.Join(cfg.DataDir, "enclosures")
+	}
+
+	// HOOK_COMMAND (split on whitespace) or HOOK_URL add a hook for every new article
+	if value := os.Getenv("HOOK_COMMAND"); value != "" {
+		cfg.Hooks = append(cfg.Hooks, HookConfig{Name: "env-command", Command: strings.Fields(value)})
+	}
+	if value := os.Getenv("HOOK_URL"); value != "" {
+		cfg.Hooks = append(cfg.Hooks, HookConfig{Name: "env-url", URL: value})
+	}
+	if err := cfg.validateHooks(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.resolve(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// BasePath returns the path prefix of every URL of the app, like "/myfeed", or "" when it
+// is served at the root. Load has validated BaseURL.
+func (c *Config) BasePath() string {
+	basePath, _ := parseBasePath(c.BaseURL)
+	return basePath
+}
+
+// PublicURL returns the full URL the app is reached at from outside, without a trailing
+// slash, or "" when BaseURL is only a path. Callbacks from other servers need it.
+func (c *Config) PublicURL() string {
+	u, err := url.Parse(c.BaseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return strings.TrimRight(c.BaseURL, "/")
+}
+
+func parseBasePath(baseURL string) (string, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.RawQuery != "" || u.Fragment != "" || (u.Host == "" && u.Scheme != "") {
+		return "", fmt.Errorf("invalid base_url %q", baseURL)
+	}
+	if u.Path != "" && !strings.HasPrefix(u.Path, "/") {
+		return "", fmt.Errorf("invalid base_url %q: the path must start with /", baseURL)
+	}
+	return strings.TrimRight(u.Path, "/"), nil
+}
+
+// readFile reads a YAML (.yaml, .yml) or JSON config file over the defaults. Unknown
+// options are rejected, so a typo does not silently leave the default in place.
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		// YAML is converted to JSON so both formats share the json field names
+		var doc map[string]interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+func overrideFromEnv(field *string, name string) {
+	if value := os.Getenv(name); value != "" {
+		*field = value
+	}
+}
+
+func overrideIntFromEnv(field *int, name string) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", name, value)
+	}
+	*field = parsed
+	return nil
+}
+
+// splitList splits a comma separated environment variable
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// resolve makes every directory absolute so later chdir calls or relative working
+// directories (systemd, containers) cannot change where files end up
+func (c *Config) resolve() error {
+	for _, dir := range []*string{&c.DataDir, &c.StaticDir, &c.BackupDir, &c.EnclosureDir} {
+		if *dir == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*dir)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %v", *dir, err)
+		}
+		*dir = abs
+	}
+	return nil
+}
+
+// DataPath returns the path of name inside the data directory
+func (c *Config) DataPath(name string) string {
+	return filepath.Join(c.DataDir, name)
+}
@@ -1,38 +1,62 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"myfeed/config"
+	"myfeed/logging"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
-	_ "github.com/mattn/go-sqlite3"
 )
 
+// ErrQueryTimeout is returned when a query exceeds the configured timeout
+var ErrQueryTimeout = errors.New("database query timed out")
+
+var dbLog = logging.For("db")
+
 type DB struct {
 	*sql.DB
 	isPostgreSQL bool
+	fullText     bool
+	queryTimeout time.Duration
+	retries      int
+	errs         errorTracker
 }
 
-func NewDatabase() (*DB, error) {
+// NewDatabase connects to PostgreSQL if a database URL is configured, otherwise it opens
+// the SQLite database inside dataDir. Every query is bounded by the configured timeout and
+// retried after transient errors, like a restarting PostgreSQL server or a locked SQLite
+// database.
+func NewDatabase(cfg config.DatabaseConfig, dataDir string) (*DB, error) {
+	var database *DB
+	var err error
 	// Check if PostgreSQL connection string is provided
-	if pgURL := os.Getenv("DATABASE_URL"); pgURL != "" {
-		log.Println("INFO: DATABASE_URL found, attempting PostgreSQL connection...")
-		return newPostgreSQLDatabase(pgURL)
+	if cfg.URL != "" {
+		dbLog.Info("Database URL found, attempting PostgreSQL connection")
+		database, err = newPostgreSQLDatabase(cfg.URL, cfg.Timeout())
+	} else {
+		// Fall back to SQLite for development
+		dbLog.Info("No database URL found, using SQLite for development")
+		database, err = newSQLiteDatabase(dataDir, cfg.Timeout())
 	}
-	
-	// Fall back to SQLite for development
-	log.Println("INFO: No DATABASE_URL found, using SQLite for development...")
-	return newSQLiteDatabase()
+	if err != nil {
+		return nil, err
+	}
+	database.retries = cfg.Retries
+	return database, nil
 }
 
-func newPostgreSQLDatabase(databaseURL string) (*DB, error) {
-	log.Println("Connecting to PostgreSQL database...")
+func newPostgreSQLDatabase(databaseURL string, queryTimeout time.Duration) (*DB, error) {
+	dbLog.Info("Connecting to PostgreSQL database")
 	
-	db, err := sql.Open("postgres", databaseURL)
+	db, err := sql.Open("postgres", postgresDSN(databaseURL))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open PostgreSQL database: %v", err)
 	}
@@ -41,25 +65,46 @@ func newPostgreSQLDatabase(databaseURL string) (*DB, error) {
 		return nil, fmt.Errorf("failed to ping PostgreSQL database: %v", err)
 	}
 
-	database := &DB{db, true}
-	if err := database.createPostgreSQLTables(); err != nil {
-		return nil, fmt.Errorf("failed to create PostgreSQL tables: %v", err)
+	database := &DB{DB: db, isPostgreSQL: true, queryTimeout: queryTimeout}
+	if err := database.migrate(); err != nil {
+		return nil, fmt.Errorf("failed to migrate PostgreSQL database: %v", err)
 	}
 
-	log.Println("PostgreSQL database initialized successfully")
+	dbLog.Info("PostgreSQL database initialized successfully")
 	return database, nil
 }
 
-func newSQLiteDatabase() (*DB, error) {
-	log.Println("Using SQLite database for development...")
+// postgresDSN sets the session timezone to UTC unless the connection string sets one.
+// TIMESTAMP columns store the wall time of the session, so CURRENT_TIMESTAMP and the
+// times written by the application only agree, and agree with SQLite, in UTC.
+func postgresDSN(databaseURL string) string {
+	if strings.HasPrefix(databaseURL, "postgres://") || strings.HasPrefix(databaseURL, "postgresql://") {
+		u, err := url.Parse(databaseURL)
+		if err != nil {
+			return databaseURL
+		}
+		query := u.Query()
+		if query.Get("timezone") == "" {
+			query.Set("timezone", "UTC")
+			u.RawQuery = query.Encode()
+		}
+		return u.String()
+	}
+	if strings.Contains(databaseURL, "timezone=") {
+		return databaseURL
+	}
+	return strings.TrimSpace(databaseURL + " timezone=UTC")
+}
+
+func newSQLiteDatabase(dataDir string, queryTimeout time.Duration) (*DB, error) {
+	dbLog.Info("Using SQLite database for development", "driver", sqliteDriver)
 	
-	dataDir := "./data"
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data directory: %v", err)
 	}
 
 	dbPath := filepath.Join(dataDir, "myfeed.db")
-	db, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=on")
+	db, err := sql.Open(sqliteDriver, sqliteDSN(dbPath))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open SQLite database: %v", err)
 	}
@@ -68,194 +113,15 @@ func newSQLiteDatabase() (*DB, error) {
 		return nil, fmt.Errorf("failed to ping SQLite database: %v", err)
 	}
 
-	database := &DB{db, false}
-	if err := database.createSQLiteTables(); err != nil {
-		return nil, fmt.Errorf("failed to create SQLite tables: %v", err)
+	database := &DB{DB: db, isPostgreSQL: false, queryTimeout: queryTimeout}
+	if err := database.migrate(); err != nil {
+		return nil, fmt.Errorf("failed to migrate SQLite database: %v", err)
 	}
 
-	log.Println("SQLite database initialized successfully")
+	dbLog.Info("SQLite database initialized successfully")
 	return database, nil
 }
 
-func (db *DB) createSQLiteTables() error {
-	schema := `
-	-- Folders table
-	CREATE TABLE IF NOT EXISTS folders (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		name TEXT NOT NULL,
-		parent_id INTEGER,
-		position INTEGER DEFAULT 0,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY (parent_id) REFERENCES folders(id) ON DELETE CASCADE
-	);
-
-	-- Feeds table
-	CREATE TABLE IF NOT EXISTS feeds (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		url TEXT UNIQUE NOT NULL,
-		title TEXT NOT NULL,
-		description TEXT,
-		folder_id INTEGER,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		last_fetch DATETIME,
-		health TEXT DEFAULT 'healthy' CHECK (health IN ('healthy', 'warning', 'error')),
-		error_count INTEGER DEFAULT 0,
-		FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE SET NULL
-	);
-
-	-- Articles table
-	CREATE TABLE IF NOT EXISTS articles (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		feed_id INTEGER NOT NULL,
-		title TEXT NOT NULL,
-		content TEXT,
-		url TEXT,
-		author TEXT,
-		published_at DATETIME NOT NULL,
-		read BOOLEAN DEFAULT FALSE,
-		saved BOOLEAN DEFAULT FALSE,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY (feed_id) REFERENCES feeds(id) ON DELETE CASCADE
-	);
-
-	-- Settings table
-	CREATE TABLE IF NOT EXISTS settings (
-		key TEXT PRIMARY KEY,
-		value TEXT NOT NULL
-	);
-
-	-- Indexes for better performance
-	CREATE INDEX IF NOT EXISTS idx_articles_feed_id ON articles(feed_id);
-	CREATE INDEX IF NOT EXISTS idx_articles_published_at ON articles(published_at);
-	CREATE INDEX IF NOT EXISTS idx_articles_read ON articles(read);
-	CREATE INDEX IF NOT EXISTS idx_articles_saved ON articles(saved);
-	CREATE INDEX IF NOT EXISTS idx_feeds_folder_id ON feeds(folder_id);
-	CREATE INDEX IF NOT EXISTS idx_folders_parent_id ON folders(parent_id);
-
-	-- Users table
-	CREATE TABLE IF NOT EXISTS users (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		username TEXT UNIQUE NOT NULL,
-		password TEXT NOT NULL,
-		is_admin BOOLEAN DEFAULT FALSE,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		last_login DATETIME
-	);
-
-	-- Sessions table
-	CREATE TABLE IF NOT EXISTS sessions (
-		id TEXT PRIMARY KEY,
-		user_id INTEGER NOT NULL,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		expires_at DATETIME NOT NULL,
-		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-	);
-
-	-- Indexes for users and sessions
-	CREATE INDEX IF NOT EXISTS idx_users_username ON users(username);
-	CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
-	CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
-
-	-- Insert default settings
-	INSERT OR IGNORE INTO settings (key, value) VALUES 
-		('app_title', 'MyFeed'),
-		('articles_per_page', '50'),
-		('cleanup_after_days', '30'),
-		('refresh_interval', '15m');
-	`
-
-	_, err := db.DB.Exec(schema)
-	return err
-}
-
-func (db *DB) createPostgreSQLTables() error {
-	schema := `
-	-- Folders table
-	CREATE TABLE IF NOT EXISTS folders (
-		id SERIAL PRIMARY KEY,
-		name TEXT NOT NULL,
-		parent_id INTEGER REFERENCES folders(id) ON DELETE CASCADE,
-		position INTEGER DEFAULT 0,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);
-
-	-- Feeds table
-	CREATE TABLE IF NOT EXISTS feeds (
-		id SERIAL PRIMARY KEY,
-		url TEXT UNIQUE NOT NULL,
-		title TEXT NOT NULL,
-		description TEXT,
-		folder_id INTEGER REFERENCES folders(id) ON DELETE SET NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		last_fetch TIMESTAMP,
-		health TEXT DEFAULT 'healthy' CHECK (health IN ('healthy', 'warning', 'error')),
-		error_count INTEGER DEFAULT 0
-	);
-
-	-- Articles table
-	CREATE TABLE IF NOT EXISTS articles (
-		id SERIAL PRIMARY KEY,
-		feed_id INTEGER NOT NULL REFERENCES feeds(id) ON DELETE CASCADE,
-		title TEXT NOT NULL,
-		content TEXT,
-		url TEXT,
-		author TEXT,
-		published_at TIMESTAMP NOT NULL,
-		read BOOLEAN DEFAULT FALSE,
-		saved BOOLEAN DEFAULT FALSE,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);
-
-	-- Settings table
-	CREATE TABLE IF NOT EXISTS settings (
-		key TEXT PRIMARY KEY,
-		value TEXT NOT NULL
-	);
-
-	-- Users table
-	CREATE TABLE IF NOT EXISTS users (
-		id SERIAL PRIMARY KEY,
-		username TEXT UNIQUE NOT NULL,
-		password TEXT NOT NULL,
-		is_admin BOOLEAN DEFAULT FALSE,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		last_login TIMESTAMP
-	);
-
-	-- Sessions table
-	CREATE TABLE IF NOT EXISTS sessions (
-		id TEXT PRIMARY KEY,
-		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		expires_at TIMESTAMP NOT NULL
-	);
-
-	-- Create indexes
-	CREATE INDEX IF NOT EXISTS idx_articles_feed_id ON articles(feed_id);
-	CREATE INDEX IF NOT EXISTS idx_articles_published_at ON articles(published_at);
-	CREATE INDEX IF NOT EXISTS idx_articles_read ON articles(read);
-	CREATE INDEX IF NOT EXISTS idx_articles_saved ON articles(saved);
-	CREATE INDEX IF NOT EXISTS idx_feeds_folder_id ON feeds(folder_id);
-	CREATE INDEX IF NOT EXISTS idx_folders_parent_id ON folders(parent_id);
-	CREATE INDEX IF NOT EXISTS idx_users_username ON users(username);
-	CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
-	CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
-
-	-- Insert default settings
-	INSERT INTO settings (key, value) VALUES 
-		('app_title', 'MyFeed'),
-		('articles_per_page', '50'),
-		('cleanup_after_days', '30'),
-		('refresh_interval', '15m')
-	ON CONFLICT (key) DO NOTHING;
-	`
-
-	_, err := db.DB.Exec(schema)
-	return err
-}
-
 // convertQuery converts SQLite-style queries (?) to PostgreSQL-style ($1, $2, etc.)
 func (db *DB) convertQuery(query string) string {
 	if !db.isPostgreSQL {
@@ -271,20 +137,158 @@ func (db *DB) convertQuery(query string) string {
 	return result
 }
 
+// withTimeout derives a context bounded by the configured query timeout ceiling.
+// A shorter deadline already present on ctx is kept.
+func (db *DB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, db.queryTimeout)
+}
+
+// Rows is sql.Rows that releases its query context when it is closed. Rows are read after
+// the query call returns, so the context cannot be cancelled on return.
+type Rows struct {
+	*sql.Rows
+	cancel context.CancelFunc
+}
+
+// Close closes the rows and releases their query context
+func (r *Rows) Close() error {
+	err := r.Rows.Close()
+	r.cancel()
+	return err
+}
+
+// Row is sql.Row that releases its query context once it is scanned
+type Row struct {
+	*sql.Row
+	cancel context.CancelFunc
+}
+
+// Scan copies the columns of the row into dest and releases its query context
+func (r *Row) Scan(dest ...interface{}) error {
+	defer r.cancel()
+	return r.Row.Scan(dest...)
+}
+
+// wrapTimeout turns deadline errors into ErrQueryTimeout so callers get a clear message
+func (db *DB) wrapTimeout(err error) error {
+	if err != nil && errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %s: %v", ErrQueryTimeout, db.queryTimeout, err)
+	}
+	return err
+}
+
+// IsTimeout reports whether err was caused by a query exceeding its timeout
+func IsTimeout(err error) bool {
+	return errors.Is(err, ErrQueryTimeout) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// utcArgs converts time arguments to UTC. The drivers write times with the offset of their
+// location, which SQLite keeps as text that no longer sorts in time order and PostgreSQL
+// drops, so every time is stored in UTC instead. The caller's slice is left as it is.
+func utcArgs(args []interface{}) []interface{} {
+	converted := args
+	for i, arg := range args {
+		var utc time.Time
+		switch t := arg.(type) {
+		case time.Time:
+			utc = t.UTC()
+		case *time.Time:
+			if t == nil {
+				continue
+			}
+			utc = t.UTC()
+		default:
+			continue
+		}
+		if &converted[0] == &args[0] {
+			converted = append([]interface{}(nil), args...)
+		}
+		converted[i] = utc
+	}
+	return converted
+}
+
 // QueryRow executes a query that returns at most one row with database-agnostic placeholders
-func (db *DB) QueryRow(query string, args ...interface{}) *sql.Row {
-	convertedQuery := db.convertQuery(query)
-	return db.DB.QueryRow(convertedQuery, args...)
+func (db *DB) QueryRow(query string, args ...interface{}) *Row {
+	return db.QueryRowContext(context.Background(), query, args...)
 }
 
 // Query executes a query that returns rows with database-agnostic placeholders
-func (db *DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
-	convertedQuery := db.convertQuery(query)
-	return db.DB.Query(convertedQuery, args...)
+func (db *DB) Query(query string, args ...interface{}) (*Rows, error) {
+	return db.QueryContext(context.Background(), query, args...)
 }
 
 // Exec executes a query that doesn't return rows with database-agnostic placeholders
 func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
-	convertedQuery := db.convertQuery(query)
-	return db.DB.Exec(convertedQuery, args...)
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+// Insert executes an INSERT into a table with an id column and returns the ID of the new
+// row. lib/pq does not support LastInsertId, so with PostgreSQL the ID is read back with
+// RETURNING instead.
+func (db *DB) Insert(query string, args ...interface{}) (int64, error) {
+	if !db.isPostgreSQL {
+		result, err := db.Exec(query, args...)
+		if err != nil {
+			return 0, err
+		}
+		return result.LastInsertId()
+	}
+
+	var id int64
+	query = strings.TrimSuffix(strings.TrimSpace(query), ";") + " RETURNING id"
+	err := db.QueryRow(query, args...).Scan(&id)
+	return id, db.wrapTimeout(err)
+}
+
+// QueryRowContext is QueryRow bounded by ctx and the query timeout ceiling
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *Row {
+	ctx, cancel := db.withTimeout(ctx)
+	query = db.convertQuery(query)
+	args = utcArgs(args)
+	var row *sql.Row
+	// Query errors are available from Err right away, scan errors only come later
+	db.retry(ctx, query, func() error {
+		row = db.DB.QueryRowContext(ctx, query, args...)
+		return row.Err()
+	})
+	db.recordError(row.Err())
+	return &Row{Row: row, cancel: cancel}
+}
+
+// QueryContext is Query bounded by ctx and the query timeout ceiling
+func (db *DB) QueryContext(ctx context.Context, query string, args ...interface{}) (*Rows, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	query = db.convertQuery(query)
+	args = utcArgs(args)
+	var rows *sql.Rows
+	err := db.retry(ctx, query, func() error {
+		var err error
+		rows, err = db.DB.QueryContext(ctx, query, args...)
+		return err
+	})
+	if err != nil {
+		cancel()
+		err = db.wrapTimeout(err)
+		db.recordError(err)
+		return nil, err
+	}
+	return &Rows{Rows: rows, cancel: cancel}, nil
+}
+
+// ExecContext is Exec bounded by ctx and the query timeout ceiling
+func (db *DB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	query = db.convertQuery(query)
+	args = utcArgs(args)
+	var result sql.Result
+	err := db.retry(ctx, query, func() error {
+		var err error
+		result, err = db.DB.ExecContext(ctx, query, args...)
+		return err
+	})
+	err = db.wrapTimeout(err)
+	db.recordError(err)
+	return result, err
 }
\ No newline at end of file
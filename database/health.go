@@ -0,0 +1,140 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"myfeed/metrics"
+	"sync"
+	"time"
+)
+
+// errorTracker remembers the most recent query failure so operators can tell whether
+// the database is the cause of slow or failing requests
+type errorTracker struct {
+	mu          sync.Mutex
+	count       int64
+	retries     int64
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// PoolStats is the JSON form of sql.DBStats
+type PoolStats struct {
+	MaxOpenConnections int   `json:"max_open_connections"`
+	OpenConnections    int   `json:"open_connections"`
+	InUse              int   `json:"in_use"`
+	Idle               int   `json:"idle"`
+	WaitCount          int64 `json:"wait_count"`
+	WaitDurationMs     int64 `json:"wait_duration_ms"`
+	MaxIdleClosed      int64 `json:"max_idle_closed"`
+	MaxIdleTimeClosed  int64 `json:"max_idle_time_closed"`
+	MaxLifetimeClosed  int64 `json:"max_lifetime_closed"`
+}
+
+// Health summarizes the connection pool and recent errors of the database
+type Health struct {
+	Engine      string     `json:"engine"`
+	Pool        PoolStats  `json:"pool"`
+	ErrorCount  int64      `json:"error_count"`
+	RetryCount  int64      `json:"retry_count"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// recordError stores err as the last database error. Missing rows are an expected
+// outcome rather than a failure and are ignored.
+func (db *DB) recordError(err error) {
+	if err == nil || errors.Is(err, sql.ErrNoRows) {
+		return
+	}
+
+	db.errs.mu.Lock()
+	defer db.errs.mu.Unlock()
+	db.errs.count++
+	db.errs.lastError = err.Error()
+	db.errs.lastErrorAt = time.Now()
+}
+
+// recordRetry counts a query retried after a transient error
+func (et *errorTracker) recordRetry() {
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	et.retries++
+}
+
+// Engine returns the name of the database backend in use
+func (db *DB) Engine() string {
+	if db.isPostgreSQL {
+		return "postgresql"
+	}
+	return "sqlite"
+}
+
+// Health returns the current pool statistics and last recorded error
+func (db *DB) Health() Health {
+	stats := db.Stats()
+	health := Health{
+		Engine: db.Engine(),
+		Pool: PoolStats{
+			MaxOpenConnections: stats.MaxOpenConnections,
+			OpenConnections:    stats.OpenConnections,
+			InUse:              stats.InUse,
+			Idle:               stats.Idle,
+			WaitCount:          stats.WaitCount,
+			WaitDurationMs:     stats.WaitDuration.Milliseconds(),
+			MaxIdleClosed:      stats.MaxIdleClosed,
+			MaxIdleTimeClosed:  stats.MaxIdleTimeClosed,
+			MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+		},
+	}
+
+	db.errs.mu.Lock()
+	defer db.errs.mu.Unlock()
+	health.ErrorCount = db.errs.count
+	health.RetryCount = db.errs.retries
+	health.LastError = db.errs.lastError
+	if !db.errs.lastErrorAt.IsZero() {
+		lastErrorAt := db.errs.lastErrorAt
+		health.LastErrorAt = &lastErrorAt
+	}
+
+	return health
+}
+
+// CollectMetrics writes the pool statistics and error counters to the metrics endpoint
+func (db *DB) CollectMetrics(w *metrics.Writer) {
+	health := db.Health()
+	engine := metrics.Label{Name: "engine", Value: health.Engine}
+	pool := health.Pool
+
+	w.Gauge("myfeed_db_max_open_connections", "Maximum number of open connections to the database.", float64(pool.MaxOpenConnections), engine)
+	w.Gauge("myfeed_db_open_connections", "Number of established connections, both in use and idle.", float64(pool.OpenConnections), engine)
+	w.Gauge("myfeed_db_in_use_connections", "Number of connections currently in use.", float64(pool.InUse), engine)
+	w.Gauge("myfeed_db_idle_connections", "Number of idle connections.", float64(pool.Idle), engine)
+	w.Counter("myfeed_db_wait_count_total", "Total number of connections waited for.", float64(pool.WaitCount), engine)
+	w.Counter("myfeed_db_wait_duration_seconds_total", "Total time blocked waiting for a new connection.", float64(pool.WaitDurationMs)/1000, engine)
+	w.Counter("myfeed_db_max_idle_closed_total", "Total number of connections closed due to SetMaxIdleConns.", float64(pool.MaxIdleClosed), engine)
+	w.Counter("myfeed_db_max_idle_time_closed_total", "Total number of connections closed due to SetConnMaxIdleTime.", float64(pool.MaxIdleTimeClosed), engine)
+	w.Counter("myfeed_db_max_lifetime_closed_total", "Total number of connections closed due to SetConnMaxLifetime.", float64(pool.MaxLifetimeClosed), engine)
+	w.Counter("myfeed_db_errors_total", "Total number of failed database queries.", float64(health.ErrorCount), engine)
+	w.Counter("myfeed_db_retries_total", "Total number of queries retried after a transient error.", float64(health.RetryCount), engine)
+
+	var lastErrorAt float64
+	if health.LastErrorAt != nil {
+		lastErrorAt = float64(health.LastErrorAt.Unix())
+	}
+	w.Gauge("myfeed_db_last_error_timestamp_seconds", "Unix time of the most recent failed database query, 0 if none.", lastErrorAt, engine)
+}
+
+// Size returns the space taken by the database in bytes: the database file for SQLite,
+// without its write-ahead log, or the current database for PostgreSQL
+func (db *DB) Size(ctx context.Context) (int64, error) {
+	query := `SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`
+	if db.isPostgreSQL {
+		query = `SELECT pg_database_size(current_database())`
+	}
+	var size int64
+	err := db.QueryRowContext(ctx, query).Scan(&size)
+	return size, err
+}
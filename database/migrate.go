@@ -0,0 +1,279 @@
+package database
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// migrationFiles holds the schema migrations, named NNNN_name.up.sql and
+// NNNN_name.down.sql, or NNNN_name.up.sqlite.sql and NNNN_name.up.postgres.sql when the
+// engines need different statements. Migrations are applied in the order of their number
+// and never edited once released; a change of the schema is a new migration.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migration is one version of the schema. Down is empty for migrations that cannot be
+// reverted.
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// searchIndexMigration creates the full-text index of articles
+const searchIndexMigration = "search_index"
+
+// optionalMigrations need a feature the database may lack: FTS5, which go-sqlite3 only has
+// with the sqlite_fts5 tag, and generated columns, new in PostgreSQL 12. If one fails, the
+// app runs without it and it is tried again at the next start.
+var optionalMigrations = map[string]string{
+	searchIndexMigration: "Full-text search is unavailable, searches scan all articles; build with -tags sqlite_fts5 or use PostgreSQL 12 or later",
+}
+
+// loadMigrations reads the migrations of the database's engine, ordered by version
+func (db *DB) loadMigrations() ([]*migration, error) {
+	engine := "sqlite"
+	if db.isPostgreSQL {
+		engine = "postgres"
+	}
+
+	byVersion := map[int]*migration{}
+	engineSpecific := map[string]bool{}
+	err := fs.WalkDir(migrationFiles, "migrations", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		// 0001_initial.up.sqlite.sql -> "0001_initial", "up", "sqlite"
+		parts := strings.Split(strings.TrimSuffix(entry.Name(), ".sql"), ".")
+		if len(parts) < 2 || len(parts) > 3 || (parts[1] != "up" && parts[1] != "down") {
+			return fmt.Errorf("invalid migration file name %s", entry.Name())
+		}
+		if len(parts) == 3 && parts[2] != engine {
+			return nil
+		}
+		number, name, _ := strings.Cut(parts[0], "_")
+		version, err := strconv.Atoi(number)
+		if err != nil || version < 1 || name == "" {
+			return fmt.Errorf("invalid migration file name %s", entry.Name())
+		}
+
+		// A script for this engine replaces the one for both
+		key := parts[0] + "." + parts[1]
+		if len(parts) == 2 && engineSpecific[key] {
+			return nil
+		}
+		engineSpecific[key] = len(parts) == 3
+
+		script, err := migrationFiles.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if m.name != name {
+			return fmt.Errorf("migrations %s and %s have the same number", m.name, name)
+		}
+		if parts[1] == "up" {
+			m.up = string(script)
+		} else {
+			m.down = string(script)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]*migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up script", m.version, m.name)
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// appliedVersions returns the versions recorded in schema_migrations, creating the table
+// on first use
+func (db *DB) appliedVersions() (map[int]bool, error) {
+	_, err := db.DB.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+
+	rows, err := db.DB.Query(`SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]bool{}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// migrate applies the migrations the database has not had yet, each in a transaction
+// with its entry in schema_migrations. Optional migrations that fail are left out.
+func (db *DB) migrate() error {
+	migrations, err := db.loadMigrations()
+	if err != nil {
+		return err
+	}
+	applied, err := db.appliedVersions()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		dbLog.Info("Applying database migration", "version", m.version, "name", m.name)
+		err := db.applyMigration(m)
+		if warning, optional := optionalMigrations[m.name]; err != nil && optional {
+			dbLog.Warn(warning, "version", m.version, "name", m.name, "error", err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("migration %d_%s failed: %v", m.version, m.name, err)
+		}
+		applied[m.version] = true
+	}
+
+	for _, m := range migrations {
+		if m.name == searchIndexMigration {
+			db.fullText = applied[m.version]
+		}
+	}
+
+	if version, err := db.SchemaVersion(); err == nil {
+		dbLog.Info("Database schema is up to date", "version", version)
+	}
+	return nil
+}
+
+// applyMigration runs the up script of a migration and records it
+func (db *DB) applyMigration(m *migration) error {
+	return db.InTx(context.Background(), func(tx *Tx) error {
+		if err := db.execScript(tx, m.up); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.version, m.name)
+		return err
+	})
+}
+
+// execScript runs the statements of a migration script. SQLite has no ADD COLUMN IF NOT
+// EXISTS, so there its statements run one by one and adding a column that already exists
+// is skipped, as PostgreSQL does with IF NOT EXISTS.
+func (db *DB) execScript(tx *Tx, script string) error {
+	if db.isPostgreSQL {
+		_, err := tx.tx.Exec(script)
+		return err
+	}
+	for _, statement := range sqliteStatements(script) {
+		_, err := tx.tx.Exec(statement)
+		if err != nil && strings.Contains(err.Error(), "duplicate column name") {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteStatements splits a script into its statements, one ending at every line that
+// ends with a semicolon. The statements in the body of a trigger stay with the trigger,
+// which ends at END;.
+func sqliteStatements(script string) []string {
+	var statements []string
+	var statement strings.Builder
+	inTrigger := false
+	for _, line := range strings.Split(script, "\n") {
+		statement.WriteString(line + "\n")
+		text := strings.ToUpper(strings.TrimSpace(line))
+		if strings.HasPrefix(text, "--") {
+			continue
+		}
+		if strings.HasPrefix(text, "CREATE TRIGGER") {
+			inTrigger = true
+		}
+		if !strings.HasSuffix(text, ";") || (inTrigger && text != "END;") {
+			continue
+		}
+		statements = append(statements, statement.String())
+		statement.Reset()
+		inTrigger = false
+	}
+	if strings.TrimSpace(statement.String()) != "" {
+		statements = append(statements, statement.String())
+	}
+	return statements
+}
+
+// SchemaVersion returns the latest migration applied to the database
+func (db *DB) SchemaVersion() (int, error) {
+	var version int
+	err := db.DB.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// MigrateDown reverts the migrations above version, newest first, for going back to an
+// older release. It stops at a migration that cannot be reverted.
+func (db *DB) MigrateDown(version int) error {
+	migrations, err := db.loadMigrations()
+	if err != nil {
+		return err
+	}
+	applied, err := db.appliedVersions()
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version <= version || !applied[m.version] {
+			continue
+		}
+		if m.down == "" {
+			return fmt.Errorf("migration %d_%s cannot be reverted", m.version, m.name)
+		}
+		dbLog.Info("Reverting database migration", "version", m.version, "name", m.name)
+		err := db.InTx(context.Background(), func(tx *Tx) error {
+			if err := db.execScript(tx, m.down); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, m.version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("reverting migration %d_%s failed: %v", m.version, m.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,430 @@
+-- Folders table
+CREATE TABLE IF NOT EXISTS folders (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	parent_id INTEGER,
+	position INTEGER DEFAULT 0,
+	imported BOOLEAN DEFAULT FALSE,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (parent_id) REFERENCES folders(id) ON DELETE CASCADE
+);
+
+-- Feeds table
+CREATE TABLE IF NOT EXISTS feeds (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	url TEXT UNIQUE NOT NULL,
+	title TEXT NOT NULL,
+	description TEXT,
+	folder_id INTEGER,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	last_fetch DATETIME,
+	health TEXT DEFAULT 'healthy' CHECK (health IN ('healthy', 'warning', 'error')),
+	error_count INTEGER DEFAULT 0,
+	unread_count INTEGER DEFAULT 0,
+	next_fetch_at DATETIME,
+	paused BOOLEAN DEFAULT FALSE,
+	position INTEGER DEFAULT 0,
+	cache_enclosures BOOLEAN,
+	refresh_interval INTEGER,
+	fetch_full_content BOOLEAN DEFAULT FALSE,
+	etag TEXT,
+	last_modified TEXT,
+	FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE SET NULL
+);
+
+-- Articles table
+CREATE TABLE IF NOT EXISTS articles (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	feed_id INTEGER NOT NULL,
+	title TEXT NOT NULL,
+	content TEXT,
+	url TEXT,
+	author TEXT,
+	published_at DATETIME NOT NULL,
+	read BOOLEAN DEFAULT FALSE,
+	saved BOOLEAN DEFAULT FALSE,
+	read_at DATETIME,
+	saved_at DATETIME,
+	content_truncated BOOLEAN DEFAULT FALSE,
+	full_content TEXT,
+	dedup_hash TEXT,
+	url_hash TEXT,
+	guid TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (feed_id) REFERENCES feeds(id) ON DELETE CASCADE
+);
+
+-- Settings table
+CREATE TABLE IF NOT EXISTS settings (
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+
+-- Per-feed statistics, maintained incrementally on ingest and read-state changes
+CREATE TABLE IF NOT EXISTS feed_stats (
+	feed_id INTEGER PRIMARY KEY,
+	article_count INTEGER DEFAULT 0,
+	first_article_at DATETIME,
+	last_article_at DATETIME,
+	avg_post_interval INTEGER DEFAULT 0,
+	opened_count INTEGER DEFAULT 0,
+	last_opened_at DATETIME,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (feed_id) REFERENCES feeds(id) ON DELETE CASCADE
+);
+
+-- Daily per-feed activity, rolled up nightly from the articles table
+CREATE TABLE IF NOT EXISTS stats_history (
+	day TEXT NOT NULL, -- YYYY-MM-DD in UTC
+	feed_id INTEGER NOT NULL,
+	articles_ingested INTEGER DEFAULT 0,
+	articles_read INTEGER DEFAULT 0,
+	articles_saved INTEGER DEFAULT 0,
+	PRIMARY KEY (day, feed_id),
+	FOREIGN KEY (feed_id) REFERENCES feeds(id) ON DELETE CASCADE
+);
+
+-- Background jobs, claimed by the worker pool in priority and run_at order
+CREATE TABLE IF NOT EXISTS jobs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	type TEXT NOT NULL,
+	target TEXT,
+	payload TEXT NOT NULL DEFAULT '{}',
+	status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'done', 'failed')),
+	attempts INTEGER DEFAULT 0,
+	max_attempts INTEGER DEFAULT 3,
+	priority INTEGER DEFAULT 0,
+	last_error TEXT,
+	result TEXT,
+	run_at DATETIME NOT NULL,
+	started_at DATETIME,
+	finished_at DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_jobs_status_run_at ON jobs(status, run_at);
+
+-- Feeds that kept failing and were paused until an admin requeues or dismisses them
+CREATE TABLE IF NOT EXISTS dead_letters (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	feed_id INTEGER NOT NULL UNIQUE,
+	error TEXT NOT NULL,
+	error_count INTEGER NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (feed_id) REFERENCES feeds(id) ON DELETE CASCADE
+);
+
+-- Email digest subscriptions, one per user
+CREATE TABLE IF NOT EXISTS digest_subscriptions (
+	user_id INTEGER PRIMARY KEY,
+	email TEXT NOT NULL,
+	frequency TEXT NOT NULL DEFAULT 'daily' CHECK (frequency IN ('daily', 'weekly')),
+	folder_id INTEGER,
+	enabled BOOLEAN DEFAULT TRUE,
+	last_sent_at DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE SET NULL
+);
+
+-- Feeds whose new articles are emailed to a user one by one
+CREATE TABLE IF NOT EXISTS email_forwards (
+	user_id INTEGER NOT NULL,
+	feed_id INTEGER NOT NULL,
+	email TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (user_id, feed_id),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (feed_id) REFERENCES feeds(id) ON DELETE CASCADE
+);
+
+-- Media files attached to articles, like podcast episodes; file is set once the
+-- enclosure has been downloaded to the enclosure directory
+CREATE TABLE IF NOT EXISTS enclosures (
+	article_id INTEGER PRIMARY KEY,
+	url TEXT NOT NULL,
+	type TEXT NOT NULL DEFAULT '',
+	length INTEGER DEFAULT 0,
+	file TEXT,
+	size INTEGER DEFAULT 0,
+	error TEXT,
+	cached_at DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (article_id) REFERENCES articles(id) ON DELETE CASCADE
+);
+
+-- WebSub subscriptions of feeds at their hubs, so hubs push new items; state is
+-- pending, active, denied, failed or none when the feed names no hub
+CREATE TABLE IF NOT EXISTS websub_subscriptions (
+	feed_id INTEGER PRIMARY KEY,
+	hub TEXT NOT NULL DEFAULT '',
+	topic TEXT NOT NULL DEFAULT '',
+	secret TEXT NOT NULL DEFAULT '',
+	state TEXT NOT NULL DEFAULT 'pending',
+	lease_expires_at DATETIME,
+	error TEXT,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (feed_id) REFERENCES feeds(id) ON DELETE CASCADE
+);
+
+-- Push notification targets (ntfy, Gotify, Pushover, webhooks) with per-target rules
+CREATE TABLE IF NOT EXISTS notification_targets (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	provider TEXT NOT NULL,
+	config TEXT NOT NULL DEFAULT '{}',
+	folder_id INTEGER,
+	keywords TEXT NOT NULL DEFAULT '[]',
+	enabled BOOLEAN DEFAULT TRUE,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE SET NULL
+);
+
+-- Rules routing matching articles to notification targets, with an hourly cap
+CREATE TABLE IF NOT EXISTS notification_rules (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	feed_id INTEGER,
+	folder_id INTEGER,
+	keywords TEXT NOT NULL DEFAULT '[]',
+	target_ids TEXT NOT NULL DEFAULT '[]',
+	max_per_hour INTEGER NOT NULL DEFAULT 0,
+	enabled BOOLEAN DEFAULT TRUE,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (feed_id) REFERENCES feeds(id) ON DELETE CASCADE,
+	FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE CASCADE
+);
+
+-- Quiet hours of each user's notifications
+CREATE TABLE IF NOT EXISTS notification_preferences (
+	user_id INTEGER PRIMARY KEY,
+	quiet_start TEXT NOT NULL DEFAULT '',
+	quiet_end TEXT NOT NULL DEFAULT '',
+	timezone TEXT NOT NULL DEFAULT 'UTC',
+	batch BOOLEAN DEFAULT FALSE,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Notifications held during quiet hours, pushed combined when they end
+CREATE TABLE IF NOT EXISTS held_notifications (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	target_id INTEGER NOT NULL,
+	title TEXT NOT NULL,
+	message TEXT NOT NULL,
+	url TEXT NOT NULL DEFAULT '',
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (target_id) REFERENCES notification_targets(id) ON DELETE CASCADE
+);
+
+-- Delivery log of notifications, kept for notification_log_days
+CREATE TABLE IF NOT EXISTS notification_deliveries (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	target_id INTEGER NOT NULL,
+	article_id INTEGER,
+	title TEXT NOT NULL,
+	message TEXT NOT NULL,
+	url TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL,
+	error TEXT,
+	attempts INTEGER DEFAULT 0,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (target_id) REFERENCES notification_targets(id) ON DELETE CASCADE,
+	FOREIGN KEY (article_id) REFERENCES articles(id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS idx_notification_deliveries_user ON notification_deliveries(user_id, created_at);
+
+-- Webhooks of users, POSTed the new articles matching their filters
+CREATE TABLE IF NOT EXISTS webhooks (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	url TEXT NOT NULL,
+	secret TEXT NOT NULL DEFAULT '',
+	feed_id INTEGER,
+	folder_id INTEGER,
+	keywords TEXT NOT NULL DEFAULT '[]',
+	enabled BOOLEAN DEFAULT TRUE,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (feed_id) REFERENCES feeds(id) ON DELETE CASCADE,
+	FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE CASCADE
+);
+
+-- Delivery log of webhooks, kept for notification_log_days
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	webhook_id INTEGER NOT NULL,
+	article_id INTEGER,
+	payload TEXT NOT NULL,
+	status TEXT NOT NULL,
+	response_status INTEGER,
+	error TEXT,
+	attempts INTEGER DEFAULT 0,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE,
+	FOREIGN KEY (article_id) REFERENCES articles(id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_user ON webhook_deliveries(user_id, created_at);
+
+-- Rules of users applied to new articles: conditions on their text and actions
+CREATE TABLE IF NOT EXISTS rules (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	feed_id INTEGER,
+	folder_id INTEGER,
+	match_mode TEXT NOT NULL DEFAULT 'all',
+	conditions TEXT NOT NULL DEFAULT '[]',
+	actions TEXT NOT NULL DEFAULT '[]',
+	enabled BOOLEAN DEFAULT TRUE,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (feed_id) REFERENCES feeds(id) ON DELETE CASCADE,
+	FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE CASCADE
+);
+
+-- Tags of articles per user, set by rules
+CREATE TABLE IF NOT EXISTS article_tags (
+	user_id INTEGER NOT NULL,
+	article_id INTEGER NOT NULL,
+	tag TEXT NOT NULL,
+	PRIMARY KEY (user_id, article_id, tag),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (article_id) REFERENCES articles(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_article_tags_tag ON article_tags(user_id, tag);
+
+-- Last run of each recurring task, to catch up on runs missed while the process was down
+CREATE TABLE IF NOT EXISTS cron_runs (
+	name TEXT PRIMARY KEY,
+	last_run_at TIMESTAMP NOT NULL
+);
+
+-- Indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_articles_feed_id ON articles(feed_id);
+CREATE INDEX IF NOT EXISTS idx_articles_published_at ON articles(published_at);
+CREATE INDEX IF NOT EXISTS idx_articles_published_id ON articles(published_at, id);
+CREATE INDEX IF NOT EXISTS idx_articles_read ON articles(read);
+CREATE INDEX IF NOT EXISTS idx_articles_saved ON articles(saved);
+CREATE INDEX IF NOT EXISTS idx_feeds_folder_id ON feeds(folder_id);
+CREATE INDEX IF NOT EXISTS idx_folders_parent_id ON folders(parent_id);
+
+-- Users table
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT UNIQUE NOT NULL,
+	password TEXT NOT NULL,
+	is_admin BOOLEAN DEFAULT FALSE,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	last_login DATETIME,
+	timezone TEXT NOT NULL DEFAULT '',
+	disabled BOOLEAN DEFAULT FALSE
+);
+
+-- Sessions table
+CREATE TABLE IF NOT EXISTS sessions (
+	id TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	expires_at DATETIME NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Personal access tokens for scripts and apps, stored as the SHA-256 of the token;
+-- prefix is the start of the token, to tell tokens apart
+CREATE TABLE IF NOT EXISTS api_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	token_hash TEXT UNIQUE NOT NULL,
+	prefix TEXT NOT NULL,
+	scope TEXT NOT NULL DEFAULT 'read',
+	last_used_at DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- The feeds each user follows, with their place in that user's folders. Feeds and
+-- their articles are shared, so a feed is fetched once however many users follow it.
+CREATE TABLE IF NOT EXISTS subscriptions (
+	user_id INTEGER NOT NULL,
+	feed_id INTEGER NOT NULL,
+	folder_id INTEGER,
+	position INTEGER DEFAULT 0,
+	unread_count INTEGER DEFAULT 0,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (user_id, feed_id),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (feed_id) REFERENCES feeds(id) ON DELETE CASCADE,
+	FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS idx_subscriptions_feed_id ON subscriptions(feed_id);
+
+-- Read and saved state of articles per user; articles without a row are unread
+CREATE TABLE IF NOT EXISTS article_states (
+	user_id INTEGER NOT NULL,
+	article_id INTEGER NOT NULL,
+	read BOOLEAN DEFAULT FALSE,
+	saved BOOLEAN DEFAULT FALSE,
+	read_at DATETIME,
+	saved_at DATETIME,
+	hidden BOOLEAN DEFAULT FALSE,
+	PRIMARY KEY (user_id, article_id),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (article_id) REFERENCES articles(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_article_states_article_id ON article_states(article_id);
+
+-- First time a user opened each article, kept after the article is cleaned up
+CREATE TABLE IF NOT EXISTS read_events (
+	user_id INTEGER NOT NULL,
+	article_id INTEGER NOT NULL,
+	feed_id INTEGER NOT NULL,
+	published_at DATETIME NOT NULL,
+	read_at DATETIME NOT NULL,
+	PRIMARY KEY (user_id, article_id),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (feed_id) REFERENCES feeds(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_read_events_read_at ON read_events(read_at);
+
+-- Indexes for users and sessions
+CREATE INDEX IF NOT EXISTS idx_users_username ON users(username);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
+
+-- Insert default settings
+INSERT OR IGNORE INTO settings (key, value) VALUES 
+	('app_title', 'MyFeed'),
+	('articles_per_page', '50'),
+	('cleanup_after_days', '30'),
+	('refresh_interval', '15m'),
+	('refresh_max_interval', '24h'),
+	('refresh_schedule', '@every 1m'),
+	('cleanup_schedule', '0 2 * * *'),
+	('repair_schedule', '0 3 * * *'),
+	('session_cleanup_schedule', '0 * * * *'),
+	('stats_schedule', '30 1 * * *'),
+	('digest_schedule', '0 7 * * *'),
+	('backup_schedule', '0 4 * * *'),
+	('backup_enabled', 'false'),
+	('backup_keep', '7'),
+	('backup_include_settings', 'true'),
+	('notification_log_days', '30'),
+	('max_article_kb', '512'),
+	('update_check', 'true'),
+	('maintenance_mode', 'false');
@@ -0,0 +1,36 @@
+-- Columns added to tables before schema migrations existed. The initial migration creates
+-- them in new databases, but CREATE TABLE IF NOT EXISTS never alters the tables of older
+-- ones.
+ALTER TABLE feeds ADD COLUMN IF NOT EXISTS unread_count INTEGER DEFAULT 0;
+ALTER TABLE folders ADD COLUMN IF NOT EXISTS imported BOOLEAN DEFAULT FALSE;
+ALTER TABLE feeds ADD COLUMN IF NOT EXISTS next_fetch_at TIMESTAMP;
+ALTER TABLE feeds ADD COLUMN IF NOT EXISTS paused BOOLEAN DEFAULT FALSE;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS target TEXT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS result TEXT;
+ALTER TABLE feed_stats ADD COLUMN IF NOT EXISTS opened_count INTEGER DEFAULT 0;
+ALTER TABLE feed_stats ADD COLUMN IF NOT EXISTS last_opened_at TIMESTAMP;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS priority INTEGER DEFAULT 0;
+ALTER TABLE articles ADD COLUMN IF NOT EXISTS read_at TIMESTAMP;
+ALTER TABLE articles ADD COLUMN IF NOT EXISTS saved_at TIMESTAMP;
+ALTER TABLE articles ADD COLUMN IF NOT EXISTS content_truncated BOOLEAN DEFAULT FALSE;
+ALTER TABLE articles ADD COLUMN IF NOT EXISTS full_content TEXT;
+ALTER TABLE feeds ADD COLUMN IF NOT EXISTS position INTEGER DEFAULT 0;
+ALTER TABLE articles ADD COLUMN IF NOT EXISTS dedup_hash TEXT;
+ALTER TABLE articles ADD COLUMN IF NOT EXISTS url_hash TEXT;
+ALTER TABLE articles ADD COLUMN IF NOT EXISTS guid TEXT;
+ALTER TABLE feeds ADD COLUMN IF NOT EXISTS cache_enclosures BOOLEAN;
+ALTER TABLE feeds ADD COLUMN IF NOT EXISTS refresh_interval INTEGER;
+ALTER TABLE feeds ADD COLUMN IF NOT EXISTS fetch_full_content BOOLEAN DEFAULT FALSE;
+ALTER TABLE folders ADD COLUMN IF NOT EXISTS user_id INTEGER REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS timezone TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled BOOLEAN DEFAULT FALSE;
+ALTER TABLE feeds ADD COLUMN IF NOT EXISTS etag TEXT;
+ALTER TABLE feeds ADD COLUMN IF NOT EXISTS last_modified TEXT;
+ALTER TABLE article_states ADD COLUMN IF NOT EXISTS hidden BOOLEAN DEFAULT FALSE;
+
+-- Indexes on those columns, which can only be created once they exist
+CREATE INDEX IF NOT EXISTS idx_feeds_next_fetch_at ON feeds(next_fetch_at);
+CREATE INDEX IF NOT EXISTS idx_articles_dedup_hash ON articles(dedup_hash);
+CREATE INDEX IF NOT EXISTS idx_articles_url_hash ON articles(url_hash);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_articles_feed_guid ON articles(feed_id, guid);
+CREATE INDEX IF NOT EXISTS idx_folders_user_id ON folders(user_id);
@@ -0,0 +1,37 @@
+-- Columns added to tables before schema migrations existed. The initial migration creates
+-- them in new databases, but CREATE TABLE IF NOT EXISTS never alters the tables of older
+-- ones. SQLite has no ADD COLUMN IF NOT EXISTS, so adding a column that already exists is
+-- skipped when migrations are applied.
+ALTER TABLE feeds ADD COLUMN unread_count INTEGER DEFAULT 0;
+ALTER TABLE folders ADD COLUMN imported BOOLEAN DEFAULT FALSE;
+ALTER TABLE feeds ADD COLUMN next_fetch_at TIMESTAMP;
+ALTER TABLE feeds ADD COLUMN paused BOOLEAN DEFAULT FALSE;
+ALTER TABLE jobs ADD COLUMN target TEXT;
+ALTER TABLE jobs ADD COLUMN result TEXT;
+ALTER TABLE feed_stats ADD COLUMN opened_count INTEGER DEFAULT 0;
+ALTER TABLE feed_stats ADD COLUMN last_opened_at TIMESTAMP;
+ALTER TABLE jobs ADD COLUMN priority INTEGER DEFAULT 0;
+ALTER TABLE articles ADD COLUMN read_at TIMESTAMP;
+ALTER TABLE articles ADD COLUMN saved_at TIMESTAMP;
+ALTER TABLE articles ADD COLUMN content_truncated BOOLEAN DEFAULT FALSE;
+ALTER TABLE articles ADD COLUMN full_content TEXT;
+ALTER TABLE feeds ADD COLUMN position INTEGER DEFAULT 0;
+ALTER TABLE articles ADD COLUMN dedup_hash TEXT;
+ALTER TABLE articles ADD COLUMN url_hash TEXT;
+ALTER TABLE articles ADD COLUMN guid TEXT;
+ALTER TABLE feeds ADD COLUMN cache_enclosures BOOLEAN;
+ALTER TABLE feeds ADD COLUMN refresh_interval INTEGER;
+ALTER TABLE feeds ADD COLUMN fetch_full_content BOOLEAN DEFAULT FALSE;
+ALTER TABLE folders ADD COLUMN user_id INTEGER REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE users ADD COLUMN timezone TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN disabled BOOLEAN DEFAULT FALSE;
+ALTER TABLE feeds ADD COLUMN etag TEXT;
+ALTER TABLE feeds ADD COLUMN last_modified TEXT;
+ALTER TABLE article_states ADD COLUMN hidden BOOLEAN DEFAULT FALSE;
+
+-- Indexes on those columns, which can only be created once they exist
+CREATE INDEX IF NOT EXISTS idx_feeds_next_fetch_at ON feeds(next_fetch_at);
+CREATE INDEX IF NOT EXISTS idx_articles_dedup_hash ON articles(dedup_hash);
+CREATE INDEX IF NOT EXISTS idx_articles_url_hash ON articles(url_hash);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_articles_feed_guid ON articles(feed_id, guid);
+CREATE INDEX IF NOT EXISTS idx_folders_user_id ON folders(user_id);
@@ -0,0 +1,11 @@
+-- Full-text index of articles: a tsvector of the title, content and author that PostgreSQL
+-- computes on every insert and update, with a GIN index. Titles weigh most. The simple
+-- configuration does not stem words, like the FTS5 tokenizer on SQLite, so both backends
+-- find the same articles whatever their language. PostgreSQL before 12 has no generated
+-- columns and cannot apply this migration; searches then scan all articles.
+ALTER TABLE articles ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (
+	setweight(to_tsvector('simple', COALESCE(title, '')), 'A') ||
+	setweight(to_tsvector('simple', COALESCE(author, '')), 'B') ||
+	setweight(to_tsvector('simple', COALESCE(content, '')), 'C')
+) STORED;
+CREATE INDEX IF NOT EXISTS idx_articles_search_vector ON articles USING GIN (search_vector);
@@ -0,0 +1,27 @@
+-- Full-text index of the title, content and author of articles with FTS5. The index refers
+-- to the rows of the articles table instead of keeping a copy of the text, and triggers
+-- keep it up to date as articles are added, changed and removed. SQLite built without
+-- FTS5 cannot apply this migration; searches then scan all articles.
+CREATE VIRTUAL TABLE IF NOT EXISTS articles_fts USING fts5(
+	title, content, author, content='articles', content_rowid='id'
+);
+
+CREATE TRIGGER IF NOT EXISTS articles_fts_insert AFTER INSERT ON articles BEGIN
+	INSERT INTO articles_fts (rowid, title, content, author)
+	VALUES (new.id, new.title, new.content, new.author);
+END;
+
+CREATE TRIGGER IF NOT EXISTS articles_fts_delete AFTER DELETE ON articles BEGIN
+	INSERT INTO articles_fts (articles_fts, rowid, title, content, author)
+	VALUES ('delete', old.id, old.title, old.content, old.author);
+END;
+
+CREATE TRIGGER IF NOT EXISTS articles_fts_update AFTER UPDATE OF title, content, author ON articles BEGIN
+	INSERT INTO articles_fts (articles_fts, rowid, title, content, author)
+	VALUES ('delete', old.id, old.title, old.content, old.author);
+	INSERT INTO articles_fts (rowid, title, content, author)
+	VALUES (new.id, new.title, new.content, new.author);
+END;
+
+-- Index the articles stored before
+INSERT INTO articles_fts (articles_fts) VALUES ('rebuild');
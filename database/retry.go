@@ -0,0 +1,98 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// retryBaseDelay is the wait before the first retry; it doubles with every attempt
+	retryBaseDelay = 50 * time.Millisecond
+	// retryMaxDelay caps the wait between two attempts
+	retryMaxDelay = 2 * time.Second
+)
+
+// retry runs a query until it succeeds, fails with an error that is not transient or
+// has been retried db.retries times. The waits between attempts count against the query
+// timeout of ctx.
+func (db *DB) retry(ctx context.Context, query string, run func() error) error {
+	readOnly := isReadOnly(query)
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		err := run()
+		if err == nil || attempt >= db.retries || !isTransient(err, readOnly) {
+			return err
+		}
+
+		db.errs.recordRetry()
+		dbLog.Warn("Retrying query after transient database error", "attempt", attempt+1, "error", err)
+
+		// Full jitter spreads out the retries of requests that failed together
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(delay))) + time.Millisecond)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay = min(delay*2, retryMaxDelay)
+	}
+}
+
+// isReadOnly reports whether a query only reads, so running it twice is harmless
+func isReadOnly(query string) bool {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "SELECT", "WITH":
+		return true
+	}
+	return false
+}
+
+// isTransient reports whether a query failed for a reason that is likely to clear up by
+// itself. Errors raised before a statement ran, like a locked SQLite database or a
+// connection that cannot be opened, are always transient. A connection lost mid-query is
+// only transient for reads, since a write may have been applied before the reply was lost.
+func isTransient(err error, readOnly bool) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, syscall.ECONNREFUSED) || isSQLiteBusy(err) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", // serialization_failure
+			"40P01", // deadlock_detected
+			"55P03", // lock_not_available
+			"57P01", // admin_shutdown
+			"57P02", // crash_shutdown
+			"57P03": // cannot_connect_now
+			return true
+		}
+		// Class 08 covers connection exceptions
+		return readOnly && pqErr.Code.Class() == "08"
+	}
+
+	if !readOnly {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.As(err, &netErr)
+}
@@ -0,0 +1,13 @@
+package database
+
+// FullTextSearch reports whether articles have a full-text index, articles_fts on SQLite
+// or the search_vector column on PostgreSQL, created by the search_index migration
+func (db *DB) FullTextSearch() bool {
+	return db.fullText
+}
+
+// IsPostgreSQL reports whether the database is PostgreSQL rather than SQLite, for the
+// few queries whose syntax differs
+func (db *DB) IsPostgreSQL() bool {
+	return db.isPostgreSQL
+}
@@ -0,0 +1,26 @@
+//go:build !purego && cgo
+
+package database
+
+import (
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteDriver is the database/sql driver name registered by mattn/go-sqlite3 (cgo)
+const sqliteDriver = "sqlite3"
+
+// sqliteDSN builds the connection string for the SQLite database at path. The busy
+// timeout makes a locked database fail after 5s instead of blocking indefinitely, and
+// times are read back in UTC whatever offset they were written with.
+func sqliteDSN(path string) string {
+	return path + "?_foreign_keys=on&_busy_timeout=5000&_loc=UTC"
+}
+
+// isSQLiteBusy reports whether a query failed because another connection held a lock on
+// the database for longer than the busy timeout
+func isSQLiteBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
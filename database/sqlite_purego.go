@@ -0,0 +1,34 @@
+//go:build purego || !cgo
+
+package database
+
+import (
+	"errors"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteDriver is the database/sql driver name registered by modernc.org/sqlite,
+// a pure-Go port that allows building with CGO_ENABLED=0
+const sqliteDriver = "sqlite"
+
+// sqliteDSN builds the connection string for the SQLite database at path. The busy
+// timeout makes a locked database fail after 5s instead of blocking indefinitely. Times
+// are written in the format of the cgo driver and CURRENT_TIMESTAMP, so they sort as text
+// and databases move between the two builds.
+func sqliteDSN(path string) string {
+	return path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_time_format=sqlite"
+}
+
+// isSQLiteBusy reports whether a query failed because another connection held a lock on
+// the database for longer than the busy timeout
+func isSQLiteBusy(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	// Extended result codes keep the primary code in the low byte
+	code := sqliteErr.Code() & 0xff
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
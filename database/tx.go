@@ -0,0 +1,53 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Tx is a transaction taking the same database-agnostic placeholders as DB. Its queries
+// are not retried, since a failed statement may have aborted the transaction.
+type Tx struct {
+	tx *sql.Tx
+	db *DB
+}
+
+// InTx runs fn in a transaction bounded by ctx and the query timeout ceiling. The
+// transaction is committed if fn returns nil and rolled back otherwise. fn must only use
+// tx: with SQLite, other queries wait for the transaction to end.
+func (db *DB) InTx(ctx context.Context, fn func(tx *Tx) error) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	sqlTx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		err = db.wrapTimeout(err)
+		db.recordError(err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err := fn(&Tx{tx: sqlTx, db: db}); err != nil {
+		sqlTx.Rollback()
+		return db.wrapTimeout(err)
+	}
+	if err := sqlTx.Commit(); err != nil {
+		err = db.wrapTimeout(err)
+		db.recordError(err)
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// QueryRow executes a query that returns at most one row within the transaction
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	row := tx.tx.QueryRow(tx.db.convertQuery(query), utcArgs(args)...)
+	tx.db.recordError(row.Err())
+	return row
+}
+
+// Exec executes a query that doesn't return rows within the transaction
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	result, err := tx.tx.Exec(tx.db.convertQuery(query), utcArgs(args)...)
+	tx.db.recordError(err)
+	return result, err
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"myfeed/services"
+	"net"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// demoFeeds holds the feeds served in demo mode. Publication dates are template calls
+// relative to the time of the request, so the articles stay recent and are never cleaned up.
+//
+//go:embed demo/*.xml
+var demoFeeds embed.FS
+
+var demoTemplates = template.Must(template.New("demo").Funcs(template.FuncMap{
+	"ago": func(hours int) string {
+		return time.Now().Add(-time.Duration(hours) * time.Hour).Format(time.RFC1123Z)
+	},
+	"atomAgo": func(hours int) string {
+		return time.Now().Add(-time.Duration(hours) * time.Hour).UTC().Format(time.RFC3339)
+	},
+}).ParseFS(demoFeeds, "demo/*.xml"))
+
+// demoFolders are created in order, so parents come before their subfolders
+var demoFolders = []struct {
+	name   string
+	parent string
+}{
+	{name: "Tech"},
+	{name: "News"},
+	{name: "World", parent: "News"},
+	{name: "Cooking"},
+}
+
+// demoSubscriptions maps each bundled feed to its folder; field-notes stays unfiled
+var demoSubscriptions = []struct {
+	feed   string
+	folder string
+}{
+	{feed: "go-notes", folder: "Tech"},
+	{feed: "release-radar", folder: "Tech"},
+	{feed: "world-report", folder: "World"},
+	{feed: "weeknight-kitchen", folder: "Cooking"},
+	{feed: "field-notes"},
+}
+
+// demoArticleLinks is where the links of the demo articles point
+const demoArticleLinks = "https://example.com"
+
+// serveDemoFeed serves a bundled feed at /demo/feeds/{name}.xml
+func serveDemoFeed(w http.ResponseWriter, r *http.Request) {
+	tmpl := demoTemplates.Lookup(mux.Vars(r)["name"] + ".xml")
+	if tmpl == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	if err := tmpl.Execute(w, struct{ Base string }{Base: demoArticleLinks}); err != nil {
+		serverLog.Error("Failed to render demo feed", "feed", tmpl.Name(), "error", err)
+	}
+}
+
+// seedDemo subscribes the first admin of an empty database to the bundled feeds, served by
+// this process, and marks some of their articles read or saved. An admin with feeds or
+// folders is left untouched, so restarting in demo mode keeps whatever was changed
+// meanwhile.
+func seedDemo(listeners []*listener, basePath string, authService *services.AuthService, folderService *services.FolderService, feedService *services.FeedService, articleService *services.ArticleService) error {
+	admin, err := authService.GetFirstAdmin()
+	if err != nil {
+		return fmt.Errorf("failed to get admin: %v", err)
+	}
+	feeds, err := feedService.GetAllFeeds(admin.ID)
+	if err != nil {
+		return err
+	}
+	folders, err := folderService.GetAllFolders(admin.ID)
+	if err != nil {
+		return err
+	}
+	if len(feeds) > 0 || len(folders) > 0 {
+		serverLog.Info("Demo data not seeded, the database already has feeds or folders")
+		return nil
+	}
+
+	var base string
+	for _, ln := range listeners {
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+			base = "http://127.0.0.1:" + strconv.Itoa(addr.Port) + basePath + "/demo/feeds/"
+			break
+		}
+	}
+	if base == "" {
+		return fmt.Errorf("demo feeds need a TCP listener to be fetched from")
+	}
+
+	folderIDs := make(map[string]int)
+	for _, folder := range demoFolders {
+		var parentID *int
+		if folder.parent != "" {
+			id := folderIDs[folder.parent]
+			parentID = &id
+		}
+		created, err := folderService.CreateFolder(admin.ID, folder.name, parentID)
+		if err != nil {
+			return fmt.Errorf("failed to create folder %s: %v", folder.name, err)
+		}
+		folderIDs[folder.name] = created.ID
+	}
+
+	for _, subscription := range demoSubscriptions {
+		var folderID *int
+		if subscription.folder != "" {
+			id := folderIDs[subscription.folder]
+			folderID = &id
+		}
+		feed, err := feedService.AddFeed(context.Background(), admin.ID, base+subscription.feed+".xml", folderID)
+		if err != nil {
+			return fmt.Errorf("failed to add feed %s: %v", subscription.feed, err)
+		}
+		// The initial refresh is queued; running it here means the articles exist below
+		if _, err := feedService.RefreshFeed(context.Background(), feed.ID); err != nil {
+			return fmt.Errorf("failed to refresh feed %s: %v", subscription.feed, err)
+		}
+	}
+
+	articles, err := articleService.GetArticles(admin.ID, nil, nil, nil, 100, 0)
+	if err != nil {
+		return err
+	}
+	for i, article := range articles {
+		if i%3 == 2 {
+			if err := articleService.MarkAsRead(admin.ID, article.ID, true); err != nil {
+				return err
+			}
+		}
+		if i%7 == 1 {
+			if err := articleService.MarkAsSaved(admin.ID, article.ID, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	serverLog.Info("Seeded demo data", "folders", len(demoFolders), "feeds", len(demoSubscriptions), "articles", len(articles))
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"html"
+	"io"
+	"io/fs"
+	"myfeed/config"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// embeddedStatic holds the frontend assets, so the binary serves them from any working
+// directory
+//
+//go:embed static
+var embeddedStatic embed.FS
+
+// Cache policies of the frontend. Fingerprinted asset URLs change with their content, so
+// browsers may keep them for a year; everything else is revalidated on every load.
+const (
+	cacheImmutable   = "public, max-age=31536000, immutable"
+	cacheRevalidate  = "no-cache"
+	assetHashLength  = 10
+	staticPathPrefix = "/static/"
+)
+
+// headTag is where serveIndex inserts the <base> element
+var headTag = regexp.MustCompile(`(?i)<head[^>]*>`)
+
+// fingerprinted matches asset names like app.3f2a9c1b0d.css
+var fingerprinted = regexp.MustCompile(`^(.*)\.([0-9a-f]{10})(\.[^./]+)$`)
+
+// staticReference matches asset references in index.html, which are rewritten to
+// fingerprinted URLs
+var staticReference = regexp.MustCompile(`((?:src|href)=["'])/static/([^"'?#]+)(["'])`)
+
+// frontend serves the single page app and its assets
+type frontend struct {
+	assets fs.FS
+	// cached is set for the embedded assets, whose hashes cannot change while running
+	cached bool
+	hashes sync.Map
+	// basePath prefixes asset URLs when the app is served under a sub-path
+	basePath string
+}
+
+// newFrontend returns the frontend assets: the static directory when one is configured,
+// which lets the frontend be edited without rebuilding, otherwise the embedded copy
+func newFrontend(cfg *config.Config) *frontend {
+	if cfg.StaticDir != "" {
+		serverLog.Info("Serving the frontend from disk", "dir", cfg.StaticDir)
+		return &frontend{assets: os.DirFS(cfg.StaticDir), basePath: cfg.BasePath()}
+	}
+
+	assets, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		fatal("Failed to load embedded frontend", err)
+	}
+	return &frontend{assets: assets, cached: true, basePath: cfg.BasePath()}
+}
+
+// hash returns the content hash of an asset, used in its fingerprinted URL and ETag
+func (f *frontend) hash(name string) (string, error) {
+	if f.cached {
+		if hash, ok := f.hashes.Load(name); ok {
+			return hash.(string), nil
+		}
+	}
+	content, err := fs.ReadFile(f.assets, name)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])[:assetHashLength]
+	if f.cached {
+		f.hashes.Store(name, hash)
+	}
+	return hash, nil
+}
+
+// assetURL returns the fingerprinted URL of an asset, or its plain URL if it does not exist
+func (f *frontend) assetURL(name string) string {
+	hash, err := f.hash(name)
+	if err != nil {
+		return f.basePath + staticPathPrefix + name
+	}
+	ext := path.Ext(name)
+	return f.basePath + staticPathPrefix + strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// serveStatic serves the assets under /static/. A fingerprinted URL whose hash matches the
+// content is cached for good; plain URLs and outdated fingerprints are revalidated.
+func (f *frontend) serveStatic(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, staticPathPrefix)
+	cacheControl := cacheRevalidate
+	if match := fingerprinted.FindStringSubmatch(name); match != nil {
+		original := match[1] + match[3]
+		if hash, err := f.hash(original); err == nil {
+			name = original
+			if hash == match[2] {
+				cacheControl = cacheImmutable
+			}
+		}
+	}
+
+	hash, err := f.hash(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	content, err := fs.ReadFile(f.assets, name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("ETag", `W/"`+hash+`"`)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(content))
+}
+
+// serveIndex serves the single page app for every route that is not an asset or API call.
+// Asset references are rewritten to fingerprinted URLs, and the page itself is revalidated
+// so a new release is picked up on the next load. A <base> element points the relative API
+// URLs of the page at the base path, whatever route the page was loaded from.
+func (f *frontend) serveIndex(w http.ResponseWriter, r *http.Request) {
+	file, err := f.assets.Open("index.html")
+	if err != nil {
+		http.Error(w, "Frontend not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Failed to read frontend", http.StatusInternalServerError)
+		return
+	}
+	base := []byte(`<base href="` + html.EscapeString(f.basePath+"/") + `">`)
+	if loc := headTag.FindIndex(content); loc != nil {
+		content = append(content[:loc[1]:loc[1]], append(base, content[loc[1]:]...)...)
+	}
+	content = staticReference.ReplaceAllFunc(content, func(ref []byte) []byte {
+		match := staticReference.FindSubmatch(ref)
+		return []byte(string(match[1]) + f.assetURL(string(match[2])) + string(match[3]))
+	})
+	sum := sha256.Sum256(content)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", cacheRevalidate)
+	w.Header().Set("ETag", `W/"`+hex.EncodeToString(sum[:])[:assetHashLength]+`"`)
+	http.ServeContent(w, r, "index.html", time.Time{}, bytes.NewReader(content))
+}
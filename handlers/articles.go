@@ -1,21 +1,32 @@
 package handlers
 
 import (
-	"encoding/json"
+	"database/sql"
+	"errors"
+	"fmt"
+	"myfeed/middleware"
+	"myfeed/models"
 	"myfeed/services"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 type ArticleHandlers struct {
-	articleService *services.ArticleService
+	articleService  *services.ArticleService
+	folderService   *services.FolderService
+	settingsService *services.SettingsService
+	authService     *services.AuthService
 }
 
-func NewArticleHandlers(articleService *services.ArticleService) *ArticleHandlers {
+func NewArticleHandlers(articleService *services.ArticleService, folderService *services.FolderService, settingsService *services.SettingsService, authService *services.AuthService) *ArticleHandlers {
 	return &ArticleHandlers{
-		articleService: articleService,
+		articleService:  articleService,
+		folderService:   folderService,
+		settingsService: settingsService,
+		authService:     authService,
 	}
 }
 
@@ -28,6 +39,11 @@ type MarkSavedRequest struct {
 }
 
 func (ah *ArticleHandlers) GetArticles(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
 	query := r.URL.Query()
 	
 	var feedID *int
@@ -51,7 +67,7 @@ func (ah *ArticleHandlers) GetArticles(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	
-	limit := 50
+	limit := ah.settingsService.GetInt(services.SettingArticlesPerPage, 50)
 	if limitStr := query.Get("limit"); limitStr != "" {
 		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 200 {
 			limit = l
@@ -65,95 +81,312 @@ func (ah *ArticleHandlers) GetArticles(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	articles, err := ah.articleService.GetArticles(feedID, read, saved, limit, offset)
+	// tag lists the articles rules tagged with it
+	if tag := query.Get("tag"); tag != "" {
+		articles, err := ah.articleService.GetTaggedArticles(user.ID, tag, limit, offset)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, articles)
+		return
+	}
+
+	// group_duplicates lists a story carried by several feeds once, with its other copies
+	if group, _ := strconv.ParseBool(query.Get("group_duplicates")); group {
+		groups, err := ah.articleService.GetArticleGroups(user.ID, feedID, read, saved, limit, offset)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, groups)
+		return
+	}
+
+	// Without a cursor parameter the articles are a plain list, as before cursors. An empty
+	// cursor asks for the first page with next_cursor and total.
+	if _, paged := query["cursor"]; !paged {
+		articles, err := ah.articleService.GetArticles(user.ID, feedID, read, saved, limit, offset)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, articles)
+		return
+	}
+
+	page, err := ah.articleService.GetArticlePage(user.ID, feedID, read, saved, limit, offset, query.Get("cursor"))
+	var invalid *services.ValidationError
+	if errors.As(err, &invalid) {
+		writeInvalid(w, err)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServerError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data:    articles,
-	})
+	writeJSON(w, http.StatusOK, page)
+}
+
+// ExportArticles downloads the current user's articles as JSON or CSV (?format=, default
+// json), optionally only those of ?feed_id= or with ?read= and ?saved= as given
+func (ah *ArticleHandlers) ExportArticles(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	var feedID *int
+	if feedIDStr := query.Get("feed_id"); feedIDStr != "" {
+		id, err := strconv.Atoi(feedIDStr)
+		if err != nil {
+			writeFieldError(w, "feed_id", "must be a feed ID")
+			return
+		}
+		feedID = &id
+	}
+	var read, saved *bool
+	if readStr := query.Get("read"); readStr != "" {
+		readBool, err := strconv.ParseBool(readStr)
+		if err != nil {
+			writeFieldError(w, "read", "must be true or false")
+			return
+		}
+		read = &readBool
+	}
+	if savedStr := query.Get("saved"); savedStr != "" {
+		savedBool, err := strconv.ParseBool(savedStr)
+		if err != nil {
+			writeFieldError(w, "saved", "must be true or false")
+			return
+		}
+		saved = &savedBool
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = services.ExportJSON
+	}
+
+	export, err := ah.articleService.ExportArticles(user.ID, format, feedID, read, saved)
+	if err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", export.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", export.Filename()))
+
+	// As for the OPML export, a failure halfway aborts the connection so the client does
+	// not take a truncated file for a complete one
+	if _, err := export.WriteTo(w); err != nil {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// GetTags lists the current user's tags with the number of articles of each
+func (ah *ArticleHandlers) GetTags(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	tags, err := ah.articleService.GetTags(user.ID)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tags)
+}
+
+// GetRiver returns the unread articles of the last ?days= (1-14, default 2: today and
+// yesterday) grouped by day, with at most ?per_day= (1-200, default 50) articles per day.
+// Days are in ?tz= or else the user's timezone.
+func (ah *ArticleHandlers) GetRiver(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	query := r.URL.Query()
+
+	days := 2
+	if daysStr := query.Get("days"); daysStr != "" {
+		d, err := strconv.Atoi(daysStr)
+		if err != nil || d < 1 || d > 14 {
+			writeFieldError(w, "days", "days must be between 1 and 14")
+			return
+		}
+		days = d
+	}
+
+	perDay := 50
+	if perDayStr := query.Get("per_day"); perDayStr != "" {
+		p, err := strconv.Atoi(perDayStr)
+		if err != nil || p < 1 || p > 200 {
+			writeFieldError(w, "per_day", "per_day must be between 1 and 200")
+			return
+		}
+		perDay = p
+	}
+
+	loc, ok := requestLocation(w, r, ah.authService)
+	if !ok {
+		return
+	}
+
+	river, err := ah.articleService.GetRiver(r.Context(), user.ID, loc, days, perDay)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, river)
+}
+
+// requestLocation returns the timezone of ?tz= or else the user's timezone, UTC without a
+// user. It writes the error response and returns false when the timezone is unknown.
+func requestLocation(w http.ResponseWriter, r *http.Request, authService *services.AuthService) (*time.Location, bool) {
+	timezone := r.URL.Query().Get("tz")
+	if timezone == "" {
+		if user := middleware.GetUserFromContext(r); user != nil {
+			loc, err := authService.UserLocation(user.ID)
+			if err != nil {
+				writeServerError(w, err)
+				return nil, false
+			}
+			return loc, true
+		}
+		return time.UTC, true
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		writeFieldError(w, "tz", "unknown timezone "+strconv.Quote(timezone))
+		return nil, false
+	}
+	return loc, true
 }
 
 func (ah *ArticleHandlers) GetArticle(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
 	vars := mux.Vars(r)
 	articleID, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(w, "Invalid article ID", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid article ID")
+		return
+	}
+
+	article, err := ah.articleService.GetArticleByID(user.ID, articleID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Article not found")
 		return
 	}
 
-	article, err := ah.articleService.GetArticleByID(articleID)
+	writeJSON(w, http.StatusOK, article)
+}
+
+// GetArticlePDF downloads an article as a PDF, for archiving in document management systems
+func (ah *ArticleHandlers) GetArticlePDF(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	articleID, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		http.Error(w, "Article not found", http.StatusNotFound)
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid article ID")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data:    article,
-	})
+	pdf, err := ah.articleService.ArticlePDF(user.ID, articleID)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Article not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"article-%d.pdf\"", articleID))
+	w.Write(pdf)
 }
 
 func (ah *ArticleHandlers) MarkAsRead(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
 	vars := mux.Vars(r)
 	articleID, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(w, "Invalid article ID", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid article ID")
 		return
 	}
 
 	var req MarkReadRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	err = ah.articleService.MarkAsRead(articleID, req.Read)
+	err = ah.articleService.MarkAsRead(user.ID, articleID, req.Read)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Article not found")
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServerError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data:    map[string]string{"message": "Article read status updated"},
-	})
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Article read status updated"})
 }
 
 func (ah *ArticleHandlers) MarkAsSaved(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
 	vars := mux.Vars(r)
 	articleID, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(w, "Invalid article ID", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid article ID")
 		return
 	}
 
 	var req MarkSavedRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	err = ah.articleService.MarkAsSaved(articleID, req.Saved)
+	err = ah.articleService.MarkAsSaved(user.ID, articleID, req.Saved)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Article not found")
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServerError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data:    map[string]string{"message": "Article saved status updated"},
-	})
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Article saved status updated"})
 }
 
 func (ah *ArticleHandlers) MarkAllAsRead(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
 	query := r.URL.Query()
 	
 	var feedID *int
@@ -163,28 +396,164 @@ func (ah *ArticleHandlers) MarkAllAsRead(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	err := ah.articleService.MarkAllAsRead(feedID)
+	err := ah.articleService.MarkAllAsRead(user.ID, feedID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServerError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data:    map[string]string{"message": "All articles marked as read"},
-	})
+	writeJSON(w, http.StatusOK, map[string]string{"message": "All articles marked as read"})
 }
 
+// MarkRead marks a selection of the current user's articles read:
+// {"feed_id": 1, "folder_id": 2, "older_than_days": 7, "article_ids": [1, 2, 3]}. The
+// filters combine and at least one is required; a folder includes its subfolders.
+func (ah *ArticleHandlers) MarkRead(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	var req struct {
+		FeedID        *int  `json:"feed_id"`
+		FolderID      *int  `json:"folder_id"`
+		OlderThanDays *int  `json:"older_than_days"`
+		ArticleIDs    []int `json:"article_ids"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.FeedID == nil && req.FolderID == nil && req.OlderThanDays == nil && req.ArticleIDs == nil {
+		writeFieldError(w, "feed_id", "Give a feed_id, folder_id, older_than_days or article_ids")
+		return
+	}
+
+	var opts services.MarkReadOptions
+	if req.FolderID != nil {
+		feedIDs, err := ah.folderService.GetFeedIDsInTree(user.ID, *req.FolderID, true)
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, models.ErrorNotFound, "Folder not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		opts.FeedIDs = []int{}
+		for _, id := range feedIDs {
+			// Within a folder, the feed has to be one of its feeds
+			if req.FeedID == nil || id == *req.FeedID {
+				opts.FeedIDs = append(opts.FeedIDs, id)
+			}
+		}
+	} else if req.FeedID != nil {
+		opts.FeedIDs = []int{*req.FeedID}
+	}
+	if req.OlderThanDays != nil {
+		if *req.OlderThanDays < 0 {
+			writeFieldError(w, "older_than_days", "Must not be negative")
+			return
+		}
+		cutoff := time.Now().AddDate(0, 0, -*req.OlderThanDays)
+		opts.OlderThan = &cutoff
+	}
+	opts.ArticleIDs = req.ArticleIDs
+
+	marked, err := ah.articleService.MarkRead(user.ID, opts)
+	var invalid *services.ValidationError
+	if errors.As(err, &invalid) {
+		writeInvalid(w, err)
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"marked": marked})
+}
+
+// SyncStates applies queued state changes in one transaction:
+// {"read": [1, 2], "unread": [3], "saved": [4], "unsaved": [5]}. Every ID gets a result,
+// updated, unchanged or not_found.
+func (ah *ArticleHandlers) SyncStates(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	var changes services.ArticleStateChanges
+	if !decodeJSON(w, r, &changes) {
+		return
+	}
+
+	results, err := ah.articleService.SyncStates(r.Context(), user.ID, changes)
+	var invalid *services.ValidationError
+	if errors.As(err, &invalid) {
+		writeInvalid(w, err)
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
+
+// SearchArticles finds articles matching ?q=, best matches first. ?feed_id= limits the
+// search to one feed and ?folder_id= to the feeds of a folder and its subfolders.
 func (ah *ArticleHandlers) SearchArticles(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
 	query := r.URL.Query()
 	searchQuery := query.Get("q")
 	if searchQuery == "" {
-		http.Error(w, "Search query is required", http.StatusBadRequest)
+		writeFieldError(w, "q", "Search query is required")
 		return
 	}
+
+	var feedIDs []int
+	if folderIDStr := query.Get("folder_id"); folderIDStr != "" {
+		folderID, err := strconv.Atoi(folderIDStr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid folder ID")
+			return
+		}
+		feedIDs, err = ah.folderService.GetFeedIDsInTree(user.ID, folderID, true)
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, models.ErrorNotFound, "Folder not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		if feedIDs == nil {
+			feedIDs = []int{}
+		}
+	}
+	if feedIDStr := query.Get("feed_id"); feedIDStr != "" {
+		feedID, err := strconv.Atoi(feedIDStr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid feed ID")
+			return
+		}
+		// Within a folder, the feed has to be one of its feeds
+		inFolder := feedIDs == nil
+		for _, id := range feedIDs {
+			inFolder = inFolder || id == feedID
+		}
+		feedIDs = []int{}
+		if inFolder {
+			feedIDs = []int{feedID}
+		}
+	}
 	
-	limit := 50
+	limit := ah.settingsService.GetInt(services.SettingArticlesPerPage, 50)
 	if limitStr := query.Get("limit"); limitStr != "" {
 		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 200 {
 			limit = l
@@ -198,15 +567,16 @@ func (ah *ArticleHandlers) SearchArticles(w http.ResponseWriter, r *http.Request
 		}
 	}
 
-	articles, err := ah.articleService.SearchArticles(searchQuery, limit, offset)
+	articles, err := ah.articleService.SearchArticles(r.Context(), user.ID, searchQuery, feedIDs, limit, offset)
+	var invalid *services.ValidationError
+	if errors.As(err, &invalid) {
+		writeInvalid(w, err)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServerError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data:    articles,
-	})
-}
\ No newline at end of file
+	writeJSON(w, http.StatusOK, articles)
+}
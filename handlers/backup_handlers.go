@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"myfeed/services"
+	"net/http"
+)
+
+type BackupHandlers struct {
+	backupService *services.BackupService
+}
+
+func NewBackupHandlers(backupService *services.BackupService) *BackupHandlers {
+	return &BackupHandlers{
+		backupService: backupService,
+	}
+}
+
+// GetBackups lists the OPML backups in the backup directory (admin only)
+func (bh *BackupHandlers) GetBackups(w http.ResponseWriter, r *http.Request) {
+	backups, err := bh.backupService.ListBackups()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, backups)
+}
+
+// CreateBackup writes a backup immediately, whether or not scheduled backups are enabled (admin only)
+func (bh *BackupHandlers) CreateBackup(w http.ResponseWriter, r *http.Request) {
+	backup, err := bh.backupService.Run()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, backup)
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"myfeed/models"
+	"myfeed/services"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type ContentHandlers struct {
+	contentService *services.ContentService
+	articleService *services.ArticleService
+}
+
+func NewContentHandlers(contentService *services.ContentService, articleService *services.ArticleService) *ContentHandlers {
+	return &ContentHandlers{
+		contentService: contentService,
+		articleService: articleService,
+	}
+}
+
+// FetchContent downloads the page of an article now and returns the article with the
+// extracted full_content
+func (ch *ContentHandlers) FetchContent(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	articleID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid article ID")
+		return
+	}
+
+	err = ch.contentService.FetchForUser(r.Context(), user.ID, articleID)
+	var upstream *services.UpstreamError
+	var invalid *services.ValidationError
+	switch {
+	case err == sql.ErrNoRows:
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Article not found")
+		return
+	case errors.As(err, &upstream):
+		writeError(w, http.StatusBadGateway, models.ErrorUpstreamFailed, err.Error())
+		return
+	case errors.As(err, &invalid):
+		writeInvalid(w, err)
+		return
+	case err != nil:
+		writeServerError(w, err)
+		return
+	}
+
+	article, err := ch.articleService.GetArticleByID(user.ID, articleID)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, article)
+}
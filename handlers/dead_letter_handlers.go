@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"database/sql"
+	"myfeed/models"
+	"myfeed/services"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type DeadLetterHandlers struct {
+	deadLetterService *services.DeadLetterService
+}
+
+func NewDeadLetterHandlers(deadLetterService *services.DeadLetterService) *DeadLetterHandlers {
+	return &DeadLetterHandlers{
+		deadLetterService: deadLetterService,
+	}
+}
+
+// GetDeadLetters lists the feeds paused after failing repeatedly (admin only)
+func (dh *DeadLetterHandlers) GetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	deadLetters, err := dh.deadLetterService.GetDeadLetters()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, deadLetters)
+}
+
+// RequeueDeadLetter resumes the feed of a dead letter and queues a refresh (admin only)
+func (dh *DeadLetterHandlers) RequeueDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid dead letter ID")
+		return
+	}
+
+	job, err := dh.deadLetterService.Requeue(id)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Dead letter not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Feed resumed and refresh queued",
+		"job_id":  job.ID,
+	})
+}
+
+// DismissDeadLetter removes a dead letter and leaves its feed paused (admin only)
+func (dh *DeadLetterHandlers) DismissDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid dead letter ID")
+		return
+	}
+
+	err = dh.deadLetterService.Dismiss(id)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Dead letter not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Dead letter dismissed"})
+}
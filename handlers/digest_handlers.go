@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"database/sql"
+	"myfeed/middleware"
+	"myfeed/models"
+	"myfeed/services"
+	"net/http"
+	"net/mail"
+	"strings"
+)
+
+type DigestHandlers struct {
+	digestService *services.DigestService
+	mailer        *services.Mailer
+}
+
+func NewDigestHandlers(digestService *services.DigestService, mailer *services.Mailer) *DigestHandlers {
+	return &DigestHandlers{
+		digestService: digestService,
+		mailer:        mailer,
+	}
+}
+
+// GetDigest returns the current user's digest subscription, or null if there is none
+func (dh *DigestHandlers) GetDigest(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	sub, err := dh.digestService.GetSubscription(user.ID)
+	if err != nil && err != sql.ErrNoRows {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"subscription": sub,
+		"mail_enabled": dh.mailer.Enabled(),
+	})
+}
+
+// SaveDigest creates or updates the current user's digest subscription
+func (dh *DigestHandlers) SaveDigest(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	req := struct {
+		Email     string `json:"email"`
+		Frequency string `json:"frequency"`
+		FolderID  *int   `json:"folder_id"`
+		Enabled   *bool  `json:"enabled"`
+	}{
+		Frequency: models.DigestDaily,
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	enabled := req.Enabled == nil || *req.Enabled
+	sub, err := dh.digestService.SaveSubscription(user.ID, req.Email, req.Frequency, req.FolderID, enabled)
+	if err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sub)
+}
+
+// DeleteDigest unsubscribes the current user from the digest
+func (dh *DigestHandlers) DeleteDigest(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	err := dh.digestService.DeleteSubscription(user.ID)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "No digest subscription")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Digest subscription removed"})
+}
+
+// SendDigest sends the current user's digest immediately, e.g. to check the SMTP setup
+func (dh *DigestHandlers) SendDigest(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	if !dh.mailer.Enabled() {
+		writeError(w, http.StatusServiceUnavailable, models.ErrorUnavailable, "No SMTP server configured")
+		return
+	}
+
+	sub, err := dh.digestService.GetSubscription(user.ID)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "No digest subscription")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	count, err := dh.digestService.Send(sub)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, models.ErrorUpstreamFailed, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"articles": count})
+}
+
+// TestSMTP sends a test message through the configured SMTP server (admin only)
+func (dh *DigestHandlers) TestSMTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		To string `json:"to"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	address, err := mail.ParseAddress(strings.TrimSpace(req.To))
+	if err != nil {
+		writeFieldError(w, "to", "Invalid email address")
+		return
+	}
+
+	if !dh.mailer.Enabled() {
+		writeError(w, http.StatusServiceUnavailable, models.ErrorUnavailable, "No SMTP server configured")
+		return
+	}
+
+	subject := "MyFeed test email"
+	htmlBody := "<p>Your SMTP settings work: MyFeed can send email digests.</p>"
+	textBody := "Your SMTP settings work: MyFeed can send email digests.\n"
+	if err := dh.mailer.Send(address.Address, subject, htmlBody, textBody); err != nil {
+		writeError(w, http.StatusBadGateway, models.ErrorUpstreamFailed, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Test email sent to " + address.Address})
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"errors"
+	"myfeed/models"
+	"myfeed/services"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type DiscoverHandlers struct {
+	discoverService *services.DiscoverService
+}
+
+func NewDiscoverHandlers(discoverService *services.DiscoverService) *DiscoverHandlers {
+	return &DiscoverHandlers{
+		discoverService: discoverService,
+	}
+}
+
+// GetRecommended suggests up to ?limit= (1-50, default 20) feeds related to the
+// subscriptions. Each comes with the body of POST /api/feeds that subscribes to it.
+func (dh *DiscoverHandlers) GetRecommended(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	limit := 20
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil || l < 1 || l > 50 {
+			writeFieldError(w, "limit", "limit must be between 1 and 50")
+			return
+		}
+		limit = l
+	}
+
+	recommendations, err := dh.discoverService.Recommend(r.Context(), user.ID, limit)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, recommendations)
+}
+
+// GetDirectory lists the feed directory by category, filtered by the words of ?q= and by
+// ?category=. Each feed comes with the body of POST /api/feeds that subscribes to it.
+func (dh *DiscoverHandlers) GetDirectory(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	directory, err := dh.discoverService.Directory(user.ID, query.Get("q"), query.Get("category"))
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, directory)
+}
+
+// FindFeeds lists the feeds of the web page at ?url=, e.g. a site's home page. Each comes
+// with the body of POST /api/feeds that subscribes to it.
+func (dh *DiscoverHandlers) FindFeeds(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	pageURL := strings.TrimSpace(r.URL.Query().Get("url"))
+	if pageURL == "" {
+		writeFieldError(w, "url", "url is required")
+		return
+	}
+
+	candidates, err := dh.discoverService.FindFeeds(r.Context(), user.ID, pageURL)
+	var upstream *services.UpstreamError
+	if errors.As(err, &upstream) {
+		writeError(w, http.StatusBadGateway, models.ErrorUpstreamFailed, err.Error())
+		return
+	}
+	var invalid *services.ValidationError
+	if errors.As(err, &invalid) {
+		writeInvalid(w, err)
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, candidates)
+}
+
+// SearchPodcasts looks up shows matching ?q= in a podcast directory, ?source= itunes or
+// podcast_index (the default when configured), returning up to ?limit= (1-50, default 20)
+// shows with their feed URLs
+func (dh *DiscoverHandlers) SearchPodcasts(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		writeFieldError(w, "q", "q is required")
+		return
+	}
+
+	sources := dh.discoverService.PodcastSources()
+	source := query.Get("source")
+	if source == "" {
+		source = sources[0]
+	} else if !slices.Contains(sources, source) {
+		writeFieldError(w, "source", "source must be one of "+strings.Join(sources, ", "))
+		return
+	}
+
+	limit := 20
+	if limitStr := query.Get("limit"); limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil || l < 1 || l > 50 {
+			writeFieldError(w, "limit", "limit must be between 1 and 50")
+			return
+		}
+		limit = l
+	}
+
+	podcasts, err := dh.discoverService.SearchPodcasts(r.Context(), user.ID, source, q, limit)
+	var upstream *services.UpstreamError
+	if errors.As(err, &upstream) {
+		writeError(w, http.StatusBadGateway, models.ErrorUpstreamFailed, err.Error())
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, podcasts)
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"database/sql"
+	"myfeed/middleware"
+	"myfeed/models"
+	"myfeed/services"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type EmailForwardHandlers struct {
+	forwardService *services.EmailForwardService
+	mailer         *services.Mailer
+}
+
+func NewEmailForwardHandlers(forwardService *services.EmailForwardService, mailer *services.Mailer) *EmailForwardHandlers {
+	return &EmailForwardHandlers{
+		forwardService: forwardService,
+		mailer:         mailer,
+	}
+}
+
+// GetForwards lists the feeds whose articles are emailed to the current user
+func (eh *EmailForwardHandlers) GetForwards(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	forwards, err := eh.forwardService.GetForwards(user.ID)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"forwards":     forwards,
+		"mail_enabled": eh.mailer.Enabled(),
+	})
+}
+
+// SaveForward emails the new articles of a feed to the current user. Without an email in
+// the body, the address of the user's digest subscription is used.
+func (eh *EmailForwardHandlers) SaveForward(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	feedID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid feed ID")
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	if r.ContentLength != 0 {
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+	}
+
+	forward, err := eh.forwardService.SaveForward(user.ID, feedID, req.Email)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Feed not found")
+		return
+	}
+	if err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, forward)
+}
+
+// DeleteForward stops emailing a feed to the current user
+func (eh *EmailForwardHandlers) DeleteForward(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	feedID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid feed ID")
+		return
+	}
+
+	err = eh.forwardService.DeleteForward(user.ID, feedID)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Feed is not emailed")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Email forwarding removed"})
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"database/sql"
+	"myfeed/models"
+	"myfeed/services"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type EnclosureHandlers struct {
+	enclosureService *services.EnclosureService
+	feedService      *services.FeedService
+}
+
+func NewEnclosureHandlers(enclosureService *services.EnclosureService, feedService *services.FeedService) *EnclosureHandlers {
+	return &EnclosureHandlers{
+		enclosureService: enclosureService,
+		feedService:      feedService,
+	}
+}
+
+// ServeEnclosure plays the enclosure of an article from the cached copy, with range
+// requests for seeking, or redirects to the original while it is not cached
+func (eh *EnclosureHandlers) ServeEnclosure(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	articleID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid article ID")
+		return
+	}
+
+	enclosure, file, err := eh.enclosureService.Open(user.ID, articleID)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Article has no enclosure")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if file == nil {
+		http.Redirect(w, r, enclosure.URL, http.StatusFound)
+		return
+	}
+	defer file.Close()
+
+	// An episode can take far longer to download than the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	var modified time.Time
+	if enclosure.CachedAt != nil {
+		modified = *enclosure.CachedAt
+	}
+	if enclosure.Type != "" {
+		w.Header().Set("Content-Type", enclosure.Type)
+	}
+	http.ServeContent(w, r, file.Name(), modified, file)
+}
+
+// PodcastFeed serves the episodes of a feed as RSS for podcast apps, which may log in
+// with HTTP Basic credentials instead of a session
+func (eh *EnclosureHandlers) PodcastFeed(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	feedID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid feed ID")
+		return
+	}
+
+	data, err := eh.enclosureService.PodcastFeed(user.ID, feedID)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Feed not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Write(data)
+}
+
+// SetFeedCaching sets whether the enclosures of a feed's new articles are downloaded:
+// {"cache": true}, {"cache": false}, or {"cache": null} to follow the cache_enclosures
+// setting. The setting is shared by everyone subscribed to the feed, so only admins change it.
+func (eh *EnclosureHandlers) SetFeedCaching(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	feedID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid feed ID")
+		return
+	}
+
+	var req struct {
+		Cache *bool `json:"cache"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if _, err := eh.feedService.GetSubscribedFeed(user.ID, feedID); err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Feed not found")
+		return
+	} else if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	err = eh.enclosureService.SetFeedCaching(feedID, req.Cache)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	feed, err := eh.feedService.GetSubscribedFeed(user.ID, feedID)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, feed)
+}
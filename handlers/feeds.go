@@ -1,10 +1,13 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
+	"myfeed/models"
 	"myfeed/services"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -12,12 +15,14 @@ import (
 type FeedHandlers struct {
 	feedService    *services.FeedService
 	articleService *services.ArticleService
+	statsService   *services.FeedStatsService
 }
 
-func NewFeedHandlers(feedService *services.FeedService, articleService *services.ArticleService) *FeedHandlers {
+func NewFeedHandlers(feedService *services.FeedService, articleService *services.ArticleService, statsService *services.FeedStatsService) *FeedHandlers {
 	return &FeedHandlers{
 		feedService:    feedService,
 		articleService: articleService,
+		statsService:   statsService,
 	}
 }
 
@@ -26,126 +31,267 @@ type AddFeedRequest struct {
 	FolderID *int   `json:"folder_id,omitempty"`
 }
 
-type APIResponse struct {
-	Success bool        `json:"success"`
-	Data    interface{} `json:"data,omitempty"`
-	Error   string      `json:"error,omitempty"`
-}
-
 func (fh *FeedHandlers) GetFeeds(w http.ResponseWriter, r *http.Request) {
-	feeds, err := fh.feedService.GetAllFeeds()
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	feeds, err := fh.feedService.GetAllFeeds(user.ID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServerError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data:    feeds,
-	})
+	statsByFeed, err := fh.statsService.GetAllFeedStats()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	for i := range feeds {
+		if stats := statsByFeed[feeds[i].ID]; stats != nil {
+			stats.UnreadCount = feeds[i].UnreadCount
+			feeds[i].Stats = stats
+		}
+	}
+
+	writeJSON(w, http.StatusOK, feeds)
 }
 
 func (fh *FeedHandlers) AddFeed(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
 	var req AddFeedRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
 	if req.URL == "" {
-		http.Error(w, "URL is required", http.StatusBadRequest)
+		writeFieldError(w, "url", "URL is required")
 		return
 	}
 
-	feed, err := fh.feedService.AddFeed(req.URL, req.FolderID)
+	feed, err := fh.feedService.AddFeed(r.Context(), user.ID, req.URL, req.FolderID)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   err.Error(),
-		})
+		writeInvalid(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data:    feed,
-	})
+	writeJSON(w, http.StatusCreated, feed)
 }
 
 func (fh *FeedHandlers) GetFeed(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
 	vars := mux.Vars(r)
 	feedID, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(w, "Invalid feed ID", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid feed ID")
 		return
 	}
 
-	feed, err := fh.feedService.GetFeedByID(feedID)
+	feed, err := fh.feedService.GetSubscribedFeed(user.ID, feedID)
 	if err != nil {
-		http.Error(w, "Feed not found", http.StatusNotFound)
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Feed not found")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data:    feed,
-	})
+	if stats, err := fh.statsService.GetFeedStats(feedID); err == nil {
+		stats.UnreadCount = feed.UnreadCount
+		feed.Stats = stats
+	}
+
+	writeJSON(w, http.StatusOK, feed)
 }
 
 func (fh *FeedHandlers) RefreshFeed(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
 	vars := mux.Vars(r)
 	feedID, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(w, "Invalid feed ID", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid feed ID")
 		return
 	}
 
-	go fh.feedService.RefreshFeed(feedID)
+	if _, err := fh.feedService.GetSubscribedFeed(user.ID, feedID); err != nil {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Feed not found")
+		return
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data:    map[string]string{"message": "Feed refresh started"},
+	job, err := fh.feedService.EnqueueRefresh(feedID)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Feed refresh queued",
+		"job_id":  job.ID,
 	})
 }
 
+// PauseFeed stops scheduled refreshes of a feed, for everyone subscribed to it. Admins only.
+func (fh *FeedHandlers) PauseFeed(w http.ResponseWriter, r *http.Request) {
+	fh.setPaused(w, r, true)
+}
+
+// ResumeFeed re-enables scheduled refreshes of a paused feed. Admins only.
+func (fh *FeedHandlers) ResumeFeed(w http.ResponseWriter, r *http.Request) {
+	fh.setPaused(w, r, false)
+}
+
+func (fh *FeedHandlers) setPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	vars := mux.Vars(r)
+	feedID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid feed ID")
+		return
+	}
+
+	if _, err := fh.feedService.GetSubscribedFeed(user.ID, feedID); err != nil {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Feed not found")
+		return
+	}
+
+	err = fh.feedService.SetPaused(feedID, paused)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Feed not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, models.ErrorInternal, "Failed to update feed")
+		return
+	}
+
+	feed, err := fh.feedService.GetSubscribedFeed(user.ID, feedID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, models.ErrorInternal, "Failed to get feed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, feed)
+}
+
+// UpdateFeed changes the options of a feed that are given, for everyone subscribed to it:
+// refresh_interval sets how often it is fetched in seconds, or with null follows its
+// posting rate, and fetch_full_content whether the pages of new articles are downloaded.
+// Admins only, since the options apply to every subscriber.
+func (fh *FeedHandlers) UpdateFeed(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	vars := mux.Vars(r)
+	feedID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid feed ID")
+		return
+	}
+
+	// A raw refresh_interval tells a null apart from a field that is left out
+	var req struct {
+		RefreshInterval  json.RawMessage `json:"refresh_interval"`
+		FetchFullContent *bool           `json:"fetch_full_content"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	var seconds *int
+	if req.RefreshInterval != nil && json.Unmarshal(req.RefreshInterval, &seconds) != nil {
+		writeFieldError(w, "refresh_interval", "must be a number of seconds or null")
+		return
+	}
+
+	if _, err := fh.feedService.GetSubscribedFeed(user.ID, feedID); err != nil {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Feed not found")
+		return
+	}
+
+	if req.RefreshInterval != nil {
+		var interval *time.Duration
+		if seconds != nil {
+			d := time.Duration(*seconds) * time.Second
+			interval = &d
+		}
+		err = fh.feedService.SetRefreshInterval(feedID, interval)
+	}
+	if err == nil && req.FetchFullContent != nil {
+		err = fh.feedService.SetFetchFullContent(feedID, *req.FetchFullContent)
+	}
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Feed not found")
+		return
+	}
+	if err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	feed, err := fh.feedService.GetSubscribedFeed(user.ID, feedID)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, feed)
+}
+
+// DeleteFeed unsubscribes the user from a feed. The feed itself is deleted with its last
+// subscriber.
 func (fh *FeedHandlers) DeleteFeed(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
 	vars := mux.Vars(r)
 	feedID, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(w, "Invalid feed ID", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid feed ID")
 		return
 	}
 
-	err = fh.feedService.DeleteFeed(feedID)
+	err = fh.feedService.DeleteFeed(user.ID, feedID)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Feed not found")
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to delete feed", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, models.ErrorInternal, "Failed to delete feed")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data:    map[string]string{"message": "Feed deleted successfully"},
-	})
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Feed deleted successfully"})
 }
 
 func (fh *FeedHandlers) GetStats(w http.ResponseWriter, r *http.Request) {
-	stats, err := fh.articleService.GetStats()
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	stats, err := fh.articleService.GetStats(user.ID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServerError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data:    stats,
-	})
+	writeJSON(w, http.StatusOK, stats)
 }
\ No newline at end of file
@@ -1,7 +1,10 @@
 package handlers
 
 import (
-	"encoding/json"
+	"database/sql"
+	"errors"
+	"fmt"
+	"myfeed/models"
 	"myfeed/services"
 	"net/http"
 	"strconv"
@@ -22,129 +25,71 @@ func NewFolderHandlers(folderService *services.FolderService, feedService *servi
 }
 
 func (fh *FolderHandlers) GetFolders(w http.ResponseWriter, r *http.Request) {
-	folders, err := fh.folderService.GetAllFolders()
-	if err != nil {
-		http.Error(w, "Failed to get folders", http.StatusInternalServerError)
-		return
-	}
-
-	// Build a hierarchical structure
-	type FolderWithFeeds struct {
-		ID        int                `json:"id"`
-		Name      string             `json:"name"`
-		ParentID  *int               `json:"parent_id"`
-		Position  int                `json:"position"`
-		CreatedAt string             `json:"created_at"`
-		Feeds     []interface{}      `json:"feeds"`
-		Children  []*FolderWithFeeds `json:"children"`
-	}
-
-	folderMap := make(map[int]*FolderWithFeeds)
-	var rootFolders []*FolderWithFeeds
-
-	// Create folder objects
-	for _, folder := range folders {
-		folderObj := &FolderWithFeeds{
-			ID:        folder.ID,
-			Name:      folder.Name,
-			ParentID:  folder.ParentID,
-			Position:  folder.Position,
-			CreatedAt: folder.CreatedAt.Format("2006-01-02T15:04:05Z"),
-			Feeds:     []interface{}{},
-			Children:  []*FolderWithFeeds{},
-		}
-		folderMap[folder.ID] = folderObj
-
-		if folder.ParentID == nil {
-			rootFolders = append(rootFolders, folderObj)
-		}
+	user := currentUser(w, r)
+	if user == nil {
+		return
 	}
 
-	// Build hierarchy
-	for _, folder := range folders {
-		if folder.ParentID != nil {
-			if parent, exists := folderMap[*folder.ParentID]; exists {
-				parent.Children = append(parent.Children, folderMap[folder.ID])
-			}
-		}
+	tree, err := fh.folderService.GetFolderTree(user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, models.ErrorInternal, "Failed to get folders")
+		return
 	}
 
-	// Get feeds for each folder
-	for folderID, folderObj := range folderMap {
-		feeds, err := fh.folderService.GetFeedsInFolder(&folderID)
-		if err == nil {
-			for _, feed := range feeds {
-				folderObj.Feeds = append(folderObj.Feeds, map[string]interface{}{
-					"id":          feed.ID,
-					"title":       feed.Title,
-					"url":         feed.URL,
-					"health":      feed.Health,
-					"error_count": feed.ErrorCount,
-				})
-			}
-		}
-	}
+	writeJSON(w, http.StatusOK, tree)
+}
 
-	// Also get feeds without folders
-	uncategorizedFeeds, err := fh.folderService.GetFeedsInFolder(nil)
-	var uncategorizedFeedData []interface{}
-	if err == nil {
-		for _, feed := range uncategorizedFeeds {
-			uncategorizedFeedData = append(uncategorizedFeedData, map[string]interface{}{
-				"id":          feed.ID,
-				"title":       feed.Title,
-				"url":         feed.URL,
-				"health":      feed.Health,
-				"error_count": feed.ErrorCount,
-			})
-		}
+// GetUnreadCounts returns unread totals per feed and per folder
+func (fh *FolderHandlers) GetUnreadCounts(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
 	}
 
-	response := map[string]interface{}{
-		"success":             true,
-		"data":                rootFolders,
-		"uncategorized_feeds": uncategorizedFeedData,
+	counts, err := fh.folderService.GetUnreadCounts(user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, models.ErrorInternal, "Failed to get unread counts")
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	writeJSON(w, http.StatusOK, counts)
 }
 
 func (fh *FolderHandlers) CreateFolder(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
 	var req struct {
 		Name     string `json:"name"`
 		ParentID *int   `json:"parent_id"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	folder, err := fh.folderService.CreateFolder(req.Name, req.ParentID)
+	folder, err := fh.folderService.CreateFolder(user.ID, req.Name, req.ParentID)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
+		writeInvalid(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"data":    folder,
-	})
+	writeJSON(w, http.StatusOK, folder)
 }
 
 func (fh *FolderHandlers) UpdateFolder(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
 	vars := mux.Vars(r)
 	idStr := vars["id"]
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "Invalid folder ID", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid folder ID")
 		return
 	}
 
@@ -152,81 +97,148 @@ func (fh *FolderHandlers) UpdateFolder(w http.ResponseWriter, r *http.Request) {
 		Name string `json:"name"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	folder, err := fh.folderService.UpdateFolder(id, req.Name)
+	folder, err := fh.folderService.UpdateFolder(user.ID, id, req.Name)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Folder not found")
+		return
+	}
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
+		writeInvalid(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"data":    folder,
-	})
+	writeJSON(w, http.StatusOK, folder)
 }
 
 func (fh *FolderHandlers) DeleteFolder(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
 	vars := mux.Vars(r)
 	idStr := vars["id"]
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "Invalid folder ID", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid folder ID")
 		return
 	}
 
-	err = fh.folderService.DeleteFolder(id)
+	err = fh.folderService.DeleteFolder(user.ID, id)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Folder not found")
+		return
+	}
+	if errors.Is(err, services.ErrFolderNotEmpty) {
+		writeError(w, http.StatusConflict, models.ErrorConflict, err.Error())
+		return
+	}
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
+		writeServerError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": "Folder deleted successfully",
-	})
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Folder deleted successfully"})
 }
 
 func (fh *FolderHandlers) MoveFeedsToFolder(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
 	var req struct {
 		FeedIDs  []int `json:"feed_ids"`
 		FolderID *int  `json:"folder_id"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	err := fh.folderService.MoveFeedsToFolder(user.ID, req.FeedIDs, req.FolderID)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Folder not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Feeds moved successfully"})
+}
+
+// ReorderFeeds sets the manual order of the feeds in a folder. A null folder_id orders the
+// feeds without a folder.
+func (fh *FolderHandlers) ReorderFeeds(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	var req struct {
+		FolderID *int  `json:"folder_id"`
+		FeedIDs  []int `json:"feed_ids"`
+	}
+
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	err := fh.folderService.ReorderFeeds(user.ID, req.FolderID, req.FeedIDs)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Folder not found")
+		return
+	}
+	if err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Feeds reordered successfully"})
+}
+
+// RefreshFolder queues a refresh of every feed in a folder, including nested subfolders.
+// Paused feeds are left alone.
+func (fh *FolderHandlers) RefreshFolder(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
 		return
 	}
 
-	err := fh.folderService.MoveFeedsToFolder(req.FeedIDs, req.FolderID)
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid folder ID")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": "Feeds moved successfully",
+	feedIDs, err := fh.folderService.GetFeedIDsInTree(user.ID, id, false)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Folder not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	jobIDs := make([]int, 0, len(feedIDs))
+	for _, feedID := range feedIDs {
+		job, err := fh.feedService.EnqueueRefresh(feedID)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		jobIDs = append(jobIDs, job.ID)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message": fmt.Sprintf("Refresh queued for %d feeds", len(jobIDs)),
+		"job_ids": jobIDs,
 	})
-}
\ No newline at end of file
+}
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"encoding/json"
+	"myfeed/models"
+	"myfeed/services"
+	"net/http"
+)
+
+// HealthHandlers serve the readiness probe for load balancers and orchestrators
+type HealthHandlers struct {
+	healthService *services.HealthService
+}
+
+func NewHealthHandlers(healthService *services.HealthService) *HealthHandlers {
+	return &HealthHandlers{healthService: healthService}
+}
+
+// Ready runs the readiness checks and answers 503 with the result of every check when
+// one of them fails. Like /api/health, the report is not wrapped in an APIResponse.
+func (hh *HealthHandlers) Ready(w http.ResponseWriter, r *http.Request) {
+	report := hh.healthService.Check(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != models.CheckOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
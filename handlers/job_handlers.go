@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"myfeed/models"
+	"myfeed/services"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type JobHandlers struct {
+	jobService *services.JobService
+}
+
+func NewJobHandlers(jobService *services.JobService) *JobHandlers {
+	return &JobHandlers{
+		jobService: jobService,
+	}
+}
+
+// GetJobs lists recent background jobs with per-status totals (admin only).
+// Supports ?status=, ?type= and ?limit= (default 50, max 500).
+func (jh *JobHandlers) GetJobs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := 50
+	if limitStr := query.Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 500 {
+			limit = l
+		}
+	}
+
+	jobs, err := jh.jobService.GetJobs(query.Get("status"), query.Get("type"), limit)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	counts, err := jh.jobService.CountByStatus()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"jobs":   jobs,
+		"counts": counts,
+	})
+}
+
+// GetJob returns a single background job (admin only)
+func (jh *JobHandlers) GetJob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid job ID")
+		return
+	}
+
+	job, err := jh.jobService.GetJob(jobID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Job not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"myfeed/services"
+	"net/http"
+	"strconv"
+)
+
+type MaintenanceHandlers struct {
+	maintenanceService *services.MaintenanceService
+	articleService     *services.ArticleService
+	settingsService    *services.SettingsService
+}
+
+func NewMaintenanceHandlers(maintenanceService *services.MaintenanceService, articleService *services.ArticleService, settingsService *services.SettingsService) *MaintenanceHandlers {
+	return &MaintenanceHandlers{
+		maintenanceService: maintenanceService,
+		articleService:     articleService,
+		settingsService:    settingsService,
+	}
+}
+
+// GetMaintenanceMode reports whether background processing is paused (admin only)
+func (mh *MaintenanceHandlers) GetMaintenanceMode(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]bool{
+		"enabled": mh.settingsService.GetBool(services.SettingMaintenanceMode, false),
+	})
+}
+
+// SetMaintenanceMode pauses or resumes the scheduler and job workers (admin only).
+// The API stays available while maintenance mode is enabled.
+func (mh *MaintenanceHandlers) SetMaintenanceMode(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if err := mh.settingsService.Set(services.SettingMaintenanceMode, strconv.FormatBool(req.Enabled)); err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{"enabled": req.Enabled})
+}
+
+// RepairOrphans runs the referential repair job immediately and returns its report (admin only)
+func (mh *MaintenanceHandlers) RepairOrphans(w http.ResponseWriter, r *http.Request) {
+	report, err := mh.maintenanceService.RepairOrphans()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// CleanupArticles runs the article cleanup immediately with the given retention (admin only).
+// days defaults to the cleanup_after_days setting; with dry_run the per-feed counts are
+// reported without deleting anything.
+func (mh *MaintenanceHandlers) CleanupArticles(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Days          *int `json:"days"`
+		IncludeUnread bool `json:"include_unread"`
+		DryRun        bool `json:"dry_run"`
+	}
+	if r.ContentLength != 0 {
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+	}
+
+	opts := services.CleanupOptions{
+		DaysOld:       mh.settingsService.GetInt(services.SettingCleanupAfterDays, 30),
+		IncludeUnread: req.IncludeUnread,
+	}
+	if req.Days != nil {
+		if *req.Days < 1 {
+			writeFieldError(w, "days", "days must be at least 1")
+			return
+		}
+		opts.DaysOld = *req.Days
+	}
+
+	report, err := mh.articleService.CleanupArticles(opts, req.DryRun)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,467 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"myfeed/middleware"
+	"myfeed/models"
+	"myfeed/services"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type NotificationHandlers struct {
+	notificationService *services.NotificationService
+	stream              *services.NotificationStream
+}
+
+func NewNotificationHandlers(notificationService *services.NotificationService, stream *services.NotificationStream) *NotificationHandlers {
+	return &NotificationHandlers{
+		notificationService: notificationService,
+		stream:              stream,
+	}
+}
+
+// streamKeepAlive is the interval of the comments sent on an idle notification stream, so
+// proxies do not time it out
+const streamKeepAlive = 30 * time.Second
+
+type streamEvent struct {
+	Title   string `json:"title"`
+	Message string `json:"message"`
+	URL     string `json:"url,omitempty"`
+}
+
+// Stream sends the notifications of the current user's browser targets as server-sent
+// "notification" events until the client disconnects
+func (nh *NotificationHandlers) Stream(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, models.ErrorInternal, "Streaming not supported")
+		return
+	}
+
+	// The stream stays open far beyond the server's read and write timeouts
+	controller := http.NewResponseController(w)
+	controller.SetReadDeadline(time.Time{})
+	controller.SetWriteDeadline(time.Time{})
+
+	notifications, cancel := nh.stream.Subscribe(user.ID)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case n, ok := <-notifications:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(streamEvent{Title: n.Title, Message: n.Message, URL: n.URL})
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: notification\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
+
+type notificationTargetRequest struct {
+	Name     string            `json:"name"`
+	Provider string            `json:"provider"`
+	Config   map[string]string `json:"config"`
+	FolderID *int              `json:"folder_id"`
+	Keywords []string          `json:"keywords"`
+	Enabled  *bool             `json:"enabled"`
+}
+
+func (req *notificationTargetRequest) target(userID, id int) *models.NotificationTarget {
+	return &models.NotificationTarget{
+		ID:       id,
+		UserID:   userID,
+		Name:     req.Name,
+		Provider: req.Provider,
+		Config:   req.Config,
+		FolderID: req.FolderID,
+		Keywords: req.Keywords,
+		Enabled:  req.Enabled == nil || *req.Enabled,
+	}
+}
+
+// GetTargets lists the current user's notification targets
+func (nh *NotificationHandlers) GetTargets(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	targets, err := nh.notificationService.GetTargets(user.ID)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	redacted := make([]*models.NotificationTarget, 0, len(targets))
+	for i := range targets {
+		redacted = append(redacted, services.RedactTarget(&targets[i]))
+	}
+
+	writeJSON(w, http.StatusOK, redacted)
+}
+
+// CreateTarget adds a notification target for the current user
+func (nh *NotificationHandlers) CreateTarget(w http.ResponseWriter, r *http.Request) {
+	nh.saveTarget(w, r, 0)
+}
+
+// UpdateTarget replaces one of the current user's notification targets
+func (nh *NotificationHandlers) UpdateTarget(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid notification target ID")
+		return
+	}
+	nh.saveTarget(w, r, id)
+}
+
+func (nh *NotificationHandlers) saveTarget(w http.ResponseWriter, r *http.Request, id int) {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req notificationTargetRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	target, err := nh.notificationService.SaveTarget(req.target(user.ID, id))
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Notification target not found")
+		return
+	}
+	if err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if id == 0 {
+		w.WriteHeader(http.StatusCreated)
+	}
+	writeJSON(w, http.StatusOK, services.RedactTarget(target))
+}
+
+// DeleteTarget removes one of the current user's notification targets
+func (nh *NotificationHandlers) DeleteTarget(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid notification target ID")
+		return
+	}
+
+	err = nh.notificationService.DeleteTarget(user.ID, id)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Notification target not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Notification target removed"})
+}
+
+// TestTarget pushes a test notification to one of the current user's targets
+func (nh *NotificationHandlers) TestTarget(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid notification target ID")
+		return
+	}
+
+	target, err := nh.notificationService.GetTarget(user.ID, id)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Notification target not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	if err := nh.notificationService.Test(r.Context(), target); err != nil {
+		writeError(w, http.StatusBadGateway, models.ErrorUpstreamFailed, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Test notification sent"})
+}
+
+type notificationRuleRequest struct {
+	Name       string   `json:"name"`
+	FeedID     *int     `json:"feed_id"`
+	FolderID   *int     `json:"folder_id"`
+	Keywords   []string `json:"keywords"`
+	TargetIDs  []int    `json:"target_ids"`
+	MaxPerHour int      `json:"max_per_hour"`
+	Enabled    *bool    `json:"enabled"`
+}
+
+// GetRules lists the current user's notification rules
+func (nh *NotificationHandlers) GetRules(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	rules, err := nh.notificationService.GetRules(user.ID)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, rules)
+}
+
+// CreateRule adds a notification rule for the current user
+func (nh *NotificationHandlers) CreateRule(w http.ResponseWriter, r *http.Request) {
+	nh.saveRule(w, r, 0)
+}
+
+// UpdateRule replaces one of the current user's notification rules
+func (nh *NotificationHandlers) UpdateRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid notification rule ID")
+		return
+	}
+	nh.saveRule(w, r, id)
+}
+
+func (nh *NotificationHandlers) saveRule(w http.ResponseWriter, r *http.Request, id int) {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req notificationRuleRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	rule, err := nh.notificationService.SaveRule(&models.NotificationRule{
+		ID:         id,
+		UserID:     user.ID,
+		Name:       req.Name,
+		FeedID:     req.FeedID,
+		FolderID:   req.FolderID,
+		Keywords:   req.Keywords,
+		TargetIDs:  req.TargetIDs,
+		MaxPerHour: req.MaxPerHour,
+		Enabled:    req.Enabled == nil || *req.Enabled,
+	})
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Notification rule not found")
+		return
+	}
+	if err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if id == 0 {
+		w.WriteHeader(http.StatusCreated)
+	}
+	writeJSON(w, http.StatusOK, rule)
+}
+
+// DeleteRule removes one of the current user's notification rules
+func (nh *NotificationHandlers) DeleteRule(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid notification rule ID")
+		return
+	}
+
+	err = nh.notificationService.DeleteRule(user.ID, id)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Notification rule not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Notification rule removed"})
+}
+
+type notificationPreferencesRequest struct {
+	QuietStart string `json:"quiet_start"`
+	QuietEnd   string `json:"quiet_end"`
+	Timezone   string `json:"timezone"`
+	Batch      bool   `json:"batch"`
+}
+
+// GetPreferences returns the current user's quiet hours
+func (nh *NotificationHandlers) GetPreferences(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	prefs, err := nh.notificationService.GetPreferences(user.ID)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, prefs)
+}
+
+// UpdatePreferences sets the current user's quiet hours
+func (nh *NotificationHandlers) UpdatePreferences(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req notificationPreferencesRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	prefs, err := nh.notificationService.SavePreferences(&models.NotificationPreferences{
+		UserID:     user.ID,
+		QuietStart: req.QuietStart,
+		QuietEnd:   req.QuietEnd,
+		Timezone:   req.Timezone,
+		Batch:      req.Batch,
+	})
+	if err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, prefs)
+}
+
+// GetDeliveries returns the current user's notification delivery log, newest first.
+// Query parameters: status, target_id, limit (default 50, at most 500) and offset.
+func (nh *NotificationHandlers) GetDeliveries(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	query := r.URL.Query()
+	filter := services.DeliveryFilter{Status: query.Get("status"), Limit: 50}
+	if limitStr := query.Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 500 {
+			filter.Limit = l
+		}
+	}
+	if offsetStr := query.Get("offset"); offsetStr != "" {
+		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+			filter.Offset = o
+		}
+	}
+	if targetStr := query.Get("target_id"); targetStr != "" {
+		targetID, err := strconv.Atoi(targetStr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid target ID")
+			return
+		}
+		filter.TargetID = &targetID
+	}
+
+	deliveries, err := nh.notificationService.GetDeliveries(user.ID, filter)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// ResendDelivery queues a failed or dropped notification again
+func (nh *NotificationHandlers) ResendDelivery(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid delivery ID")
+		return
+	}
+
+	delivery, err := nh.notificationService.Resend(user.ID, id)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Delivery not found")
+		return
+	}
+	if err == services.ErrNotResendable {
+		writeError(w, http.StatusConflict, models.ErrorConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, delivery)
+}
@@ -1,13 +1,16 @@
 package handlers
 
 import (
-	"encoding/json"
+	"database/sql"
 	"fmt"
 	"io"
+	"myfeed/models"
 	"myfeed/services"
 	"net/http"
 	"strconv"
 	"time"
+
+	"github.com/gorilla/mux"
 )
 
 type OPMLHandlers struct {
@@ -22,24 +25,24 @@ func NewOPMLHandlers(opmlService *services.OPMLService) *OPMLHandlers {
 
 // ImportOPML handles OPML file import
 func (oh *OPMLHandlers) ImportOPML(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
 	// Limit upload size to 10MB
 	r.Body = http.MaxBytesReader(w, r.Body, 10<<20)
 
 	// Parse multipart form
 	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		writeError(w, http.StatusRequestEntityTooLarge, models.ErrorTooLarge, "File too large")
 		return
 	}
 
 	// Get the file from the form
 	file, _, err := r.FormFile("opml_file")
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "No file uploaded or invalid file",
-		})
+		writeFieldError(w, "opml_file", "No file uploaded or invalid file")
 		return
 	}
 	defer file.Close()
@@ -47,48 +50,86 @@ func (oh *OPMLHandlers) ImportOPML(w http.ResponseWriter, r *http.Request) {
 	// Read file contents
 	opmlData, err := io.ReadAll(file)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Failed to read file",
-		})
+		writeError(w, http.StatusInternalServerError, models.ErrorInternal, "Failed to read file")
 		return
 	}
 
-	// Import the OPML
-	result, err := oh.opmlService.ImportOPML(opmlData)
+	// Queue the import; adding each feed fetches it, which takes too long for one request
+	job, err := oh.opmlService.StartImport(user.ID, opmlData)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   fmt.Sprintf("Failed to import OPML: %v", err),
-		})
+		writeError(w, http.StatusBadRequest, models.ErrorValidationFailed, fmt.Sprintf("Failed to import OPML: %v", err))
 		return
 	}
 
-	// Return success response with import statistics
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": fmt.Sprintf("Import completed: %d feeds imported, %d skipped", 
-			result.ImportedFeeds, result.SkippedFeeds),
-		"data": result,
+	// Return the job ID so the client can poll for progress
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"message": "Import started",
+		"job_id":  job.ID,
 	})
 }
 
-// ExportOPML handles OPML file export
+// GetImportStatus returns the progress of an OPML import and, once it has finished,
+// the final ImportResult
+func (oh *OPMLHandlers) GetImportStatus(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	jobID, err := strconv.Atoi(mux.Vars(r)["job_id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid job ID")
+		return
+	}
+
+	job, result, err := oh.opmlService.GetImport(user.ID, jobID)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Import not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	status := map[string]interface{}{
+		"job_id": job.ID,
+		"status": job.Status,
+		"done":   job.Status == models.JobDone || job.Status == models.JobFailed,
+		"result": result,
+	}
+	if job.Status == models.JobFailed && job.LastError != nil {
+		status["error"] = *job.LastError
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// ExportOPML handles OPML file export. ?folder_id= exports only that folder and its
+// subfolders.
 func (oh *OPMLHandlers) ExportOPML(w http.ResponseWriter, r *http.Request) {
-	// Generate OPML data
-	opmlData, err := oh.opmlService.ExportOPML()
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	var folderID *int
+	if folderIDStr := r.URL.Query().Get("folder_id"); folderIDStr != "" {
+		id, err := strconv.Atoi(folderIDStr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid folder ID")
+			return
+		}
+		folderID = &id
+	}
+
+	export, err := oh.opmlService.ExportOPML(user.ID, folderID)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Folder not found")
+		return
+	}
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   fmt.Sprintf("Failed to export OPML: %v", err),
-		})
+		writeError(w, http.StatusInternalServerError, models.ErrorInternal, fmt.Sprintf("Failed to export OPML: %v", err))
 		return
 	}
 
@@ -98,8 +139,10 @@ func (oh *OPMLHandlers) ExportOPML(w http.ResponseWriter, r *http.Request) {
 	
 	w.Header().Set("Content-Type", "application/xml")
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
-	w.Header().Set("Content-Length", strconv.Itoa(len(opmlData)))
 
-	// Write OPML data
-	w.Write(opmlData)
+	// The document is streamed with chunked encoding. If writing fails halfway, abort the
+	// connection so the client sees an error instead of a truncated but complete-looking file.
+	if _, err := export.WriteTo(w); err != nil {
+		panic(http.ErrAbortHandler)
+	}
 }
\ No newline at end of file
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"myfeed/httpjson"
+	"myfeed/middleware"
+	"myfeed/models"
+	"net/http"
+)
+
+// APIResponse is the envelope of every response written by the handlers
+type APIResponse = models.APIResponse
+
+// The response helpers are shared with the middleware, see httpjson
+var (
+	writeJSON        = httpjson.WriteJSON
+	writeError       = httpjson.WriteError
+	writeFieldError  = httpjson.WriteFieldError
+	writeInvalid     = httpjson.WriteInvalid
+	writeServerError = httpjson.WriteServerError
+	decodeJSON       = httpjson.DecodeJSON
+)
+
+// currentUser returns the signed-in user whose feeds a request works on. Without one it
+// answers the request with 401 and returns nil.
+func currentUser(w http.ResponseWriter, r *http.Request) *models.User {
+	user := middleware.GetUserFromContext(r)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+	}
+	return user
+}
+
+// NotFound answers API requests for endpoints that do not exist or are switched off
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, models.ErrorNotFound, "No such API endpoint")
+}
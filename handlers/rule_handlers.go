@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"database/sql"
+	"myfeed/models"
+	"myfeed/services"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type RuleHandlers struct {
+	ruleService *services.RuleService
+}
+
+func NewRuleHandlers(ruleService *services.RuleService) *RuleHandlers {
+	return &RuleHandlers{
+		ruleService: ruleService,
+	}
+}
+
+type ruleRequest struct {
+	Name       string                 `json:"name"`
+	FeedID     *int                   `json:"feed_id"`
+	FolderID   *int                   `json:"folder_id"`
+	Match      string                 `json:"match"`
+	Conditions []models.RuleCondition `json:"conditions"`
+	Actions    []models.RuleAction    `json:"actions"`
+	Enabled    *bool                  `json:"enabled"`
+}
+
+func (req *ruleRequest) rule(userID, id int) *models.Rule {
+	enabled := true
+	if req.Enabled != nil {
+		enabled = *req.Enabled
+	}
+	return &models.Rule{
+		ID:         id,
+		UserID:     userID,
+		Name:       req.Name,
+		FeedID:     req.FeedID,
+		FolderID:   req.FolderID,
+		Match:      req.Match,
+		Conditions: req.Conditions,
+		Actions:    req.Actions,
+		Enabled:    enabled,
+	}
+}
+
+// GetRules lists the current user's rules in the order they are applied
+func (rh *RuleHandlers) GetRules(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	rules, err := rh.ruleService.GetRules(user.ID)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, rules)
+}
+
+// CreateRule adds a rule for the current user
+func (rh *RuleHandlers) CreateRule(w http.ResponseWriter, r *http.Request) {
+	rh.saveRule(w, r, 0)
+}
+
+// UpdateRule replaces one of the current user's rules
+func (rh *RuleHandlers) UpdateRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid rule ID")
+		return
+	}
+	rh.saveRule(w, r, id)
+}
+
+func (rh *RuleHandlers) saveRule(w http.ResponseWriter, r *http.Request, id int) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	var req ruleRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	rule, err := rh.ruleService.SaveRule(req.rule(user.ID, id))
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Rule not found")
+		return
+	}
+	if err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if id == 0 {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, rule)
+}
+
+// DeleteRule removes one of the current user's rules
+func (rh *RuleHandlers) DeleteRule(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid rule ID")
+		return
+	}
+
+	err = rh.ruleService.DeleteRule(user.ID, id)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Rule not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Rule removed"})
+}
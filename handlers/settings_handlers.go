@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"myfeed/logging"
+	"myfeed/services"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type SettingsHandlers struct {
+	settingsService *services.SettingsService
+}
+
+func NewSettingsHandlers(settingsService *services.SettingsService) *SettingsHandlers {
+	return &SettingsHandlers{
+		settingsService: settingsService,
+	}
+}
+
+// GetSettings returns all application settings with secrets redacted (admin only)
+func (sh *SettingsHandlers) GetSettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := sh.settingsService.GetAll()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, services.RedactSecrets(settings))
+}
+
+// UpdateSettings stores the given settings after validating every value (admin only)
+func (sh *SettingsHandlers) UpdateSettings(w http.ResponseWriter, r *http.Request) {
+	var req map[string]string
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if err := sh.settingsService.Update(req); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	settings, err := sh.settingsService.GetAll()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, services.RedactSecrets(settings))
+}
+
+// loggingState is the logging configuration in effect
+type loggingState struct {
+	LogLevel   string   `json:"log_level"`
+	FetchTrace bool     `json:"fetch_trace"`
+	Levels     []string `json:"levels"`
+}
+
+func currentLogging() loggingState {
+	return loggingState{
+		LogLevel:   strings.ToLower(logging.Level().String()),
+		FetchTrace: services.FetchesTraced(),
+		Levels:     logging.Levels,
+	}
+}
+
+// GetLogging returns the log level in effect and whether fetches are traced (admin only)
+func (sh *SettingsHandlers) GetLogging(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentLogging())
+}
+
+// UpdateLogging changes the log level and turns fetch tracing on or off without a restart
+// (admin only). Both are stored as settings; an empty log_level returns to the level of
+// the config file.
+func (sh *SettingsHandlers) UpdateLogging(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		LogLevel   *string `json:"log_level"`
+		FetchTrace *bool   `json:"fetch_trace"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	changes := make(map[string]string, 2)
+	if req.LogLevel != nil {
+		changes[services.SettingLogLevel] = strings.ToLower(*req.LogLevel)
+	}
+	if req.FetchTrace != nil {
+		changes[services.SettingFetchTrace] = strconv.FormatBool(*req.FetchTrace)
+	}
+	if err := sh.settingsService.Update(changes); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, currentLogging())
+}
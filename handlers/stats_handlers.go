@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"myfeed/models"
+	"myfeed/services"
+	"net/http"
+	"strconv"
+)
+
+type StatsHandlers struct {
+	statsHistoryService *services.StatsHistoryService
+	articleService      *services.ArticleService
+	authService         *services.AuthService
+}
+
+func NewStatsHandlers(statsHistoryService *services.StatsHistoryService, articleService *services.ArticleService, authService *services.AuthService) *StatsHandlers {
+	return &StatsHandlers{
+		statsHistoryService: statsHistoryService,
+		articleService:      articleService,
+		authService:         authService,
+	}
+}
+
+// GetStatsHistory returns daily article counts from the nightly aggregation.
+// Supports ?feed_id= and ?days= (default 30, max 365).
+func (sh *StatsHandlers) GetStatsHistory(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	query := r.URL.Query()
+
+	days := 30
+	if daysStr := query.Get("days"); daysStr != "" {
+		if d, err := strconv.Atoi(daysStr); err == nil && d > 0 && d <= 365 {
+			days = d
+		}
+	}
+
+	var feedID *int
+	if feedIDStr := query.Get("feed_id"); feedIDStr != "" {
+		id, err := strconv.Atoi(feedIDStr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid feed ID")
+			return
+		}
+		feedID = &id
+	}
+
+	history, err := sh.statsHistoryService.GetHistory(user.ID, feedID, days)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, history)
+}
+
+// GetReadingStats returns articles read per day and week over the last ?days= (1-365,
+// default 30), the ?feeds= (1-100, default 10) feeds read most, the average time to read
+// and reading streaks. Days are in ?tz= or else the user's timezone.
+func (sh *StatsHandlers) GetReadingStats(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	query := r.URL.Query()
+
+	days := 30
+	if daysStr := query.Get("days"); daysStr != "" {
+		d, err := strconv.Atoi(daysStr)
+		if err != nil || d < 1 || d > 365 {
+			writeFieldError(w, "days", "days must be between 1 and 365")
+			return
+		}
+		days = d
+	}
+
+	feeds := 10
+	if feedsStr := query.Get("feeds"); feedsStr != "" {
+		f, err := strconv.Atoi(feedsStr)
+		if err != nil || f < 1 || f > 100 {
+			writeFieldError(w, "feeds", "feeds must be between 1 and 100")
+			return
+		}
+		feeds = f
+	}
+
+	loc, ok := requestLocation(w, r, sh.authService)
+	if !ok {
+		return
+	}
+
+	stats, err := sh.articleService.GetReadingStats(r.Context(), user.ID, loc, days, feeds)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"myfeed/models"
+	"myfeed/services"
+	"net/http"
+	"time"
+)
+
+// StatusHandlers serve a compact summary for dashboards such as a Home Assistant REST
+// sensor. The endpoint sits outside the session login and is only enabled with a token;
+// unread counts are those of the first admin.
+type StatusHandlers struct {
+	feedService   *services.FeedService
+	folderService *services.FolderService
+	authService   *services.AuthService
+	token         string
+}
+
+func NewStatusHandlers(feedService *services.FeedService, folderService *services.FolderService, authService *services.AuthService, token string) *StatusHandlers {
+	return &StatusHandlers{
+		feedService:   feedService,
+		folderService: folderService,
+		authService:   authService,
+		token:         token,
+	}
+}
+
+type folderStatus struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	ParentID *int   `json:"parent_id"`
+	Unread   int    `json:"unread"` // including subfolders
+}
+
+// statusResponse is deliberately flat and unwrapped, and fields are only ever added, so
+// dashboard templates keep working across upgrades
+type statusResponse struct {
+	Unread        int                      `json:"unread"`
+	Uncategorized int                      `json:"uncategorized"`
+	Folders       []folderStatus           `json:"folders"`
+	Feeds         *models.FeedHealthTotals `json:"feeds"`
+	GeneratedAt   time.Time                `json:"generated_at"`
+}
+
+// GetStatus returns unread counts per folder and feed health totals. It requires
+// "Authorization: Bearer <STATUS_TOKEN>" and is not found while no token is configured.
+func (sh *StatusHandlers) GetStatus(w http.ResponseWriter, r *http.Request) {
+	if sh.token == "" {
+		NotFound(w, r)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+sh.token)) != 1 {
+		writeError(w, http.StatusUnauthorized, models.ErrorUnauthorized, "Unauthorized")
+		return
+	}
+
+	admin, err := sh.authService.GetFirstAdmin()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, models.ErrorInternal, "Failed to get admin")
+		return
+	}
+	counts, err := sh.folderService.GetUnreadCounts(admin.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, models.ErrorInternal, "Failed to get unread counts")
+		return
+	}
+	folders, err := sh.folderService.GetAllFolders(admin.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, models.ErrorInternal, "Failed to get folders")
+		return
+	}
+	health, err := sh.feedService.GetHealthTotals()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, models.ErrorInternal, "Failed to get feed health")
+		return
+	}
+
+	status := statusResponse{
+		Unread:        counts.Total,
+		Uncategorized: counts.Uncategorized,
+		Folders:       make([]folderStatus, 0, len(folders)),
+		Feeds:         health,
+		GeneratedAt:   time.Now().UTC(),
+	}
+	for _, folder := range folders {
+		status.Folders = append(status.Folders, folderStatus{
+			ID:       folder.ID,
+			Name:     folder.Name,
+			ParentID: folder.ParentID,
+			Unread:   counts.Folders[folder.ID],
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"myfeed/models"
+	"myfeed/services"
+	"net/http"
+	"strconv"
+)
+
+type SystemHandlers struct {
+	systemService *services.SystemService
+	updateService *services.UpdateService
+}
+
+func NewSystemHandlers(systemService *services.SystemService, updateService *services.UpdateService) *SystemHandlers {
+	return &SystemHandlers{
+		systemService: systemService,
+		updateService: updateService,
+	}
+}
+
+// GetSystem returns build information, uptime, database size, row counts, scheduler
+// status and the last backup (admin only). ?top= sets how many of the feeds with the
+// most articles are listed (default 10, max 100).
+func (sh *SystemHandlers) GetSystem(w http.ResponseWriter, r *http.Request) {
+	top := 10
+	if topStr := r.URL.Query().Get("top"); topStr != "" {
+		t, err := strconv.Atoi(topStr)
+		if err != nil || t < 0 || t > 100 {
+			writeFieldError(w, "top", "Must be a number from 0 to 100")
+			return
+		}
+		top = t
+	}
+
+	info, err := sh.systemService.GetSystemInfo(r.Context(), top)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+// GetVersion returns the version, commit and build date of the server. It needs no login,
+// so clients and monitoring can tell which release they talk to.
+func (sh *SystemHandlers) GetVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, services.GetBuildInfo())
+}
+
+// CheckUpdate looks for a newer release right away instead of waiting for the daily check
+// (admin only). It is unavailable while the update_check setting is off.
+func (sh *SystemHandlers) CheckUpdate(w http.ResponseWriter, r *http.Request) {
+	if !sh.updateService.Enabled() {
+		writeError(w, http.StatusServiceUnavailable, models.ErrorUnavailable, "Update checks are disabled by the update_check setting")
+		return
+	}
+	if err := sh.updateService.Check(r.Context()); err != nil {
+		writeError(w, http.StatusBadGateway, models.ErrorUpstreamFailed, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, sh.updateService.Status())
+}
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"myfeed/services"
+	"net/http"
+)
+
+type TemplateHandlers struct {
+	templates *services.MessageTemplates
+}
+
+func NewTemplateHandlers(templates *services.MessageTemplates) *TemplateHandlers {
+	return &TemplateHandlers{templates: templates}
+}
+
+// GetTemplates lists the customizable message templates with their built-in defaults (admin only).
+// They are changed through the settings endpoint.
+func (th *TemplateHandlers) GetTemplates(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, th.templates.List())
+}
+
+type templatePreviewRequest struct {
+	Key      string  `json:"key"`
+	Template *string `json:"template"` // omitted to preview the stored template
+}
+
+// PreviewTemplate renders a message template with sample data (admin only)
+func (th *TemplateHandlers) PreviewTemplate(w http.ResponseWriter, r *http.Request) {
+	var req templatePreviewRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	output, err := th.templates.Preview(req.Key, req.Template)
+	if err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"key":    req.Key,
+		"output": output,
+	})
+}
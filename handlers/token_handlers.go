@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"database/sql"
+	"myfeed/middleware"
+	"myfeed/models"
+	"myfeed/services"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type TokenHandlers struct {
+	authService *services.AuthService
+}
+
+func NewTokenHandlers(authService *services.AuthService) *TokenHandlers {
+	return &TokenHandlers{
+		authService: authService,
+	}
+}
+
+// sessionUser is currentUser for requests that need a login: tokens cannot manage tokens,
+// so a leaked token cannot be used to make more
+func sessionUser(w http.ResponseWriter, r *http.Request) *models.User {
+	if middleware.GetTokenFromContext(r) != nil {
+		writeError(w, http.StatusForbidden, models.ErrorForbidden, "API tokens can only be managed when logged in")
+		return nil
+	}
+	return currentUser(w, r)
+}
+
+// GetTokens lists the current user's API tokens, without the tokens themselves
+func (th *TokenHandlers) GetTokens(w http.ResponseWriter, r *http.Request) {
+	user := sessionUser(w, r)
+	if user == nil {
+		return
+	}
+
+	tokens, err := th.authService.GetTokens(user.ID)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// CreateToken creates an API token: {"name": "...", "scope": "read"}, "write" or, for
+// admins, "admin". The token is only in this response.
+func (th *TokenHandlers) CreateToken(w http.ResponseWriter, r *http.Request) {
+	user := sessionUser(w, r)
+	if user == nil {
+		return
+	}
+
+	var req struct {
+		Name  string `json:"name"`
+		Scope string `json:"scope"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	token, err := th.authService.CreateToken(user, req.Name, req.Scope)
+	if err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, token)
+}
+
+// DeleteToken revokes one of the current user's API tokens
+func (th *TokenHandlers) DeleteToken(w http.ResponseWriter, r *http.Request) {
+	user := sessionUser(w, r)
+	if user == nil {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid token ID")
+		return
+	}
+
+	err = th.authService.DeleteToken(user.ID, id)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Token not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Token revoked"})
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"database/sql"
+	"myfeed/models"
+	"myfeed/services"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type UserHandlers struct {
+	authService *services.AuthService
+}
+
+func NewUserHandlers(authService *services.AuthService) *UserHandlers {
+	return &UserHandlers{
+		authService: authService,
+	}
+}
+
+// userID parses the user ID of a request, writing a 400 response if it is invalid
+func userID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid user ID")
+		return 0, false
+	}
+	return id, true
+}
+
+// writeUserError answers a request that failed to change a user
+func writeUserError(w http.ResponseWriter, err error) {
+	switch err {
+	case sql.ErrNoRows:
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "User not found")
+	case services.ErrUserExists, services.ErrLastAdmin, services.ErrOwnAccount:
+		writeError(w, http.StatusConflict, models.ErrorConflict, err.Error())
+	default:
+		writeInvalid(w, err)
+	}
+}
+
+// GetUsers lists all users
+func (uh *UserHandlers) GetUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := uh.authService.GetUsers()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, users)
+}
+
+// CreateUser adds a user: {"username": "...", "password": "...", "is_admin": false}
+func (uh *UserHandlers) CreateUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		IsAdmin  bool   `json:"is_admin"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	user, err := uh.authService.AddUser(req.Username, req.Password, req.IsAdmin)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, user)
+}
+
+// UpdateUser disables or enables a user and grants or revokes admin rights:
+// {"disabled": true} or {"is_admin": false}; fields left out stay as they are
+func (uh *UserHandlers) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	admin := currentUser(w, r)
+	if admin == nil {
+		return
+	}
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Disabled *bool `json:"disabled"`
+		IsAdmin  *bool `json:"is_admin"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	user, err := uh.authService.UpdateUser(admin.ID, id, req.Disabled, req.IsAdmin)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, user)
+}
+
+// DeleteUser removes a user and everything of theirs
+func (uh *UserHandlers) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	admin := currentUser(w, r)
+	if admin == nil {
+		return
+	}
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := uh.authService.DeleteUser(admin.ID, id); err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "User deleted"})
+}
+
+// ResetPassword sets a new password for a user: {"password": "..."}
+func (uh *UserHandlers) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if err := uh.authService.ResetPassword(id, req.Password); err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Password reset"})
+}
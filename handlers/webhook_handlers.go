@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"myfeed/models"
+	"myfeed/services"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type WebhookHandlers struct {
+	webhookService *services.WebhookService
+}
+
+func NewWebhookHandlers(webhookService *services.WebhookService) *WebhookHandlers {
+	return &WebhookHandlers{
+		webhookService: webhookService,
+	}
+}
+
+type webhookRequest struct {
+	Name     string   `json:"name"`
+	URL      string   `json:"url"`
+	Secret   string   `json:"secret"`
+	FeedID   *int     `json:"feed_id"`
+	FolderID *int     `json:"folder_id"`
+	Keywords []string `json:"keywords"`
+	Enabled  *bool    `json:"enabled"`
+}
+
+func (req *webhookRequest) webhook(userID, id int) *models.Webhook {
+	enabled := true
+	if req.Enabled != nil {
+		enabled = *req.Enabled
+	}
+	return &models.Webhook{
+		ID:       id,
+		UserID:   userID,
+		Name:     req.Name,
+		URL:      req.URL,
+		Secret:   req.Secret,
+		FeedID:   req.FeedID,
+		FolderID: req.FolderID,
+		Keywords: req.Keywords,
+		Enabled:  enabled,
+	}
+}
+
+// webhookID parses the webhook ID of a request, writing a 400 response if it is invalid
+func webhookID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid webhook ID")
+		return 0, false
+	}
+	return id, true
+}
+
+// GetWebhooks lists the current user's webhooks, with their secrets redacted
+func (wh *WebhookHandlers) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	webhooks, err := wh.webhookService.GetWebhooks(user.ID)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	for i := range webhooks {
+		webhooks[i] = *services.RedactWebhook(&webhooks[i])
+	}
+	writeJSON(w, http.StatusOK, webhooks)
+}
+
+// CreateWebhook adds a webhook for the current user
+func (wh *WebhookHandlers) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	wh.saveWebhook(w, r, 0)
+}
+
+// UpdateWebhook replaces one of the current user's webhooks
+func (wh *WebhookHandlers) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+	wh.saveWebhook(w, r, id)
+}
+
+func (wh *WebhookHandlers) saveWebhook(w http.ResponseWriter, r *http.Request, id int) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	var req webhookRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	webhook, err := wh.webhookService.SaveWebhook(req.webhook(user.ID, id))
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Webhook not found")
+		return
+	}
+	if err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if id == 0 {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, services.RedactWebhook(webhook))
+}
+
+// DeleteWebhook removes one of the current user's webhooks and its delivery log
+func (wh *WebhookHandlers) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+
+	err := wh.webhookService.DeleteWebhook(user.ID, id)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Webhook not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Webhook removed"})
+}
+
+// TestWebhook POSTs a test event to one of the current user's webhooks and returns the
+// logged delivery
+func (wh *WebhookHandlers) TestWebhook(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+
+	webhook, err := wh.webhookService.GetWebhook(user.ID, id)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Webhook not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	delivery, err := wh.webhookService.Test(r.Context(), webhook)
+	var upstream *services.UpstreamError
+	if errors.As(err, &upstream) {
+		writeError(w, http.StatusBadGateway, models.ErrorUpstreamFailed, err.Error())
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, delivery)
+}
+
+// GetDeliveries lists the current user's webhook delivery log, newest first, optionally
+// only of one status or one webhook (?webhook_id=)
+func (wh *WebhookHandlers) GetDeliveries(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := services.DeliveryFilter{Status: query.Get("status"), Limit: 50}
+	if limitStr := query.Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 500 {
+			filter.Limit = l
+		}
+	}
+	if offsetStr := query.Get("offset"); offsetStr != "" {
+		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+			filter.Offset = o
+		}
+	}
+	if webhookStr := query.Get("webhook_id"); webhookStr != "" {
+		id, err := strconv.Atoi(webhookStr)
+		if err != nil {
+			writeFieldError(w, "webhook_id", "must be a webhook ID")
+			return
+		}
+		filter.TargetID = &id
+	}
+
+	deliveries, err := wh.webhookService.GetDeliveries(user.ID, filter)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// RedeliverDelivery queues the payload of a failed delivery again
+func (wh *WebhookHandlers) RedeliverDelivery(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid delivery ID")
+		return
+	}
+
+	delivery, err := wh.webhookService.Redeliver(user.ID, id)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "Delivery not found")
+		return
+	}
+	if err == services.ErrNotRedeliverable {
+		writeError(w, http.StatusConflict, models.ErrorConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, delivery)
+}
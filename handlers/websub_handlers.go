@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"myfeed/models"
+	"myfeed/services"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type WebSubHandlers struct {
+	websubService *services.WebSubService
+}
+
+func NewWebSubHandlers(websubService *services.WebSubService) *WebSubHandlers {
+	return &WebSubHandlers{
+		websubService: websubService,
+	}
+}
+
+// Callback is the endpoint hubs call for a feed: GET to verify a subscription, answered
+// with the challenge, and POST to push new content. It needs no login; pushes are checked
+// against the subscription's secret instead.
+func (wh *WebSubHandlers) Callback(w http.ResponseWriter, r *http.Request) {
+	feedID, err := strconv.Atoi(mux.Vars(r)["feed_id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid feed ID")
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		challenge, err := wh.websubService.Verify(feedID, r.URL.Query())
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, models.ErrorNotFound, "No such subscription")
+			return
+		}
+		var invalid *services.ValidationError
+		if errors.As(err, &invalid) {
+			writeInvalid(w, err)
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, challenge)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 10<<20))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, models.ErrorTooLarge, "Content too large")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Failed to read content")
+		return
+	}
+	_, err = wh.websubService.Push(r.Context(), feedID, r.Header.Get("X-Hub-Signature"), body)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, models.ErrorNotFound, "No such subscription")
+		return
+	}
+	var invalid *services.ValidationError
+	if errors.As(err, &invalid) {
+		writeInvalid(w, err)
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,93 @@
+// Package httpjson writes the JSON envelope of API responses and reads JSON request
+// bodies, for the handlers and the middleware alike, so every error has the same shape.
+package httpjson
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"myfeed/database"
+	"myfeed/models"
+	"myfeed/services"
+	"net/http"
+	"strings"
+)
+
+// WriteJSON sends data wrapped in a successful models.APIResponse
+func WriteJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(models.APIResponse{Success: true, Data: data})
+}
+
+// WriteError sends a failed models.APIResponse with one of the models.Error* codes
+func WriteError(w http.ResponseWriter, status int, code, message string) {
+	WriteAPIError(w, status, &models.APIError{Code: code, Message: message})
+}
+
+// WriteFieldError rejects a request because of a single invalid field
+func WriteFieldError(w http.ResponseWriter, field, message string) {
+	WriteAPIError(w, http.StatusBadRequest, &models.APIError{
+		Code:    models.ErrorValidationFailed,
+		Message: message,
+		Fields:  map[string]string{field: message},
+	})
+}
+
+// WriteInvalid answers a request with the error of a service that validated it. Validation
+// errors and errors with a code of their own are reported to the client; anything else is
+// a server error.
+func WriteInvalid(w http.ResponseWriter, err error) {
+	var invalid *services.ValidationError
+	switch {
+	case errors.As(err, &invalid):
+		WriteAPIError(w, http.StatusBadRequest, &models.APIError{
+			Code:    models.ErrorValidationFailed,
+			Message: invalid.Message,
+			Fields:  invalid.Fields,
+		})
+	case errors.Is(err, services.ErrFeedExists):
+		WriteError(w, http.StatusConflict, models.ErrorFeedExists, err.Error())
+	default:
+		WriteServerError(w, err)
+	}
+}
+
+// WriteServerError reports a failed service call. Database timeouts get 504 so clients
+// can tell them apart from other failures.
+func WriteServerError(w http.ResponseWriter, err error) {
+	if database.IsTimeout(err) {
+		WriteError(w, http.StatusGatewayTimeout, models.ErrorTimeout, err.Error())
+		return
+	}
+	WriteError(w, http.StatusInternalServerError, models.ErrorInternal, err.Error())
+}
+
+// DecodeJSON reads the request body into v. Fields v does not have are rejected, so typos
+// in a request do not pass silently. On failure it answers the request and returns false.
+func DecodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err == nil {
+		return true
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		WriteError(w, http.StatusRequestEntityTooLarge, models.ErrorTooLarge,
+			fmt.Sprintf("Request body is larger than %d bytes", tooLarge.Limit))
+	} else if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		WriteFieldError(w, strings.Trim(field, `"`), "unknown field")
+	} else {
+		WriteError(w, http.StatusBadRequest, models.ErrorInvalidRequest, "Invalid JSON")
+	}
+	return false
+}
+
+// WriteAPIError sends a failed models.APIResponse with the given error
+func WriteAPIError(w http.ResponseWriter, status int, apiErr *models.APIError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(models.APIResponse{Success: false, Error: apiErr})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"myfeed/config"
+	"myfeed/handlers"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation
+const listenFDsStart = 3
+
+// unixPrefix marks listen addresses that are Unix socket paths
+const unixPrefix = "unix:"
+
+// listener is where the server accepts connections. It is inherited from systemd, or bound
+// with SO_REUSEPORT so a new process can take over the port while the old one finishes its
+// requests, or an ordinary listener.
+type listener struct {
+	net.Listener
+	// addr is the configured address, bound by bind
+	addr string
+	// admin listeners also serve the admin API and metrics, which are kept off the others
+	admin bool
+	// handoff is set for inherited and reuse_port listeners. They are served only once
+	// startup completes: connections wait in the socket backlog, or go to the process that
+	// is being replaced, instead of being answered 503 while the database is migrated.
+	handoff    bool
+	source     string
+	socketMode os.FileMode
+}
+
+// listen returns the sockets passed by systemd if there are any. Otherwise it binds every
+// configured address right away, unless reuse_port defers it to bind, which the caller runs
+// once startup is complete.
+func listen(cfg config.ServerConfig) ([]*listener, error) {
+	inherited, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(inherited) > 0 {
+		return inherited, nil
+	}
+
+	var listeners []*listener
+	add := func(addrs []string, admin bool) error {
+		for _, addr := range addrs {
+			l := &listener{addr: addr, admin: admin, source: "bind", socketMode: cfg.SocketFileMode()}
+			if cfg.ReusePort {
+				l.handoff = true
+				l.source = "reuse_port"
+			} else if err := l.bind(); err != nil {
+				return err
+			}
+			listeners = append(listeners, l)
+		}
+		return nil
+	}
+	err = add(cfg.Listen, false)
+	if err == nil {
+		err = add(cfg.AdminListen, true)
+	}
+	if err != nil {
+		for _, l := range listeners {
+			if l.Listener != nil {
+				l.Close()
+			}
+		}
+		return nil, err
+	}
+	return listeners, nil
+}
+
+// bind opens a listener that is not open yet. With reuse_port, binding a TCP address fails
+// unless the process holding the port set SO_REUSEPORT as well.
+func (l *listener) bind() error {
+	if l.Listener != nil {
+		return nil
+	}
+	if path, ok := strings.CutPrefix(l.addr, unixPrefix); ok {
+		ln, err := listenUnix(path, l.socketMode)
+		if err != nil {
+			return err
+		}
+		l.Listener = ln
+		return nil
+	}
+
+	lc := net.ListenConfig{}
+	if l.handoff {
+		lc.Control = reusePortControl
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", l.addr)
+	if err != nil {
+		return err
+	}
+	l.Listener = ln
+	return nil
+}
+
+// listenUnix binds a Unix socket next to path and renames it into place, which replaces
+// the socket of a previous process in one step: new connections go to this process, while
+// the previous one keeps the connections it has.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	tmp := path + ".new"
+	os.Remove(tmp)
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is renamed, and closing must not remove the one of a newer process
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to set the mode of %s: %v", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to move the socket to %s: %v", path, err)
+	}
+	return ln, nil
+}
+
+// Accept marks the connections of admin listeners, so requests can tell where they came in
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil || !l.admin {
+		return conn, err
+	}
+	return adminConn{conn}, nil
+}
+
+// String describes the listener for the startup log
+func (l *listener) String() string {
+	if strings.HasPrefix(l.addr, unixPrefix) {
+		return l.addr
+	}
+	if l.Addr().Network() == "unix" {
+		return unixPrefix + l.Addr().String()
+	}
+	return l.Addr().String()
+}
+
+type adminConn struct {
+	net.Conn
+}
+
+type adminConnKey struct{}
+
+// connContext is the ConnContext of the server: it records whether a connection came in
+// on an admin listener
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	if _, ok := conn.(adminConn); ok {
+		return context.WithValue(ctx, adminConnKey{}, true)
+	}
+	return ctx
+}
+
+// adminRoutes answers 404 to admin API and metrics requests that did not come in on an
+// admin listener. It is only installed when admin listeners are configured.
+func adminRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admin, _ := r.Context().Value(adminConnKey{}).(bool)
+		if !admin && (strings.HasPrefix(r.URL.Path, "/api/admin/") || r.URL.Path == "/metrics") {
+			handlers.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// systemdListeners returns the sockets passed with LISTEN_FDS, or nil when the process was
+// not socket activated. Sockets named "admin" with FileDescriptorName= are admin listeners.
+// The variables are removed so hook commands do not inherit them.
+func systemdListeners() ([]*listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]*listener, 0, count)
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to use socket %d passed by systemd: %v", i+1, err)
+		}
+		admin := i < len(names) && names[i] == "admin"
+		listeners = append(listeners, &listener{Listener: ln, admin: admin, handoff: true, source: "systemd"})
+	}
+	return listeners, nil
+}
+
+// sdNotify sends a state like "READY=1" to systemd when running as a Type=notify service,
+// so a restart waits until the new process accepts connections. It does nothing otherwise.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		serverLog.Warn("Failed to notify systemd", "state", state, "error", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		serverLog.Warn("Failed to notify systemd", "state", state, "error", err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortControl fails, since SO_REUSEPORT is not available on this platform
+func reusePortControl(network, address string, conn syscall.RawConn) error {
+	return errors.New("reuse_port is not supported on this platform")
+}
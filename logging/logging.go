@@ -0,0 +1,157 @@
+// Package logging configures structured logging with log/slog. Every part of the server
+// logs through a component logger, so a log aggregator can filter e.g. refresh noise
+// from the fetcher apart from errors elsewhere.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Levels lists the accepted level names
+var Levels = []string{"debug", "info", "warn", "error"}
+
+// level is shared by every handler, so SetLevel takes effect without a restart
+var level = new(slog.LevelVar)
+
+// Setup installs the default logger. The log package is redirected to it as well, so
+// anything still using log.Printf ends up in the same output at info level.
+func Setup(levelName, format string) error {
+	if levelName != "" {
+		if err := SetLevel(levelName); err != nil {
+			return err
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", FormatText:
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("unknown log format %q, expected %s or %s", format, FormatText, FormatJSON)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// ParseLevel parses one of Levels
+func ParseLevel(name string) (slog.Level, error) {
+	var parsed slog.Level
+	if err := parsed.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q, expected one of %s", name, strings.Join(Levels, ", "))
+	}
+	return parsed, nil
+}
+
+// SetLevel changes the minimum level that is logged
+func SetLevel(name string) error {
+	parsed, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	level.Set(parsed)
+	return nil
+}
+
+// Level returns the current minimum level
+func Level() slog.Level {
+	return level.Level()
+}
+
+// debugging holds the components that log at debug level whatever the minimum level is
+var debugging sync.Map
+
+// SetDebug makes a component log at debug level regardless of the minimum level, to trace
+// e.g. the fetcher without the debug output of everything else
+func SetDebug(component string, on bool) {
+	if on {
+		debugging.Store(component, true)
+	} else {
+		debugging.Delete(component)
+	}
+}
+
+// Debugging reports whether SetDebug enabled debug level for a component
+func Debugging(component string) bool {
+	_, ok := debugging.Load(component)
+	return ok
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context that carries the ID of an HTTP request. Records logged with
+// the context, e.g. through InfoContext, get a request_id attribute.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, or an empty string
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// For returns the logger of a component. Component loggers are usually package variables
+// created before Setup runs, so they look up the default handler on every record.
+func For(component string) *slog.Logger {
+	return slog.New(&componentHandler{
+		component: component,
+		attrs:     []slog.Attr{slog.String("component", component)},
+	})
+}
+
+// componentHandler adds its attributes and groups to whatever handler is the default
+// when a record is logged
+type componentHandler struct {
+	component string
+	attrs     []slog.Attr
+	groups    []string
+}
+
+func (h *componentHandler) handler() slog.Handler {
+	handler := slog.Default().Handler().WithAttrs(h.attrs)
+	for _, group := range h.groups {
+		handler = handler.WithGroup(group)
+	}
+	return handler
+}
+
+func (h *componentHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	// The default handlers leave level checks to Enabled, so records of a debugged
+	// component pass them
+	return slog.Default().Handler().Enabled(ctx, l) || (l >= slog.LevelDebug && Debugging(h.component))
+}
+
+func (h *componentHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r = r.Clone()
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.handler().Handle(ctx, r)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(h.groups) > 0 {
+		// Attributes after a group belong to it; resolve against the current default
+		return h.handler().WithAttrs(attrs)
+	}
+	return &componentHandler{component: h.component, attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return &componentHandler{component: h.component, attrs: h.attrs, groups: append(append([]string{}, h.groups...), name)}
+}
@@ -1,59 +1,228 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
+	"myfeed/config"
 	"myfeed/database"
 	"myfeed/handlers"
+	"myfeed/logging"
+	"myfeed/metrics"
 	"myfeed/middleware"
+	"myfeed/models"
 	"myfeed/services"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
+	_ "time/tzdata" // quiet hours use IANA time zones, which slim images do not ship
 
 	"github.com/gorilla/mux"
-	"github.com/robfig/cron/v3"
 	"golang.org/x/crypto/bcrypt"
 )
 
+var serverLog = logging.For("server")
+
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Until the configuration is loaded, log with the level and format of the environment
+	if err := logging.Setup(os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT")); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid logging configuration:", err)
+		os.Exit(1)
+	}
+
+	configPath := flag.String("config", os.Getenv("MYFEED_CONFIG"), "path to a YAML or JSON config file")
+	demo := flag.Bool("demo", false, "serve bundled demo feeds and subscribe an empty database to them")
+	migrateDownTo := flag.Int("migrate-down-to", -1, "revert the database migrations above this version, for going back to an older release, and exit")
+	flag.Parse()
+
+	// Signals are caught from the start, so a SIGTERM during a long migration stops the
+	// server in order once startup completes instead of killing it halfway
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fatal("Failed to load configuration", err)
+	}
+	if err := logging.Setup(cfg.Log.Level, cfg.Log.Format); err != nil {
+		fatal("Invalid logging configuration", err)
+	}
+	serverLog.Info("Using data directory", "dir", cfg.DataDir)
+
+	if *migrateDownTo >= 0 {
+		db, err := database.NewDatabase(cfg.Database, cfg.DataDir)
+		if err != nil {
+			fatal("Failed to initialize database", err)
+		}
+		if err := db.MigrateDown(*migrateDownTo); err != nil {
+			fatal("Failed to revert database migrations", err)
+		}
+		db.Close()
+		serverLog.Info("Database migrations reverted", "version", *migrateDownTo)
+		return
+	}
+	if basePath := cfg.BasePath(); basePath != "" {
+		serverLog.Info("Serving under a base path", "path", basePath)
+	}
+
+	// Listen before migrating, so liveness probes pass during a long migration. Until
+	// startup completes, every request but the probes is answered with 503. Sockets handed
+	// over by systemd or another process are only served once startup completes.
+	probes := &probes{}
+	readHeaderTimeout, readTimeout, writeTimeout, idleTimeout := cfg.Server.Timeouts()
+	server := &http.Server{
+		Handler:           probes,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+		ConnContext:       connContext,
+	}
+	listeners, err := listen(cfg.Server)
+	if err != nil {
+		fatal("Failed to listen", err)
+	}
+	serve := func(ln *listener) {
+		serverLog.Info("MyFeed server starting", "addr", ln.String(), "listener", ln.source, "admin", ln.admin)
+		go func() {
+			if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+				fatal("HTTP server failed", err)
+			}
+		}()
+	}
+	for _, ln := range listeners {
+		if !ln.handoff {
+			serve(ln)
+		}
 	}
 
 	// Initialize database
-	db, err := database.NewDatabase()
+	db, err := database.NewDatabase(cfg.Database, cfg.DataDir)
 	if err != nil {
-		log.Fatal("Failed to initialize database:", err)
+		fatal("Failed to initialize database", err)
 	}
 	defer db.Close()
+	probes.migrated(db)
 
 	// Initialize services
-	feedService := services.NewFeedService(db)
-	articleService := services.NewArticleService(db)
+	feedStatsService := services.NewFeedStatsService(db)
+	statsHistoryService := services.NewStatsHistoryService(db)
+	jobService := services.NewJobService(db, cfg.Fetch.MaxConcurrentRefreshes)
+	settingsService := services.NewSettingsService(db)
+	feedService := services.NewFeedService(db, feedStatsService, jobService, settingsService)
+	articleService := services.NewArticleService(db, feedStatsService)
 	authService := services.NewAuthService(db)
-	folderService := services.NewFolderService(db)
-	opmlService := services.NewOPMLService(db, feedService, folderService)
+	folderService := services.NewFolderService(db, feedStatsService)
+	opmlService := services.NewOPMLService(db, feedService, folderService, settingsService, jobService)
+	discoverService := services.NewDiscoverService(cfg.Podcasts, feedService, folderService, settingsService)
+	maintenanceService := services.NewMaintenanceService(db, feedStatsService)
+	deadLetterService := services.NewDeadLetterService(db, feedService)
+	schedulerService := services.NewSchedulerService(db, feedService, feedStatsService, settingsService, deadLetterService)
+	cronService := services.NewCronService(db, settingsService)
+	mailer := services.NewMailer(cfg.SMTP, settingsService)
+	messageTemplates := services.NewMessageTemplates(settingsService)
+	digestService := services.NewDigestService(db, folderService, settingsService, messageTemplates, mailer)
+	backupService := services.NewBackupService(cfg.BackupDir, opmlService, authService, settingsService)
+	notificationStream := services.NewNotificationStream()
+	hookService := services.NewHookService(cfg.Hooks, feedService, folderService, jobService)
+	emailForwardService := services.NewEmailForwardService(db, feedService, articleService, digestService, messageTemplates, mailer, jobService)
+	enclosureService := services.NewEnclosureService(cfg.EnclosureDir, db, feedService, settingsService, jobService)
+	contentService := services.NewContentService(db, feedService, settingsService, jobService)
+	webhookService := services.NewWebhookService(db, feedService, folderService, jobService)
+	websubService := services.NewWebSubService(cfg.PublicURL(), db, feedService, jobService)
+	ruleService := services.NewRuleService(db, feedService, folderService, articleService, feedStatsService)
+	bookmarkService := services.NewBookmarkService(cfg.Bookmarks, articleService, feedService, folderService, settingsService, jobService)
+	healthService := services.NewHealthService(cfg.Health, cfg.DataDir, db, feedService, schedulerService, settingsService, jobService)
+	updateService := services.NewUpdateService(settingsService)
+	systemService := services.NewSystemService(db, feedService, schedulerService, jobService, backupService, updateService)
+	notificationService := services.NewNotificationService(cfg.Notifications, db, feedService, folderService, jobService, messageTemplates, notificationStream)
 
 	// Ensure default admin user exists
-	if err := authService.EnsureDefaultAdmin(); err != nil {
-		log.Printf("Warning: Failed to ensure default admin: %v", err)
+	if err := authService.EnsureDefaultAdmin(cfg.Auth.AdminUsername, cfg.Auth.AdminPassword); err != nil {
+		serverLog.Warn("Failed to ensure default admin", "error", err)
+	}
+
+	// Feeds, folders and read state from before per-user subscriptions go to the first admin
+	if admin, err := authService.GetFirstAdmin(); err != nil {
+		serverLog.Warn("Failed to get admin to adopt shared feeds", "error", err)
+	} else if count, err := feedService.AdoptSharedData(admin.ID); err != nil {
+		serverLog.Warn("Failed to adopt shared feeds", "error", err)
+	} else if count > 0 {
+		serverLog.Info("Subscribed admin to existing feeds", "user", admin.Username, "feeds", count)
+	}
+
+	// Build statistics for feeds that predate the feed_stats table
+	if err := feedStatsService.RecalculateMissing(); err != nil {
+		serverLog.Warn("Failed to build feed stats", "error", err)
+	}
+
+	// Hash the titles and URLs of articles that predate duplicate grouping
+	if count, err := articleService.BackfillDedupHashes(); err != nil {
+		serverLog.Warn("Failed to hash article titles", "error", err)
+	} else if count > 0 {
+		serverLog.Info("Hashed article titles and URLs for duplicate grouping", "articles", count)
 	}
 
 	// Initialize middleware and handlers
-	authMiddleware := middleware.NewAuthMiddleware(authService)
-	feedHandlers := handlers.NewFeedHandlers(feedService, articleService)
-	articleHandlers := handlers.NewArticleHandlers(articleService)
+	authMiddleware := middleware.NewAuthMiddleware(authService, cfg.Auth, cfg.BasePath())
+	feedHandlers := handlers.NewFeedHandlers(feedService, articleService, feedStatsService)
+	articleHandlers := handlers.NewArticleHandlers(articleService, folderService, settingsService, authService)
 	folderHandlers := handlers.NewFolderHandlers(folderService, feedService)
 	opmlHandlers := handlers.NewOPMLHandlers(opmlService)
+	discoverHandlers := handlers.NewDiscoverHandlers(discoverService)
+	systemHandlers := handlers.NewSystemHandlers(systemService, updateService)
+	settingsHandlers := handlers.NewSettingsHandlers(settingsService)
+	maintenanceHandlers := handlers.NewMaintenanceHandlers(maintenanceService, articleService, settingsService)
+	jobHandlers := handlers.NewJobHandlers(jobService)
+	statsHandlers := handlers.NewStatsHandlers(statsHistoryService, articleService, authService)
+	deadLetterHandlers := handlers.NewDeadLetterHandlers(deadLetterService)
+	digestHandlers := handlers.NewDigestHandlers(digestService, mailer)
+	templateHandlers := handlers.NewTemplateHandlers(messageTemplates)
+	backupHandlers := handlers.NewBackupHandlers(backupService)
+	notificationHandlers := handlers.NewNotificationHandlers(notificationService, notificationStream)
+	emailForwardHandlers := handlers.NewEmailForwardHandlers(emailForwardService, mailer)
+	enclosureHandlers := handlers.NewEnclosureHandlers(enclosureService, feedService)
+	contentHandlers := handlers.NewContentHandlers(contentService, articleService)
+	webhookHandlers := handlers.NewWebhookHandlers(webhookService)
+	websubHandlers := handlers.NewWebSubHandlers(websubService)
+	tokenHandlers := handlers.NewTokenHandlers(authService)
+	userHandlers := handlers.NewUserHandlers(authService)
+	ruleHandlers := handlers.NewRuleHandlers(ruleService)
+	healthHandlers := handlers.NewHealthHandlers(healthService)
+	statusHandlers := handlers.NewStatusHandlers(feedService, folderService, authService, cfg.Auth.StatusToken)
 
 	// Setup routes
 	r := mux.NewRouter()
+	httpMetrics := middleware.NewHTTPMetrics()
+	r.Use(middleware.LogRequests)
+	r.Use(httpMetrics.Measure)
+	r.Use(middleware.Compress)
+	r.Use(middleware.Recover)
 
 	// API routes
 	api := r.PathPrefix("/api").Subrouter()
+	api.Use(middleware.NoStore)
+
+	// Bound request bodies and handler time. Routes that fetch from other servers get
+	// longer and the OPML upload may be larger. Streamed responses, the notification stream,
+	// the OPML and article exports and cached enclosures, have no timeout, which would buffer the whole
+	// response.
+	handlerTimeout, maxBodyBytes := cfg.Server.Limits()
+	api.Use(middleware.Limit(middleware.Limits{Timeout: handlerTimeout, MaxBodyBytes: maxBodyBytes}, map[string]middleware.Limits{
+		"/api/feeds":                          {Timeout: 45 * time.Second, MaxBodyBytes: maxBodyBytes},
+		"/api/admin/backups":                  {Timeout: time.Minute, MaxBodyBytes: maxBodyBytes},
+		"/api/admin/smtp/test":                {Timeout: time.Minute, MaxBodyBytes: maxBodyBytes},
+		"/api/opml/import":                    {Timeout: time.Minute, MaxBodyBytes: 10 << 20},
+		"/api/opml/export":                    {MaxBodyBytes: maxBodyBytes},
+		"/api/articles/export":                {MaxBodyBytes: maxBodyBytes},
+		"/api/notifications/stream":           {},
+		"/api/articles/{id:[0-9]+}/enclosure": {},
+	}))
 	
 	// Public routes (no authentication required)
 	public := api.PathPrefix("").Subrouter()
@@ -63,16 +232,105 @@ func main() {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		
-		debugMode := os.Getenv("DISABLE_AUTH") == "true"
-		if debugMode {
-			fmt.Fprintf(w, `{"status": "ok", "message": "MyFeed is running", "timestamp": "%s", "debug_mode": true}`, time.Now().Format(time.RFC3339))
-		} else {
-			fmt.Fprintf(w, `{"status": "ok", "message": "MyFeed is running", "timestamp": "%s", "debug_mode": false}`, time.Now().Format(time.RFC3339))
+		appTitle := settingsService.GetString(services.SettingAppTitle, "MyFeed")
+		debugMode := cfg.Auth.Disabled
+		response := map[string]interface{}{
+			"status":           "ok",
+			"message":          appTitle + " is running",
+			"app_title":        appTitle,
+			"timestamp":        time.Now().Format(time.RFC3339),
+			"debug_mode":       debugMode,
+			"maintenance_mode": settingsService.GetBool(services.SettingMaintenanceMode, false),
 		}
+
+		// Deep check: include connection pool statistics and the last database error. The
+		// error may name internal hosts, so only requests with the metrics token see it.
+		if r.URL.Query().Get("deep") == "true" {
+			health := db.Health()
+			if !metrics.HasToken(r, cfg.Auth.MetricsToken) {
+				health.LastError = ""
+			}
+			response["database"] = health
+		}
+
+		json.NewEncoder(w).Encode(response)
 	}).Methods("GET")
 
+	// Readiness: 503 when the database, scheduler, refreshes or disk are in trouble
+	public.HandleFunc("/health/ready", healthHandlers.Ready).Methods("GET")
+
+	// Dashboard summary, authenticated with STATUS_TOKEN instead of a session
+	public.HandleFunc("/status", statusHandlers.GetStatus).Methods("GET")
+
+	// Version, commit and build date of the running server
+	public.HandleFunc("/version", systemHandlers.GetVersion).Methods("GET")
+
+	// WebSub hubs verify subscriptions and push new items of a feed here
+	public.HandleFunc("/websub/callback/{feed_id:[0-9]+}", websubHandlers.Callback).Methods("GET", "POST")
+
+	// Authentication routes
+	auth := public.PathPrefix("/auth").Subrouter()
+	auth.HandleFunc("/login", authMiddleware.Login).Methods("POST")
+	auth.HandleFunc("/logout", authMiddleware.Logout).Methods("POST")
+	auth.HandleFunc("/user", authMiddleware.GetCurrentUser).Methods("GET")
+
+	// Podcast feeds, for podcast apps that log in with HTTP Basic credentials
+	api.Handle("/feeds/{id:[0-9]+}/podcast.xml", authMiddleware.RequireAuthOrBasic(http.HandlerFunc(enclosureHandlers.PodcastFeed))).Methods("GET")
+
+	// Protected routes (authentication required)
+	protected := api.PathPrefix("").Subrouter()
+	protected.Use(authMiddleware.RequireAuth)
+	
+	// Protected auth routes
+	protectedAuth := protected.PathPrefix("/auth").Subrouter()
+	protectedAuth.HandleFunc("/change-password", authMiddleware.ChangePassword).Methods("POST")
+	protectedAuth.HandleFunc("/user", authMiddleware.UpdateCurrentUser).Methods("PUT")
+
+	// API tokens for scripts and apps, managed when logged in
+	protected.HandleFunc("/tokens", tokenHandlers.GetTokens).Methods("GET")
+	protected.HandleFunc("/tokens", tokenHandlers.CreateToken).Methods("POST")
+	protected.HandleFunc("/tokens/{id:[0-9]+}", tokenHandlers.DeleteToken).Methods("DELETE")
+
+	// Stats
+	protected.HandleFunc("/stats", feedHandlers.GetStats).Methods("GET")
+	protected.HandleFunc("/stats/history", statsHandlers.GetStatsHistory).Methods("GET")
+	protected.HandleFunc("/stats/reading", statsHandlers.GetReadingStats).Methods("GET")
+
+	// Admin routes: is_admin is required, on top of a login
+	admin := protected.PathPrefix("").Subrouter()
+	admin.Use(authMiddleware.RequireAdmin)
+
+	// Settings
+	admin.HandleFunc("/settings", settingsHandlers.GetSettings).Methods("GET")
+	admin.HandleFunc("/settings", settingsHandlers.UpdateSettings).Methods("PUT")
+
+	// Maintenance, jobs, backups and diagnostics
+	admin.HandleFunc("/admin/users", userHandlers.GetUsers).Methods("GET")
+	admin.HandleFunc("/admin/users", userHandlers.CreateUser).Methods("POST")
+	admin.HandleFunc("/admin/users/{id:[0-9]+}", userHandlers.UpdateUser).Methods("PUT")
+	admin.HandleFunc("/admin/users/{id:[0-9]+}", userHandlers.DeleteUser).Methods("DELETE")
+	admin.HandleFunc("/admin/users/{id:[0-9]+}/password", userHandlers.ResetPassword).Methods("POST")
+	admin.HandleFunc("/admin/system", systemHandlers.GetSystem).Methods("GET")
+	admin.HandleFunc("/admin/update-check", systemHandlers.CheckUpdate).Methods("POST")
+	admin.HandleFunc("/admin/logging", settingsHandlers.GetLogging).Methods("GET")
+	admin.HandleFunc("/admin/logging", settingsHandlers.UpdateLogging).Methods("PUT")
+	admin.HandleFunc("/admin/maintenance", maintenanceHandlers.GetMaintenanceMode).Methods("GET")
+	admin.HandleFunc("/admin/maintenance", maintenanceHandlers.SetMaintenanceMode).Methods("PUT")
+	admin.HandleFunc("/admin/maintenance/repair", maintenanceHandlers.RepairOrphans).Methods("POST")
+	admin.HandleFunc("/admin/cleanup", maintenanceHandlers.CleanupArticles).Methods("POST")
+	admin.HandleFunc("/admin/jobs", jobHandlers.GetJobs).Methods("GET")
+	admin.HandleFunc("/admin/jobs/{id:[0-9]+}", jobHandlers.GetJob).Methods("GET")
+	admin.HandleFunc("/admin/dead-letters", deadLetterHandlers.GetDeadLetters).Methods("GET")
+	admin.HandleFunc("/admin/dead-letters/{id:[0-9]+}/requeue", deadLetterHandlers.RequeueDeadLetter).Methods("POST")
+	admin.HandleFunc("/admin/dead-letters/{id:[0-9]+}", deadLetterHandlers.DismissDeadLetter).Methods("DELETE")
+	admin.HandleFunc("/admin/backups", backupHandlers.GetBackups).Methods("GET")
+	admin.HandleFunc("/admin/backups", backupHandlers.CreateBackup).Methods("POST")
+	admin.HandleFunc("/admin/smtp/test", digestHandlers.TestSMTP).Methods("POST")
+	admin.HandleFunc("/admin/templates", templateHandlers.GetTemplates).Methods("GET")
+	admin.HandleFunc("/admin/templates/preview", templateHandlers.PreviewTemplate).Methods("POST")
+
 	// Temporary debug endpoint to check database status
-	public.HandleFunc("/debug", func(w http.ResponseWriter, r *http.Request) {
+	admin.HandleFunc("/debug", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		
 		// Check user count
@@ -95,15 +353,12 @@ func main() {
 	}).Methods("GET")
 
 	// Temporary admin reset endpoint (remove after fixing)
-	public.HandleFunc("/reset-admin", func(w http.ResponseWriter, r *http.Request) {
+	admin.HandleFunc("/reset-admin", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		
 		// Force create/update admin user
-		username := os.Getenv("ADMIN_USERNAME")
-		password := os.Getenv("ADMIN_PASSWORD")
-		if username == "" {
-			username = "admin"
-		}
+		username := cfg.Auth.AdminUsername
+		password := cfg.Auth.AdminPassword
 		if password == "" {
 			password = "newpassword123"
 		}
@@ -138,23 +393,6 @@ func main() {
 		}
 	}).Methods("POST", "GET")
 
-	// Authentication routes
-	auth := public.PathPrefix("/auth").Subrouter()
-	auth.HandleFunc("/login", authMiddleware.Login).Methods("POST")
-	auth.HandleFunc("/logout", authMiddleware.Logout).Methods("POST")
-	auth.HandleFunc("/user", authMiddleware.GetCurrentUser).Methods("GET")
-
-	// Protected routes (authentication required)
-	protected := api.PathPrefix("").Subrouter()
-	protected.Use(authMiddleware.RequireAuth)
-	
-	// Protected auth routes
-	protectedAuth := protected.PathPrefix("/auth").Subrouter()
-	protectedAuth.HandleFunc("/change-password", authMiddleware.ChangePassword).Methods("POST")
-
-	// Stats
-	protected.HandleFunc("/stats", feedHandlers.GetStats).Methods("GET")
-
 	// Feed routes
 	protected.HandleFunc("/feeds", feedHandlers.GetFeeds).Methods("GET")
 	protected.HandleFunc("/feeds", feedHandlers.AddFeed).Methods("POST")
@@ -162,84 +400,442 @@ func main() {
 	protected.HandleFunc("/feeds/{id:[0-9]+}", feedHandlers.DeleteFeed).Methods("DELETE")
 	protected.HandleFunc("/feeds/{id:[0-9]+}/refresh", feedHandlers.RefreshFeed).Methods("POST")
 
+	// Options of the shared feed row apply to every subscriber, so only admins change them
+	admin.HandleFunc("/feeds/{id:[0-9]+}", feedHandlers.UpdateFeed).Methods("PUT")
+	admin.HandleFunc("/feeds/{id:[0-9]+}/pause", feedHandlers.PauseFeed).Methods("POST")
+	admin.HandleFunc("/feeds/{id:[0-9]+}/resume", feedHandlers.ResumeFeed).Methods("POST")
+	admin.HandleFunc("/feeds/{id:[0-9]+}/enclosures", enclosureHandlers.SetFeedCaching).Methods("PUT")
+
 	// Article routes
 	protected.HandleFunc("/articles", articleHandlers.GetArticles).Methods("GET")
 	protected.HandleFunc("/articles/{id:[0-9]+}", articleHandlers.GetArticle).Methods("GET")
 	protected.HandleFunc("/articles/{id:[0-9]+}/read", articleHandlers.MarkAsRead).Methods("PUT")
 	protected.HandleFunc("/articles/{id:[0-9]+}/save", articleHandlers.MarkAsSaved).Methods("PUT")
 	protected.HandleFunc("/articles/mark-all-read", articleHandlers.MarkAllAsRead).Methods("POST")
+	protected.HandleFunc("/articles/mark-read", articleHandlers.MarkRead).Methods("POST")
+	protected.HandleFunc("/articles/state", articleHandlers.SyncStates).Methods("POST")
 	protected.HandleFunc("/articles/search", articleHandlers.SearchArticles).Methods("GET")
+	protected.HandleFunc("/articles/river", articleHandlers.GetRiver).Methods("GET")
+	protected.HandleFunc("/articles/export", articleHandlers.ExportArticles).Methods("GET")
+	protected.HandleFunc("/tags", articleHandlers.GetTags).Methods("GET")
+	protected.HandleFunc("/articles/{id:[0-9]+}/pdf", articleHandlers.GetArticlePDF).Methods("GET")
+	protected.HandleFunc("/articles/{id:[0-9]+}/enclosure", enclosureHandlers.ServeEnclosure).Methods("GET", "HEAD")
+	protected.HandleFunc("/articles/{id:[0-9]+}/fetch-content", contentHandlers.FetchContent).Methods("POST")
 
 	// Folder/Category routes
 	protected.HandleFunc("/folders", folderHandlers.GetFolders).Methods("GET")
 	protected.HandleFunc("/folders", folderHandlers.CreateFolder).Methods("POST")
 	protected.HandleFunc("/folders/{id:[0-9]+}", folderHandlers.UpdateFolder).Methods("PUT")
 	protected.HandleFunc("/folders/{id:[0-9]+}", folderHandlers.DeleteFolder).Methods("DELETE")
+	protected.HandleFunc("/folders/{id:[0-9]+}/refresh", folderHandlers.RefreshFolder).Methods("POST")
 	protected.HandleFunc("/folders/move-feeds", folderHandlers.MoveFeedsToFolder).Methods("POST")
+	protected.HandleFunc("/folders/reorder-feeds", folderHandlers.ReorderFeeds).Methods("POST")
+	protected.HandleFunc("/counts", folderHandlers.GetUnreadCounts).Methods("GET")
+
+	// Email digest of the current user
+	protected.HandleFunc("/digest", digestHandlers.GetDigest).Methods("GET")
+	protected.HandleFunc("/digest", digestHandlers.SaveDigest).Methods("PUT")
+	protected.HandleFunc("/digest", digestHandlers.DeleteDigest).Methods("DELETE")
+	protected.HandleFunc("/digest/send", digestHandlers.SendDigest).Methods("POST")
+
+	// Feeds emailed article by article to the current user
+	protected.HandleFunc("/email-forwards", emailForwardHandlers.GetForwards).Methods("GET")
+	protected.HandleFunc("/feeds/{id:[0-9]+}/email", emailForwardHandlers.SaveForward).Methods("PUT")
+	protected.HandleFunc("/feeds/{id:[0-9]+}/email", emailForwardHandlers.DeleteForward).Methods("DELETE")
+
+	// Push notification targets of the current user
+	protected.HandleFunc("/notifications", notificationHandlers.GetTargets).Methods("GET")
+	protected.HandleFunc("/notifications", notificationHandlers.CreateTarget).Methods("POST")
+	protected.HandleFunc("/notifications/{id:[0-9]+}", notificationHandlers.UpdateTarget).Methods("PUT")
+	protected.HandleFunc("/notifications/{id:[0-9]+}", notificationHandlers.DeleteTarget).Methods("DELETE")
+	protected.HandleFunc("/notifications/{id:[0-9]+}/test", notificationHandlers.TestTarget).Methods("POST")
+	protected.HandleFunc("/notifications/stream", notificationHandlers.Stream).Methods("GET")
+	protected.HandleFunc("/notifications/deliveries", notificationHandlers.GetDeliveries).Methods("GET")
+	protected.HandleFunc("/notifications/deliveries/{id:[0-9]+}/resend", notificationHandlers.ResendDelivery).Methods("POST")
+	protected.HandleFunc("/notifications/preferences", notificationHandlers.GetPreferences).Methods("GET")
+	protected.HandleFunc("/notifications/preferences", notificationHandlers.UpdatePreferences).Methods("PUT")
+	protected.HandleFunc("/notifications/rules", notificationHandlers.GetRules).Methods("GET")
+	protected.HandleFunc("/notifications/rules", notificationHandlers.CreateRule).Methods("POST")
+	protected.HandleFunc("/notifications/rules/{id:[0-9]+}", notificationHandlers.UpdateRule).Methods("PUT")
+	protected.HandleFunc("/notifications/rules/{id:[0-9]+}", notificationHandlers.DeleteRule).Methods("DELETE")
+
+	// Webhooks of the current user, POSTed new articles
+	protected.HandleFunc("/webhooks", webhookHandlers.GetWebhooks).Methods("GET")
+	protected.HandleFunc("/webhooks", webhookHandlers.CreateWebhook).Methods("POST")
+	protected.HandleFunc("/webhooks/{id:[0-9]+}", webhookHandlers.UpdateWebhook).Methods("PUT")
+	protected.HandleFunc("/webhooks/{id:[0-9]+}", webhookHandlers.DeleteWebhook).Methods("DELETE")
+	protected.HandleFunc("/webhooks/{id:[0-9]+}/test", webhookHandlers.TestWebhook).Methods("POST")
+	protected.HandleFunc("/webhooks/deliveries", webhookHandlers.GetDeliveries).Methods("GET")
+	protected.HandleFunc("/webhooks/deliveries/{id:[0-9]+}/redeliver", webhookHandlers.RedeliverDelivery).Methods("POST")
+
+	// Rules of the current user applied to new articles
+	protected.HandleFunc("/rules", ruleHandlers.GetRules).Methods("GET")
+	protected.HandleFunc("/rules", ruleHandlers.CreateRule).Methods("POST")
+	protected.HandleFunc("/rules/{id:[0-9]+}", ruleHandlers.UpdateRule).Methods("PUT")
+	protected.HandleFunc("/rules/{id:[0-9]+}", ruleHandlers.DeleteRule).Methods("DELETE")
 
 	// OPML Import/Export routes
 	protected.HandleFunc("/opml/import", opmlHandlers.ImportOPML).Methods("POST")
+	protected.HandleFunc("/opml/import/{job_id}", opmlHandlers.GetImportStatus).Methods("GET")
 	protected.HandleFunc("/opml/export", opmlHandlers.ExportOPML).Methods("GET")
+	protected.HandleFunc("/discover/recommended", discoverHandlers.GetRecommended).Methods("GET")
+	protected.HandleFunc("/discover/directory", discoverHandlers.GetDirectory).Methods("GET")
+	protected.HandleFunc("/discover/podcasts", discoverHandlers.SearchPodcasts).Methods("GET")
+	protected.HandleFunc("/discover/feeds", discoverHandlers.FindFeeds).Methods("GET")
+
+	// Prometheus metrics, optionally protected by METRICS_TOKEN
+	metrics.Register(db.CollectMetrics)
+	metrics.Register(jobService.CollectMetrics)
+	metrics.Register(schedulerService.CollectMetrics)
+	metrics.Register(httpMetrics.CollectMetrics)
+	r.Handle("/metrics", metrics.Handler(cfg.Auth.MetricsToken)).Methods("GET")
 
-	// Static files and frontend
-	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static/"))))
+	// Static files and frontend, embedded in the binary unless STATIC_DIR is set
+	frontend := newFrontend(cfg)
+	r.PathPrefix("/static/").HandlerFunc(frontend.serveStatic)
+
+	// Demo feeds, served by the app itself so demo mode works offline
+	if *demo {
+		r.HandleFunc("/demo/feeds/{name:[a-z-]+}.xml", serveDemoFeed).Methods("GET")
+	}
 	
 	// Serve frontend for all other routes
 	r.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Serve API 404 for API routes
 		if strings.HasPrefix(r.URL.Path, "/api/") {
-			http.NotFound(w, r)
+			handlers.NotFound(w, r)
 			return
 		}
 		// Serve index.html for all other routes (SPA routing)
-		http.ServeFile(w, r, "static/index.html")
+		frontend.serveIndex(w, r)
 	})
 
-	// Setup background jobs
-	setupCronJobs(feedService, articleService, authService)
+	// Start the job workers and background jobs
+	watchMaintenanceMode(settingsService, cronService, jobService)
+	watchConcurrency(settingsService, jobService, cfg.Fetch.MaxConcurrentRefreshes)
+	watchLogLevel(settingsService, cfg.Log.Level)
+	jobService.Register(services.JobRefreshFeed, schedulerService.HandleRefreshJob)
+	jobService.Register(services.JobImportOPML, opmlService.HandleImportJob)
+	jobService.Register(services.JobSendNotification, notificationService.HandleNotificationJob)
+	jobService.Register(services.JobRunHook, hookService.HandleHookJob)
+	jobService.Register(services.JobSyncBookmark, bookmarkService.HandleBookmarkJob)
+	jobService.Register(services.JobForwardArticle, emailForwardService.HandleForwardJob)
+	jobService.Register(services.JobCacheEnclosure, enclosureService.HandleCacheJob)
+	jobService.Register(services.JobFetchContent, contentService.HandleFetchJob)
+	jobService.Register(services.JobDeliverWebhook, webhookService.HandleDeliverJob)
+	jobService.Register(services.JobWebSubSubscribe, websubService.HandleSubscribeJob)
+	if err := jobService.Start(); err != nil {
+		fatal("Failed to start job workers", err)
+	}
 
-	fmt.Printf("MyFeed server starting on port %s\n", port)
-	fmt.Println("Database initialized and ready")
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	setupCronJobs(cronService, schedulerService, articleService, authService, settingsService, maintenanceService, statsHistoryService, digestService, backupService, notificationService, webhookService, websubService, updateService, discoverService, enclosureService, jobService)
+	probes.schedulerStarted()
+
+	// Open notification streams would otherwise keep the shutdown waiting
+	server.RegisterOnShutdown(notificationStream.Close)
+
+	// With admin listeners, the admin API and metrics are only served on them
+	var app http.Handler = r
+	for _, ln := range listeners {
+		if ln.admin {
+			app = adminRoutes(r)
+			break
+		}
+	}
+	probes.serve(middleware.BasePath(cfg.BasePath(), app))
+	for _, ln := range listeners {
+		if ln.handoff {
+			if err := ln.bind(); err != nil {
+				fatal("Failed to listen", err)
+			}
+			serve(ln)
+		}
+	}
+	if *demo {
+		if err := seedDemo(listeners, cfg.BasePath(), authService, folderService, feedService, articleService); err != nil {
+			serverLog.Error("Failed to seed demo data", "error", err)
+		}
+	}
+	sdNotify("READY=1")
+	serverLog.Info("MyFeed server ready")
+
+	<-ctx.Done()
+	// A second signal ends the process right away instead of waiting for the shutdown
+	stop()
+	shutdown(server, cronService, jobService, cfg.Server.ShutdownDuration())
 }
 
-func setupCronJobs(feedService *services.FeedService, articleService *services.ArticleService, authService *services.AuthService) {
-	c := cron.New()
+// shutdown stops the HTTP server and the background work. The listener is closed first,
+// so during an upgrade new connections go to the process taking over, while in-flight
+// requests and running refreshes get until timeout to finish before the refreshes are
+// cancelled and requeued. The database is closed by main's deferred Close once this returns.
+func shutdown(server *http.Server, cronService *services.CronService, jobService *services.JobService, timeout time.Duration) {
+	serverLog.Info("Shutting down", "timeout", timeout)
+	sdNotify("STOPPING=1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	// Refresh all feeds every 15 minutes
-	c.AddFunc("*/15 * * * *", func() {
-		log.Println("Starting scheduled feed refresh...")
-		feeds, err := feedService.GetAllFeeds()
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+		if err := server.Shutdown(ctx); err != nil {
+			serverLog.Error("HTTP server shutdown failed", "error", err)
+		}
+	}()
+
+	select {
+	case <-cronService.Stop().Done():
+	case <-ctx.Done():
+		serverLog.Warn("Timed out waiting for scheduled tasks to finish")
+	}
+
+	jobService.Stop(ctx)
+	<-serverDone
+
+	serverLog.Info("Shutdown complete")
+}
+
+func setupCronJobs(cronService *services.CronService, schedulerService *services.SchedulerService, articleService *services.ArticleService, authService *services.AuthService, settingsService *services.SettingsService, maintenanceService *services.MaintenanceService, statsHistoryService *services.StatsHistoryService, digestService *services.DigestService, backupService *services.BackupService, notificationService *services.NotificationService, webhookService *services.WebhookService, websubService *services.WebSubService, updateService *services.UpdateService, discoverService *services.DiscoverService, enclosureService *services.EnclosureService, jobService *services.JobService) {
+	// Maintenance tasks run through the job queue so their outcome shows up in /api/admin/jobs
+	jobService.Register(services.JobCleanupArticles, func(ctx context.Context, job *models.Job) error {
+		if err := articleService.CleanupOldArticles(settingsService.GetInt(services.SettingCleanupAfterDays, 30)); err != nil {
+			return err
+		}
+		// Cached enclosures expire on their own and go with their articles
+		removed, freed, err := enclosureService.Cleanup(settingsService.GetInt(services.SettingEnclosureRetentionDays, 30))
+		if removed > 0 {
+			serverLog.Info("Removed cached enclosures", "files", removed, "bytes", freed)
+		}
+		return err
+	})
+
+	jobService.Register(services.JobRepairOrphans, func(ctx context.Context, job *models.Job) error {
+		report, err := maintenanceService.RepairOrphans()
 		if err != nil {
-			log.Printf("Failed to get feeds for refresh: %v", err)
-			return
+			return err
+		}
+		if report.Total() > 0 {
+			serverLog.Info("Repaired orphaned data", "articles", report.OrphanedArticles,
+				"feed_stats", report.OrphanedStats, "sessions", report.OrphanedSessions,
+				"detached_feeds", report.DetachedFeeds, "detached_folders", report.DetachedFolders,
+				"empty_import_folders", report.EmptyImportFolders)
+		}
+		return nil
+	})
+
+	jobService.Register(services.JobCleanupSessions, func(ctx context.Context, job *models.Job) error {
+		if err := authService.CleanupExpiredSessions(); err != nil {
+			return err
+		}
+		logDays := settingsService.GetInt(services.SettingNotificationLogDays, 30)
+		if _, err := notificationService.CleanupDeliveries(logDays); err != nil {
+			return err
 		}
+		if _, err := webhookService.CleanupDeliveries(logDays); err != nil {
+			return err
+		}
+		_, err := jobService.PurgeFinished(7 * 24 * time.Hour)
+		return err
+	})
+
+	jobService.Register(services.JobAggregateStats, func(ctx context.Context, job *models.Job) error {
+		days, err := statsHistoryService.Aggregate()
+		if days > 0 {
+			serverLog.Info("Aggregated statistics", "days", days)
+		}
+		return err
+	})
 
-		for _, feed := range feeds {
-			go feedService.RefreshFeed(feed.ID)
+	jobService.Register(services.JobSendDigests, func(ctx context.Context, job *models.Job) error {
+		sent, err := digestService.SendDue()
+		if sent > 0 {
+			serverLog.Info("Sent email digests", "count", sent)
 		}
-		log.Printf("Started refresh for %d feeds", len(feeds))
+		return err
 	})
 
-	// Cleanup old articles daily at 2 AM
-	c.AddFunc("0 2 * * *", func() {
-		log.Println("Starting article cleanup...")
-		err := articleService.CleanupOldArticles(30)
+	jobService.Register(services.JobBackup, func(ctx context.Context, job *models.Job) error {
+		backup, err := backupService.Run()
 		if err != nil {
-			log.Printf("Failed to cleanup articles: %v", err)
-		} else {
-			log.Println("Article cleanup completed")
+			return err
 		}
+		serverLog.Info("Wrote backup", "name", backup.Name)
+		return nil
 	})
 
-	// Cleanup expired sessions every hour
-	c.AddFunc("0 * * * *", func() {
-		err := authService.CleanupExpiredSessions()
+	jobService.Register(services.JobRefreshDirectory, func(ctx context.Context, job *models.Job) error {
+		return discoverService.RefreshDirectory(ctx)
+	})
+	jobService.Register(services.JobCheckUpdate, func(ctx context.Context, job *models.Job) error {
+		return updateService.Check(ctx)
+	})
+
+	// Queue refreshes for feeds whose next fetch time has passed
+	cronService.Register("feed refresh dispatch", services.SettingRefreshSchedule, services.DefaultRefreshSchedule, func() {
+		dispatched, err := schedulerService.DispatchDue()
 		if err != nil {
-			log.Printf("Failed to cleanup expired sessions: %v", err)
+			serverLog.Error("Failed to dispatch feed refreshes", "error", err)
+			return
+		}
+		if dispatched > 0 {
+			serverLog.Debug("Queued feed refreshes", "count", dispatched)
 		}
 	})
 
-	c.Start()
-	log.Println("Background jobs scheduled")
-}
\ No newline at end of file
+	// Push notifications held during quiet hours once they end
+	cronService.Register("held notification flush", "", "@every 1m", func() {
+		flushed, err := notificationService.FlushHeld()
+		if err != nil {
+			serverLog.Error("Failed to flush held notifications", "error", err)
+		}
+		if flushed > 0 {
+			serverLog.Info("Queued combined notifications after quiet hours", "count", flushed)
+		}
+	})
+
+	// Roll up daily statistics (daily at 1:30 AM by default, before the cleanup removes articles)
+	cronService.Register("statistics aggregation", services.SettingStatsSchedule, "30 1 * * *", enqueueTask(jobService, services.JobAggregateStats))
+
+	// Send the email digests that are due. digest_schedule is applied in each subscriber's
+	// timezone (daily at 7 AM by default; weekly subscriptions go out every 7 days)
+	cronService.Register("email digest", "", "*/15 * * * *", enqueueTask(jobService, services.JobSendDigests))
+
+	// Back up the subscription list when backup_enabled is set (daily at 4 AM by default)
+	enqueueBackup := enqueueTask(jobService, services.JobBackup)
+	cronService.Register("subscription backup", services.SettingBackupSchedule, "0 4 * * *", func() {
+		if backupService.Enabled() {
+			enqueueBackup()
+		}
+	})
+
+	// Cleanup old articles (daily at 2 AM by default)
+	cronService.Register("article cleanup", services.SettingCleanupSchedule, "0 2 * * *", enqueueTask(jobService, services.JobCleanupArticles))
+
+	// Repair orphaned rows (daily at 3 AM by default, after the article cleanup)
+	cronService.Register("orphan repair", services.SettingRepairSchedule, "0 3 * * *", enqueueTask(jobService, services.JobRepairOrphans))
+
+	// Cleanup expired sessions, old finished jobs and the notification log (hourly by default)
+	cronService.Register("session cleanup", services.SettingSessionCleanupSchedule, "0 * * * *", enqueueTask(jobService, services.JobCleanupSessions))
+
+	// Look for a newer release at startup and once a day, unless update_check is off
+	enqueueUpdateCheck := enqueueTask(jobService, services.JobCheckUpdate)
+	cronService.Register("update check", "", "@every 24h", func() {
+		if updateService.Enabled() {
+			enqueueUpdateCheck()
+		}
+	})
+	if updateService.Enabled() {
+		enqueueUpdateCheck()
+	}
+
+	// Subscribe feeds at their WebSub hubs, and renew leases before they end, when
+	// base_url is the public URL hubs can call back
+	if websubService.Enabled() {
+		cronService.Register("websub renewal", "", "@every 1h", func() {
+			queued, err := websubService.RenewDue()
+			if err != nil {
+				serverLog.Error("Failed to renew hub subscriptions", "error", err)
+				return
+			}
+			if queued > 0 {
+				serverLog.Debug("Queued hub subscriptions", "count", queued)
+			}
+		})
+	}
+
+	// Download the feed directory at startup and once a day when directory_url is set, and
+	// right away when it changes; clearing it restores the bundled directory
+	enqueueDirectoryRefresh := enqueueTask(jobService, services.JobRefreshDirectory)
+	cronService.Register("directory refresh", "", "@every 24h", func() {
+		if settingsService.GetString(services.SettingDirectoryURL, "") != "" {
+			enqueueDirectoryRefresh()
+		}
+	})
+	if settingsService.GetString(services.SettingDirectoryURL, "") != "" {
+		enqueueDirectoryRefresh()
+	}
+	settingsService.Subscribe(func(changed map[string]string) {
+		if _, ok := changed[services.SettingDirectoryURL]; ok {
+			enqueueDirectoryRefresh()
+		}
+	})
+
+	cronService.Start()
+	serverLog.Info("Background jobs scheduled")
+}
+
+// watchMaintenanceMode pauses the scheduler and job workers while the maintenance_mode
+// setting is enabled and resumes them when it is switched off
+func watchMaintenanceMode(settingsService *services.SettingsService, cronService *services.CronService, jobService *services.JobService) {
+	apply := func() {
+		enabled := settingsService.GetBool(services.SettingMaintenanceMode, false)
+		if enabled != jobService.IsPaused() {
+			if enabled {
+				serverLog.Info("Maintenance mode enabled: background processing paused")
+			} else {
+				serverLog.Info("Maintenance mode disabled: background processing resumed")
+			}
+		}
+		cronService.SetPaused(enabled)
+		jobService.SetPaused(enabled)
+	}
+
+	apply()
+	settingsService.Subscribe(func(changed map[string]string) {
+		if _, ok := changed[services.SettingMaintenanceMode]; ok {
+			apply()
+		}
+	})
+}
+
+// watchConcurrency sizes the job worker pool from the max_concurrent_refreshes setting,
+// falling back to the configured count or a CPU-based default when it is not set
+func watchConcurrency(settingsService *services.SettingsService, jobService *services.JobService, configured int) {
+	apply := func() {
+		jobService.SetWorkers(settingsService.GetInt(services.SettingMaxConcurrentRefreshes, services.DefaultWorkerCount(configured)))
+	}
+
+	apply()
+	settingsService.Subscribe(func(changed map[string]string) {
+		if _, ok := changed[services.SettingMaxConcurrentRefreshes]; ok {
+			apply()
+		}
+	})
+}
+
+// watchLogLevel applies the log_level setting, falling back to the configured level when
+// it is not set, and the fetch_trace setting
+func watchLogLevel(settingsService *services.SettingsService, configured string) {
+	apply := func() {
+		name := settingsService.GetString(services.SettingLogLevel, configured)
+		if err := logging.SetLevel(name); err != nil {
+			serverLog.Warn("Ignoring invalid log level", "error", err)
+		}
+		services.TraceFetches(settingsService.GetBool(services.SettingFetchTrace, false))
+	}
+
+	apply()
+	settingsService.Subscribe(func(changed map[string]string) {
+		_, levelChanged := changed[services.SettingLogLevel]
+		_, traceChanged := changed[services.SettingFetchTrace]
+		if levelChanged || traceChanged {
+			apply()
+		}
+	})
+}
+
+// fatal logs an error that prevents the server from running and exits
+func fatal(msg string, err error) {
+	serverLog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// enqueueTask returns a cron function that queues a job of the given type
+func enqueueTask(jobService *services.JobService, jobType string) func() {
+	return func() {
+		if _, err := jobService.Enqueue(jobType, "", struct{}{}); err != nil {
+			serverLog.Error("Failed to enqueue task", "type", jobType, "error", err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of request latency histograms: from 5 ms
+// for cached reads to 10 s for requests that fetch from other servers
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts observations into buckets. Unlike a Window it covers every observation,
+// so it can be aggregated across instances and over any time range with rate().
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // per bucket, the last one for observations above every bound
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram returns a histogram with the given bucket upper bounds
+func NewHistogram(bounds []float64) *Histogram {
+	sorted := append([]float64{}, bounds...)
+	sort.Float64s(sorted)
+	return &Histogram{bounds: sorted, counts: make([]uint64, len(sorted)+1)}
+}
+
+// Observe records a value
+func (h *Histogram) Observe(value float64) {
+	bucket := sort.SearchFloat64s(h.bounds, value)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[bucket]++
+	h.sum += value
+	h.count++
+}
+
+// Snapshot returns the bucket bounds with the cumulative count of each, as Prometheus
+// expects them, together with the sum and count of all observations
+func (h *Histogram) Snapshot() ([]float64, []uint64, float64, uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cumulative := make([]uint64, len(h.bounds))
+	var total uint64
+	for i := range h.bounds {
+		total += h.counts[i]
+		cumulative[i] = total
+	}
+	return h.bounds, cumulative, h.sum, h.count
+}
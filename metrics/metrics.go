@@ -0,0 +1,162 @@
+// Package metrics exposes application metrics in the Prometheus text exposition format
+// without pulling in the full Prometheus client library.
+package metrics
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Label is a single name/value pair attached to a sample
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Collector writes its current samples to w at scrape time
+type Collector func(w *Writer)
+
+// Registry holds the collectors rendered by the metrics endpoint
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Default is the registry served by Handler
+var Default = NewRegistry()
+
+// Register adds a collector to the default registry
+func Register(c Collector) {
+	Default.Register(c)
+}
+
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Render writes every registered collector
+func (r *Registry) Render(out io.Writer) {
+	r.mu.Lock()
+	collectors := make([]Collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.mu.Unlock()
+
+	w := &Writer{out: out, described: make(map[string]bool)}
+	for _, collect := range collectors {
+		collect(w)
+	}
+}
+
+// Handler serves the default registry. If token is non-empty, requests must send it
+// as a bearer token so the endpoint can be scraped without a user session.
+func Handler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && !HasToken(r, token) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Default.Render(w)
+	})
+}
+
+// HasToken reports whether a request sends token as its bearer token. An empty token is
+// never sent.
+func HasToken(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+// Writer renders samples, emitting HELP/TYPE lines once per metric name
+type Writer struct {
+	out       io.Writer
+	described map[string]bool
+}
+
+// Gauge writes a gauge sample
+func (w *Writer) Gauge(name, help string, value float64, labels ...Label) {
+	w.sample(name, "gauge", help, value, labels)
+}
+
+// Counter writes a counter sample
+func (w *Writer) Counter(name, help string, value float64, labels ...Label) {
+	w.sample(name, "counter", help, value, labels)
+}
+
+// Summary writes the quantiles, sum and count of a summary, typically taken from a Window
+func (w *Writer) Summary(name, help string, quantiles map[float64]float64, sum float64, count uint64, labels ...Label) {
+	w.describe(name, "summary", help)
+
+	qs := make([]float64, 0, len(quantiles))
+	for q := range quantiles {
+		qs = append(qs, q)
+	}
+	sort.Float64s(qs)
+
+	for _, q := range qs {
+		withQuantile := append(append([]Label{}, labels...), Label{Name: "quantile", Value: strconv.FormatFloat(q, 'g', -1, 64)})
+		fmt.Fprintf(w.out, "%s%s %v\n", name, formatLabels(withQuantile), quantiles[q])
+	}
+	fmt.Fprintf(w.out, "%s_sum%s %v\n", name, formatLabels(labels), sum)
+	fmt.Fprintf(w.out, "%s_count%s %v\n", name, formatLabels(labels), count)
+}
+
+// Histogram writes the buckets, sum and count of a histogram
+func (w *Writer) Histogram(name, help string, h *Histogram, labels ...Label) {
+	w.describe(name, "histogram", help)
+
+	bounds, cumulative, sum, count := h.Snapshot()
+	for i, bound := range bounds {
+		withBound := append(append([]Label{}, labels...), Label{Name: "le", Value: strconv.FormatFloat(bound, 'g', -1, 64)})
+		fmt.Fprintf(w.out, "%s_bucket%s %v\n", name, formatLabels(withBound), cumulative[i])
+	}
+	withInf := append(append([]Label{}, labels...), Label{Name: "le", Value: "+Inf"})
+	fmt.Fprintf(w.out, "%s_bucket%s %v\n", name, formatLabels(withInf), count)
+	fmt.Fprintf(w.out, "%s_sum%s %v\n", name, formatLabels(labels), sum)
+	fmt.Fprintf(w.out, "%s_count%s %v\n", name, formatLabels(labels), count)
+}
+
+func (w *Writer) describe(name, metricType, help string) {
+	if w.described[name] {
+		return
+	}
+	w.described[name] = true
+	fmt.Fprintf(w.out, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w.out, "# TYPE %s %s\n", name, metricType)
+}
+
+func (w *Writer) sample(name, metricType, help string, value float64, labels []Label) {
+	w.describe(name, metricType, help)
+	fmt.Fprintf(w.out, "%s%s %v\n", name, formatLabels(labels), value)
+}
+
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	sorted := make([]Label, len(labels))
+	copy(sorted, labels)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	parts := make([]string, len(sorted))
+	for i, label := range sorted {
+		parts[i] = fmt.Sprintf("%s=%q", label.Name, label.Value)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+)
+
+// Window keeps the most recent observations of a value so quantiles can be reported
+// without storing every sample. Sum and count cover all observations ever made.
+type Window struct {
+	mu     sync.Mutex
+	values []float64
+	next   int
+	full   bool
+	sum    float64
+	count  uint64
+}
+
+// NewWindow returns a window holding the last size observations
+func NewWindow(size int) *Window {
+	return &Window{values: make([]float64, size)}
+}
+
+// Observe records a value
+func (win *Window) Observe(value float64) {
+	win.mu.Lock()
+	defer win.mu.Unlock()
+
+	win.values[win.next] = value
+	win.next++
+	if win.next == len(win.values) {
+		win.next = 0
+		win.full = true
+	}
+	win.sum += value
+	win.count++
+}
+
+// Snapshot returns the requested quantiles of the retained observations together with
+// the total sum and count. Quantiles are omitted while the window is empty.
+func (win *Window) Snapshot(quantiles ...float64) (map[float64]float64, float64, uint64) {
+	win.mu.Lock()
+	n := win.next
+	if win.full {
+		n = len(win.values)
+	}
+	sorted := make([]float64, n)
+	copy(sorted, win.values[:n])
+	sum, count := win.sum, win.count
+	win.mu.Unlock()
+
+	result := make(map[float64]float64, len(quantiles))
+	if n == 0 {
+		return result, sum, count
+	}
+
+	sort.Float64s(sorted)
+	for _, q := range quantiles {
+		index := int(q * float64(n-1))
+		result[q] = sorted[index]
+	}
+	return result, sum, count
+}
@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// BasePath serves next under a path prefix, for a reverse proxy that forwards a sub-path
+// like /myfeed/ without rewriting it. The prefix is removed before routing, so routes and
+// their path templates stay the same; requests outside the prefix are not found, and the
+// bare prefix redirects to the app with a trailing slash.
+func BasePath(prefix string, next http.Handler) http.Handler {
+	if prefix == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == prefix {
+			target := prefix + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		path, ok := strings.CutPrefix(r.URL.Path, prefix+"/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		stripped := r.Clone(r.Context())
+		stripped.URL.Path = "/" + path
+		if r.URL.RawPath != "" {
+			stripped.URL.RawPath = "/" + strings.TrimPrefix(r.URL.RawPath, prefix+"/")
+		}
+		next.ServeHTTP(w, stripped)
+	})
+}
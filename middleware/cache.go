@@ -0,0 +1,12 @@
+package middleware
+
+import "net/http"
+
+// NoStore keeps browsers and proxies from caching API responses, which carry per-user data
+// that changes all the time. Handlers may still set their own Cache-Control.
+func NoStore(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	})
+}
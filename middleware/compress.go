@@ -0,0 +1,221 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// minCompressSize is the smallest response worth compressing; below it the gzip framing
+// outweighs the savings
+const minCompressSize = 1024
+
+// compressibleTypes lists the content types that are compressed. Images and fonts are
+// already compressed, and the notification event stream must not be buffered.
+var compressibleTypes = []string{
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"image/svg+xml",
+	"text/html",
+	"text/css",
+	"text/plain",
+	"text/javascript",
+	"text/xml",
+	"text/x-opml",
+}
+
+var gzipWriters = sync.Pool{New: func() any {
+	w, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+	return w
+}}
+
+// deflateWriters hold zlib writers: the deflate content coding is zlib-wrapped (RFC 9110)
+var deflateWriters = sync.Pool{New: func() any {
+	return zlib.NewWriter(io.Discard)
+}}
+
+// Compress gzip or deflate encodes text responses for clients that accept it. Range and
+// HEAD requests are passed through unchanged.
+func Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// acceptedEncoding picks gzip or deflate from an Accept-Encoding header, preferring gzip
+func acceptedEncoding(header string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				continue
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	switch {
+	case accepted["gzip"]:
+		return "gzip"
+	case accepted["deflate"]:
+		return "deflate"
+	}
+	return ""
+}
+
+// compressWriter buffers the start of a response until it knows whether compressing it
+// pays off, then either compresses or passes through everything written
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	buf      []byte
+	decided  bool
+	encoder  interface {
+		io.WriteCloser
+		Flush() error
+	}
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	cw.status = status
+	// Responses without a body have nothing to compress
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.start(false)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if !cw.decided {
+		if !cw.compressible() {
+			cw.start(false)
+		} else {
+			cw.buf = append(cw.buf, b...)
+			if len(cw.buf) >= minCompressSize {
+				cw.start(true)
+			}
+			return len(b), nil
+		}
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush sends what has been written so far, compressed if the response is
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.start(cw.compressible() && len(cw.buf) >= minCompressSize)
+	}
+	if cw.encoder != nil {
+		cw.encoder.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// Close writes a response that was too small to decide on and finishes the compressed stream
+func (cw *compressWriter) Close() {
+	if !cw.decided {
+		if cw.status == 0 && len(cw.buf) == 0 {
+			// The handler wrote nothing; net/http sends its default response
+			return
+		}
+		cw.start(cw.compressible() && len(cw.buf) >= minCompressSize)
+	}
+	if cw.encoder == nil {
+		return
+	}
+	cw.encoder.Close()
+	switch encoder := cw.encoder.(type) {
+	case *gzip.Writer:
+		gzipWriters.Put(encoder)
+	case *zlib.Writer:
+		deflateWriters.Put(encoder)
+	}
+	cw.encoder = nil
+}
+
+// compressible reports whether the content type and encoding of the response allow
+// compressing it. Like net/http, a missing content type is detected from the first bytes.
+func (cw *compressWriter) compressible() bool {
+	header := cw.Header()
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	contentType := header.Get("Content-Type")
+	if contentType == "" && len(cw.buf) > 0 {
+		contentType = http.DetectContentType(cw.buf)
+		header.Set("Content-Type", contentType)
+	}
+	contentType, _, _ = strings.Cut(contentType, ";")
+	contentType = strings.TrimSpace(strings.ToLower(contentType))
+	for _, compressible := range compressibleTypes {
+		if contentType == compressible {
+			return true
+		}
+	}
+	return false
+}
+
+// start sends the headers and the buffered start of the response
+func (cw *compressWriter) start(compress bool) {
+	cw.decided = true
+	if compress {
+		header := cw.Header()
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", cw.encoding)
+		if cw.encoding == "gzip" {
+			encoder := gzipWriters.Get().(*gzip.Writer)
+			encoder.Reset(cw.ResponseWriter)
+			cw.encoder = encoder
+		} else {
+			encoder := deflateWriters.Get().(*zlib.Writer)
+			encoder.Reset(cw.ResponseWriter)
+			cw.encoder = encoder
+		}
+	}
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	if len(cw.buf) > 0 {
+		if cw.encoder != nil {
+			cw.encoder.Write(cw.buf)
+		} else {
+			cw.ResponseWriter.Write(cw.buf)
+		}
+	}
+	cw.buf = nil
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"encoding/json"
+	"myfeed/models"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Limits bounds a request: how large its body may be and how long its handler may run.
+// Zero lifts the limit.
+type Limits struct {
+	Timeout      time.Duration
+	MaxBodyBytes int64
+}
+
+// timeoutBody is answered, with 503, by handlers that run out of time
+var timeoutBody = func() string {
+	body, _ := json.Marshal(models.APIResponse{
+		Error: &models.APIError{Code: models.ErrorTimeout, Message: "Request timed out"},
+	})
+	return string(body)
+}()
+
+// Limit applies the limits to every route of a router. Routes listed in overrides by
+// their path template, like "/api/opml/import", get their own limits instead; streams
+// need Limits{} since a timed handler cannot flush.
+//
+// Bodies over the limit fail to read with an *http.MaxBytesError, which the handlers
+// answer with 413. Handlers over the timeout get 503 and whatever they write afterwards
+// is discarded.
+func Limit(defaults Limits, overrides map[string]Limits) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		timed := make(map[Limits]http.Handler)
+		timed[defaults] = withTimeout(next, defaults.Timeout)
+		for _, limits := range overrides {
+			if _, ok := timed[limits]; !ok {
+				timed[limits] = withTimeout(next, limits.Timeout)
+			}
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limits := defaults
+			if route := mux.CurrentRoute(r); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					if override, ok := overrides[template]; ok {
+						limits = override
+					}
+				}
+			}
+
+			if limits.MaxBodyBytes > 0 && r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, limits.MaxBodyBytes)
+			}
+			timed[limits].ServeHTTP(w, r)
+		})
+	}
+}
+
+func withTimeout(next http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+	timed := http.TimeoutHandler(next, timeout, timeoutBody)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// TimeoutHandler copies the headers of the handler when it completes, so this
+		// only labels the timeout answer
+		w.Header().Set("Content-Type", "application/json")
+		timed.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"myfeed/logging"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var httpLog = logging.For("http")
+
+// RequestIDHeader carries the ID of a request. An ID set by a reverse proxy is kept,
+// otherwise one is generated; either way it is returned in the response.
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID limits IDs taken from the client to what is safe to log and echo
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// maxLoggedError caps how much of a server error response ends up in the log
+const maxLoggedError = 512
+
+// requestLog collects what the access log line reports about a request
+type requestLog struct {
+	username string
+}
+
+type requestLogKey struct{}
+
+// setRequestUser records the authenticated user for the access log
+func setRequestUser(r *http.Request, username string) {
+	if entry, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		entry.username = username
+	}
+}
+
+// statusRecorder remembers the status code and size of a response, and the start of the
+// body of server errors
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	body   strings.Builder
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	if sr.status >= http.StatusInternalServerError && sr.body.Len() < maxLoggedError &&
+		sr.Header().Get("Content-Encoding") == "" {
+		sr.body.Write(b[:min(len(b), maxLoggedError-sr.body.Len())])
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps the notification stream working behind the recorder
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// LogRequests assigns every request an ID and writes an access log line with its status,
+// size, duration and user. The ID is added to the request context, so services logging
+// with it can be correlated, and returned in the X-Request-ID header, also of errors.
+// Server errors are logged at error level together with the error message.
+func LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		entry := &requestLog{}
+		ctx := logging.WithRequestID(r.Context(), id)
+		ctx = context.WithValue(ctx, requestLogKey{}, entry)
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		attrs := []any{"method", r.Method, "path", r.URL.Path, "status", status,
+			"bytes", recorder.bytes, "duration_ms", time.Since(start).Milliseconds()}
+		if entry.username != "" {
+			attrs = append(attrs, "user", entry.username)
+		}
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+			attrs = append(attrs, "error", strings.TrimSpace(recorder.body.String()))
+		}
+		httpLog.Log(ctx, level, "Request handled", attrs...)
+	})
+}
+
+// newRequestID returns a random 16 character hex ID
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"myfeed/metrics"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// routeKey identifies a route by method and path template, e.g. GET /api/feeds/{id:[0-9]+},
+// which keeps the number of series bounded however many feeds there are
+type routeKey struct {
+	method string
+	route  string
+}
+
+type routeStatusKey struct {
+	routeKey
+	class string
+}
+
+// HTTPMetrics counts the requests served by every route and how long they took. It is
+// kept apart from the feed pipeline metrics, to monitor the API itself.
+type HTTPMetrics struct {
+	mu        sync.Mutex
+	requests  map[routeStatusKey]uint64
+	latencies map[routeKey]*metrics.Histogram
+}
+
+func NewHTTPMetrics() *HTTPMetrics {
+	return &HTTPMetrics{
+		requests:  make(map[routeStatusKey]uint64),
+		latencies: make(map[routeKey]*metrics.Histogram),
+	}
+}
+
+// Measure records the status class and latency of every request under its route. It has
+// to run inside the router, where the matched route is known.
+func (hm *HTTPMetrics) Measure(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		hm.record(routeOf(r), status, time.Since(start))
+	})
+}
+
+func (hm *HTTPMetrics) record(key routeKey, status int, duration time.Duration) {
+	hm.mu.Lock()
+	hm.requests[routeStatusKey{routeKey: key, class: strconv.Itoa(status/100) + "xx"}]++
+	latency, exists := hm.latencies[key]
+	if !exists {
+		latency = metrics.NewHistogram(metrics.LatencyBuckets)
+		hm.latencies[key] = latency
+	}
+	hm.mu.Unlock()
+
+	latency.Observe(duration.Seconds())
+}
+
+// routeOf returns the method and route template of a request. Methods the router does not
+// use are counted together, so clients cannot create series at will.
+func routeOf(r *http.Request) routeKey {
+	key := routeKey{method: r.Method, route: "unmatched"}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete:
+	default:
+		key.method = "OTHER"
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			key.route = template
+		}
+	}
+	return key
+}
+
+// CollectMetrics writes the request counters and latency histograms to the metrics endpoint
+func (hm *HTTPMetrics) CollectMetrics(w *metrics.Writer) {
+	hm.mu.Lock()
+	requests := make(map[routeStatusKey]uint64, len(hm.requests))
+	for key, count := range hm.requests {
+		requests[key] = count
+	}
+	latencies := make(map[routeKey]*metrics.Histogram, len(hm.latencies))
+	for key, latency := range hm.latencies {
+		latencies[key] = latency
+	}
+	hm.mu.Unlock()
+
+	statusKeys := make([]routeStatusKey, 0, len(requests))
+	for key := range requests {
+		statusKeys = append(statusKeys, key)
+	}
+	sort.Slice(statusKeys, func(i, j int) bool {
+		if statusKeys[i].routeKey != statusKeys[j].routeKey {
+			return lessRoute(statusKeys[i].routeKey, statusKeys[j].routeKey)
+		}
+		return statusKeys[i].class < statusKeys[j].class
+	})
+	for _, key := range statusKeys {
+		w.Counter("myfeed_http_requests_total", "Total number of HTTP requests served, by method, route and status class.", float64(requests[key]),
+			metrics.Label{Name: "method", Value: key.method}, metrics.Label{Name: "route", Value: key.route},
+			metrics.Label{Name: "code", Value: key.class})
+	}
+
+	routeKeys := make([]routeKey, 0, len(latencies))
+	for key := range latencies {
+		routeKeys = append(routeKeys, key)
+	}
+	sort.Slice(routeKeys, func(i, j int) bool { return lessRoute(routeKeys[i], routeKeys[j]) })
+	for _, key := range routeKeys {
+		w.Histogram("myfeed_http_request_duration_seconds", "Time taken to serve HTTP requests, by method and route.", latencies[key],
+			metrics.Label{Name: "method", Value: key.method}, metrics.Label{Name: "route", Value: key.route})
+	}
+}
+
+func lessRoute(a, b routeKey) bool {
+	if a.route != b.route {
+		return a.route < b.route
+	}
+	return a.method < b.method
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"myfeed/models"
+	"net/http"
+	"runtime/debug"
+)
+
+// headerWriter remembers whether the response has been started
+type headerWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (hw *headerWriter) WriteHeader(status int) {
+	hw.started = true
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *headerWriter) Write(b []byte) (int, error) {
+	hw.started = true
+	return hw.ResponseWriter.Write(b)
+}
+
+// Flush keeps the notification stream working behind the writer
+func (hw *headerWriter) Flush() {
+	if flusher, ok := hw.ResponseWriter.(http.Flusher); ok {
+		hw.started = true
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (hw *headerWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+// Recover turns a panicking handler into a JSON 500 with the internal_error code, and logs
+// the panic with its stack and the request ID. A response that was already started cannot
+// be replaced; its connection is aborted instead. http.ErrAbortHandler is passed on, since
+// it is how handlers abort a response on purpose.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hw := &headerWriter{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			httpLog.ErrorContext(r.Context(), "Handler panicked", "method", r.Method, "path", r.URL.Path,
+				"panic", p, "stack", string(debug.Stack()))
+			if hw.started {
+				panic(http.ErrAbortHandler)
+			}
+			writeError(w, http.StatusInternalServerError, models.ErrorInternal, "Internal server error")
+		}()
+		next.ServeHTTP(hw, r)
+	})
+}
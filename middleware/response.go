@@ -0,0 +1,11 @@
+package middleware
+
+import "myfeed/httpjson"
+
+// The middleware answers with the same envelope as the handlers, see httpjson
+var (
+	writeJSON    = httpjson.WriteJSON
+	writeError   = httpjson.WriteError
+	writeInvalid = httpjson.WriteInvalid
+	decodeJSON   = httpjson.DecodeJSON
+)
@@ -4,6 +4,8 @@ import (
 	"time"
 )
 
+// Feed is shared by the users subscribed to it. FolderID, UnreadCount and Position are
+// those of one user's subscription, and are unset where a feed is read without one.
 type Feed struct {
 	ID          int       `json:"id" db:"id"`
 	URL         string    `json:"url" db:"url"`
@@ -15,6 +17,20 @@ type Feed struct {
 	LastFetch   *time.Time `json:"last_fetch" db:"last_fetch"`
 	Health      string    `json:"health" db:"health"` // "healthy", "warning", "error"
 	ErrorCount  int       `json:"error_count" db:"error_count"`
+	UnreadCount int       `json:"unread_count" db:"unread_count"`
+	NextFetchAt *time.Time `json:"next_fetch_at" db:"next_fetch_at"`
+	Paused      bool       `json:"paused" db:"paused"`
+	Position    int        `json:"position" db:"position"` // order within the folder
+	// CacheEnclosures downloads the enclosures of new articles; nil follows the
+	// cache_enclosures setting
+	CacheEnclosures *bool `json:"cache_enclosures" db:"cache_enclosures"`
+	// RefreshInterval is the time between scheduled fetches in seconds; nil follows the
+	// feed's posting rate
+	RefreshInterval *int `json:"refresh_interval" db:"refresh_interval"`
+	// FetchFullContent downloads the page of every new article and keeps its readable
+	// text, for feeds that only carry a summary
+	FetchFullContent bool `json:"fetch_full_content" db:"fetch_full_content"`
+	Stats       *FeedStatistics `json:"stats,omitempty" db:"-"`
 }
 
 type Folder struct {
@@ -35,7 +51,165 @@ type Article struct {
 	PublishedAt time.Time `json:"published_at" db:"published_at"`
 	Read        bool      `json:"read" db:"read"`
 	Saved       bool      `json:"saved" db:"saved"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	// ContentTruncated is set when the content was cut to the max_article_kb setting; the
+	// full article is only available at URL
+	ContentTruncated bool      `json:"content_truncated" db:"content_truncated"`
+	CreatedAt        time.Time `json:"created_at" db:"created_at"`
+	// FullContent is the readable text of the article's page, when it was fetched; only
+	// filled in for a single article
+	FullContent string `json:"full_content,omitempty" db:"full_content"`
+	// Enclosure is the media file of the article. Article lists only fill in its URL, type,
+	// length and whether it is cached.
+	Enclosure *Enclosure `json:"enclosure,omitempty" db:"-"`
+	// Tags are the user's tags of the article, only filled in for a single article
+	Tags []string `json:"tags,omitempty" db:"-"`
+}
+
+// Enclosure is the media file attached to an article, like a podcast episode. Cached
+// enclosures are served from the server's own copy at /api/articles/{id}/enclosure.
+type Enclosure struct {
+	ArticleID int        `json:"article_id"`
+	URL       string     `json:"url"`
+	Type      string     `json:"type"`
+	Length    int64      `json:"length"` // as announced by the feed, 0 if unknown
+	Cached    bool       `json:"cached"`
+	Size      int64      `json:"size,omitempty"` // of the cached copy
+	CachedAt  *time.Time `json:"cached_at,omitempty"`
+	Error     string     `json:"error,omitempty"` // why the download failed
+}
+
+// Recommendation is a feed suggested from the subscriptions, by the blogrolls of subscribed
+// sites or a category of the bundled catalog that the subscriptions belong to
+type Recommendation struct {
+	Title    string   `json:"title"`
+	URL      string   `json:"url"`
+	SiteURL  string   `json:"site_url,omitempty"`
+	Category string   `json:"category,omitempty"`
+	Reasons  []string `json:"reasons"`
+	Score    int      `json:"score"`
+	// Subscribe is the body of POST /api/feeds that adds the feed
+	Subscribe SubscribeRequest `json:"subscribe"`
+}
+
+// Directory is the catalog of popular feeds by category, filtered by a search
+type Directory struct {
+	// Source is "bundled" or the directory_url the catalog was downloaded from, at UpdatedAt
+	Source     string              `json:"source"`
+	UpdatedAt  *time.Time          `json:"updated_at"`
+	Categories []DirectoryCategory `json:"categories"`
+}
+
+// DirectoryCategory lists the directory feeds of a category
+type DirectoryCategory struct {
+	Name  string          `json:"name"`
+	Feeds []DirectoryFeed `json:"feeds"`
+}
+
+// DirectoryFeed is a feed of the directory. Subscribed feeds are listed too, marked.
+type DirectoryFeed struct {
+	Title       string           `json:"title"`
+	URL         string           `json:"url"`
+	SiteURL     string           `json:"site_url,omitempty"`
+	Description string           `json:"description,omitempty"`
+	Subscribed  bool             `json:"subscribed"`
+	Subscribe   SubscribeRequest `json:"subscribe"`
+}
+
+// Podcast is a show found in a podcast directory
+type Podcast struct {
+	Title        string           `json:"title"`
+	Author       string           `json:"author"`
+	URL          string           `json:"url"` // of the RSS feed
+	SiteURL      string           `json:"site_url,omitempty"`
+	ImageURL     string           `json:"image_url,omitempty"`
+	Description  string           `json:"description,omitempty"`
+	Categories   []string         `json:"categories"`
+	EpisodeCount int              `json:"episode_count,omitempty"`
+	Source       string           `json:"source"` // "itunes" or "podcast_index"
+	Subscribed   bool             `json:"subscribed"`
+	Subscribe    SubscribeRequest `json:"subscribe"`
+}
+
+// FeedCandidate is a feed found on a web page, of Type "rss", "atom" or "json"
+type FeedCandidate struct {
+	URL        string           `json:"url"`
+	Title      string           `json:"title"`
+	Type       string           `json:"type"`
+	Subscribed bool             `json:"subscribed"`
+	Subscribe  SubscribeRequest `json:"subscribe"`
+}
+
+// SubscribeRequest adds a feed, optionally to a folder
+type SubscribeRequest struct {
+	URL      string `json:"url"`
+	FolderID *int   `json:"folder_id"`
+}
+
+// ArticlePage is a page of an article list. NextCursor fetches the page after it and is
+// null on the last page; Total counts the matching articles of all pages.
+type ArticlePage struct {
+	Items      []Article `json:"items"`
+	NextCursor *string   `json:"next_cursor"`
+	Total      int       `json:"total"`
+}
+
+// Outcomes of a change in an article state sync
+const (
+	StateUpdated   = "updated"
+	StateUnchanged = "unchanged"
+	StateNotFound  = "not_found"
+)
+
+// ArticleStateResult is the outcome of one change of a state sync: Action is read,
+// unread, saved or unsaved and Status one of the State constants
+type ArticleStateResult struct {
+	ID     int    `json:"id"`
+	Action string `json:"action"`
+	Status string `json:"status"`
+}
+
+// ArticleGroup is an article listed once for all the feeds that carry the same story.
+// The article is the earliest copy; Sources are the others, oldest first.
+type ArticleGroup struct {
+	Article
+	Sources []ArticleSource `json:"sources"`
+}
+
+// ArticleSource is another copy of a grouped article
+type ArticleSource struct {
+	ID          int       `json:"id"`
+	FeedID      int       `json:"feed_id"`
+	FeedTitle   string    `json:"feed_title"`
+	URL         string    `json:"url"`
+	PublishedAt time.Time `json:"published_at"`
+	Read        bool      `json:"read"`
+}
+
+// River is the unread articles of the last days, newest day first, for reading what
+// happened today and yesterday in order
+type River struct {
+	Timezone string     `json:"timezone"`
+	Days     []RiverDay `json:"days"`
+}
+
+// RiverDay holds the unread articles published on a calendar day in the river's timezone.
+// Count is the number of unread articles of the day, which may exceed len(Articles).
+type RiverDay struct {
+	Date     string      `json:"date"` // "2006-01-02"
+	Count    int         `json:"count"`
+	Articles []RiverItem `json:"articles"`
+}
+
+// RiverItem is an article in the river with a plain text summary instead of its content
+type RiverItem struct {
+	ID          int       `json:"id"`
+	FeedID      int       `json:"feed_id"`
+	FeedTitle   string    `json:"feed_title"`
+	Title       string    `json:"title"`
+	URL         string    `json:"url"`
+	Author      string    `json:"author"`
+	PublishedAt time.Time `json:"published_at"`
+	Summary     string    `json:"summary"`
 }
 
 type Setting struct {
@@ -43,6 +217,43 @@ type Setting struct {
 	Value string `json:"value" db:"value"`
 }
 
+// FolderTree is the folder hierarchy with the feeds of every folder, as shown in the sidebar
+type FolderTree struct {
+	Folders       []*FolderNode `json:"folders"`
+	Uncategorized []FeedSummary `json:"uncategorized"`
+}
+
+// FolderNode is a folder in the tree. UnreadCount includes the feeds of nested subfolders.
+type FolderNode struct {
+	ID          int           `json:"id"`
+	Name        string        `json:"name"`
+	ParentID    *int          `json:"parent_id"`
+	Position    int           `json:"position"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UnreadCount int           `json:"unread_count"`
+	Feeds       []FeedSummary `json:"feeds"`
+	Children    []*FolderNode `json:"children"`
+}
+
+// FeedSummary is the part of a feed the folder tree lists
+type FeedSummary struct {
+	ID          int    `json:"id"`
+	Title       string `json:"title"`
+	URL         string `json:"url"`
+	Health      string `json:"health"`
+	ErrorCount  int    `json:"error_count"`
+	UnreadCount int    `json:"unread_count"`
+	Position    int    `json:"position"`
+}
+
+// UnreadCounts holds unread totals per feed and per folder (including nested subfolders)
+type UnreadCounts struct {
+	Total         int         `json:"total"`
+	Uncategorized int         `json:"uncategorized"`
+	Feeds         map[int]int `json:"feeds"`
+	Folders       map[int]int `json:"folders"`
+}
+
 type FeedStats struct {
 	TotalFeeds     int `json:"total_feeds"`
 	TotalArticles  int `json:"total_articles"`
@@ -50,6 +261,365 @@ type FeedStats struct {
 	SavedArticles  int `json:"saved_articles"`
 }
 
+// FeedHealthTotals counts feeds by health. Paused feeds are counted separately and not
+// by health.
+type FeedHealthTotals struct {
+	Total       int        `json:"total"`
+	Healthy     int        `json:"healthy"`
+	Warning     int        `json:"warning"`
+	Error       int        `json:"error"`
+	Paused      int        `json:"paused"`
+	LastRefresh *time.Time `json:"last_refresh"`
+}
+
+// FeedStatistics holds the materialized per-feed counters from the feed_stats table
+type FeedStatistics struct {
+	FeedID          int        `json:"feed_id" db:"feed_id"`
+	ArticleCount    int        `json:"article_count" db:"article_count"`
+	UnreadCount     int        `json:"unread_count" db:"unread_count"`
+	FirstArticleAt  *time.Time `json:"first_article_at" db:"first_article_at"`
+	LastArticleAt   *time.Time `json:"last_article_at" db:"last_article_at"`
+	AvgPostInterval int64      `json:"avg_post_interval" db:"avg_post_interval"` // seconds between posts
+	OpenedCount     int        `json:"opened_count" db:"opened_count"`           // articles read one by one
+	LastOpenedAt    *time.Time `json:"last_opened_at" db:"last_opened_at"`
+	UpdatedAt       time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// DeadLetter records a feed that was paused after failing too many times in a row
+type DeadLetter struct {
+	ID         int       `json:"id" db:"id"`
+	FeedID     int       `json:"feed_id" db:"feed_id"`
+	FeedTitle  string    `json:"feed_title" db:"-"`
+	FeedURL    string    `json:"feed_url" db:"-"`
+	Error      string    `json:"error" db:"error"` // the last refresh error
+	ErrorCount int       `json:"error_count" db:"error_count"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// Digest frequencies
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// DigestSubscription is a user's email digest of unread articles
+type DigestSubscription struct {
+	UserID     int        `json:"user_id" db:"user_id"`
+	Email      string     `json:"email" db:"email"`
+	Frequency  string     `json:"frequency" db:"frequency"` // "daily" or "weekly"
+	FolderID   *int       `json:"folder_id" db:"folder_id"` // nil for all feeds
+	Enabled    bool       `json:"enabled" db:"enabled"`
+	LastSentAt *time.Time `json:"last_sent_at" db:"last_sent_at"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+}
+
+// EmailForward emails every new article of a feed to a user
+type EmailForward struct {
+	UserID    int       `json:"user_id" db:"user_id"`
+	FeedID    int       `json:"feed_id" db:"feed_id"`
+	FeedTitle string    `json:"feed_title" db:"-"`
+	Email     string    `json:"email" db:"email"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// Notification providers
+const (
+	NotifyNtfy     = "ntfy"
+	NotifyGotify   = "gotify"
+	NotifyPushover = "pushover"
+	NotifyWebhook  = "webhook"
+	NotifyBrowser  = "browser" // streamed to the user's open browser tabs and apps over SSE
+)
+
+// NotificationTarget pushes new articles to one of a user's devices. Only articles of
+// feeds in FolderID (and its subfolders) and matching one of Keywords are pushed, when set.
+type NotificationTarget struct {
+	ID        int               `json:"id" db:"id"`
+	UserID    int               `json:"user_id" db:"user_id"`
+	Name      string            `json:"name" db:"name"`
+	Provider  string            `json:"provider" db:"provider"`
+	Config    map[string]string `json:"config" db:"config"` // provider settings, JSON encoded
+	FolderID  *int              `json:"folder_id" db:"folder_id"`
+	Keywords  []string          `json:"keywords" db:"keywords"` // JSON encoded
+	Enabled   bool              `json:"enabled" db:"enabled"`
+	CreatedAt time.Time         `json:"created_at" db:"created_at"`
+}
+
+// NotificationRule routes the new articles of a feed or folder (including subfolders) that
+// match one of Keywords to TargetIDs. Targets used by a rule are only notified through
+// rules, on top of their own filters. At most MaxPerHour notifications are sent to each
+// target per hour; 0 means no cap.
+type NotificationRule struct {
+	ID         int       `json:"id" db:"id"`
+	UserID     int       `json:"user_id" db:"user_id"`
+	Name       string    `json:"name" db:"name"`
+	FeedID     *int      `json:"feed_id" db:"feed_id"`
+	FolderID   *int      `json:"folder_id" db:"folder_id"`
+	Keywords   []string  `json:"keywords" db:"keywords"`     // JSON encoded
+	TargetIDs  []int     `json:"target_ids" db:"target_ids"` // JSON encoded
+	MaxPerHour int       `json:"max_per_hour" db:"max_per_hour"`
+	Enabled    bool      `json:"enabled" db:"enabled"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// NotificationPreferences are a user's quiet hours. Between QuietStart and QuietEnd
+// ("HH:MM" in Timezone, possibly spanning midnight) no notifications are pushed; with
+// Batch they are held and pushed as one combined message per target when the window ends,
+// otherwise they are dropped.
+type NotificationPreferences struct {
+	UserID     int       `json:"user_id" db:"user_id"`
+	QuietStart string    `json:"quiet_start" db:"quiet_start"` // empty when there are no quiet hours
+	QuietEnd   string    `json:"quiet_end" db:"quiet_end"`
+	Timezone   string    `json:"timezone" db:"timezone"` // IANA name, e.g. "Europe/Berlin"
+	Batch      bool      `json:"batch" db:"batch"`
+	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// Notification delivery statuses
+const (
+	DeliveryPending  = "pending"
+	DeliveryRetrying = "retrying"
+	DeliverySent     = "sent"
+	DeliveryFailed   = "failed"
+	DeliveryDropped  = "dropped" // not sent because of quiet hours, a rule cap or a disabled target
+)
+
+// NotificationDelivery is one notification in the delivery log
+type NotificationDelivery struct {
+	ID         int       `json:"id" db:"id"`
+	UserID     int       `json:"user_id" db:"user_id"`
+	TargetID   int       `json:"target_id" db:"target_id"`
+	TargetName string    `json:"target_name" db:"-"`
+	Provider   string    `json:"provider" db:"-"`
+	ArticleID  *int      `json:"article_id" db:"article_id"` // nil for summaries and tests
+	Title      string    `json:"title" db:"title"`
+	Message    string    `json:"message" db:"message"`
+	URL        string    `json:"url" db:"url"`
+	Status     string    `json:"status" db:"status"`
+	Error      *string   `json:"error" db:"error"`
+	Attempts   int       `json:"attempts" db:"attempts"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// Webhook is a URL of a user that new articles are POSTed to as JSON, optionally only
+// those of a feed or folder or matching one of Keywords. With a Secret, every request is
+// signed with HMAC-SHA256 in the X-MyFeed-Signature header.
+type Webhook struct {
+	ID        int       `json:"id" db:"id"`
+	UserID    int       `json:"user_id" db:"user_id"`
+	Name      string    `json:"name" db:"name"`
+	URL       string    `json:"url" db:"url"`
+	Secret    string    `json:"secret" db:"secret"`
+	FeedID    *int      `json:"feed_id" db:"feed_id"`
+	FolderID  *int      `json:"folder_id" db:"folder_id"`
+	Keywords  []string  `json:"keywords" db:"keywords"` // JSON encoded
+	Enabled   bool      `json:"enabled" db:"enabled"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// WebhookDelivery is one POST of an article to a webhook in the delivery log. Status
+// takes the values of NotificationDelivery.Status, except dropped.
+type WebhookDelivery struct {
+	ID             int       `json:"id" db:"id"`
+	UserID         int       `json:"user_id" db:"user_id"`
+	WebhookID      int       `json:"webhook_id" db:"webhook_id"`
+	WebhookName    string    `json:"webhook_name" db:"-"`
+	ArticleID      *int      `json:"article_id" db:"article_id"` // nil for tests
+	Payload        string    `json:"payload" db:"payload"`
+	Status         string    `json:"status" db:"status"`
+	ResponseStatus *int      `json:"response_status" db:"response_status"`
+	Error          *string   `json:"error" db:"error"`
+	Attempts       int       `json:"attempts" db:"attempts"`
+	CreatedAt      time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// Fields, operators and actions of rules
+const (
+	RuleFieldTitle   = "title"
+	RuleFieldContent = "content" // as plain text
+	RuleFieldAuthor  = "author"
+	RuleFieldAny     = "any" // title, content or author
+
+	RuleContains = "contains" // case-insensitive substring
+	RuleMatches  = "matches"  // regular expression
+
+	RuleMarkRead  = "mark_read"
+	RuleMarkSaved = "mark_saved"
+	RuleDelete    = "delete" // hides the article from the user and marks it read
+	RuleTag       = "tag"
+)
+
+// RuleCondition tests one field of an article; Negate inverts the test
+type RuleCondition struct {
+	Field    string `json:"field"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+	Negate   bool   `json:"negate"`
+}
+
+// RuleAction is what a rule does to the articles it matches. Tag is the tag of tag actions.
+type RuleAction struct {
+	Type string `json:"type"`
+	Tag  string `json:"tag,omitempty"`
+}
+
+// Rule applies its Actions to new articles of FeedID or FolderID (and its subfolders),
+// when set, that meet all of its Conditions, or any of them when Match is "any". Rules
+// act for their user only, since articles are shared by the subscribers of a feed.
+type Rule struct {
+	ID         int             `json:"id" db:"id"`
+	UserID     int             `json:"user_id" db:"user_id"`
+	Name       string          `json:"name" db:"name"`
+	FeedID     *int            `json:"feed_id" db:"feed_id"`
+	FolderID   *int            `json:"folder_id" db:"folder_id"`
+	Match      string          `json:"match" db:"match_mode"`      // all or any
+	Conditions []RuleCondition `json:"conditions" db:"conditions"` // JSON encoded
+	Actions    []RuleAction    `json:"actions" db:"actions"`       // JSON encoded
+	Enabled    bool            `json:"enabled" db:"enabled"`
+	CreatedAt  time.Time       `json:"created_at" db:"created_at"`
+}
+
+// TagCount is a tag of a user with the number of articles that have it
+type TagCount struct {
+	Tag      string `json:"tag"`
+	Articles int    `json:"articles"`
+}
+
+// DailyStats is the activity of one day, for a single feed or summed over all feeds
+type DailyStats struct {
+	Day              string `json:"day" db:"day"` // YYYY-MM-DD in UTC
+	ArticlesIngested int    `json:"articles_ingested" db:"articles_ingested"`
+	ArticlesRead     int    `json:"articles_read" db:"articles_read"`
+	ArticlesSaved    int    `json:"articles_saved" db:"articles_saved"`
+}
+
+// ReadingStats summarizes which articles were opened when, for a personal dashboard. Days
+// are calendar days in Timezone; weeks start on Monday.
+type ReadingStats struct {
+	Timezone     string        `json:"timezone"`
+	Days         int           `json:"days"`
+	TotalRead    int           `json:"total_read"`
+	PerDay       []ReadingDay  `json:"per_day"`
+	PerWeek      []ReadingDay  `json:"per_week"`
+	BusiestFeeds []ReadingFeed `json:"busiest_feeds"`
+	// AverageTimeToRead is the mean time from publication to opening, in seconds; nil
+	// without reads
+	AverageTimeToRead *int64 `json:"average_time_to_read_seconds"`
+	CurrentStreak     int    `json:"current_streak"` // days in a row with reads, up to today
+	LongestStreak     int    `json:"longest_streak"`
+}
+
+// ReadingDay is the number of articles read on a day, or in the week starting on it
+type ReadingDay struct {
+	Date  string `json:"date"` // "2006-01-02"
+	Count int    `json:"count"`
+}
+
+// ReadingFeed is the number of articles of a feed read in the window
+type ReadingFeed struct {
+	FeedID    int    `json:"feed_id"`
+	FeedTitle string `json:"feed_title"`
+	Count     int    `json:"count"`
+}
+
+// Readiness check results
+const (
+	CheckOK       = "ok"
+	CheckDegraded = "degraded"
+	CheckSkipped  = "skipped" // not applicable, e.g. the scheduler in maintenance mode
+)
+
+// HealthCheck is the result of one readiness check
+type HealthCheck struct {
+	Status     string `json:"status"`
+	Detail     string `json:"detail"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// HealthReport is the outcome of all readiness checks. Status is degraded if any check is.
+type HealthReport struct {
+	Status    string                 `json:"status"`
+	Checks    map[string]HealthCheck `json:"checks"`
+	CheckedAt time.Time              `json:"checked_at"`
+}
+
+// SystemInfo is the operator overview served by /api/admin/system
+type SystemInfo struct {
+	Build         BuildInfo          `json:"build"`
+	StartedAt     time.Time          `json:"started_at"`
+	UptimeSeconds int64              `json:"uptime_seconds"`
+	Database      SystemDatabase     `json:"database"`
+	Counts        SystemCounts       `json:"counts"`
+	Feeds         *FeedHealthTotals  `json:"feeds"`
+	TopFeeds      []FeedArticleCount `json:"top_feeds"` // by number of stored articles
+	Scheduler     SchedulerStatus    `json:"scheduler"`
+	Backups       BackupStatus       `json:"backups"`
+	Update        UpdateStatus       `json:"update"`
+	GeneratedAt   time.Time          `json:"generated_at"`
+}
+
+// BuildInfo identifies the running binary. Revision is the VCS commit it was built from,
+// when the build recorded one.
+type BuildInfo struct {
+	Version      string     `json:"version"`
+	GoVersion    string     `json:"go_version"`
+	BuildDate    *time.Time `json:"build_date,omitempty"`
+	Revision     string     `json:"revision,omitempty"`
+	RevisionTime *time.Time `json:"revision_time,omitempty"`
+	Modified     bool       `json:"modified"` // built from a working tree with changes
+}
+
+type SystemDatabase struct {
+	Engine        string `json:"engine"`
+	SchemaVersion int    `json:"schema_version"`
+	SizeBytes     int64  `json:"size_bytes"`
+	ErrorCount int64  `json:"error_count"`
+	RetryCount int64  `json:"retry_count"`
+}
+
+type SystemCounts struct {
+	Users    int `json:"users"`
+	Folders  int `json:"folders"`
+	Feeds    int `json:"feeds"`
+	Articles int `json:"articles"`
+	Unread   int `json:"unread"`
+	Saved    int `json:"saved"`
+}
+
+type FeedArticleCount struct {
+	FeedID       int    `json:"feed_id"`
+	Title        string `json:"title"`
+	ArticleCount int    `json:"article_count"`
+}
+
+// SchedulerStatus shows whether feeds are being refreshed. Jobs counts the background jobs
+// by status.
+type SchedulerStatus struct {
+	Paused       bool           `json:"paused"` // maintenance mode
+	Workers      int            `json:"workers"`
+	LastDispatch time.Time      `json:"last_dispatch"`
+	Jobs         map[string]int `json:"jobs"`
+}
+
+// UpdateStatus is the outcome of the last check for a newer release. Available is only
+// set when the running version is a release older than LatestVersion.
+type UpdateStatus struct {
+	Enabled       bool       `json:"enabled"`
+	CheckedAt     *time.Time `json:"checked_at"`
+	LatestVersion string     `json:"latest_version,omitempty"`
+	ReleaseURL    string     `json:"release_url,omitempty"`
+	Available     bool       `json:"available"`
+	Error         string     `json:"error,omitempty"`
+}
+
+type BackupStatus struct {
+	Enabled    bool       `json:"enabled"`
+	Count      int        `json:"count"`
+	LastBackup *time.Time `json:"last_backup"`
+}
+
 type User struct {
 	ID        int       `json:"id" db:"id"`
 	Username  string    `json:"username" db:"username"`
@@ -57,6 +627,9 @@ type User struct {
 	IsAdmin   bool      `json:"is_admin" db:"is_admin"`
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 	LastLogin *time.Time `json:"last_login" db:"last_login"`
+	Timezone  string     `json:"timezone" db:"timezone"` // IANA name, empty when not set
+	// Disabled users cannot log in, and their sessions and tokens stop working
+	Disabled bool `json:"disabled" db:"disabled"`
 }
 
 type Session struct {
@@ -64,4 +637,83 @@ type Session struct {
 	UserID    int       `json:"user_id" db:"user_id"`
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
-}
\ No newline at end of file
+}
+
+// Scopes of API tokens: read tokens may only make GET and HEAD requests, and only admin
+// tokens of admins reach the admin endpoints
+const (
+	TokenScopeRead  = "read"
+	TokenScopeWrite = "write"
+	TokenScopeAdmin = "admin"
+)
+
+// APIToken is a personal access token, sent as Authorization: Bearer. Token is only set
+// when the token is created; afterwards only its Prefix is known.
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scope      string     `json:"scope"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Token      string     `json:"token,omitempty"`
+}
+
+// Job statuses
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Job is a unit of background work persisted in the jobs table
+type Job struct {
+	ID          int        `json:"id" db:"id"`
+	Type        string     `json:"type" db:"type"`
+	Target      *string    `json:"target,omitempty" db:"target"` // e.g. "feed:12"
+	Payload     string     `json:"payload" db:"payload"` // JSON encoded
+	Status      string     `json:"status" db:"status"`
+	Attempts    int        `json:"attempts" db:"attempts"`
+	MaxAttempts int        `json:"max_attempts" db:"max_attempts"`
+	Priority    int        `json:"priority" db:"priority"` // higher runs first
+	LastError   *string    `json:"last_error,omitempty" db:"last_error"`
+	Result      *string    `json:"result,omitempty" db:"result"` // JSON encoded, written by the handler
+	RunAt       time.Time  `json:"run_at" db:"run_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty" db:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty" db:"finished_at"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	DurationMs  *int64     `json:"duration_ms,omitempty" db:"-"`
+}
+
+// APIResponse is the envelope of every API response: data on success, an error otherwise
+type APIResponse struct {
+	Success bool        `json:"success"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   *APIError   `json:"error,omitempty"`
+}
+
+// Error codes of APIError. Clients branch on them, so codes are only added, never changed.
+const (
+	ErrorInvalidRequest   = "invalid_request"   // malformed JSON or path parameter
+	ErrorValidationFailed = "validation_failed" // see Fields for the invalid fields
+	ErrorUnauthorized     = "unauthorized"
+	ErrorForbidden        = "forbidden"
+	ErrorNotFound         = "not_found"
+	ErrorConflict         = "conflict"
+	ErrorFeedExists       = "feed_exists"
+	ErrorTooLarge         = "too_large"
+	ErrorUpstreamFailed   = "upstream_failed" // an SMTP server, push service or bookmark service failed
+	ErrorUnavailable      = "unavailable"     // a feature that is not configured, or maintenance mode
+	ErrorTimeout          = "timeout"
+	ErrorInternal         = "internal_error"
+)
+
+// APIError describes why a request failed. Message is meant for people and may change;
+// Code is stable. Fields maps invalid request fields to what is wrong with them.
+type APIError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"myfeed/database"
+	"myfeed/httpjson"
+	"myfeed/models"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Probe paths for Kubernetes and Compose health checks. They sit outside /api so they need
+// no session and skip the access log, which would otherwise fill up with probe requests.
+const (
+	livenessPath  = "/healthz"
+	readinessPath = "/readyz"
+)
+
+// probeTimeout bounds the database ping of the readiness probe
+const probeTimeout = 2 * time.Second
+
+// startupRetryAfter is the Retry-After sent with the 503 answered while starting up
+const startupRetryAfter = "5"
+
+// probes is the root handler of the server. The server listens before the database is
+// migrated, so liveness probes pass while a long migration runs, but every request other
+// than the probes is answered with 503 until startup completes and the app is installed.
+type probes struct {
+	db        atomic.Pointer[database.DB]
+	scheduled atomic.Bool
+	app       atomic.Pointer[http.Handler]
+}
+
+// migrated records that the database schema is up to date
+func (p *probes) migrated(db *database.DB) {
+	p.db.Store(db)
+}
+
+// schedulerStarted records that the job workers and scheduled tasks are running
+func (p *probes) schedulerStarted() {
+	p.scheduled.Store(true)
+}
+
+// serve installs the app handler and starts accepting traffic
+func (p *probes) serve(app http.Handler) {
+	p.app.Store(&app)
+}
+
+func (p *probes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case livenessPath:
+		p.live(w, r)
+		return
+	case readinessPath:
+		p.ready(w, r)
+		return
+	}
+
+	app := p.app.Load()
+	if app == nil {
+		w.Header().Set("Retry-After", startupRetryAfter)
+		httpjson.WriteError(w, http.StatusServiceUnavailable, models.ErrorUnavailable, "Starting up")
+		return
+	}
+	(*app).ServeHTTP(w, r)
+}
+
+// live answers as long as the process can serve requests at all
+func (p *probes) live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"status": models.CheckOK})
+}
+
+// ready answers 503 until the database is reachable and migrated, the scheduler runs and
+// the app accepts traffic. Unlike /api/health/ready it leaves out feed refreshes and disk
+// space, which an orchestrator cannot fix by restarting or rerouting.
+func (p *probes) ready(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+	defer cancel()
+
+	report := &models.HealthReport{
+		Status:    models.CheckOK,
+		Checks:    make(map[string]models.HealthCheck, 4),
+		CheckedAt: time.Now().UTC(),
+	}
+	check := func(name string, ok bool, detail string) {
+		status := models.CheckOK
+		if !ok {
+			status = models.CheckDegraded
+			report.Status = models.CheckDegraded
+		}
+		report.Checks[name] = models.HealthCheck{Status: status, Detail: detail}
+	}
+
+	db := p.db.Load()
+	if db == nil {
+		check("migrations", false, "not applied yet")
+		check("database", false, "not connected yet")
+	} else {
+		check("migrations", true, "applied")
+		if err := db.PingContext(ctx); err != nil {
+			check("database", false, fmt.Sprintf("ping failed: %v", err))
+		} else {
+			check("database", true, fmt.Sprintf("%s reachable", db.Engine()))
+		}
+	}
+
+	if p.scheduled.Load() {
+		check("scheduler", true, "started")
+	} else {
+		check("scheduler", false, "not started yet")
+	}
+	if p.app.Load() != nil {
+		check("startup", true, "complete")
+	} else {
+		check("startup", false, "in progress")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != models.CheckOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"myfeed/models"
+	"strings"
+	"time"
+)
+
+// apiTokenPrefix starts every API token, so leaked tokens are easy to search for
+const apiTokenPrefix = "mft_"
+
+// tokenUseInterval is how often the last use of a token is recorded at most
+const tokenUseInterval = time.Minute
+
+const apiTokenColumns = `id, user_id, name, prefix, scope, last_used_at, created_at`
+
+func scanAPIToken(row rowScanner, token *models.APIToken) error {
+	return row.Scan(&token.ID, &token.UserID, &token.Name, &token.Prefix, &token.Scope,
+		&token.LastUsedAt, &token.CreatedAt)
+}
+
+// hashAPIToken is how tokens are stored. Tokens are random, so a plain hash is enough.
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateToken creates an API token of a user with the read, write or, for admins, admin
+// scope. The token is only returned here; the database keeps its hash.
+func (as *AuthService) CreateToken(user *models.User, name, scope string) (*models.APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, invalidField("name", "name is required")
+	}
+	if scope == "" {
+		scope = models.TokenScopeRead
+	}
+	switch scope {
+	case models.TokenScopeRead, models.TokenScopeWrite:
+	case models.TokenScopeAdmin:
+		if !user.IsAdmin {
+			return nil, invalidField("scope", "admin tokens can only be created by admins")
+		}
+	default:
+		return nil, invalidField("scope", "must be read, write or admin")
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return nil, fmt.Errorf("failed to generate token: %v", err)
+	}
+	secret := apiTokenPrefix + hex.EncodeToString(random)
+
+	query := `INSERT INTO api_tokens (user_id, name, token_hash, prefix, scope) VALUES (?, ?, ?, ?, ?)`
+	id, err := as.db.Insert(query, user.ID, name, hashAPIToken(secret), secret[:len(apiTokenPrefix)+8], scope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token: %v", err)
+	}
+
+	token := &models.APIToken{}
+	err = scanAPIToken(as.db.QueryRow(`SELECT `+apiTokenColumns+` FROM api_tokens WHERE id = ?`, id), token)
+	if err != nil {
+		return nil, err
+	}
+	token.Token = secret
+	return token, nil
+}
+
+// GetTokens lists the API tokens of a user, newest first
+func (as *AuthService) GetTokens(userID int) ([]models.APIToken, error) {
+	rows, err := as.db.Query(`SELECT `+apiTokenColumns+` FROM api_tokens WHERE user_id = ? ORDER BY id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []models.APIToken{}
+	for rows.Next() {
+		var token models.APIToken
+		if err := scanAPIToken(rows, &token); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteToken revokes an API token of a user
+func (as *AuthService) DeleteToken(userID, id int) error {
+	result, err := as.db.Exec(`DELETE FROM api_tokens WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// AuthenticateToken returns the user of an API token and the token, or an error if it is
+// unknown. The time it was last used is recorded.
+func (as *AuthService) AuthenticateToken(secret string) (*models.User, *models.APIToken, error) {
+	if !strings.HasPrefix(secret, apiTokenPrefix) {
+		return nil, nil, fmt.Errorf("invalid token")
+	}
+
+	token := &models.APIToken{}
+	query := `SELECT ` + apiTokenColumns + ` FROM api_tokens WHERE token_hash = ?`
+	if err := scanAPIToken(as.db.QueryRow(query, hashAPIToken(secret)), token); err != nil {
+		return nil, nil, fmt.Errorf("invalid token")
+	}
+
+	user, err := as.GetUserByID(token.UserID)
+	if err != nil || user.Disabled {
+		return nil, nil, fmt.Errorf("invalid token")
+	}
+
+	now := time.Now().UTC()
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= tokenUseInterval {
+		if _, err := as.db.Exec(`UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, now, token.ID); err != nil {
+			authLog.Error("Failed to record token use", "token_id", token.ID, "error", err)
+		}
+		token.LastUsedAt = &now
+	}
+	return user, token, nil
+}
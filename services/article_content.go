@@ -0,0 +1,45 @@
+package services
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// defaultMaxArticleKB caps stored article content when max_article_kb is not set
+	defaultMaxArticleKB = 512
+	// maxEntityLength is the length of the longest HTML character reference
+	maxEntityLength = 33
+)
+
+// inlineImage matches img tags with a data: URI source. Feeds that embed whole images in
+// base64 are the usual reason for oversized content.
+var inlineImage = regexp.MustCompile(`(?i)<img\b[^>]*\bsrc\s*=\s*["']?data:[^>]*>`)
+
+// limitContent caps article HTML at maxBytes and reports whether it had to change it.
+// Inline images are dropped first, which often keeps the whole text; what is still too
+// long is cut at the last complete character, tag and entity before the limit.
+func limitContent(content string, maxBytes int) (string, bool) {
+	if maxBytes <= 0 || len(content) <= maxBytes {
+		return content, false
+	}
+
+	content = inlineImage.ReplaceAllString(content, "")
+	if len(content) <= maxBytes {
+		return content, true
+	}
+
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(content[cut]) {
+		cut--
+	}
+	content = content[:cut]
+	if open := strings.LastIndexByte(content, '<'); open > strings.LastIndexByte(content, '>') {
+		content = content[:open]
+	}
+	if amp := strings.LastIndexByte(content, '&'); amp > strings.LastIndexByte(content, ';') && len(content)-amp < maxEntityLength {
+		content = content[:amp]
+	}
+	return content, true
+}
@@ -0,0 +1,247 @@
+package services
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"myfeed/database"
+	"myfeed/models"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// dedupMinWords is how many words a title needs to be matched across feeds. Short titles
+// like "Weekly links" are shared by unrelated articles.
+const dedupMinWords = 4
+
+// dedupHash identifies the story of an article by its title, ignoring case, punctuation and
+// spacing, so the same press release carried by several feeds gets the same hash. Titles
+// that are too short to tell stories apart get an empty hash and are never grouped.
+func dedupHash(title string) string {
+	titleWords := words(title)
+	if len(titleWords) < dedupMinWords {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(titleWords, " ")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// trackingParams are query parameters that only say where a link was shared, and are
+// ignored when comparing article URLs, along with all utm_ parameters
+var trackingParams = map[string]bool{"fbclid": true, "gclid": true, "mc_cid": true, "mc_eid": true, "ref_src": true}
+
+// urlHash identifies an article by its URL regardless of scheme, www., fragment, trailing
+// slash, tracking parameters and the order of the query, or is empty without a URL
+func urlHash(rawURL string) string {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		if !trackingParams[strings.ToLower(key)] && !strings.HasPrefix(strings.ToLower(key), "utm_") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			params = append(params, url.QueryEscape(key)+"="+url.QueryEscape(value))
+		}
+	}
+
+	normalized := strings.TrimPrefix(strings.ToLower(u.Host), "www.") + strings.TrimSuffix(u.EscapedPath(), "/") +
+		"?" + strings.Join(params, "&")
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:16])
+}
+
+// storyHash is the dedup_hash of a new article. An article linking to the same page as one
+// stored before joins that article's story, whatever its title; otherwise the story is
+// identified by the title, or by the URL when the title is too short.
+func storyHash(db *database.DB, title, articleURLHash string) (string, error) {
+	if articleURLHash == "" {
+		return dedupHash(title), nil
+	}
+
+	var hash string
+	query := `SELECT dedup_hash FROM articles WHERE url_hash = ? AND COALESCE(dedup_hash, '') <> '' ORDER BY id LIMIT 1`
+	err := db.QueryRow(query, articleURLHash).Scan(&hash)
+	if err == nil {
+		return hash, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	if hash = dedupHash(title); hash == "" {
+		hash = "url:" + articleURLHash
+	}
+	return hash, nil
+}
+
+// BackfillDedupHashes computes the hashes of articles stored before hashes existed. The
+// stories of older articles are only matched by title.
+func (as *ArticleService) BackfillDedupHashes() (int, error) {
+	rows, err := as.db.Query(`SELECT id, title, COALESCE(url, ''), dedup_hash FROM articles WHERE dedup_hash IS NULL OR url_hash IS NULL`)
+	if err != nil {
+		return 0, err
+	}
+
+	type hashes struct{ story, url string }
+	byID := make(map[int]hashes)
+	for rows.Next() {
+		var id int
+		var title, articleURL string
+		var story *string
+		if err := rows.Scan(&id, &title, &articleURL, &story); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		h := hashes{url: urlHash(articleURL)}
+		if story != nil {
+			h.story = *story
+		} else {
+			h.story = dedupHash(title)
+		}
+		byID[id] = h
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for id, h := range byID {
+		if _, err := as.db.Exec(`UPDATE articles SET dedup_hash = ?, url_hash = ? WHERE id = ?`, h.story, h.url, id); err != nil {
+			return 0, err
+		}
+	}
+	return len(byID), nil
+}
+
+// articleFilter returns the conditions of an article listing on the articles table alias,
+// joined with userArticles, as AND clauses, with their arguments
+func articleFilter(alias string, feedID *int, read, saved *bool) (string, []interface{}) {
+	var conditions strings.Builder
+	var args []interface{}
+	if feedID != nil {
+		conditions.WriteString(" AND " + alias + ".feed_id = ?")
+		args = append(args, *feedID)
+	}
+	if read != nil {
+		conditions.WriteString(" AND COALESCE(" + alias + "_st.read, false) = ?")
+		args = append(args, *read)
+	}
+	if saved != nil {
+		conditions.WriteString(" AND COALESCE(" + alias + "_st.saved, false) = ?")
+		args = append(args, *saved)
+	}
+	return conditions.String(), args
+}
+
+// GetArticleGroups lists articles like GetArticles, but the copies of a story carried by
+// several feeds take a single slot: the earliest matching copy is listed with the others
+// as its sources. Only copies that match the filters are grouped, so with read=false a
+// story that was read in one feed is listed with its unread copies.
+func (as *ArticleService) GetArticleGroups(userID int, feedID *int, read *bool, saved *bool, limit, offset int) ([]models.ArticleGroup, error) {
+	filter, filterArgs := articleFilter("a", feedID, read, saved)
+	otherFilter, otherArgs := articleFilter("b", feedID, read, saved)
+
+	// An article is listed unless an earlier copy of it matches the filters as well
+	query := `
+		SELECT a.id, a.feed_id, a.title, a.content, a.url, a.author,
+		       a.published_at, COALESCE(a_st.read, false), COALESCE(a_st.saved, false), a.content_truncated, a.created_at, a.dedup_hash
+		FROM articles a` + userArticles("a") + `
+		WHERE 1=1` + filter + `
+		AND (COALESCE(a.dedup_hash, '') = '' OR NOT EXISTS (
+			SELECT 1 FROM articles b` + userArticles("b") + `
+			WHERE b.dedup_hash = a.dedup_hash` + otherFilter + `
+			AND (b.published_at < a.published_at OR (b.published_at = a.published_at AND b.id < a.id))
+		))
+		ORDER BY a.published_at DESC LIMIT ? OFFSET ?
+	`
+	args := append([]interface{}{userID}, filterArgs...)
+	args = append(args, userID)
+	args = append(args, otherArgs...)
+	args = append(args, limit, offset)
+
+	rows, err := as.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []models.ArticleGroup{}
+	byHash := make(map[string]int)
+	for rows.Next() {
+		group := models.ArticleGroup{Sources: []models.ArticleSource{}}
+		article := &group.Article
+		var hash *string
+		err := rows.Scan(
+			&article.ID, &article.FeedID, &article.Title, &article.Content, &article.URL,
+			&article.Author, &article.PublishedAt, &article.Read, &article.Saved, &article.ContentTruncated, &article.CreatedAt, &hash,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if hash != nil && *hash != "" {
+			byHash[*hash] = len(groups)
+		}
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if len(byHash) == 0 {
+		return groups, nil
+	}
+	if err := as.addSources(userID, groups, byHash, feedID, read, saved); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// addSources adds the other copies of the listed stories, indexed by hash, to their groups
+func (as *ArticleService) addSources(userID int, groups []models.ArticleGroup, byHash map[string]int, feedID *int, read, saved *bool) error {
+	placeholders := make([]string, 0, len(byHash))
+	args := make([]interface{}, 0, len(byHash)+1)
+	args = append(args, userID)
+	for hash := range byHash {
+		placeholders = append(placeholders, "?")
+		args = append(args, hash)
+	}
+	filter, filterArgs := articleFilter("a", feedID, read, saved)
+	args = append(args, filterArgs...)
+
+	query := `
+		SELECT a.id, a.feed_id, f.title, a.url, a.published_at, COALESCE(a_st.read, false), a.dedup_hash
+		FROM articles a JOIN feeds f ON f.id = a.feed_id` + userArticles("a") + `
+		WHERE a.dedup_hash IN (` + strings.Join(placeholders, ", ") + `)` + filter + `
+		ORDER BY a.published_at, a.id
+	`
+	rows, err := as.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var source models.ArticleSource
+		var hash string
+		if err := rows.Scan(&source.ID, &source.FeedID, &source.FeedTitle, &source.URL,
+			&source.PublishedAt, &source.Read, &hash); err != nil {
+			return err
+		}
+		group := &groups[byHash[hash]]
+		if source.ID != group.ID {
+			group.Sources = append(group.Sources, source)
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,175 @@
+package services
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+)
+
+// exportBatchSize is how many articles an export reads per query, so that no query runs
+// into the database timeout however many articles are exported
+const exportBatchSize = 500
+
+// Formats of article exports
+const (
+	ExportJSON = "json"
+	ExportCSV  = "csv"
+)
+
+// exportedArticle is an article as written by an export. Content is the full content of
+// the article's page when it was fetched, else the content from the feed.
+type exportedArticle struct {
+	ID          int       `json:"id"`
+	FeedID      int       `json:"feed_id"`
+	FeedTitle   string    `json:"feed_title"`
+	Title       string    `json:"title"`
+	URL         string    `json:"url"`
+	Author      string    `json:"author"`
+	PublishedAt time.Time `json:"published_at"`
+	Read        bool      `json:"read"`
+	Saved       bool      `json:"saved"`
+	Content     string    `json:"content"`
+}
+
+var exportCSVHeader = []string{"id", "feed_id", "feed_title", "title", "url", "author", "published_at", "read", "saved", "content"}
+
+// ArticleExport writes a user's articles as a JSON array or CSV file, in the order they
+// were stored. Articles are read in batches while the file is written, so exports of any
+// size take little memory.
+type ArticleExport struct {
+	as          *ArticleService
+	userID      int
+	format      string
+	feedID      *int
+	read, saved *bool
+}
+
+// ExportArticles prepares an export of the articles of a user matching the filters, as
+// for GetArticles. Nothing is read until it is written.
+func (as *ArticleService) ExportArticles(userID int, format string, feedID *int, read, saved *bool) (*ArticleExport, error) {
+	if format != ExportJSON && format != ExportCSV {
+		return nil, invalidField("format", "must be json or csv")
+	}
+	return &ArticleExport{as: as, userID: userID, format: format, feedID: feedID, read: read, saved: saved}, nil
+}
+
+// ContentType is the media type of the export
+func (e *ArticleExport) ContentType() string {
+	if e.format == ExportCSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/json"
+}
+
+// WriteTo writes the export to w
+func (e *ArticleExport) WriteTo(w io.Writer) (int64, error) {
+	counter := &countingWriter{w: w}
+	var csvWriter *csv.Writer
+	if e.format == ExportCSV {
+		csvWriter = csv.NewWriter(counter)
+		if err := csvWriter.Write(exportCSVHeader); err != nil {
+			return counter.n, err
+		}
+	} else if _, err := io.WriteString(counter, "["); err != nil {
+		return counter.n, err
+	}
+
+	afterID, written := 0, 0
+	for {
+		articles, err := e.batch(afterID)
+		if err != nil {
+			return counter.n, err
+		}
+
+		for _, article := range articles {
+			if csvWriter != nil {
+				err = csvWriter.Write([]string{
+					strconv.Itoa(article.ID), strconv.Itoa(article.FeedID), article.FeedTitle, article.Title,
+					article.URL, article.Author, article.PublishedAt.UTC().Format(time.RFC3339),
+					strconv.FormatBool(article.Read), strconv.FormatBool(article.Saved), article.Content,
+				})
+			} else {
+				err = e.writeJSON(counter, &article, written == 0)
+			}
+			if err != nil {
+				return counter.n, err
+			}
+			written++
+		}
+
+		if csvWriter != nil {
+			csvWriter.Flush()
+			if err := csvWriter.Error(); err != nil {
+				return counter.n, err
+			}
+		}
+		if len(articles) < exportBatchSize {
+			break
+		}
+		afterID = articles[len(articles)-1].ID
+	}
+
+	if csvWriter == nil {
+		if _, err := io.WriteString(counter, "\n]\n"); err != nil {
+			return counter.n, err
+		}
+	}
+	return counter.n, nil
+}
+
+func (e *ArticleExport) writeJSON(w io.Writer, article *exportedArticle, first bool) error {
+	separator := ",\n"
+	if first {
+		separator = "\n"
+	}
+	data, err := json.Marshal(article)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, separator); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// batch reads the next articles of the export after the article with ID afterID
+func (e *ArticleExport) batch(afterID int) ([]exportedArticle, error) {
+	filter, filterArgs := articleFilter("a", e.feedID, e.read, e.saved)
+	query := `
+		SELECT a.id, a.feed_id, COALESCE(f.title, ''), a.title, COALESCE(a.url, ''), COALESCE(a.author, ''),
+		       a.published_at, COALESCE(a_st.read, false), COALESCE(a_st.saved, false),
+		       COALESCE(NULLIF(a.full_content, ''), a.content, '')
+		FROM articles a` + userArticles("a") + `
+		JOIN feeds f ON f.id = a.feed_id
+		WHERE a.id > ?` + filter + `
+		ORDER BY a.id LIMIT ?
+	`
+	args := append([]interface{}{e.userID, afterID}, filterArgs...)
+	args = append(args, exportBatchSize)
+
+	rows, err := e.as.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	articles := make([]exportedArticle, 0, exportBatchSize)
+	for rows.Next() {
+		var article exportedArticle
+		err := rows.Scan(&article.ID, &article.FeedID, &article.FeedTitle, &article.Title, &article.URL,
+			&article.Author, &article.PublishedAt, &article.Read, &article.Saved, &article.Content)
+		if err != nil {
+			return nil, err
+		}
+		articles = append(articles, article)
+	}
+	return articles, rows.Err()
+}
+
+// Filename is the name the export is downloaded as
+func (e *ArticleExport) Filename() string {
+	return "myfeed_articles_" + time.Now().Format("2006-01-02_15-04-05") + "." + e.format
+}
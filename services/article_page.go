@@ -0,0 +1,76 @@
+package services
+
+import (
+	"encoding/base64"
+	"fmt"
+	"myfeed/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// encodeArticleCursor returns the cursor of the page after an article: its publication
+// time and ID, which the list is ordered by
+func encodeArticleCursor(article *models.Article) string {
+	key := strconv.FormatInt(article.PublishedAt.UnixNano(), 10) + ":" + strconv.Itoa(article.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func decodeArticleCursor(cursor string) (time.Time, int, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, invalidField("cursor", "invalid cursor")
+	}
+	nanos, id, ok := strings.Cut(string(key), ":")
+	publishedAt, errTime := strconv.ParseInt(nanos, 10, 64)
+	articleID, errID := strconv.Atoi(id)
+	if !ok || errTime != nil || errID != nil {
+		return time.Time{}, 0, invalidField("cursor", "invalid cursor")
+	}
+	return time.Unix(0, publishedAt).UTC(), articleID, nil
+}
+
+// GetArticlePage lists articles like GetArticles, newest first, with the number of
+// matching articles and the cursor of the next page. The page after a cursor starts right
+// after the article it was taken from, so deep pages stay fast and do not shift when new
+// articles arrive; without a cursor, offset skips articles as before.
+func (as *ArticleService) GetArticlePage(userID int, feedID *int, read, saved *bool, limit, offset int, cursor string) (*models.ArticlePage, error) {
+	filter, filterArgs := articleFilter("a", feedID, read, saved)
+	from := ` FROM articles a` + userArticles("a")
+	where := ` WHERE 1=1` + filter
+	args := append([]interface{}{userID}, filterArgs...)
+
+	page := &models.ArticlePage{Items: []models.Article{}}
+	if err := as.db.QueryRow(`SELECT COUNT(*)`+from+where, args...).Scan(&page.Total); err != nil {
+		return nil, fmt.Errorf("failed to count articles: %v", err)
+	}
+
+	query := `SELECT ` + articleListColumns + from + `
+		LEFT JOIN enclosures e ON e.article_id = a.id` + where
+	if cursor != "" {
+		publishedAt, id, err := decodeArticleCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		query += " AND (a.published_at < ? OR (a.published_at = ? AND a.id < ?))"
+		args = append(args, publishedAt, publishedAt, id)
+		offset = 0
+	}
+	query += " ORDER BY a.published_at DESC, a.id DESC LIMIT ? OFFSET ?"
+	// One more than the page shows whether there is a next page
+	args = append(args, limit+1, offset)
+
+	articles, err := as.queryArticles(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(articles) > limit {
+		articles = articles[:limit]
+		next := encodeArticleCursor(&articles[limit-1])
+		page.NextCursor = &next
+	}
+	if articles != nil {
+		page.Items = articles
+	}
+	return page, nil
+}
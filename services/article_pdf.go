@@ -0,0 +1,78 @@
+package services
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// htmlHiddenBlocks matches elements whose text is not part of the article
+var htmlHiddenBlocks = regexp.MustCompile(`(?is)<(script|style|noscript)\b.*?</(script|style|noscript)\s*>`)
+
+var (
+	pdfTitleStyle  = pdfStyle{font: pdfHelveticaBold, size: 18, leading: 23}
+	pdfMetaStyle   = pdfStyle{font: pdfHelvetica, size: 9, leading: 13, gray: 0.35}
+	pdfBodyStyle   = pdfStyle{font: pdfHelvetica, size: 11, leading: 15.5}
+	pdfFooterStyle = pdfStyle{font: pdfHelvetica, size: 8, leading: 10, gray: 0.45}
+)
+
+// ArticlePDF renders an article as an A4 PDF for archiving: the title, the feed, author
+// and date it was published with, in the user's timezone, a link to the original, and the
+// content as plain text. Every page names the source in its footer. It returns sql.ErrNoRows for articles of
+// feeds the user does not subscribe to.
+func (as *ArticleService) ArticlePDF(userID, articleID int) ([]byte, error) {
+	article, err := as.GetArticleByID(userID, articleID)
+	if err != nil {
+		return nil, err
+	}
+	var feedTitle string
+	if err := as.db.QueryRow(`SELECT title FROM feeds WHERE id = ?`, article.FeedID).Scan(&feedTitle); err != nil {
+		return nil, err
+	}
+	loc, err := userLocation(as.db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	title := strings.TrimSpace(article.Title)
+	if title == "" {
+		title = "Untitled article"
+	}
+	doc := newPDFDocument(title)
+	doc.paragraph(title, pdfTitleStyle)
+	doc.space(4)
+
+	meta := []string{feedTitle}
+	if article.Author != "" {
+		meta = append(meta, article.Author)
+	}
+	meta = append(meta, article.PublishedAt.In(loc).Format("January 2, 2006 15:04 MST"))
+	doc.paragraph(strings.Join(meta, " · "), pdfMetaStyle)
+	if article.URL != "" {
+		doc.link(article.URL, article.URL, pdfMetaStyle)
+	}
+	doc.rule()
+
+	text := htmlToText(htmlHiddenBlocks.ReplaceAllString(article.Content, ""))
+	if text == "" {
+		text = "This article has no content in the feed."
+	}
+	for _, block := range strings.Split(text, "\n\n") {
+		for _, line := range strings.Split(block, "\n") {
+			doc.paragraph(line, pdfBodyStyle)
+		}
+		doc.space(pdfBodyStyle.leading / 2)
+	}
+	if article.ContentTruncated {
+		doc.paragraph("The content was shortened to the size limit of this server; the full article is at the link above.", pdfMetaStyle)
+	}
+
+	source := feedTitle
+	if article.URL != "" {
+		source += " – " + article.URL
+	}
+	doc.footer(pdfFooterStyle, func(page, pages int) (string, string) {
+		return "Source: " + source, "Page " + strconv.Itoa(page) + " of " + strconv.Itoa(pages)
+	})
+	return doc.Bytes()
+}
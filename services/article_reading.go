@@ -0,0 +1,175 @@
+package services
+
+import (
+	"context"
+	"myfeed/models"
+	"sort"
+	"time"
+)
+
+// recordRead stores when a user first opened an article. Reading it again after marking
+// it unread keeps the first time, so every article counts once.
+func (as *ArticleService) recordRead(userID, articleID, feedID int, publishedAt, readAt time.Time) error {
+	_, err := as.db.Exec(`
+		INSERT INTO read_events (user_id, article_id, feed_id, published_at, read_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, article_id) DO NOTHING
+	`, userID, articleID, feedID, publishedAt, readAt)
+	return err
+}
+
+// GetReadingStats summarizes the articles a user opened in the last days calendar days in loc,
+// today included: the count per day and per week, oldest first, the feeds read most (at
+// most feedLimit) and the average time from publication to opening. Streaks count days
+// with reads over the whole history; today without reads yet does not break the current
+// streak. Marking articles read in bulk is not reading them and is not counted.
+func (as *ArticleService) GetReadingStats(ctx context.Context, userID int, loc *time.Location, days, feedLimit int) (*models.ReadingStats, error) {
+	now := time.Now().In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	start := today.AddDate(0, 0, -(days - 1))
+
+	stats := &models.ReadingStats{
+		Timezone:     loc.String(),
+		Days:         days,
+		PerDay:       make([]models.ReadingDay, 0, days),
+		PerWeek:      []models.ReadingDay{},
+		BusiestFeeds: []models.ReadingFeed{},
+	}
+	dayIndex := make(map[string]int, days)
+	for day := start; !day.After(today); day = day.AddDate(0, 0, 1) {
+		date := day.Format(time.DateOnly)
+		dayIndex[date] = len(stats.PerDay)
+		stats.PerDay = append(stats.PerDay, models.ReadingDay{Date: date})
+	}
+	weekIndex := make(map[string]int)
+	for week := startOfWeek(start); !week.After(today); week = week.AddDate(0, 0, 7) {
+		date := week.Format(time.DateOnly)
+		weekIndex[date] = len(stats.PerWeek)
+		stats.PerWeek = append(stats.PerWeek, models.ReadingDay{Date: date})
+	}
+
+	rows, err := as.db.QueryContext(ctx, `
+		SELECT e.feed_id, f.title, e.published_at, e.read_at
+		FROM read_events e JOIN feeds f ON f.id = e.feed_id
+		WHERE e.user_id = ? AND e.read_at >= ?
+	`, userID, start.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	feeds := make(map[int]*models.ReadingFeed)
+	var waited time.Duration
+	for rows.Next() {
+		var feed models.ReadingFeed
+		var publishedAt, readAt time.Time
+		if err := rows.Scan(&feed.FeedID, &feed.FeedTitle, &publishedAt, &readAt); err != nil {
+			return nil, err
+		}
+
+		read := readAt.In(loc)
+		i, ok := dayIndex[read.Format(time.DateOnly)]
+		if !ok {
+			continue
+		}
+		stats.TotalRead++
+		stats.PerDay[i].Count++
+		stats.PerWeek[weekIndex[startOfWeek(read).Format(time.DateOnly)]].Count++
+
+		if feeds[feed.FeedID] == nil {
+			feeds[feed.FeedID] = &feed
+		}
+		feeds[feed.FeedID].Count++
+
+		// Articles dated after they were read were opened right away
+		if readAt.After(publishedAt) {
+			waited += readAt.Sub(publishedAt)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if stats.TotalRead > 0 {
+		average := int64((waited / time.Duration(stats.TotalRead)).Seconds())
+		stats.AverageTimeToRead = &average
+	}
+
+	for _, feed := range feeds {
+		stats.BusiestFeeds = append(stats.BusiestFeeds, *feed)
+	}
+	sort.Slice(stats.BusiestFeeds, func(i, j int) bool {
+		a, b := stats.BusiestFeeds[i], stats.BusiestFeeds[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.FeedTitle < b.FeedTitle
+	})
+	if len(stats.BusiestFeeds) > feedLimit {
+		stats.BusiestFeeds = stats.BusiestFeeds[:feedLimit]
+	}
+
+	stats.CurrentStreak, stats.LongestStreak, err = as.readingStreaks(ctx, userID, loc, today)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// readingStreaks returns the number of consecutive days with reads up to today, or up to
+// yesterday while today has none, and the longest such run ever
+func (as *ArticleService) readingStreaks(ctx context.Context, userID int, loc *time.Location, today time.Time) (current, longest int, err error) {
+	rows, err := as.db.QueryContext(ctx, `SELECT read_at FROM read_events WHERE user_id = ?`, userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	readDays := make(map[string]bool)
+	for rows.Next() {
+		var readAt time.Time
+		if err := rows.Scan(&readAt); err != nil {
+			return 0, 0, err
+		}
+		readDays[readAt.In(loc).Format(time.DateOnly)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	day := today
+	if !readDays[day.Format(time.DateOnly)] {
+		day = day.AddDate(0, 0, -1)
+	}
+	for readDays[day.Format(time.DateOnly)] {
+		current++
+		day = day.AddDate(0, 0, -1)
+	}
+
+	dates := make([]string, 0, len(readDays))
+	for date := range readDays {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+	run := 0
+	var previous time.Time
+	for _, date := range dates {
+		day, _ := time.Parse(time.DateOnly, date)
+		if run > 0 && previous.AddDate(0, 0, 1).Equal(day) {
+			run++
+		} else {
+			run = 1
+		}
+		if run > longest {
+			longest = run
+		}
+		previous = day
+	}
+	return current, longest, nil
+}
+
+// startOfWeek returns midnight of the Monday of the week containing t, in t's location
+func startOfWeek(t time.Time) time.Time {
+	offset := (int(t.Weekday()) + 6) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"context"
+	"myfeed/models"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// riverSummaryLength is how many characters of plain text a river summary keeps
+const riverSummaryLength = 240
+
+// riverContentLength is how much of the content is read to build a summary. It leaves room
+// for markup, which is stripped.
+const riverContentLength = 2000
+
+// GetRiver returns a user's unread articles of the last days, grouped by the calendar day they
+// were published on in loc, newest first. Every day of the window is listed, also without
+// articles. Each day keeps at most perDay articles but counts all of them; articles dated
+// in the future are counted as today.
+func (as *ArticleService) GetRiver(ctx context.Context, userID int, loc *time.Location, days, perDay int) (*models.River, error) {
+	now := time.Now().In(loc)
+	start := time.Date(now.Year(), now.Month(), now.Day()-(days-1), 0, 0, 0, 0, loc)
+
+	river := &models.River{Timezone: loc.String(), Days: make([]models.RiverDay, 0, days)}
+	dayIndex := make(map[string]int, days)
+	for i := 0; i < days; i++ {
+		date := time.Date(now.Year(), now.Month(), now.Day()-i, 0, 0, 0, 0, loc).Format(time.DateOnly)
+		dayIndex[date] = i
+		river.Days = append(river.Days, models.RiverDay{Date: date, Articles: []models.RiverItem{}})
+	}
+
+	query := `
+		SELECT a.id, a.feed_id, f.title, a.title, a.url, a.author, a.published_at,
+		       COALESCE(SUBSTR(a.content, 1, ?), '')
+		FROM articles a JOIN feeds f ON f.id = a.feed_id` + userArticles("a") + `
+		WHERE COALESCE(a_st.read, false) = ? AND a.published_at >= ?
+		ORDER BY a.published_at DESC
+	`
+	rows, err := as.db.QueryContext(ctx, query, riverContentLength, userID, false, start.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.RiverItem
+		var content string
+		if err := rows.Scan(&item.ID, &item.FeedID, &item.FeedTitle, &item.Title, &item.URL,
+			&item.Author, &item.PublishedAt, &content); err != nil {
+			return nil, err
+		}
+
+		published := item.PublishedAt.In(loc)
+		if published.After(now) {
+			published = now
+		}
+		i, ok := dayIndex[published.Format(time.DateOnly)]
+		if !ok {
+			continue
+		}
+		day := &river.Days[i]
+		day.Count++
+		if len(day.Articles) < perDay {
+			item.Summary = riverSummary(content)
+			day.Articles = append(day.Articles, item)
+		}
+	}
+
+	return river, rows.Err()
+}
+
+// riverSummary reduces the start of an article's content to one line of plain text, cut
+// at a word boundary
+func riverSummary(content string) string {
+	// The content was cut off, possibly inside a tag that htmlToText cannot recognize
+	if open := strings.LastIndex(content, "<"); open > strings.LastIndex(content, ">") {
+		content = content[:open]
+	}
+	text := strings.Join(strings.Fields(htmlToText(content)), " ")
+	if utf8.RuneCountInString(text) <= riverSummaryLength {
+		return text
+	}
+
+	cut := []rune(text)[:riverSummaryLength]
+	if space := strings.LastIndex(string(cut), " "); space > 0 {
+		return string(cut)[:space] + "…"
+	}
+	return string(cut) + "…"
+}
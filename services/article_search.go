@@ -0,0 +1,183 @@
+package services
+
+import (
+	"context"
+	"myfeed/models"
+	"strings"
+	"unicode"
+)
+
+// searchTerm is a word or quoted phrase of a search, which excluded terms must not match
+type searchTerm struct {
+	text     string
+	phrase   bool
+	excluded bool
+}
+
+// parseSearch splits a search the way web search engines do: words must all match,
+// "quoted phrases" match as a whole, OR between two terms matches either and a leading
+// minus excludes a term. Each element of the result is a group of alternatives joined
+// by OR.
+func parseSearch(search string) [][]searchTerm {
+	var groups [][]searchTerm
+	or := false
+	for rest := strings.TrimSpace(search); rest != ""; rest = strings.TrimSpace(rest) {
+		var term searchTerm
+		if strings.HasPrefix(rest, "-") {
+			term.excluded = true
+			rest = rest[1:]
+		}
+
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				// An unterminated quote runs to the end
+				end = len(rest) - 1
+			}
+			term.text, term.phrase = rest[1:end+1], true
+			rest = rest[min(end+2, len(rest)):]
+		} else {
+			end := strings.IndexFunc(rest, unicode.IsSpace)
+			if end < 0 {
+				end = len(rest)
+			}
+			term.text, rest = rest[:end], rest[end:]
+		}
+
+		if !term.phrase && !term.excluded && term.text == "OR" {
+			or = len(groups) > 0
+			continue
+		}
+		// Terms of punctuation alone match nothing
+		if strings.IndexFunc(term.text, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }) < 0 {
+			or = false
+			continue
+		}
+
+		if or && !term.excluded {
+			last := len(groups) - 1
+			if !groups[last][0].excluded {
+				groups[last] = append(groups[last], term)
+				or = false
+				continue
+			}
+		}
+		groups = append(groups, []searchTerm{term})
+		or = false
+	}
+	return groups
+}
+
+// fts5Query writes a parsed search as an FTS5 query. Every term is quoted, so characters
+// with a meaning in FTS5 queries are searched for as they are. It returns an empty string
+// when nothing is left to match, like a search of excluded terms only.
+func fts5Query(groups [][]searchTerm) string {
+	var required, excluded []string
+	for _, group := range groups {
+		alternatives := make([]string, len(group))
+		for i, term := range group {
+			alternatives[i] = `"` + strings.ReplaceAll(term.text, `"`, `""`) + `"`
+		}
+		if group[0].excluded {
+			excluded = append(excluded, alternatives[0])
+		} else if len(alternatives) > 1 {
+			required = append(required, "("+strings.Join(alternatives, " OR ")+")")
+		} else {
+			required = append(required, alternatives[0])
+		}
+	}
+	if len(required) == 0 {
+		return ""
+	}
+
+	query := "(" + strings.Join(required, " AND ") + ")"
+	for _, term := range excluded {
+		query += " NOT " + term
+	}
+	return query
+}
+
+// SearchArticles finds the articles of a user's feeds whose title, content or author
+// match a search, optionally only in the given feeds. Words must all match; "quoted
+// phrases", OR and -excluded terms work as in web search engines. With a full-text index
+// the best matches come first, matches in the title counting most; otherwise, as on
+// SQLite built without FTS5, every article is scanned with LIKE for the search as a
+// whole and the newest come first. The search is bounded by ctx (usually the request
+// context) and the database query timeout, so an expensive query is abandoned instead of
+// running on.
+func (as *ArticleService) SearchArticles(ctx context.Context, userID int, search string, feedIDs []int, limit, offset int) ([]models.Article, error) {
+	if feedIDs != nil && len(feedIDs) == 0 {
+		return []models.Article{}, nil
+	}
+
+	const columns = `a.id, a.feed_id, a.title, a.content, a.url, a.author,
+		       a.published_at, COALESCE(a_st.read, false), COALESCE(a_st.saved, false), a.content_truncated, a.created_at`
+	var query string
+	var args []interface{}
+	switch {
+	case !as.db.FullTextSearch():
+		query = `
+			SELECT ` + columns + `
+			FROM articles a` + userArticles("a") + `
+			WHERE (a.title LIKE ? OR a.content LIKE ? OR a.author LIKE ?)`
+		pattern := "%" + strings.ToLower(search) + "%"
+		args = []interface{}{userID, pattern, pattern, pattern}
+	case as.db.IsPostgreSQL():
+		query = `
+			SELECT ` + columns + `
+			FROM articles a` + userArticles("a") + `
+			CROSS JOIN websearch_to_tsquery('simple', ?) q
+			WHERE a.search_vector @@ q`
+		args = []interface{}{userID, search}
+	default:
+		match := fts5Query(parseSearch(search))
+		if match == "" {
+			return nil, invalidField("q", "search for at least one word that is not excluded")
+		}
+		query = `
+			SELECT ` + columns + `
+			FROM articles_fts JOIN articles a ON a.id = articles_fts.rowid` + userArticles("a") + `
+			WHERE articles_fts MATCH ?`
+		args = []interface{}{userID, match}
+	}
+
+	if feedIDs != nil {
+		query += " AND a.feed_id IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(feedIDs)), ", ") + ")"
+		for _, id := range feedIDs {
+			args = append(args, id)
+		}
+	}
+
+	switch {
+	case !as.db.FullTextSearch():
+		query += " ORDER BY a.published_at DESC"
+	case as.db.IsPostgreSQL():
+		query += " ORDER BY ts_rank_cd(a.search_vector, q) DESC, a.published_at DESC"
+	default:
+		// bm25 ranks better matches lower; the weights follow the columns of articles_fts
+		query += " ORDER BY bm25(articles_fts, 10.0, 1.0, 5.0), a.published_at DESC"
+	}
+	query += " LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := as.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	articles := []models.Article{}
+	for rows.Next() {
+		article := models.Article{}
+		err := rows.Scan(
+			&article.ID, &article.FeedID, &article.Title, &article.Content, &article.URL,
+			&article.Author, &article.PublishedAt, &article.Read, &article.Saved, &article.ContentTruncated, &article.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		articles = append(articles, article)
+	}
+
+	return articles, rows.Err()
+}
@@ -1,48 +1,66 @@
 package services
 
 import (
+	"database/sql"
 	"fmt"
 	"myfeed/database"
 	"myfeed/models"
 	"strings"
+	"sync"
+	"time"
 )
 
 type ArticleService struct {
-	db *database.DB
+	db           *database.DB
+	statsService *FeedStatsService
+
+	mu               sync.RWMutex
+	savedSubscribers []func(userID int, article *models.Article)
+}
+
+func NewArticleService(db *database.DB, statsService *FeedStatsService) *ArticleService {
+	return &ArticleService{
+		db:           db,
+		statsService: statsService,
+	}
 }
 
-func NewArticleService(db *database.DB) *ArticleService {
-	return &ArticleService{db: db}
+// userArticles joins the articles table alias to the subscription of a user, as alias_s,
+// and to the user's state of each article, as alias_st. Articles of feeds the user does
+// not subscribe to drop out, as do those a rule of the user deleted; articles without a
+// state are unread and not saved. The join takes the user ID as its argument.
+func userArticles(alias string) string {
+	return fmt.Sprintf(`
+		JOIN subscriptions %[1]s_s ON %[1]s_s.feed_id = %[1]s.feed_id AND %[1]s_s.user_id = ?
+			AND NOT EXISTS (
+				SELECT 1 FROM article_states %[1]s_h
+				WHERE %[1]s_h.article_id = %[1]s.id AND %[1]s_h.user_id = %[1]s_s.user_id AND %[1]s_h.hidden = true
+			)
+		LEFT JOIN article_states %[1]s_st ON %[1]s_st.article_id = %[1]s.id AND %[1]s_st.user_id = %[1]s_s.user_id`, alias)
 }
 
-func (as *ArticleService) GetArticles(feedID *int, read *bool, saved *bool, limit, offset int) ([]models.Article, error) {
+func (as *ArticleService) GetArticles(userID int, feedID *int, read *bool, saved *bool, limit, offset int) ([]models.Article, error) {
+	filter, args := articleFilter("a", feedID, read, saved)
 	query := `
-		SELECT a.id, a.feed_id, a.title, a.content, a.url, a.author, 
-		       a.published_at, a.read, a.saved, a.created_at
-		FROM articles a
-		WHERE 1=1
-	`
-	
-	var args []interface{}
+		SELECT ` + articleListColumns + `
+		FROM articles a` + userArticles("a") + `
+		LEFT JOIN enclosures e ON e.article_id = a.id
+		WHERE 1=1` + filter
+	args = append([]interface{}{userID}, args...)
 	
-	if feedID != nil {
-		query += " AND a.feed_id = ?"
-		args = append(args, *feedID)
-	}
-	
-	if read != nil {
-		query += " AND a.read = ?"
-		args = append(args, *read)
-	}
-	
-	if saved != nil {
-		query += " AND a.saved = ?"
-		args = append(args, *saved)
-	}
-	
-	query += " ORDER BY a.published_at DESC LIMIT ? OFFSET ?"
+	query += " ORDER BY a.published_at DESC, a.id DESC LIMIT ? OFFSET ?"
 	args = append(args, limit, offset)
+	return as.queryArticles(query, args...)
+}
+
+// articleListColumns are the columns of articles in lists, read by queryArticles. They
+// need the enclosures joined as e.
+const articleListColumns = `a.id, a.feed_id, a.title, a.content, a.url, a.author,
+	a.published_at, COALESCE(a_st.read, false), COALESCE(a_st.saved, false), a.content_truncated, a.created_at,
+	COALESCE(e.url, ''), COALESCE(e.type, ''), COALESCE(e.length, 0), COALESCE(e.file, '') <> ''`
 
+// queryArticles runs a query selecting articleListColumns
+func (as *ArticleService) queryArticles(query string, args ...interface{}) ([]models.Article, error) {
 	rows, err := as.db.Query(query, args...)
 	if err != nil {
 		return nil, err
@@ -52,121 +70,349 @@ func (as *ArticleService) GetArticles(feedID *int, read *bool, saved *bool, limi
 	var articles []models.Article
 	for rows.Next() {
 		article := models.Article{}
+		enclosure := models.Enclosure{}
 		err := rows.Scan(
 			&article.ID, &article.FeedID, &article.Title, &article.Content, &article.URL,
-			&article.Author, &article.PublishedAt, &article.Read, &article.Saved, &article.CreatedAt,
+			&article.Author, &article.PublishedAt, &article.Read, &article.Saved, &article.ContentTruncated, &article.CreatedAt,
+			&enclosure.URL, &enclosure.Type, &enclosure.Length, &enclosure.Cached,
 		)
 		if err != nil {
 			return nil, err
 		}
+		if enclosure.URL != "" {
+			enclosure.ArticleID = article.ID
+			article.Enclosure = &enclosure
+		}
 		articles = append(articles, article)
 	}
 	
-	return articles, nil
+	return articles, rows.Err()
 }
 
-func (as *ArticleService) GetArticleByID(id int) (*models.Article, error) {
+// GetArticleByID returns an article of a feed the user subscribes to, or sql.ErrNoRows
+func (as *ArticleService) GetArticleByID(userID, id int) (*models.Article, error) {
 	query := `
 		SELECT a.id, a.feed_id, a.title, a.content, a.url, a.author, 
-		       a.published_at, a.read, a.saved, a.created_at
-		FROM articles a
+		       a.published_at, COALESCE(a_st.read, false), COALESCE(a_st.saved, false), a.content_truncated, a.created_at,
+		       COALESCE(a.full_content, '')
+		FROM articles a` + userArticles("a") + `
 		WHERE a.id = ?
 	`
 	
 	article := &models.Article{}
-	err := as.db.QueryRow(query, id).Scan(
+	err := as.db.QueryRow(query, userID, id).Scan(
 		&article.ID, &article.FeedID, &article.Title, &article.Content, &article.URL,
-		&article.Author, &article.PublishedAt, &article.Read, &article.Saved, &article.CreatedAt,
+		&article.Author, &article.PublishedAt, &article.Read, &article.Saved, &article.ContentTruncated, &article.CreatedAt,
+		&article.FullContent,
 	)
 	
 	if err != nil {
 		return nil, err
 	}
+
+	enclosure, _, err := getEnclosure(as.db, id)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	article.Enclosure = enclosure
+
+	article.Tags, err = as.articleTags(userID, id)
+	if err != nil {
+		return nil, err
+	}
 	
 	return article, nil
 }
 
-func (as *ArticleService) MarkAsRead(articleID int, read bool) error {
-	query := `UPDATE articles SET read = ? WHERE id = ?`
-	_, err := as.db.Exec(query, read, articleID)
-	return err
+func (as *ArticleService) MarkAsRead(userID, articleID int, read bool) error {
+	var feedID int
+	var currentlyRead bool
+	var publishedAt time.Time
+	err := as.db.QueryRow(`
+		SELECT a.feed_id, COALESCE(a_st.read, false), a.published_at
+		FROM articles a`+userArticles("a")+`
+		WHERE a.id = ?
+	`, userID, articleID).Scan(&feedID, &currentlyRead, &publishedAt)
+	if err != nil {
+		return err
+	}
+
+	if currentlyRead == read {
+		return nil
+	}
+
+	var readAt *time.Time
+	if read {
+		now := time.Now().UTC()
+		readAt = &now
+	}
+
+	// Only a request that changes the state adjusts the unread count, so concurrent
+	// requests for the same article count it once
+	query := `
+		INSERT INTO article_states (user_id, article_id, read, read_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, article_id) DO UPDATE SET read = excluded.read, read_at = excluded.read_at
+		WHERE article_states.read <> excluded.read
+	`
+	result, err := as.db.Exec(query, userID, articleID, read, readAt)
+	if err != nil {
+		return err
+	}
+	if changed, err := result.RowsAffected(); err != nil || changed == 0 {
+		return err
+	}
+
+	delta := 1
+	if read {
+		delta = -1
+	}
+	if err := as.statsService.AdjustUnread(userID, feedID, delta); err != nil {
+		articleLog.Error("Failed to update unread count", "feed_id", feedID, "error", err)
+	}
+
+	// Reading an article one by one (unlike mark-all-read) shows interest in the feed
+	if read {
+		if err := as.statsService.RecordOpened(feedID); err != nil {
+			articleLog.Error("Failed to record engagement", "feed_id", feedID, "error", err)
+		}
+		if err := as.recordRead(userID, articleID, feedID, publishedAt, *readAt); err != nil {
+			articleLog.Error("Failed to record read event", "article_id", articleID, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// MarkAsSaved saves or unsaves an article of a feed the user follows, or returns
+// sql.ErrNoRows if there is no such article
+func (as *ArticleService) MarkAsSaved(userID, articleID int, saved bool) error {
+	var savedAt *time.Time
+	if saved {
+		now := time.Now().UTC()
+		savedAt = &now
+	}
+
+	// Only articles of subscribed feeds get a state, and unchanged states are skipped so
+	// saving twice does not move saved_at
+	query := `
+		INSERT INTO article_states (user_id, article_id, saved, saved_at)
+		SELECT s.user_id, a.id, ?, ?
+		FROM articles a JOIN subscriptions s ON s.feed_id = a.feed_id AND s.user_id = ?
+		WHERE a.id = ?
+		ON CONFLICT (user_id, article_id) DO UPDATE SET saved = excluded.saved, saved_at = excluded.saved_at
+		WHERE article_states.saved <> excluded.saved
+	`
+	result, err := as.db.Exec(query, saved, savedAt, userID, articleID)
+	if err != nil {
+		return err
+	}
+
+	changed, err := result.RowsAffected()
+	if err == nil && changed == 0 {
+		// Nothing changed: the state was already set, or the article is not the user's
+		var count int
+		visible := `SELECT COUNT(*) FROM articles a JOIN subscriptions s ON s.feed_id = a.feed_id AND s.user_id = ? WHERE a.id = ?`
+		if err := as.db.QueryRow(visible, userID, articleID).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 {
+			return sql.ErrNoRows
+		}
+	}
+	if err == nil && changed > 0 && saved {
+		article, err := as.GetArticleByID(userID, articleID)
+		if err != nil {
+			articleLog.Error("Failed to load saved article", "article_id", articleID, "error", err)
+			return nil
+		}
+		as.notifySaved(userID, article)
+	}
+	return nil
 }
 
-func (as *ArticleService) MarkAsSaved(articleID int, saved bool) error {
-	query := `UPDATE articles SET saved = ? WHERE id = ?`
-	_, err := as.db.Exec(query, saved, articleID)
-	return err
+// SubscribeSaved registers fn to be called with the user who saved an article. Saving an
+// article that is already saved does not call it again.
+func (as *ArticleService) SubscribeSaved(fn func(userID int, article *models.Article)) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.savedSubscribers = append(as.savedSubscribers, fn)
 }
 
-func (as *ArticleService) MarkAllAsRead(feedID *int) error {
-	query := `UPDATE articles SET read = true WHERE 1=1`
-	var args []interface{}
+func (as *ArticleService) notifySaved(userID int, article *models.Article) {
+	as.mu.RLock()
+	subscribers := as.savedSubscribers
+	as.mu.RUnlock()
+
+	for _, fn := range subscribers {
+		fn(userID, article)
+	}
+}
+
+// MarkAllAsRead marks the articles of one or all of the user's feeds read. Articles the
+// user has no state for yet get one.
+func (as *ArticleService) MarkAllAsRead(userID int, feedID *int) error {
+	now := time.Now().UTC()
+	query := `UPDATE article_states SET read = true, read_at = ? WHERE user_id = ? AND read = false`
+	args := []interface{}{now, userID}
 	
 	if feedID != nil {
-		query += " AND feed_id = ?"
+		query += " AND article_id IN (SELECT id FROM articles WHERE feed_id = ?)"
 		args = append(args, *feedID)
 	}
 	
 	_, err := as.db.Exec(query, args...)
-	return err
-}
+	if err != nil {
+		return err
+	}
 
-func (as *ArticleService) SearchArticles(searchQuery string, limit, offset int) ([]models.Article, error) {
-	query := `
-		SELECT a.id, a.feed_id, a.title, a.content, a.url, a.author, 
-		       a.published_at, a.read, a.saved, a.created_at
-		FROM articles a
-		WHERE a.title LIKE ? OR a.content LIKE ? OR a.author LIKE ?
-		ORDER BY a.published_at DESC 
-		LIMIT ? OFFSET ?
+	query = `
+		INSERT INTO article_states (user_id, article_id, read, read_at)
+		SELECT s.user_id, a.id, true, ?
+		FROM articles a JOIN subscriptions s ON s.feed_id = a.feed_id AND s.user_id = ?
+		WHERE NOT EXISTS (SELECT 1 FROM article_states st WHERE st.user_id = s.user_id AND st.article_id = a.id)
 	`
-	
-	searchPattern := "%" + strings.ToLower(searchQuery) + "%"
-	rows, err := as.db.Query(query, searchPattern, searchPattern, searchPattern, limit, offset)
-	if err != nil {
-		return nil, err
+	args = []interface{}{now, userID}
+	if feedID != nil {
+		query += " AND a.feed_id = ?"
+		args = append(args, *feedID)
+	}
+	if _, err := as.db.Exec(query, args...); err != nil {
+		return err
 	}
-	defer rows.Close()
 
-	var articles []models.Article
+	if err := as.statsService.ResetUnread(userID, feedID); err != nil {
+		articleLog.Error("Failed to reset unread counts", "error", err)
+	}
+
+	return nil
+}
+
+// maxMarkReadIDs caps the article IDs of one MarkRead
+const maxMarkReadIDs = 1000
+
+// MarkReadOptions select the articles MarkRead marks: those of FeedIDs (nil for every
+// feed), published before OlderThan if set, and only ArticleIDs if given
+type MarkReadOptions struct {
+	FeedIDs    []int
+	OlderThan  *time.Time
+	ArticleIDs []int
+}
+
+// MarkRead marks the user's unread articles matching opts read and returns how many were
+// marked. Unlike MarkAllAsRead the unread counters of the feeds concerned are recounted,
+// since only some of their articles may be marked.
+func (as *ArticleService) MarkRead(userID int, opts MarkReadOptions) (int, error) {
+	if len(opts.ArticleIDs) > maxMarkReadIDs {
+		return 0, invalidField("article_ids", "at most %d articles can be marked at once", maxMarkReadIDs)
+	}
+	if (opts.FeedIDs != nil && len(opts.FeedIDs) == 0) || (opts.ArticleIDs != nil && len(opts.ArticleIDs) == 0) {
+		return 0, nil
+	}
+
+	var condition strings.Builder
+	var args []interface{}
+	if opts.FeedIDs != nil {
+		condition.WriteString(" AND a.feed_id IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(opts.FeedIDs)), ", ") + ")")
+		for _, id := range opts.FeedIDs {
+			args = append(args, id)
+		}
+	}
+	if opts.OlderThan != nil {
+		condition.WriteString(" AND a.published_at < ?")
+		args = append(args, opts.OlderThan.UTC())
+	}
+	if opts.ArticleIDs != nil {
+		condition.WriteString(" AND a.id IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(opts.ArticleIDs)), ", ") + ")")
+		for _, id := range opts.ArticleIDs {
+			args = append(args, id)
+		}
+	}
+
+	// The feeds whose counters change, found before the articles are marked
+	rows, err := as.db.Query(`
+		SELECT DISTINCT a.feed_id FROM articles a`+userArticles("a")+`
+		WHERE COALESCE(a_st.read, false) = false`+condition.String(),
+		append([]interface{}{userID}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	var feedIDs []int
 	for rows.Next() {
-		article := models.Article{}
-		err := rows.Scan(
-			&article.ID, &article.FeedID, &article.Title, &article.Content, &article.URL,
-			&article.Author, &article.PublishedAt, &article.Read, &article.Saved, &article.CreatedAt,
-		)
-		if err != nil {
-			return nil, err
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
 		}
-		articles = append(articles, article)
+		feedIDs = append(feedIDs, id)
 	}
-	
-	return articles, nil
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(feedIDs) == 0 {
+		return 0, nil
+	}
+
+	now := time.Now().UTC()
+	subscribed := `
+		FROM articles a JOIN subscriptions s ON s.feed_id = a.feed_id AND s.user_id = ?
+		WHERE 1=1` + condition.String()
+	result, err := as.db.Exec(`
+		UPDATE article_states SET read = true, read_at = ?
+		WHERE user_id = ? AND read = false AND article_id IN (SELECT a.id `+subscribed+`)`,
+		append([]interface{}{now, userID, userID}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	updated, _ := result.RowsAffected()
+
+	result, err = as.db.Exec(`
+		INSERT INTO article_states (user_id, article_id, read, read_at)
+		SELECT s.user_id, a.id, true, ? `+subscribed+`
+		AND NOT EXISTS (SELECT 1 FROM article_states st WHERE st.user_id = s.user_id AND st.article_id = a.id)`,
+		append([]interface{}{now, userID}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	inserted, _ := result.RowsAffected()
+
+	for _, feedID := range feedIDs {
+		if err := as.statsService.RecountUnread(userID, feedID); err != nil {
+			articleLog.Error("Failed to recount unread articles", "feed_id", feedID, "error", err)
+		}
+	}
+	return int(updated + inserted), nil
 }
 
-func (as *ArticleService) GetStats() (*models.FeedStats, error) {
+// GetStats counts the feeds a user subscribes to and their articles
+func (as *ArticleService) GetStats(userID int) (*models.FeedStats, error) {
 	stats := &models.FeedStats{}
 	
 	// Get total feeds
-	err := as.db.QueryRow("SELECT COUNT(*) FROM feeds").Scan(&stats.TotalFeeds)
+	err := as.db.QueryRow("SELECT COUNT(*) FROM subscriptions WHERE user_id = ?", userID).Scan(&stats.TotalFeeds)
 	if err != nil {
 		return nil, err
 	}
 	
 	// Get total articles
-	err = as.db.QueryRow("SELECT COUNT(*) FROM articles").Scan(&stats.TotalArticles)
+	err = as.db.QueryRow("SELECT COUNT(*) FROM articles a JOIN subscriptions s ON s.feed_id = a.feed_id WHERE s.user_id = ?", userID).Scan(&stats.TotalArticles)
 	if err != nil {
 		return nil, err
 	}
 	
-	// Get unread articles
-	err = as.db.QueryRow("SELECT COUNT(*) FROM articles WHERE read = false").Scan(&stats.UnreadArticles)
+	// Get unread articles from the denormalized per-subscription counters
+	err = as.db.QueryRow("SELECT COALESCE(SUM(unread_count), 0) FROM subscriptions WHERE user_id = ?", userID).Scan(&stats.UnreadArticles)
 	if err != nil {
 		return nil, err
 	}
 	
 	// Get saved articles
-	err = as.db.QueryRow("SELECT COUNT(*) FROM articles WHERE saved = true").Scan(&stats.SavedArticles)
+	err = as.db.QueryRow(`
+		SELECT COUNT(*) FROM article_states st
+		JOIN articles a ON a.id = st.article_id
+		JOIN subscriptions s ON s.feed_id = a.feed_id AND s.user_id = st.user_id
+		WHERE st.user_id = ? AND st.saved = true
+	`, userID).Scan(&stats.SavedArticles)
 	if err != nil {
 		return nil, err
 	}
@@ -174,27 +420,110 @@ func (as *ArticleService) GetStats() (*models.FeedStats, error) {
 	return stats, nil
 }
 
+// CleanupOptions selects the articles removed by a cleanup. Articles saved by any user are
+// always kept, and without IncludeUnread so are those not read by every subscriber.
+type CleanupOptions struct {
+	DaysOld       int  `json:"days"`
+	IncludeUnread bool `json:"include_unread"`
+}
+
+// FeedCleanupCount is the number of articles a cleanup removes from one feed
+type FeedCleanupCount struct {
+	FeedID    int    `json:"feed_id"`
+	FeedTitle string `json:"feed_title"`
+	Articles  int64  `json:"articles"`
+}
+
+// CleanupReport describes what a cleanup removed, or would remove when DryRun is set
+type CleanupReport struct {
+	Cutoff        time.Time          `json:"cutoff"`
+	IncludeUnread bool               `json:"include_unread"`
+	DryRun        bool               `json:"dry_run"`
+	Total         int64              `json:"total"`
+	Feeds         []FeedCleanupCount `json:"feeds"`
+}
+
 func (as *ArticleService) CleanupOldArticles(daysOld int) error {
-	query := `
-		DELETE FROM articles 
-		WHERE read = true 
-		AND saved = false 
-		AND created_at < datetime('now', '-' || ? || ' days')
-	`
-	
-	result, err := as.db.Exec(query, daysOld)
+	report, err := as.CleanupArticles(CleanupOptions{DaysOld: daysOld}, false)
 	if err != nil {
 		return err
 	}
-	
-	rowsAffected, err := result.RowsAffected()
+
+	if report.Total > 0 {
+		articleLog.Info("Cleaned up old articles", "count", report.Total)
+	}
+
+	return nil
+}
+
+// CleanupArticles removes unsaved articles older than opts.DaysOld and reports the
+// number removed per feed. With dryRun nothing is deleted, so retention settings can
+// be tried out first.
+func (as *ArticleService) CleanupArticles(opts CleanupOptions, dryRun bool) (*CleanupReport, error) {
+	report := &CleanupReport{
+		Cutoff:        time.Now().AddDate(0, 0, -opts.DaysOld).UTC(),
+		IncludeUnread: opts.IncludeUnread,
+		DryRun:        dryRun,
+		Feeds:         make([]FeedCleanupCount, 0),
+	}
+
+	where := ` WHERE a.created_at < ?
+		AND NOT EXISTS (SELECT 1 FROM article_states st WHERE st.article_id = a.id AND st.saved = ?)`
+	args := []interface{}{report.Cutoff, true}
+	if !opts.IncludeUnread {
+		where += `
+		AND NOT EXISTS (
+			SELECT 1 FROM subscriptions s
+			WHERE s.feed_id = a.feed_id AND NOT EXISTS (
+				SELECT 1 FROM article_states st WHERE st.article_id = a.id AND st.user_id = s.user_id AND st.read = ?
+			)
+		)`
+		args = append(args, true)
+	}
+
+	countQuery := `
+		SELECT a.feed_id, COALESCE(f.title, ''), COUNT(*)
+		FROM articles a
+		LEFT JOIN feeds f ON f.id = a.feed_id` + where + `
+		GROUP BY a.feed_id, f.title
+		ORDER BY COUNT(*) DESC
+	`
+	rows, err := as.db.Query(countQuery, args...)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to count articles to clean up: %v", err)
 	}
-	
-	if rowsAffected > 0 {
-		fmt.Printf("Cleaned up %d old articles\n", rowsAffected)
+	defer rows.Close()
+
+	for rows.Next() {
+		var count FeedCleanupCount
+		if err := rows.Scan(&count.FeedID, &count.FeedTitle, &count.Articles); err != nil {
+			return nil, err
+		}
+		report.Feeds = append(report.Feeds, count)
+		report.Total += count.Articles
 	}
-	
-	return nil
-}
\ No newline at end of file
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if dryRun || report.Total == 0 {
+		return report, nil
+	}
+
+	result, err := as.db.Exec(`DELETE FROM articles WHERE id IN (SELECT a.id FROM articles a`+where+`)`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete articles: %v", err)
+	}
+	if report.Total, err = result.RowsAffected(); err != nil {
+		return nil, err
+	}
+
+	for _, count := range report.Feeds {
+		if err := as.statsService.Recalculate(count.FeedID); err != nil {
+			articleLog.Error("Failed to recalculate feed stats after cleanup", "feed_id", count.FeedID, "error", err)
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"myfeed/database"
+	"myfeed/models"
+	"time"
+)
+
+// maxStateChanges caps the article IDs of one state sync
+const maxStateChanges = 1000
+
+// ArticleStateChanges are the articles a state sync marks read, unread, saved and unsaved
+type ArticleStateChanges struct {
+	Read    []int `json:"read"`
+	Unread  []int `json:"unread"`
+	Saved   []int `json:"saved"`
+	Unsaved []int `json:"unsaved"`
+}
+
+// SyncStates applies the state changes a client queued, e.g. while offline, in one
+// transaction, and returns the outcome of each: articles that do not exist or belong to
+// feeds the user does not follow are reported not_found without failing the others.
+// An article cannot be both read and unread, or saved and unsaved. Marking articles read
+// this way is not counted as reading them.
+func (as *ArticleService) SyncStates(ctx context.Context, userID int, changes ArticleStateChanges) ([]models.ArticleStateResult, error) {
+	if len(changes.Read)+len(changes.Unread)+len(changes.Saved)+len(changes.Unsaved) > maxStateChanges {
+		return nil, invalidField("read", "at most %d changes can be synced at once", maxStateChanges)
+	}
+	if id, ok := overlap(changes.Read, changes.Unread); ok {
+		return nil, invalidField("unread", "article %d is also marked read", id)
+	}
+	if id, ok := overlap(changes.Saved, changes.Unsaved); ok {
+		return nil, invalidField("unsaved", "article %d is also marked saved", id)
+	}
+
+	results := []models.ArticleStateResult{}
+	feeds := map[int]bool{}
+	var newlySaved []int
+	actions := []struct {
+		ids    []int
+		action string
+	}{{changes.Read, "read"}, {changes.Unread, "unread"}, {changes.Saved, "saved"}, {changes.Unsaved, "unsaved"}}
+	err := as.db.InTx(ctx, func(tx *database.Tx) error {
+		now := time.Now().UTC()
+		for _, change := range actions {
+			for _, id := range change.ids {
+				status, feedID, err := setArticleState(tx, userID, id, change.action, now)
+				if err != nil {
+					return err
+				}
+				if status == models.StateUpdated {
+					switch change.action {
+					case "read", "unread":
+						feeds[feedID] = true
+					case "saved":
+						newlySaved = append(newlySaved, id)
+					}
+				}
+				results = append(results, models.ArticleStateResult{ID: id, Action: change.action, Status: status})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for feedID := range feeds {
+		if err := as.statsService.RecountUnread(userID, feedID); err != nil {
+			articleLog.Error("Failed to recount unread articles", "feed_id", feedID, "error", err)
+		}
+	}
+	for _, id := range newlySaved {
+		article, err := as.GetArticleByID(userID, id)
+		if err != nil {
+			articleLog.Error("Failed to load saved article", "article_id", id, "error", err)
+			continue
+		}
+		as.notifySaved(userID, article)
+	}
+	return results, nil
+}
+
+// setArticleState applies one change of a state sync and returns its outcome with the
+// feed of the article
+func setArticleState(tx *database.Tx, userID, articleID int, action string, now time.Time) (string, int, error) {
+	var feedID int
+	var read, saved bool
+	err := tx.QueryRow(`
+		SELECT a.feed_id, COALESCE(a_st.read, false), COALESCE(a_st.saved, false)
+		FROM articles a`+userArticles("a")+`
+		WHERE a.id = ?
+	`, userID, articleID).Scan(&feedID, &read, &saved)
+	if err == sql.ErrNoRows {
+		return models.StateNotFound, 0, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	var query string
+	var args []interface{}
+	switch action {
+	case "read", "unread":
+		if read == (action == "read") {
+			return models.StateUnchanged, feedID, nil
+		}
+		var readAt *time.Time
+		if action == "read" {
+			readAt = &now
+		}
+		query = `
+			INSERT INTO article_states (user_id, article_id, read, read_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (user_id, article_id) DO UPDATE SET read = excluded.read, read_at = excluded.read_at
+		`
+		args = []interface{}{userID, articleID, action == "read", readAt}
+	default:
+		if saved == (action == "saved") {
+			return models.StateUnchanged, feedID, nil
+		}
+		var savedAt *time.Time
+		if action == "saved" {
+			savedAt = &now
+		}
+		query = `
+			INSERT INTO article_states (user_id, article_id, saved, saved_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (user_id, article_id) DO UPDATE SET saved = excluded.saved, saved_at = excluded.saved_at
+		`
+		args = []interface{}{userID, articleID, action == "saved", savedAt}
+	}
+	if _, err := tx.Exec(query, args...); err != nil {
+		return "", 0, err
+	}
+	return models.StateUpdated, feedID, nil
+}
+
+// overlap returns an ID that is in both a and b
+func overlap(a, b []int) (int, bool) {
+	in := make(map[int]bool, len(a))
+	for _, id := range a {
+		in[id] = true
+	}
+	for _, id := range b {
+		if in[id] {
+			return id, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,83 @@
+package services
+
+import (
+	"myfeed/models"
+)
+
+// articleTags returns a user's tags of an article, alphabetically
+func (as *ArticleService) articleTags(userID, articleID int) ([]string, error) {
+	rows, err := as.db.Query(`SELECT tag FROM article_tags WHERE user_id = ? AND article_id = ? ORDER BY tag`, userID, articleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// GetTags returns the tags rules gave a user's articles, with the number of articles of
+// each, alphabetically
+func (as *ArticleService) GetTags(userID int) ([]models.TagCount, error) {
+	query := `
+		SELECT t.tag, COUNT(*)
+		FROM article_tags t
+		JOIN articles a ON a.id = t.article_id` + userArticles("a") + `
+		WHERE t.user_id = a_s.user_id
+		GROUP BY t.tag
+		ORDER BY t.tag
+	`
+	rows, err := as.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []models.TagCount{}
+	for rows.Next() {
+		var tag models.TagCount
+		if err := rows.Scan(&tag.Tag, &tag.Articles); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// GetTaggedArticles lists the articles with a tag of the user, newest first
+func (as *ArticleService) GetTaggedArticles(userID int, tag string, limit, offset int) ([]models.Article, error) {
+	query := `
+		SELECT a.id, a.feed_id, a.title, a.content, a.url, a.author,
+		       a.published_at, COALESCE(a_st.read, false), COALESCE(a_st.saved, false), a.content_truncated, a.created_at
+		FROM articles a` + userArticles("a") + `
+		JOIN article_tags t ON t.article_id = a.id AND t.user_id = a_s.user_id
+		WHERE t.tag = ?
+		ORDER BY a.published_at DESC LIMIT ? OFFSET ?
+	`
+	rows, err := as.db.Query(query, userID, tag, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	articles := []models.Article{}
+	for rows.Next() {
+		article := models.Article{}
+		err := rows.Scan(
+			&article.ID, &article.FeedID, &article.Title, &article.Content, &article.URL,
+			&article.Author, &article.PublishedAt, &article.Read, &article.Saved, &article.ContentTruncated, &article.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		articles = append(articles, article)
+	}
+	return articles, rows.Err()
+}
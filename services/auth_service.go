@@ -2,12 +2,12 @@ package services
 
 import (
 	"crypto/rand"
+	"database/sql"
 	"encoding/hex"
 	"fmt"
-	"log"
 	"myfeed/database"
 	"myfeed/models"
-	"os"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -29,7 +29,7 @@ func (as *AuthService) CreateUser(username, password string, isAdmin bool) (*mod
 	// Check if user already exists
 	existingUser, err := as.GetUserByUsername(username)
 	if err == nil && existingUser != nil {
-		return nil, fmt.Errorf("user already exists")
+		return nil, ErrUserExists
 	}
 
 	// Hash the password
@@ -44,30 +44,26 @@ func (as *AuthService) CreateUser(username, password string, isAdmin bool) (*mod
 		VALUES (?, ?, ?)
 	`
 	
-	result, err := as.db.Exec(query, username, string(hashedPassword), isAdmin)
+	userID, err := as.db.Insert(query, username, string(hashedPassword), isAdmin)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create user: %v", err)
 	}
 
-	userID, err := result.LastInsertId()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get user ID: %v", err)
-	}
-
 	return as.GetUserByID(int(userID))
 }
 
+const userColumns = `id, username, password, is_admin, created_at, last_login, timezone, COALESCE(disabled, false)`
+
+func scanUser(row rowScanner, user *models.User) error {
+	return row.Scan(&user.ID, &user.Username, &user.Password, &user.IsAdmin,
+		&user.CreatedAt, &user.LastLogin, &user.Timezone, &user.Disabled)
+}
+
 func (as *AuthService) GetUserByID(id int) (*models.User, error) {
-	query := `
-		SELECT id, username, password, is_admin, created_at, last_login
-		FROM users WHERE id = ?
-	`
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = ?`
 	
 	user := &models.User{}
-	err := as.db.QueryRow(query, id).Scan(
-		&user.ID, &user.Username, &user.Password, &user.IsAdmin,
-		&user.CreatedAt, &user.LastLogin,
-	)
+	err := scanUser(as.db.QueryRow(query, id), user)
 	
 	if err != nil {
 		return nil, err
@@ -77,16 +73,10 @@ func (as *AuthService) GetUserByID(id int) (*models.User, error) {
 }
 
 func (as *AuthService) GetUserByUsername(username string) (*models.User, error) {
-	query := `
-		SELECT id, username, password, is_admin, created_at, last_login
-		FROM users WHERE username = ?
-	`
+	query := `SELECT ` + userColumns + ` FROM users WHERE username = ?`
 	
 	user := &models.User{}
-	err := as.db.QueryRow(query, username).Scan(
-		&user.ID, &user.Username, &user.Password, &user.IsAdmin,
-		&user.CreatedAt, &user.LastLogin,
-	)
+	err := scanUser(as.db.QueryRow(query, username), user)
 	
 	if err != nil {
 		return nil, err
@@ -95,9 +85,23 @@ func (as *AuthService) GetUserByUsername(username string) (*models.User, error)
 	return user, nil
 }
 
+// GetFirstAdmin returns the admin created first, who owns the instance-wide views such as
+// the status summary and backups, or sql.ErrNoRows when there is no admin
+func (as *AuthService) GetFirstAdmin() (*models.User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE is_admin = ? ORDER BY id LIMIT 1`
+
+	user := &models.User{}
+	err := scanUser(as.db.QueryRow(query, true), user)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
 func (as *AuthService) AuthenticateUser(username, password string) (*models.User, error) {
 	user, err := as.GetUserByUsername(username)
-	if err != nil {
+	if err != nil || user.Disabled {
 		return nil, fmt.Errorf("invalid credentials")
 	}
 
@@ -110,7 +114,7 @@ func (as *AuthService) AuthenticateUser(username, password string) (*models.User
 	// Update last login
 	_, err = as.db.Exec("UPDATE users SET last_login = CURRENT_TIMESTAMP WHERE id = ?", user.ID)
 	if err != nil {
-		log.Printf("Failed to update last login for user %d: %v", user.ID, err)
+		authLog.Error("Failed to update last login", "user_id", user.ID, "error", err)
 	}
 
 	return user, nil
@@ -182,7 +186,7 @@ func (as *AuthService) CleanupExpiredSessions() error {
 	}
 	
 	if rowsAffected > 0 {
-		log.Printf("Cleaned up %d expired sessions", rowsAffected)
+		authLog.Info("Cleaned up expired sessions", "count", rowsAffected)
 	}
 	
 	return nil
@@ -194,46 +198,45 @@ func (as *AuthService) GetUserCount() (int, error) {
 	return count, err
 }
 
-func (as *AuthService) EnsureDefaultAdmin() error {
+// EnsureDefaultAdmin creates the admin account, or resets its password to the configured
+// one. An empty username is "admin" and an empty password the insecure default.
+func (as *AuthService) EnsureDefaultAdmin(username, password string) error {
 	// Check if any users exist
 	count, err := as.GetUserCount()
 	if err != nil {
-		log.Printf("ERROR: Failed to get user count: %v", err)
+		authLog.Error("Failed to get user count", "error", err)
 		return err
 	}
 
-	log.Printf("INFO: Current user count: %d", count)
-	
-	username := os.Getenv("ADMIN_USERNAME")
-	password := os.Getenv("ADMIN_PASSWORD")
+	authLog.Info("Checked users", "count", count)
 	
 	if username == "" {
 		username = "admin"
 	}
 	if password == "" {
 		password = "admin123" // Default password - should be changed
-		log.Println("WARNING: Using default admin password. Please change it!")
+		authLog.Warn("Using the default admin password, set ADMIN_PASSWORD")
 	}
 
 	// Always check if admin user exists and ensure it has the correct password
 	adminUser, err := as.GetUserByUsername(username)
 	if err != nil {
 		// Admin user doesn't exist, create it
-		log.Printf("INFO: Creating admin user '%s' because it doesn't exist", username)
+		authLog.Info("Creating admin user", "username", username)
 		_, err := as.CreateUser(username, password, true)
 		if err != nil {
-			log.Printf("ERROR: Failed to create admin user: %v", err)
+			authLog.Error("Failed to create admin user", "username", username, "error", err)
 			return fmt.Errorf("failed to create admin user: %v", err)
 		}
-		log.Printf("SUCCESS: Created admin user: %s", username)
+		authLog.Info("Created admin user", "username", username)
 	} else {
 		// Admin user exists, ensure it has the current password from environment
-		log.Printf("INFO: Admin user exists with ID: %d, ensuring password is current", adminUser.ID)
+		authLog.Info("Admin user exists, ensuring password is current", "user_id", adminUser.ID)
 		
 		// Hash the current environment password
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 		if err != nil {
-			log.Printf("ERROR: Failed to hash password: %v", err)
+			authLog.Error("Failed to hash admin password", "error", err)
 			return fmt.Errorf("failed to hash password: %v", err)
 		}
 
@@ -241,10 +244,10 @@ func (as *AuthService) EnsureDefaultAdmin() error {
 		query := `UPDATE users SET password = ? WHERE username = ?`
 		_, err = as.db.Exec(query, string(hashedPassword), username)
 		if err != nil {
-			log.Printf("ERROR: Failed to update admin password: %v", err)
+			authLog.Error("Failed to update admin password", "username", username, "error", err)
 			return fmt.Errorf("failed to update admin password: %v", err)
 		}
-		log.Printf("SUCCESS: Updated admin password for user: %s", username)
+		authLog.Info("Updated admin password", "username", username)
 	}
 
 	return nil
@@ -252,11 +255,14 @@ func (as *AuthService) EnsureDefaultAdmin() error {
 
 func (as *AuthService) ChangePassword(userID int, currentPassword, newPassword string) error {
 	if currentPassword == "" || newPassword == "" {
-		return fmt.Errorf("current password and new password are required")
+		return &ValidationError{
+			Message: "current password and new password are required",
+			Fields:  map[string]string{"current_password": "required", "new_password": "required"},
+		}
 	}
 
 	if len(newPassword) < 6 {
-		return fmt.Errorf("new password must be at least 6 characters long")
+		return invalidField("new_password", "new password must be at least 6 characters long")
 	}
 
 	// Get current user
@@ -268,7 +274,7 @@ func (as *AuthService) ChangePassword(userID int, currentPassword, newPassword s
 	// Verify current password
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(currentPassword))
 	if err != nil {
-		return fmt.Errorf("current password is incorrect")
+		return invalidField("current_password", "current password is incorrect")
 	}
 
 	// Hash new password
@@ -287,6 +293,54 @@ func (as *AuthService) ChangePassword(userID int, currentPassword, newPassword s
 	return nil
 }
 
+// SetTimezone sets the timezone preference of a user, an IANA name like "Europe/Berlin".
+// An empty timezone removes the preference.
+func (as *AuthService) SetTimezone(userID int, timezone string) error {
+	timezone = strings.TrimSpace(timezone)
+	if timezone != "" {
+		if _, err := time.LoadLocation(timezone); err != nil {
+			return invalidField("timezone", "unknown timezone %q", timezone)
+		}
+	}
+
+	_, err := as.db.Exec(`UPDATE users SET timezone = ? WHERE id = ?`, timezone, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update timezone: %v", err)
+	}
+	return nil
+}
+
+// UserLocation returns the timezone days and dates are shown in for a user
+func (as *AuthService) UserLocation(userID int) (*time.Location, error) {
+	return userLocation(as.db, userID)
+}
+
+// userLocation returns the timezone preference of a user, or else the timezone of their
+// notification preferences, which came first, or else UTC
+func userLocation(db *database.DB, userID int) (*time.Location, error) {
+	var timezone, notificationTimezone string
+	query := `
+		SELECT u.timezone, COALESCE(p.timezone, '')
+		FROM users u LEFT JOIN notification_preferences p ON p.user_id = u.id
+		WHERE u.id = ?
+	`
+	err := db.QueryRow(query, userID).Scan(&timezone, &notificationTimezone)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if timezone == "" {
+		timezone = notificationTimezone
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		// Validated when saved, but the timezone database of the host can change
+		authLog.Warn("Unknown timezone, using UTC", "user_id", userID, "timezone", timezone)
+		return time.UTC, nil
+	}
+	return loc, nil
+}
+
 func generateSessionID() (string, error) {
 	bytes := make([]byte, 32)
 	_, err := rand.Read(bytes)
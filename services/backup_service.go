@@ -0,0 +1,204 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// backupPrefix and backupTimeFormat name backup files so they sort chronologically
+	backupPrefix     = "myfeed-"
+	backupTimeFormat = "20060102-150405"
+	// backupSettingsSuffix is appended to the name of the settings file of a backup
+	backupSettingsSuffix = "-settings.json"
+	defaultBackupKeep    = 7
+)
+
+// Backup describes one backup in the backup directory
+type Backup struct {
+	Name         string    `json:"name"`
+	CreatedAt    time.Time `json:"created_at"`
+	OPMLFile     string    `json:"opml_file"`
+	SettingsFile string    `json:"settings_file,omitempty"`
+	Size         int64     `json:"size"`
+}
+
+// BackupService writes timestamped OPML exports of the subscription list of the first
+// admin, optionally with the settings, to the backup directory and keeps only the most
+// recent ones. The files do not depend on the database, so subscriptions can be restored
+// by importing the OPML even when the database is lost.
+type BackupService struct {
+	dir             string
+	opmlService     *OPMLService
+	authService     *AuthService
+	settingsService *SettingsService
+}
+
+func NewBackupService(dir string, opmlService *OPMLService, authService *AuthService, settingsService *SettingsService) *BackupService {
+	return &BackupService{
+		dir:             dir,
+		opmlService:     opmlService,
+		authService:     authService,
+		settingsService: settingsService,
+	}
+}
+
+// Enabled reports whether scheduled backups are switched on
+func (bs *BackupService) Enabled() bool {
+	return bs.settingsService.GetBool(SettingBackupEnabled, false)
+}
+
+// Run writes a new backup and removes the ones beyond the backup_keep setting
+func (bs *BackupService) Run() (*Backup, error) {
+	if err := os.MkdirAll(bs.dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %v", err)
+	}
+
+	admin, err := bs.authService.GetFirstAdmin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get admin: %v", err)
+	}
+	export, err := bs.opmlService.ExportOPML(admin.ID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export OPML: %v", err)
+	}
+
+	createdAt := time.Now().UTC()
+	name := backupPrefix + createdAt.Format(backupTimeFormat)
+	backup := &Backup{
+		Name:      name,
+		CreatedAt: createdAt,
+		OPMLFile:  name + ".opml",
+	}
+
+	size, err := writeFileAtomic(filepath.Join(bs.dir, backup.OPMLFile), export)
+	if err != nil {
+		return nil, err
+	}
+	backup.Size = size
+
+	if bs.settingsService.GetBool(SettingBackupIncludeSettings, true) {
+		settings, err := bs.settingsService.GetAll()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get settings: %v", err)
+		}
+		settingsData, err := json.MarshalIndent(RedactSecrets(settings), "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode settings: %v", err)
+		}
+
+		backup.SettingsFile = name + backupSettingsSuffix
+		size, err := writeFileAtomic(filepath.Join(bs.dir, backup.SettingsFile), bytes.NewReader(settingsData))
+		if err != nil {
+			return nil, err
+		}
+		backup.Size += size
+	}
+
+	if err := bs.rotate(bs.settingsService.GetInt(SettingBackupKeep, defaultBackupKeep)); err != nil {
+		backupLog.Error("Failed to remove old backups", "error", err)
+	}
+
+	return backup, nil
+}
+
+// ListBackups returns the backups in the backup directory, newest first
+func (bs *BackupService) ListBackups() ([]Backup, error) {
+	entries, err := os.ReadDir(bs.dir)
+	if os.IsNotExist(err) {
+		return []Backup{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup directory: %v", err)
+	}
+
+	files := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		files[entry.Name()] = true
+	}
+
+	backups := []Backup{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".opml")
+		if !ok || !strings.HasPrefix(name, backupPrefix) {
+			continue
+		}
+		createdAt, err := time.Parse(backupTimeFormat, strings.TrimPrefix(name, backupPrefix))
+		if err != nil {
+			continue
+		}
+
+		backup := Backup{Name: name, CreatedAt: createdAt, OPMLFile: entry.Name()}
+		if info, err := entry.Info(); err == nil {
+			backup.Size = info.Size()
+		}
+		if settingsFile := name + backupSettingsSuffix; files[settingsFile] {
+			backup.SettingsFile = settingsFile
+			if info, err := os.Stat(filepath.Join(bs.dir, settingsFile)); err == nil {
+				backup.Size += info.Size()
+			}
+		}
+		backups = append(backups, backup)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.After(backups[j].CreatedAt)
+	})
+	return backups, nil
+}
+
+// rotate deletes every backup except the newest keep
+func (bs *BackupService) rotate(keep int) error {
+	if keep < 1 {
+		keep = 1
+	}
+
+	backups, err := bs.ListBackups()
+	if err != nil {
+		return err
+	}
+
+	for i := keep; i < len(backups); i++ {
+		files := []string{backups[i].OPMLFile}
+		if backups[i].SettingsFile != "" {
+			files = append(files, backups[i].SettingsFile)
+		}
+		for _, file := range files {
+			if err := os.Remove(filepath.Join(bs.dir, file)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into place, so an
+// interrupted backup never leaves a truncated file behind
+func writeFileAtomic(path string, data io.WriterTo) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create backup file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := data.WriteTo(tmp)
+	if err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("failed to write backup file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, fmt.Errorf("failed to write backup file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, fmt.Errorf("failed to save backup file: %v", err)
+	}
+	return size, nil
+}
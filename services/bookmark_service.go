@@ -0,0 +1,244 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"myfeed/config"
+	"myfeed/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bookmarkTimeout bounds one request to the bookmark manager
+const bookmarkTimeout = 30 * time.Second
+
+// bookmark is what gets posted for a saved article
+type bookmark struct {
+	URL         string
+	Title       string
+	Description string
+	Tags        []string
+}
+
+type bookmarkPayload struct {
+	UserID    int `json:"user_id"`
+	ArticleID int `json:"article_id"`
+}
+
+// BookmarkService posts saved articles to a linkding or Shaarli instance. Folders are
+// MyFeed's tags: the folder of the article's feed and its parent folders become bookmark
+// tags, next to the tags configured for every bookmark. The bookmark_* settings override
+// the config file and environment, so the instance can be changed without a restart.
+type BookmarkService struct {
+	cfg             config.BookmarkConfig
+	articleService  *ArticleService
+	feedService     *FeedService
+	folderService   *FolderService
+	settingsService *SettingsService
+	jobService      *JobService
+	client          *http.Client
+}
+
+func NewBookmarkService(cfg config.BookmarkConfig, articleService *ArticleService, feedService *FeedService, folderService *FolderService, settingsService *SettingsService, jobService *JobService) *BookmarkService {
+	bs := &BookmarkService{
+		cfg:             cfg,
+		articleService:  articleService,
+		feedService:     feedService,
+		folderService:   folderService,
+		settingsService: settingsService,
+		jobService:      jobService,
+		client:          &http.Client{Timeout: bookmarkTimeout},
+	}
+	articleService.SubscribeSaved(bs.articleSaved)
+	return bs
+}
+
+// config returns the bookmark manager with the stored settings applied
+func (bs *BookmarkService) config() config.BookmarkConfig {
+	cfg := bs.cfg
+	cfg.Service = bs.settingsService.GetString(SettingBookmarkService, cfg.Service)
+	cfg.URL = strings.TrimRight(bs.settingsService.GetString(SettingBookmarkURL, cfg.URL), "/")
+	cfg.Token = bs.settingsService.GetString(SettingBookmarkToken, cfg.Token)
+	if tags := bs.settingsService.GetString(SettingBookmarkTags, ""); tags != "" {
+		cfg.Tags = strings.Split(tags, ",")
+	}
+	return cfg
+}
+
+// Enabled reports whether a bookmark manager is configured
+func (bs *BookmarkService) Enabled() bool {
+	return bs.config().Enabled()
+}
+
+// articleSaved queues posting a newly saved article. The article is posted by a job so a
+// bookmark manager that is down does not slow down saving, and the post is retried.
+func (bs *BookmarkService) articleSaved(userID int, article *models.Article) {
+	if !bs.Enabled() {
+		return
+	}
+	target := "article:" + strconv.Itoa(article.ID)
+	if _, err := bs.jobService.Enqueue(JobSyncBookmark, target, bookmarkPayload{UserID: userID, ArticleID: article.ID}); err != nil {
+		bookmarkLog.Error("Failed to queue bookmark", "article_id", article.ID, "error", err)
+	}
+}
+
+// HandleBookmarkJob is the job handler for sync_bookmark jobs
+func (bs *BookmarkService) HandleBookmarkJob(ctx context.Context, job *models.Job) error {
+	var payload bookmarkPayload
+	if err := decodePayload(job, &payload); err != nil {
+		return PermanentJobError(err)
+	}
+
+	cfg := bs.config()
+	if !cfg.Enabled() {
+		return PermanentJobError(fmt.Errorf("no bookmark manager configured"))
+	}
+
+	article, err := bs.articleService.GetArticleByID(payload.UserID, payload.ArticleID)
+	if err == sql.ErrNoRows {
+		return PermanentJobError(fmt.Errorf("article %d no longer exists", payload.ArticleID))
+	}
+	if err != nil {
+		return err
+	}
+	if !article.Saved {
+		// Unsaved again before the job ran
+		return nil
+	}
+
+	b := bookmark{URL: article.URL, Title: article.Title, Tags: bs.tags(cfg, payload.UserID, article.FeedID)}
+	if feed, err := bs.feedService.GetFeedByID(article.FeedID); err == nil {
+		b.Description = "Saved from " + feed.Title
+	}
+
+	switch cfg.Service {
+	case config.BookmarkLinkding:
+		return bs.postLinkding(ctx, cfg, b)
+	case config.BookmarkShaarli:
+		return bs.postShaarli(ctx, cfg, b)
+	}
+	return PermanentJobError(fmt.Errorf("unknown bookmark service %q", cfg.Service))
+}
+
+// tags returns the configured tags followed by the folders the user keeps a feed in,
+// outermost first
+func (bs *BookmarkService) tags(cfg config.BookmarkConfig, userID, feedID int) []string {
+	tags := []string{}
+	seen := make(map[string]bool)
+	add := func(name string) {
+		tag := bookmarkTag(name)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	for _, tag := range cfg.Tags {
+		add(tag)
+	}
+
+	feed, err := bs.feedService.GetSubscribedFeed(userID, feedID)
+	if err != nil || feed.FolderID == nil {
+		return tags
+	}
+	var folders []string
+	visited := make(map[int]bool)
+	for id := feed.FolderID; id != nil && !visited[*id]; {
+		visited[*id] = true
+		folder, err := bs.folderService.GetFolderByID(userID, *id)
+		if err != nil {
+			break
+		}
+		folders = append([]string{folder.Name}, folders...)
+		id = folder.ParentID
+	}
+	for _, name := range folders {
+		add(name)
+	}
+	return tags
+}
+
+// bookmarkTag turns a folder name into a tag. Both services split tags on whitespace and
+// Shaarli also on commas, so those become dashes.
+func bookmarkTag(name string) string {
+	fields := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	return strings.Join(fields, "-")
+}
+
+// postLinkding creates the bookmark through the linkding REST API, which updates the
+// existing bookmark when the URL is already bookmarked
+func (bs *BookmarkService) postLinkding(ctx context.Context, cfg config.BookmarkConfig, b bookmark) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"url":         b.URL,
+		"title":       b.Title,
+		"description": b.Description,
+		"tag_names":   b.Tags,
+	})
+	if err != nil {
+		return PermanentJobError(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL+"/api/bookmarks/", bytes.NewReader(body))
+	if err != nil {
+		return PermanentJobError(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Token "+cfg.Token)
+	return doPush(bs.client, req)
+}
+
+// postShaarli creates the link through the Shaarli REST API. A link that already exists is
+// left as it is.
+func (bs *BookmarkService) postShaarli(ctx context.Context, cfg config.BookmarkConfig, b bookmark) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"url":         b.URL,
+		"title":       b.Title,
+		"description": b.Description,
+		"tags":        b.Tags,
+		"private":     false,
+	})
+	if err != nil {
+		return PermanentJobError(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL+"/api/v1/links", bytes.NewReader(body))
+	if err != nil {
+		return PermanentJobError(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+shaarliToken(cfg.Token, time.Now()))
+	req.Header.Set("User-Agent", feedUserAgent)
+	resp, err := bs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return pushError(resp)
+	}
+	return nil
+}
+
+// shaarliToken signs the short-lived JWT the Shaarli API expects with the API secret
+func shaarliToken(secret string, now time.Time) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	header := encode([]byte(`{"typ":"JWT","alg":"HS512"}`))
+	claims := encode([]byte(fmt.Sprintf(`{"iat":%d}`, now.Unix())))
+
+	mac := hmac.New(sha512.New, []byte(secret))
+	mac.Write([]byte(header + "." + claims))
+	return header + "." + claims + "." + encode(mac.Sum(nil))
+}
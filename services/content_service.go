@@ -0,0 +1,153 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"myfeed/database"
+	"myfeed/models"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// contentTimeout bounds the download of one article page
+	contentTimeout = 30 * time.Second
+	// maxPageBytes caps the article pages read for extraction
+	maxPageBytes = 5 << 20
+)
+
+type contentPayload struct {
+	ArticleID int `json:"article_id"`
+}
+
+// ContentService downloads the pages of articles and keeps their readable text as the
+// article's full_content, for feeds that only carry a summary. New articles of feeds with
+// fetch_full_content are fetched in the background; any article can be fetched on demand.
+type ContentService struct {
+	db              *database.DB
+	settingsService *SettingsService
+	jobService      *JobService
+	client          *http.Client
+}
+
+func NewContentService(db *database.DB, feedService *FeedService, settingsService *SettingsService, jobService *JobService) *ContentService {
+	cs := &ContentService{
+		db:              db,
+		settingsService: settingsService,
+		jobService:      jobService,
+		client:          &http.Client{Timeout: contentTimeout},
+	}
+	feedService.SubscribeNewArticles(cs.articlesAdded)
+	return cs
+}
+
+// articlesAdded queues the extraction of the new articles of feeds that fetch full content
+func (cs *ContentService) articlesAdded(feed *models.Feed, articles []models.Article) {
+	if !feed.FetchFullContent {
+		return
+	}
+	for _, article := range articles {
+		if article.ID == 0 || article.URL == "" {
+			continue
+		}
+		target := "article:" + strconv.Itoa(article.ID)
+		if _, err := cs.jobService.Enqueue(JobFetchContent, target, contentPayload{ArticleID: article.ID}); err != nil {
+			articleLog.Error("Failed to queue full content fetch", "article_id", article.ID, "error", err)
+		}
+	}
+}
+
+// FetchForUser extracts the full content of an article of a feed the user subscribes to,
+// replacing what was stored before. It returns sql.ErrNoRows for other articles.
+func (cs *ContentService) FetchForUser(ctx context.Context, userID, articleID int) error {
+	var subscribed int
+	err := cs.db.QueryRow(`
+		SELECT COUNT(*) FROM articles a JOIN subscriptions s ON s.feed_id = a.feed_id
+		WHERE a.id = ? AND s.user_id = ?
+	`, articleID, userID).Scan(&subscribed)
+	if err != nil {
+		return err
+	}
+	if subscribed == 0 {
+		return sql.ErrNoRows
+	}
+	return cs.FetchContent(ctx, articleID)
+}
+
+// FetchContent downloads the page of an article and stores its readable text, cut to the
+// max_article_kb setting like feed content. A page that cannot be downloaded or has no
+// readable text is an *UpstreamError.
+func (cs *ContentService) FetchContent(ctx context.Context, articleID int) error {
+	var pageURL string
+	err := cs.db.QueryRow(`SELECT COALESCE(url, '') FROM articles WHERE id = ?`, articleID).Scan(&pageURL)
+	if err != nil {
+		return err
+	}
+	if pageURL == "" {
+		return invalidField("url", "article has no link to fetch")
+	}
+
+	content, err := cs.extract(ctx, pageURL)
+	if err != nil {
+		return &UpstreamError{Err: err}
+	}
+	content, _ = limitContent(content, cs.settingsService.GetInt(SettingMaxArticleKB, defaultMaxArticleKB)<<10)
+
+	_, err = cs.db.Exec(`UPDATE articles SET full_content = ? WHERE id = ?`, content, articleID)
+	return err
+}
+
+// extract downloads an HTML page and returns its readable body
+func (cs *ContentService) extract(ctx context.Context, pageURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return "", PermanentJobError(err)
+	}
+	req.Header.Set("User-Agent", feedUserAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9,*/*;q=0.1")
+	resp, err := cs.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to download article: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return "", PermanentJobError(fmt.Errorf("article returned HTTP %d", resp.StatusCode))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("article returned HTTP %d", resp.StatusCode)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "" && mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return "", PermanentJobError(fmt.Errorf("article is %s, not a web page", mediaType))
+	}
+
+	// Relative links resolve against the page the redirects ended on
+	content, err := extractReadable(io.LimitReader(resp.Body, maxPageBytes), resp.Request.URL)
+	if err == errNotReadable {
+		return "", PermanentJobError(err)
+	}
+	return content, err
+}
+
+// HandleFetchJob is the job handler for fetch_content jobs
+func (cs *ContentService) HandleFetchJob(ctx context.Context, job *models.Job) error {
+	var payload contentPayload
+	if err := decodePayload(job, &payload); err != nil {
+		return PermanentJobError(err)
+	}
+
+	err := cs.FetchContent(ctx, payload.ArticleID)
+	if err == sql.ErrNoRows {
+		return PermanentJobError(fmt.Errorf("article %d no longer exists", payload.ArticleID))
+	}
+	var invalid *ValidationError
+	if errors.As(err, &invalid) {
+		return PermanentJobError(err)
+	}
+	return err
+}
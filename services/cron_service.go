@@ -0,0 +1,194 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"myfeed/database"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// cronTask is a recurring task whose schedule is read from a setting
+type cronTask struct {
+	name       string
+	settingKey string
+	fallback   string
+	run        func()
+	spec       string
+	entryID    cron.EntryID
+}
+
+// CronService runs the recurring background tasks. Schedules live in the settings table
+// and entries are rebuilt whenever one of them changes, so no restart is needed.
+// The last run of every task is persisted so runs missed during downtime are caught up.
+type CronService struct {
+	db              *database.DB
+	mu              sync.Mutex
+	cron            *cron.Cron
+	settingsService *SettingsService
+	tasks           []*cronTask
+	paused          atomic.Bool
+}
+
+func NewCronService(db *database.DB, settingsService *SettingsService) *CronService {
+	cs := &CronService{
+		db:              db,
+		// A panicking task is logged instead of crashing the process
+		cron:            cron.New(cron.WithChain(cron.Recover(cron.DefaultLogger))),
+		settingsService: settingsService,
+	}
+	settingsService.Subscribe(cs.settingsChanged)
+	return cs
+}
+
+// Register adds a task scheduled by the cron expression stored under settingKey.
+// fallback is used when the setting is missing or invalid, and always without a settingKey.
+func (cs *CronService) Register(name, settingKey, fallback string, run func()) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.tasks = append(cs.tasks, &cronTask{
+		name:       name,
+		settingKey: settingKey,
+		fallback:   fallback,
+		run:        run,
+	})
+}
+
+// SetPaused skips every task while paused, without removing the entries
+func (cs *CronService) SetPaused(paused bool) {
+	cs.paused.Store(paused)
+}
+
+// Start schedules every registered task, runs the tasks whose last scheduled run was
+// missed while the process was down, and starts the cron runner
+func (cs *CronService) Start() {
+	cs.Reload()
+	cs.catchUp()
+	cs.cron.Start()
+}
+
+// Stop halts the cron runner. The returned context is done once running tasks finish.
+func (cs *CronService) Stop() context.Context {
+	return cs.cron.Stop()
+}
+
+// Reload re-reads every schedule and replaces the entries whose schedule changed
+func (cs *CronService) Reload() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for _, task := range cs.tasks {
+		spec := task.fallback
+		if task.settingKey != "" {
+			spec = cs.settingsService.GetString(task.settingKey, task.fallback)
+		}
+		if spec == task.spec {
+			continue
+		}
+
+		if task.entryID != 0 {
+			cs.cron.Remove(task.entryID)
+			task.entryID = 0
+		}
+
+		entryID, err := cs.cron.AddFunc(spec, cs.wrap(task))
+		if err != nil {
+			cronLog.Warn("Invalid schedule, using the default", "task", task.name, "schedule", spec, "default", task.fallback, "error", err)
+			spec = task.fallback
+			if entryID, err = cs.cron.AddFunc(spec, cs.wrap(task)); err != nil {
+				cronLog.Error("Failed to schedule task", "task", task.name, "error", err)
+				task.spec = ""
+				continue
+			}
+		}
+
+		task.entryID = entryID
+		task.spec = spec
+		cronLog.Info("Scheduled task", "task", task.name, "schedule", spec)
+	}
+}
+
+// wrap skips the task while the service is paused
+func (cs *CronService) wrap(task *cronTask) func() {
+	return func() {
+		if cs.paused.Load() {
+			cronLog.Info("Skipping task in maintenance mode", "task", task.name)
+			return
+		}
+		startedAt := time.Now()
+		task.run()
+		cs.recordRun(task.name, startedAt)
+	}
+}
+
+// catchUp runs once every task that should have run since its last recorded run.
+// Tasks that have never run are only recorded, so a fresh install does not start
+// with a burst of maintenance work.
+func (cs *CronService) catchUp() {
+	cs.mu.Lock()
+	var missed []*cronTask
+	now := time.Now()
+	for _, task := range cs.tasks {
+		if task.spec == "" {
+			continue
+		}
+
+		var lastRunAt time.Time
+		err := cs.db.QueryRow(`SELECT last_run_at FROM cron_runs WHERE name = ?`, task.name).Scan(&lastRunAt)
+		if err == sql.ErrNoRows {
+			cs.recordRun(task.name, now)
+			continue
+		}
+		if err != nil {
+			cronLog.Error("Failed to get last run", "task", task.name, "error", err)
+			continue
+		}
+
+		schedule, err := cron.ParseStandard(task.spec)
+		if err != nil {
+			continue
+		}
+		// Times are read back in UTC, but the runner evaluates schedules in its location
+		if due := schedule.Next(lastRunAt.In(cs.cron.Location())); due.Before(now) {
+			cronLog.Info("Running missed task", "task", task.name, "due", due)
+			missed = append(missed, task)
+		}
+	}
+	cs.mu.Unlock()
+
+	for _, task := range missed {
+		cs.wrap(task)()
+	}
+}
+
+// recordRun persists the time a task last ran
+func (cs *CronService) recordRun(name string, at time.Time) {
+	query := `
+		INSERT INTO cron_runs (name, last_run_at) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET last_run_at = excluded.last_run_at
+	`
+	if _, err := cs.db.Exec(query, name, at.UTC()); err != nil {
+		cronLog.Error("Failed to record run", "task", name, "error", err)
+	}
+}
+
+// settingsChanged reloads the schedules if any of the changed settings is a schedule
+func (cs *CronService) settingsChanged(changed map[string]string) {
+	cs.mu.Lock()
+	affected := false
+	for _, task := range cs.tasks {
+		if _, ok := changed[task.settingKey]; ok {
+			affected = true
+			break
+		}
+	}
+	cs.mu.Unlock()
+
+	if affected {
+		cs.Reload()
+	}
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"myfeed/database"
+	"myfeed/models"
+)
+
+// deadLetterAfterErrors is the number of consecutive refresh errors after which a feed
+// is paused and listed as a dead letter
+const deadLetterAfterErrors = 10
+
+// DeadLetterService parks feeds that keep failing. Instead of being retried (and logged)
+// forever, such a feed is paused and recorded until an admin requeues or dismisses it.
+type DeadLetterService struct {
+	db          *database.DB
+	feedService *FeedService
+}
+
+func NewDeadLetterService(db *database.DB, feedService *FeedService) *DeadLetterService {
+	return &DeadLetterService{
+		db:          db,
+		feedService: feedService,
+	}
+}
+
+// CheckFeed dead-letters a feed whose error count has reached the limit, recording
+// refreshErr as the final error. It reports whether the feed was dead-lettered.
+func (dls *DeadLetterService) CheckFeed(feedID int, refreshErr error) (bool, error) {
+	var errorCount int
+	if err := dls.db.QueryRow(`SELECT error_count FROM feeds WHERE id = ?`, feedID).Scan(&errorCount); err != nil {
+		return false, err
+	}
+	if errorCount < deadLetterAfterErrors {
+		return false, nil
+	}
+
+	query := `
+		INSERT INTO dead_letters (feed_id, error, error_count) VALUES (?, ?, ?)
+		ON CONFLICT (feed_id) DO UPDATE SET error = excluded.error, error_count = excluded.error_count
+	`
+	if _, err := dls.db.Exec(query, feedID, refreshErr.Error(), errorCount); err != nil {
+		return false, fmt.Errorf("failed to record dead letter: %v", err)
+	}
+
+	if err := dls.feedService.SetPaused(feedID, true); err != nil {
+		return false, fmt.Errorf("failed to pause feed: %v", err)
+	}
+
+	schedulerLog.Warn("Feed paused after consecutive errors", "feed_id", feedID, "errors", errorCount, "error", refreshErr)
+	return true, nil
+}
+
+// GetDeadLetters returns every dead letter, newest first
+func (dls *DeadLetterService) GetDeadLetters() ([]models.DeadLetter, error) {
+	query := `
+		SELECT d.id, d.feed_id, f.title, f.url, d.error, d.error_count, d.created_at
+		FROM dead_letters d
+		JOIN feeds f ON f.id = d.feed_id
+		ORDER BY d.created_at DESC, d.id DESC
+	`
+
+	rows, err := dls.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deadLetters := make([]models.DeadLetter, 0)
+	for rows.Next() {
+		var dl models.DeadLetter
+		err := rows.Scan(&dl.ID, &dl.FeedID, &dl.FeedTitle, &dl.FeedURL, &dl.Error, &dl.ErrorCount, &dl.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, dl)
+	}
+
+	return deadLetters, rows.Err()
+}
+
+// Requeue removes a dead letter, resumes its feed with a clean error count and queues
+// an immediate refresh. sql.ErrNoRows is returned if the dead letter does not exist.
+func (dls *DeadLetterService) Requeue(id int) (*models.Job, error) {
+	feedID, err := dls.remove(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := dls.db.Exec(`UPDATE feeds SET error_count = 0 WHERE id = ?`, feedID); err != nil {
+		return nil, fmt.Errorf("failed to reset feed errors: %v", err)
+	}
+	if err := dls.feedService.SetPaused(feedID, false); err != nil {
+		return nil, fmt.Errorf("failed to resume feed: %v", err)
+	}
+
+	return dls.feedService.EnqueueRefresh(feedID)
+}
+
+// Dismiss removes a dead letter. The feed stays paused; it can be resumed or deleted
+// separately. sql.ErrNoRows is returned if the dead letter does not exist.
+func (dls *DeadLetterService) Dismiss(id int) error {
+	_, err := dls.remove(id)
+	return err
+}
+
+func (dls *DeadLetterService) remove(id int) (int, error) {
+	var feedID int
+	if err := dls.db.QueryRow(`SELECT feed_id FROM dead_letters WHERE id = ?`, id).Scan(&feedID); err != nil {
+		return 0, err
+	}
+
+	result, err := dls.db.Exec(`DELETE FROM dead_letters WHERE id = ?`, id)
+	if err != nil {
+		return 0, err
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return 0, sql.ErrNoRows
+	}
+
+	return feedID, nil
+}
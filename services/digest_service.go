@@ -0,0 +1,394 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"myfeed/database"
+	"myfeed/models"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	// digestMaxArticles caps the number of articles listed in one digest
+	digestMaxArticles = 100
+	// digestSlack lets a digest go out slightly early, so a daily digest is not skipped
+	// when the previous run finished a few minutes after the scheduled time
+	digestSlack = time.Hour
+	// digestUnfiled is the heading of feeds that are not in a folder
+	digestUnfiled = "Unfiled"
+	// defaultDigestSchedule sends digests at 7 AM in each subscriber's timezone
+	defaultDigestSchedule = "0 7 * * *"
+)
+
+// digestIntervals is the time between two digests of each frequency
+var digestIntervals = map[string]time.Duration{
+	models.DigestDaily:  24 * time.Hour,
+	models.DigestWeekly: 7 * 24 * time.Hour,
+}
+
+// Built-in digest templates, executed with a digestData. Admins can replace them through
+// the digest_*_template settings.
+const defaultDigestSubject = `{{.Title}}: {{.Count}} unread articles`
+
+const defaultDigestHTML = `<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; max-width: 640px; margin: 0 auto;">
+<h1 style="font-size: 20px;">{{.Title}}</h1>
+<p style="color: #666;">{{.Count}} unread articles since {{.Since.Format "Jan 2, 15:04 MST"}}{{if .Truncated}} (showing the newest {{.Count}}){{end}}</p>
+{{range .Folders}}
+<h2 style="font-size: 18px; margin-top: 32px; border-bottom: 1px solid #ddd;">{{.Name}}</h2>
+{{range .Feeds}}
+<h3 style="font-size: 15px; margin-top: 16px;">{{.Title}}</h3>
+<ul>
+{{range .Articles}}<li><a href="{{.URL}}">{{.Title}}</a> <span style="color: #999;">{{.PublishedAt.Format "Jan 2"}}</span></li>
+{{end}}</ul>
+{{end}}
+{{end}}
+</body>
+</html>
+`
+
+const defaultDigestText = `{{.Title}}
+
+{{.Count}} unread articles since {{.Since.Format "Jan 2, 15:04 MST"}}{{if .Truncated}} (showing the newest {{.Count}}){{end}}
+{{range .Folders}}
+== {{.Name}} ==
+{{range .Feeds}}
+{{.Title}}
+{{range .Articles}}  - {{.Title}} ({{.PublishedAt.Format "Jan 2"}})
+{{if .URL}}    {{.URL}}
+{{end}}{{end}}{{end}}{{end}}`
+
+type digestArticle struct {
+	Title       string
+	URL         string
+	PublishedAt time.Time
+}
+
+type digestFeed struct {
+	Title    string
+	Articles []digestArticle
+}
+
+type digestFolder struct {
+	Name  string
+	Feeds []*digestFeed
+}
+
+type digestData struct {
+	Title     string
+	Since     time.Time
+	Count     int
+	Truncated bool
+	Folders   []*digestFolder
+}
+
+// DigestService emails users a periodic digest of their unread articles, optionally
+// limited to one folder and its subfolders
+type DigestService struct {
+	db              *database.DB
+	folderService   *FolderService
+	settingsService *SettingsService
+	templates       *MessageTemplates
+	mailer          *Mailer
+}
+
+func NewDigestService(db *database.DB, folderService *FolderService, settingsService *SettingsService, templates *MessageTemplates, mailer *Mailer) *DigestService {
+	return &DigestService{
+		db:              db,
+		folderService:   folderService,
+		settingsService: settingsService,
+		templates:       templates,
+		mailer:          mailer,
+	}
+}
+
+const digestColumns = `user_id, email, frequency, folder_id, enabled, last_sent_at, created_at`
+
+func scanDigestSubscription(row rowScanner, sub *models.DigestSubscription) error {
+	return row.Scan(&sub.UserID, &sub.Email, &sub.Frequency, &sub.FolderID, &sub.Enabled, &sub.LastSentAt, &sub.CreatedAt)
+}
+
+// GetSubscription returns the digest subscription of a user, or sql.ErrNoRows
+func (ds *DigestService) GetSubscription(userID int) (*models.DigestSubscription, error) {
+	sub := &models.DigestSubscription{}
+	query := `SELECT ` + digestColumns + ` FROM digest_subscriptions WHERE user_id = ?`
+	if err := scanDigestSubscription(ds.db.QueryRow(query, userID), sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// SaveSubscription creates or updates the digest subscription of a user
+func (ds *DigestService) SaveSubscription(userID int, email, frequency string, folderID *int, enabled bool) (*models.DigestSubscription, error) {
+	address, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil {
+		return nil, invalidField("email", "invalid email address: %v", err)
+	}
+	if _, ok := digestIntervals[frequency]; !ok {
+		return nil, invalidField("frequency", "frequency must be %q or %q", models.DigestDaily, models.DigestWeekly)
+	}
+	if folderID != nil {
+		if _, err := ds.folderService.GetFolderByID(userID, *folderID); err != nil {
+			return nil, invalidField("folder_id", "folder not found")
+		}
+	}
+
+	query := `
+		INSERT INTO digest_subscriptions (user_id, email, frequency, folder_id, enabled)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET
+			email = excluded.email,
+			frequency = excluded.frequency,
+			folder_id = excluded.folder_id,
+			enabled = excluded.enabled
+	`
+	if _, err := ds.db.Exec(query, userID, address.Address, frequency, folderID, enabled); err != nil {
+		return nil, fmt.Errorf("failed to save digest subscription: %v", err)
+	}
+
+	return ds.GetSubscription(userID)
+}
+
+// DeleteSubscription removes the digest subscription of a user
+func (ds *DigestService) DeleteSubscription(userID int) error {
+	result, err := ds.db.Exec(`DELETE FROM digest_subscriptions WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SendDue sends the digest of every enabled subscription that is due and returns the
+// number of digests sent. The digest_schedule setting is read in the timezone of each
+// subscriber, so "0 7 * * *" sends at 7 AM wherever they are, and weekly digests wait
+// for the first scheduled time a week after the previous one. Subscriptions are skipped
+// while no SMTP server is configured.
+func (ds *DigestService) SendDue() (int, error) {
+	if !ds.mailer.Enabled() {
+		return 0, nil
+	}
+
+	query := `SELECT ` + digestColumns + ` FROM digest_subscriptions WHERE enabled = ?`
+	rows, err := ds.db.Query(query, true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get digest subscriptions: %v", err)
+	}
+
+	var subs []models.DigestSubscription
+	for rows.Next() {
+		var sub models.DigestSubscription
+		if err := scanDigestSubscription(rows, &sub); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		subs = append(subs, sub)
+	}
+	rows.Close()
+
+	schedule, err := cron.ParseStandard(ds.settingsService.GetString(SettingDigestSchedule, defaultDigestSchedule))
+	if err != nil {
+		schedule, _ = cron.ParseStandard(defaultDigestSchedule)
+	}
+
+	now := time.Now()
+	sent := 0
+	for i := range subs {
+		sub := &subs[i]
+		due, err := ds.nextDigest(sub, schedule)
+		if err != nil {
+			mailLog.Error("Failed to schedule digest", "user_id", sub.UserID, "error", err)
+			continue
+		}
+		if due.After(now) {
+			continue
+		}
+
+		count, err := ds.Send(sub)
+		if err != nil {
+			mailLog.Error("Failed to send digest", "user_id", sub.UserID, "error", err)
+			continue
+		}
+		if count > 0 {
+			sent++
+		}
+	}
+
+	return sent, nil
+}
+
+// nextDigest returns when the digest of a subscription is due: the first time of the
+// schedule in the subscriber's timezone once its interval has passed since the previous
+// digest, or since it was created
+func (ds *DigestService) nextDigest(sub *models.DigestSubscription, schedule cron.Schedule) (time.Time, error) {
+	loc, err := userLocation(ds.db, sub.UserID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if spec, ok := schedule.(*cron.SpecSchedule); ok {
+		local := *spec
+		local.Location = loc
+		schedule = &local
+	}
+
+	if sub.LastSentAt == nil {
+		return schedule.Next(sub.CreatedAt.In(loc)), nil
+	}
+	return schedule.Next(sub.LastSentAt.In(loc).Add(digestIntervals[sub.Frequency] - digestSlack)), nil
+}
+
+// Send emails the digest of one subscription right away and returns the number of
+// articles it listed. Nothing is sent when there are no new unread articles.
+func (ds *DigestService) Send(sub *models.DigestSubscription) (int, error) {
+	now := time.Now().UTC()
+	since := now.Add(-digestIntervals[sub.Frequency])
+	if sub.LastSentAt != nil {
+		since = *sub.LastSentAt
+	}
+
+	data, err := ds.collect(sub, since)
+	if err != nil {
+		return 0, err
+	}
+
+	if data.Count > 0 {
+		subject, htmlBody, textBody, err := ds.render(data)
+		if err != nil {
+			return 0, err
+		}
+		if err := ds.mailer.Send(sub.Email, subject, htmlBody, textBody); err != nil {
+			return 0, err
+		}
+	}
+
+	// The window is consumed even when it was empty, so the next digest starts from now
+	if _, err := ds.db.Exec(`UPDATE digest_subscriptions SET last_sent_at = ? WHERE user_id = ?`, now, sub.UserID); err != nil {
+		return data.Count, fmt.Errorf("failed to record digest: %v", err)
+	}
+
+	return data.Count, nil
+}
+
+// render returns the subject and the HTML and plain text versions of a digest
+func (ds *DigestService) render(data *digestData) (subject, htmlBody, textBody string, err error) {
+	if subject, err = ds.templates.Render(SettingDigestSubjectTemplate, data); err != nil {
+		return "", "", "", fmt.Errorf("failed to render digest subject: %v", err)
+	}
+	if htmlBody, err = ds.templates.Render(SettingDigestHTMLTemplate, data); err != nil {
+		return "", "", "", fmt.Errorf("failed to render digest: %v", err)
+	}
+	if textBody, err = ds.templates.Render(SettingDigestTextTemplate, data); err != nil {
+		return "", "", "", fmt.Errorf("failed to render digest: %v", err)
+	}
+	return strings.TrimSpace(subject), htmlBody, textBody, nil
+}
+
+// collect gathers the subscriber's unread articles added since the given time, grouped by
+// the subscriber's folders and feeds. Folders are sorted by name with unfiled feeds last.
+func (ds *DigestService) collect(sub *models.DigestSubscription, since time.Time) (*digestData, error) {
+	// Dates are shown in the subscriber's timezone
+	loc, err := userLocation(ds.db, sub.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &digestData{
+		Title: ds.settingsService.GetString(SettingAppTitle, "MyFeed") + " digest",
+		Since: since.In(loc),
+	}
+
+	query := `
+		SELECT fo.name, f.title, a.title, a.url, a.published_at
+		FROM articles a
+		JOIN feeds f ON f.id = a.feed_id` + userArticles("a") + `
+		LEFT JOIN folders fo ON fo.id = a_s.folder_id
+		WHERE COALESCE(a_st.read, false) = ? AND a.created_at > ?
+	`
+	args := []interface{}{sub.UserID, false, since.UTC()}
+
+	if sub.FolderID != nil {
+		feedIDs, err := ds.folderService.GetFeedIDsInTree(sub.UserID, *sub.FolderID, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get folder feeds: %v", err)
+		}
+		if len(feedIDs) == 0 {
+			return data, nil
+		}
+		query += " AND a.feed_id IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(feedIDs)), ", ") + ")"
+		for _, id := range feedIDs {
+			args = append(args, id)
+		}
+	}
+
+	// Fetch one extra row to know whether the list was truncated
+	query += " ORDER BY a.published_at DESC LIMIT ?"
+	args = append(args, digestMaxArticles+1)
+
+	rows, err := ds.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get unread articles: %v", err)
+	}
+	defer rows.Close()
+
+	folders := make(map[string]*digestFolder)
+	feeds := make(map[string]*digestFeed)
+	for rows.Next() {
+		var folderName *string
+		var feedTitle string
+		var article digestArticle
+		var url *string
+		if err := rows.Scan(&folderName, &feedTitle, &article.Title, &url, &article.PublishedAt); err != nil {
+			return nil, err
+		}
+		if data.Count == digestMaxArticles {
+			data.Truncated = true
+			break
+		}
+		if url != nil {
+			article.URL = *url
+		}
+		article.PublishedAt = article.PublishedAt.In(loc)
+
+		name := digestUnfiled
+		if folderName != nil {
+			name = *folderName
+		}
+		folder, ok := folders[name]
+		if !ok {
+			folder = &digestFolder{Name: name}
+			folders[name] = folder
+			data.Folders = append(data.Folders, folder)
+		}
+
+		feedKey := name + "\x00" + feedTitle
+		feed, ok := feeds[feedKey]
+		if !ok {
+			feed = &digestFeed{Title: feedTitle}
+			feeds[feedKey] = feed
+			folder.Feeds = append(folder.Feeds, feed)
+		}
+		feed.Articles = append(feed.Articles, article)
+		data.Count++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(data.Folders, func(i, j int) bool {
+		a, b := data.Folders[i].Name, data.Folders[j].Name
+		if (a == digestUnfiled) != (b == digestUnfiled) {
+			return b == digestUnfiled
+		}
+		return strings.ToLower(a) < strings.ToLower(b)
+	})
+
+	return data, nil
+}
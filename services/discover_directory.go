@@ -0,0 +1,162 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"myfeed/models"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// directoryBundled is the source of the catalog compiled into the binary
+const directoryBundled = "bundled"
+
+// maxDirectoryBytes caps the size of a downloaded catalog
+const maxDirectoryBytes = 4 << 20
+
+// parseCatalog reads a catalog and checks that every category has a name and every feed a
+// title and an http(s) URL
+func parseCatalog(data []byte) ([]catalogCategory, error) {
+	var categories []catalogCategory
+	if err := json.Unmarshal(data, &categories); err != nil {
+		return nil, err
+	}
+	if len(categories) == 0 {
+		return nil, fmt.Errorf("no categories")
+	}
+	for _, category := range categories {
+		if strings.TrimSpace(category.Name) == "" {
+			return nil, fmt.Errorf("category without a name")
+		}
+		for _, feed := range category.Feeds {
+			u, err := url.Parse(feed.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("feed %q in %s has an invalid URL %q", feed.Title, category.Name, feed.URL)
+			}
+			if strings.TrimSpace(feed.Title) == "" {
+				return nil, fmt.Errorf("feed %s in %s has no title", feed.URL, category.Name)
+			}
+		}
+	}
+	return categories, nil
+}
+
+// Directory lists the catalog feeds of a category, or of all categories when category is
+// empty, whose title, description, site or category contain every word of query. Feeds
+// the user subscribes to already are marked.
+func (ds *DiscoverService) Directory(userID int, query, category string) (*models.Directory, error) {
+	feeds, err := ds.feedService.GetAllFeeds(userID)
+	if err != nil {
+		return nil, err
+	}
+	subscribed := make(map[string]bool, len(feeds))
+	for _, feed := range feeds {
+		subscribed[normalizeFeedURL(feed.URL)] = true
+	}
+
+	ds.mu.Lock()
+	categories, source, updatedAt := ds.categories, ds.source, ds.updatedAt
+	ds.mu.Unlock()
+
+	queryWords := words(query)
+	directory := &models.Directory{Source: source, UpdatedAt: updatedAt, Categories: []models.DirectoryCategory{}}
+	for _, c := range categories {
+		if category != "" && !strings.EqualFold(c.Name, category) {
+			continue
+		}
+		listed := models.DirectoryCategory{Name: c.Name, Feeds: []models.DirectoryFeed{}}
+		for _, feed := range c.Feeds {
+			text := " " + strings.Join(words(c.Name+" "+feed.Title+" "+feed.Description+" "+feed.Site), " ")
+			if !containsWords(text, queryWords) {
+				continue
+			}
+			listed.Feeds = append(listed.Feeds, models.DirectoryFeed{
+				Title:       feed.Title,
+				URL:         feed.URL,
+				SiteURL:     feed.Site,
+				Description: feed.Description,
+				Subscribed:  subscribed[normalizeFeedURL(feed.URL)],
+				Subscribe:   models.SubscribeRequest{URL: feed.URL},
+			})
+		}
+		if len(listed.Feeds) > 0 {
+			directory.Categories = append(directory.Categories, listed)
+		}
+	}
+	return directory, nil
+}
+
+// containsWords reports whether every query word starts a word of text, which is a space
+// separated list of lower case words with a leading space
+func containsWords(text string, queryWords []string) bool {
+	for _, word := range queryWords {
+		if !strings.Contains(text, " "+word) {
+			return false
+		}
+	}
+	return true
+}
+
+// RefreshDirectory downloads the catalog from the directory_url setting and replaces the
+// current one. Without the setting, the bundled catalog is restored. A failed download
+// keeps the current catalog.
+func (ds *DiscoverService) RefreshDirectory(ctx context.Context) error {
+	directoryURL := ds.settingsService.GetString(SettingDirectoryURL, "")
+	if directoryURL == "" {
+		categories, err := parseCatalog(discoverCatalog)
+		if err != nil {
+			return PermanentJobError(err)
+		}
+		ds.setCatalog(categories, directoryBundled)
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, directoryURL, nil)
+	if err != nil {
+		return PermanentJobError(err)
+	}
+	req.Header.Set("User-Agent", feedUserAgent)
+	req.Header.Set("Accept", "application/json")
+	resp, err := ds.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download the directory: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download the directory: %s returned HTTP %d", directoryURL, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxDirectoryBytes+1))
+	if err != nil {
+		return fmt.Errorf("failed to download the directory: %w", err)
+	}
+	if len(data) > maxDirectoryBytes {
+		return PermanentJobError(fmt.Errorf("directory is larger than %d bytes", maxDirectoryBytes))
+	}
+	categories, err := parseCatalog(data)
+	if err != nil {
+		return PermanentJobError(fmt.Errorf("invalid directory: %w", err))
+	}
+
+	ds.setCatalog(categories, directoryURL)
+	discoverLog.Info("Refreshed the feed directory", "url", directoryURL, "categories", len(categories))
+	return nil
+}
+
+// setCatalog replaces the catalog; only a downloaded one has a time it was updated at
+func (ds *DiscoverService) setCatalog(categories []catalogCategory, source string) {
+	var updatedAt *time.Time
+	if source != directoryBundled {
+		now := time.Now().UTC()
+		updatedAt = &now
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.categories = categories
+	ds.source = source
+	ds.updatedAt = updatedAt
+}
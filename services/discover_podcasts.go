@@ -0,0 +1,208 @@
+package services
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"myfeed/models"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Podcast directories that can be searched
+const (
+	PodcastSourceITunes       = "itunes"
+	PodcastSourcePodcastIndex = "podcast_index"
+)
+
+const (
+	itunesSearchURL       = "https://itunes.apple.com/search"
+	podcastIndexSearchURL = "https://api.podcastindex.org/api/1.0/search/byterm"
+	// maxPodcastResponseBytes caps the size of a search response that is read
+	maxPodcastResponseBytes = 4 << 20
+)
+
+// PodcastSources returns the directories that can be searched, the default first: Podcast
+// Index when its credentials are configured, iTunes otherwise
+func (ds *DiscoverService) PodcastSources() []string {
+	if ds.podcasts.PodcastIndexEnabled() {
+		return []string{PodcastSourcePodcastIndex, PodcastSourceITunes}
+	}
+	return []string{PodcastSourceITunes}
+}
+
+// SearchPodcasts looks up shows by name, author or topic in a podcast directory and returns
+// up to limit of them with their feed URLs. Shows without a feed are left out. Failures of
+// the directory are returned as *UpstreamError. Shows the user subscribes to are marked.
+func (ds *DiscoverService) SearchPodcasts(ctx context.Context, userID int, source, query string, limit int) ([]models.Podcast, error) {
+	feeds, err := ds.feedService.GetAllFeeds(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var podcasts []models.Podcast
+	switch source {
+	case PodcastSourceITunes:
+		podcasts, err = ds.searchITunes(ctx, query, limit)
+	case PodcastSourcePodcastIndex:
+		podcasts, err = ds.searchPodcastIndex(ctx, query, limit)
+	default:
+		return nil, invalidField("source", "unknown podcast directory %q", source)
+	}
+	if err != nil {
+		return nil, &UpstreamError{Err: fmt.Errorf("%s search failed: %w", source, err)}
+	}
+
+	subscribed := make(map[string]bool, len(feeds))
+	for _, feed := range feeds {
+		subscribed[normalizeFeedURL(feed.URL)] = true
+	}
+	for i := range podcasts {
+		podcasts[i].Source = source
+		podcasts[i].Subscribed = subscribed[normalizeFeedURL(podcasts[i].URL)]
+		podcasts[i].Subscribe = models.SubscribeRequest{URL: podcasts[i].URL}
+	}
+	return podcasts, nil
+}
+
+// searchITunes uses the iTunes Search API, which needs no credentials
+func (ds *DiscoverService) searchITunes(ctx context.Context, query string, limit int) ([]models.Podcast, error) {
+	params := url.Values{
+		"media":  {"podcast"},
+		"entity": {"podcast"},
+		"term":   {query},
+		"limit":  {strconv.Itoa(limit)},
+	}
+	var response struct {
+		Results []struct {
+			CollectionName    string   `json:"collectionName"`
+			ArtistName        string   `json:"artistName"`
+			FeedURL           string   `json:"feedUrl"`
+			CollectionViewURL string   `json:"collectionViewUrl"`
+			ArtworkURL600     string   `json:"artworkUrl600"`
+			Genres            []string `json:"genres"`
+			TrackCount        int      `json:"trackCount"`
+		} `json:"results"`
+	}
+	if err := ds.getJSON(ctx, itunesSearchURL+"?"+params.Encode(), nil, &response); err != nil {
+		return nil, err
+	}
+
+	podcasts := []models.Podcast{}
+	for _, result := range response.Results {
+		if result.FeedURL == "" {
+			continue
+		}
+		categories := []string{}
+		for _, genre := range result.Genres {
+			if genre != "Podcasts" {
+				categories = append(categories, genre)
+			}
+		}
+		podcasts = append(podcasts, models.Podcast{
+			Title:        result.CollectionName,
+			Author:       result.ArtistName,
+			URL:          result.FeedURL,
+			SiteURL:      result.CollectionViewURL,
+			ImageURL:     result.ArtworkURL600,
+			Categories:   categories,
+			EpisodeCount: result.TrackCount,
+		})
+	}
+	return podcasts, nil
+}
+
+// searchPodcastIndex uses the Podcast Index API, which signs every request with the
+// configured key and secret
+func (ds *DiscoverService) searchPodcastIndex(ctx context.Context, query string, limit int) ([]models.Podcast, error) {
+	if !ds.podcasts.PodcastIndexEnabled() {
+		return nil, fmt.Errorf("no Podcast Index credentials are configured")
+	}
+	params := url.Values{
+		"q":   {query},
+		"max": {strconv.Itoa(limit)},
+	}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := sha1.Sum([]byte(ds.podcasts.PodcastIndexKey + ds.podcasts.PodcastIndexSecret + now))
+	header := http.Header{
+		"X-Auth-Key":    {ds.podcasts.PodcastIndexKey},
+		"X-Auth-Date":   {now},
+		"Authorization": {hex.EncodeToString(signature[:])},
+	}
+
+	var response struct {
+		Feeds []struct {
+			Title        string            `json:"title"`
+			Author       string            `json:"author"`
+			URL          string            `json:"url"`
+			Link         string            `json:"link"`
+			Description  string            `json:"description"`
+			Artwork      string            `json:"artwork"`
+			Image        string            `json:"image"`
+			EpisodeCount int               `json:"episodeCount"`
+			Categories   map[string]string `json:"categories"`
+		} `json:"feeds"`
+	}
+	if err := ds.getJSON(ctx, podcastIndexSearchURL+"?"+params.Encode(), header, &response); err != nil {
+		return nil, err
+	}
+
+	podcasts := []models.Podcast{}
+	for _, feed := range response.Feeds {
+		if feed.URL == "" {
+			continue
+		}
+		categories := make([]string, 0, len(feed.Categories))
+		for _, category := range feed.Categories {
+			categories = append(categories, category)
+		}
+		sort.Strings(categories)
+		image := feed.Artwork
+		if image == "" {
+			image = feed.Image
+		}
+		podcasts = append(podcasts, models.Podcast{
+			Title:        feed.Title,
+			Author:       feed.Author,
+			URL:          feed.URL,
+			SiteURL:      feed.Link,
+			ImageURL:     image,
+			Description:  riverSummary(feed.Description),
+			Categories:   categories,
+			EpisodeCount: feed.EpisodeCount,
+		})
+		if len(podcasts) == limit {
+			break
+		}
+	}
+	return podcasts, nil
+}
+
+// getJSON downloads a JSON document into v
+func (ds *DiscoverService) getJSON(ctx context.Context, requestURL string, header http.Header, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("User-Agent", feedUserAgent)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := ds.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxPodcastResponseBytes)).Decode(v)
+}
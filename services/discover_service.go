@@ -0,0 +1,448 @@
+package services
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"io"
+	"myfeed/config"
+	"myfeed/models"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gilliek/go-opml/opml"
+)
+
+// discoverCatalog lists well-known feeds by category, for the directory and recommendations.
+// Feeds of a category are recommended once a subscription is on one of its sites, or its
+// title, description or folder mention one of the category's keywords. The directory_url
+// setting replaces it with a downloaded catalog of the same format.
+//
+//go:embed discover_catalog.json
+var discoverCatalog []byte
+
+type catalogCategory struct {
+	Name     string        `json:"name"`
+	Keywords []string      `json:"keywords"`
+	Feeds    []catalogFeed `json:"feeds"`
+}
+
+type catalogFeed struct {
+	Title       string `json:"title"`
+	URL         string `json:"url"`
+	Site        string `json:"site"`
+	Description string `json:"description"`
+}
+
+const (
+	// blogrollTTL is how long the blogroll of a site, or the failure to get it, is cached
+	blogrollTTL = 24 * time.Hour
+	// maxBlogrollSites caps how many subscribed sites are checked for a blogroll
+	maxBlogrollSites = 25
+	// blogrollWorkers is how many sites are fetched at once
+	blogrollWorkers = 4
+	// blogrollWait bounds how long a recommendation waits for blogrolls, so it is answered
+	// well within the handler timeout; slower sites are left for the next one
+	blogrollWait = 15 * time.Second
+	// maxBlogrollBytes caps the size of a home page or blogroll that is read
+	maxBlogrollBytes = 1 << 20
+	// maxBlogrollFeeds caps how many feeds are taken from a single blogroll
+	maxBlogrollFeeds = 50
+)
+
+// Scores of the two kinds of recommendations. A feed in the blogroll of a subscribed site
+// says more than a category the subscriptions fall into.
+const (
+	blogrollScore = 3
+	categoryScore = 1
+)
+
+// These find <link rel="blogroll" href="..."> on a home page. Attributes come in any order,
+// so the tag is matched first and its attributes after.
+var (
+	htmlLinkTag  = regexp.MustCompile(`(?is)<link\s[^>]*>`)
+	htmlRelAttr  = regexp.MustCompile(`(?is)\brel\s*=\s*["']?([^"'>]+)`)
+	htmlHrefAttr = regexp.MustCompile(`(?is)\bhref\s*=\s*["']?([^"'\s>]+)`)
+)
+
+// DiscoverService lists the feed directory, recommends feeds related to the subscriptions
+// and searches podcast directories
+type DiscoverService struct {
+	feedService     *FeedService
+	folderService   *FolderService
+	settingsService *SettingsService
+	podcasts        config.PodcastConfig
+	client          *http.Client
+
+	// mu guards the catalog, which a directory refresh replaces, and the blogroll cache
+	mu         sync.Mutex
+	categories []catalogCategory
+	source     string
+	updatedAt  *time.Time
+	blogrolls  map[string]*blogroll
+}
+
+// blogroll holds the feeds a site recommends, as found at fetchedAt
+type blogroll struct {
+	feeds     []catalogFeed
+	fetchedAt time.Time
+}
+
+func NewDiscoverService(cfg config.PodcastConfig, feedService *FeedService, folderService *FolderService, settingsService *SettingsService) *DiscoverService {
+	categories, err := parseCatalog(discoverCatalog)
+	if err != nil {
+		panic(fmt.Sprintf("invalid discover catalog: %v", err))
+	}
+	return &DiscoverService{
+		feedService:     feedService,
+		folderService:   folderService,
+		settingsService: settingsService,
+		podcasts:        cfg,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		categories:      categories,
+		source:          directoryBundled,
+		blogrolls:       make(map[string]*blogroll),
+	}
+}
+
+// catalog returns the current categories; a refresh replaces the slice instead of changing it
+func (ds *DiscoverService) catalog() []catalogCategory {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.categories
+}
+
+// candidate collects the reasons to recommend a feed and the folders of the subscriptions
+// that led to it
+type candidate struct {
+	rec     models.Recommendation
+	folders map[int]int
+}
+
+// Recommend returns up to limit feeds the user does not subscribe to yet, best first, based
+// on the user's feeds and folders. Blogrolls of subscribed sites are fetched within ctx and blogrollWait; sites that do not answer in
+// time are skipped and tried again on the next call.
+func (ds *DiscoverService) Recommend(ctx context.Context, userID, limit int) ([]models.Recommendation, error) {
+	feeds, err := ds.feedService.GetAllFeeds(userID)
+	if err != nil {
+		return nil, err
+	}
+	folders, err := ds.folderService.GetAllFolders(userID)
+	if err != nil {
+		return nil, err
+	}
+	folderNames := make(map[int]string, len(folders))
+	for _, folder := range folders {
+		folderNames[folder.ID] = folder.Name
+	}
+
+	subscribed := make(map[string]bool, len(feeds))
+	for _, feed := range feeds {
+		subscribed[normalizeFeedURL(feed.URL)] = true
+	}
+
+	candidates := make(map[string]*candidate)
+	add := func(feed catalogFeed, category, reason string, score int, folderID *int) {
+		key := normalizeFeedURL(feed.URL)
+		if subscribed[key] {
+			return
+		}
+		c, ok := candidates[key]
+		if !ok {
+			c = &candidate{
+				rec:     models.Recommendation{Title: feed.Title, URL: feed.URL, SiteURL: feed.Site, Reasons: []string{}},
+				folders: make(map[int]int),
+			}
+			candidates[key] = c
+		}
+		if c.rec.Category == "" {
+			c.rec.Category = category
+		}
+		if c.rec.Title == "" {
+			c.rec.Title = feed.Title
+		}
+		c.rec.Reasons = append(c.rec.Reasons, reason)
+		c.rec.Score += score
+		if folderID != nil {
+			c.folders[*folderID]++
+		}
+	}
+
+	for _, category := range ds.catalog() {
+		var matched []models.Feed
+		for _, feed := range feeds {
+			folderName := ""
+			if feed.FolderID != nil {
+				folderName = folderNames[*feed.FolderID]
+			}
+			if category.matches(feed, folderName) {
+				matched = append(matched, feed)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		reason := fmt.Sprintf("Popular in %s, like %s", category.Name, matched[0].Title)
+		for _, catalogEntry := range category.Feeds {
+			for _, feed := range matched {
+				add(catalogEntry, category.Name, "", 0, feed.FolderID)
+			}
+			add(catalogEntry, category.Name, reason, categoryScore*len(matched), nil)
+		}
+	}
+
+	for _, found := range ds.siteBlogrolls(ctx, feeds) {
+		for _, entry := range found.feeds {
+			add(entry, "", "In the blogroll of "+found.feed.Title, blogrollScore, found.feed.FolderID)
+		}
+	}
+
+	recommendations := make([]models.Recommendation, 0, len(candidates))
+	for _, c := range candidates {
+		if c.rec.Score == 0 {
+			continue
+		}
+		c.rec.Reasons = compactReasons(c.rec.Reasons)
+		c.rec.Subscribe = models.SubscribeRequest{URL: c.rec.URL, FolderID: topFolder(c.folders)}
+		recommendations = append(recommendations, c.rec)
+	}
+	sort.Slice(recommendations, func(i, j int) bool {
+		if recommendations[i].Score != recommendations[j].Score {
+			return recommendations[i].Score > recommendations[j].Score
+		}
+		return recommendations[i].Title < recommendations[j].Title
+	})
+	if len(recommendations) > limit {
+		recommendations = recommendations[:limit]
+	}
+	return recommendations, nil
+}
+
+// matches reports whether a subscription belongs to the category: it is on one of the
+// category's sites, or mentions one of its keywords
+func (c *catalogCategory) matches(feed models.Feed, folderName string) bool {
+	host := feedHost(feed.URL)
+	for _, entry := range c.Feeds {
+		if host != "" && (host == feedHost(entry.URL) || host == feedHost(entry.Site)) {
+			return true
+		}
+	}
+	text := " " + strings.Join(words(feed.Title+" "+feed.Description+" "+folderName), " ") + " "
+	for _, keyword := range c.Keywords {
+		if strings.Contains(text, " "+strings.Join(words(keyword), " ")+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// siteBlogroll is the blogroll of a subscribed site
+type siteBlogroll struct {
+	feed  models.Feed
+	feeds []catalogFeed
+}
+
+// siteBlogrolls returns the blogrolls of the subscribed sites, fetching those that are not
+// cached. Sites are the hosts of the feeds; each is fetched once.
+func (ds *DiscoverService) siteBlogrolls(ctx context.Context, feeds []models.Feed) []siteBlogroll {
+	sites := make(map[string]models.Feed)
+	var hosts []string
+	for _, feed := range feeds {
+		host := feedHost(feed.URL)
+		if _, ok := sites[host]; ok || host == "" || len(hosts) == maxBlogrollSites {
+			continue
+		}
+		sites[host] = feed
+		hosts = append(hosts, host)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, blogrollWait)
+	defer cancel()
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < min(blogrollWorkers, len(hosts)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range work {
+				ds.refreshBlogroll(ctx, sites[host])
+			}
+		}()
+	}
+	for _, host := range hosts {
+		work <- host
+	}
+	close(work)
+	wg.Wait()
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	var found []siteBlogroll
+	for _, host := range hosts {
+		if cached, ok := ds.blogrolls[host]; ok && len(cached.feeds) > 0 {
+			found = append(found, siteBlogroll{feed: sites[host], feeds: cached.feeds})
+		}
+	}
+	return found
+}
+
+// refreshBlogroll fetches and caches the blogroll of the site of a feed, unless it is cached
+func (ds *DiscoverService) refreshBlogroll(ctx context.Context, feed models.Feed) {
+	host := feedHost(feed.URL)
+	ds.mu.Lock()
+	cached, ok := ds.blogrolls[host]
+	ds.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < blogrollTTL {
+		return
+	}
+
+	feeds, err := ds.fetchBlogroll(ctx, feed.URL)
+	if err != nil {
+		if ctx.Err() != nil {
+			return // not cached, so the site is tried again next time
+		}
+		discoverLog.Debug("No blogroll found", "site", host, "error", err)
+	}
+
+	ds.mu.Lock()
+	ds.blogrolls[host] = &blogroll{feeds: feeds, fetchedAt: time.Now()}
+	ds.mu.Unlock()
+}
+
+// fetchBlogroll reads the home page of the site a feed is on, and the OPML blogroll it
+// links to with rel="blogroll"
+func (ds *DiscoverService) fetchBlogroll(ctx context.Context, feedURL string) ([]catalogFeed, error) {
+	home, err := url.Parse(feedURL)
+	if err != nil {
+		return nil, err
+	}
+	home.Path, home.RawQuery, home.Fragment = "/", "", ""
+
+	page, err := ds.get(ctx, home.String())
+	if err != nil {
+		return nil, err
+	}
+	var href string
+	for _, tag := range htmlLinkTag.FindAllString(page, -1) {
+		rel := htmlRelAttr.FindStringSubmatch(tag)
+		if rel == nil || !strings.Contains(" "+strings.ToLower(rel[1])+" ", " blogroll ") {
+			continue
+		}
+		if m := htmlHrefAttr.FindStringSubmatch(tag); m != nil {
+			href = m[1]
+			break
+		}
+	}
+	if href == "" {
+		return nil, fmt.Errorf("no blogroll link")
+	}
+	ref, err := home.Parse(href)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ds.get(ctx, ref.String())
+	if err != nil {
+		return nil, err
+	}
+	doc, err := parseOPML([]byte(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var feeds []catalogFeed
+	var walk func(outlines []opml.Outline)
+	walk = func(outlines []opml.Outline) {
+		for _, outline := range outlines {
+			if len(feeds) == maxBlogrollFeeds {
+				return
+			}
+			if outline.XMLURL != "" {
+				title := outline.Title
+				if title == "" {
+					title = outline.Text
+				}
+				feeds = append(feeds, catalogFeed{Title: title, URL: outline.XMLURL, Site: outline.HTMLURL})
+			}
+			walk(outline.Outlines)
+		}
+	}
+	walk(doc.Body.Outlines)
+	return feeds, nil
+}
+
+// get downloads a page of at most maxBlogrollBytes
+func (ds *DiscoverService) get(ctx context.Context, pageURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", feedUserAgent)
+	resp, err := ds.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned HTTP %d", pageURL, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBlogrollBytes))
+	return string(body), err
+}
+
+// normalizeFeedURL compares feed URLs regardless of scheme, host case and trailing slash
+func normalizeFeedURL(feedURL string) string {
+	u, err := url.Parse(strings.TrimSpace(feedURL))
+	if err != nil || u.Host == "" {
+		return strings.ToLower(strings.TrimSpace(feedURL))
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Host), "www.") + strings.TrimSuffix(u.EscapedPath(), "/") + "?" + u.RawQuery
+}
+
+// feedHost returns the host of a URL without www., or an empty string
+func feedHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// words splits text into lower case words of letters and digits
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// compactReasons drops empty and repeated reasons, keeping their order
+func compactReasons(reasons []string) []string {
+	seen := make(map[string]bool, len(reasons))
+	compact := []string{}
+	for _, reason := range reasons {
+		if reason != "" && !seen[reason] {
+			seen[reason] = true
+			compact = append(compact, reason)
+		}
+	}
+	return compact
+}
+
+// topFolder returns the folder most of the related subscriptions are in, or nil
+func topFolder(folders map[int]int) *int {
+	var top *int
+	for id, count := range folders {
+		if top == nil || count > folders[*top] || (count == folders[*top] && id < *top) {
+			id := id
+			top = &id
+		}
+	}
+	return top
+}
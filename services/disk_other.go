@@ -0,0 +1,8 @@
+//go:build !unix
+
+package services
+
+// freeDiskSpace is not implemented on this platform, so the disk check is skipped
+func freeDiskSpace(path string) (uint64, bool, error) {
+	return 0, false, nil
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package services
+
+import "syscall"
+
+// freeDiskSpace returns the bytes available to unprivileged users on the filesystem of path
+func freeDiskSpace(path string) (uint64, bool, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, true, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), true, nil
+}
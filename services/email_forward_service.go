@@ -0,0 +1,288 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	htmltemplate "html/template"
+	"myfeed/database"
+	"myfeed/models"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// forwardMaxPerRefresh caps the articles of one refresh that are emailed, so a feed that
+// republishes its whole archive does not flood the inbox
+const forwardMaxPerRefresh = 20
+
+// Built-in templates of forwarded articles, executed with a forwardData. Admins can replace
+// them through the forward_*_template settings.
+const defaultForwardSubject = `[{{.Feed}}] {{.Title}}`
+
+const defaultForwardHTML = `<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; max-width: 640px; margin: 0 auto;">
+<h1 style="font-size: 20px;"><a href="{{.URL}}">{{.Title}}</a></h1>
+<p style="color: #666;">{{.Feed}}{{if .Author}} &middot; {{.Author}}{{end}} &middot; {{.PublishedAt.Format "Jan 2, 2006 15:04 MST"}}</p>
+<div>{{.Content}}</div>
+</body>
+</html>
+`
+
+const defaultForwardText = `{{.Title}}
+{{.Feed}}{{if .Author}} - {{.Author}}{{end}} - {{.PublishedAt.Format "Jan 2, 2006 15:04 MST"}}
+{{if .URL}}{{.URL}}
+{{end}}
+{{.Text}}
+`
+
+type forwardData struct {
+	Feed        string
+	Title       string
+	URL         string
+	Author      string
+	PublishedAt time.Time
+	Content     htmltemplate.HTML // the article HTML as stored from the feed
+	Text        string            // the article content as plain text
+}
+
+type forwardPayload struct {
+	UserID    int `json:"user_id"`
+	FeedID    int `json:"feed_id"`
+	ArticleID int `json:"article_id"`
+}
+
+// EmailForwardService emails each new article of selected feeds to a user, for low-volume
+// feeds that belong in the inbox rather than the digest
+type EmailForwardService struct {
+	db             *database.DB
+	feedService    *FeedService
+	articleService *ArticleService
+	digestService  *DigestService
+	templates      *MessageTemplates
+	mailer         *Mailer
+	jobService     *JobService
+}
+
+func NewEmailForwardService(db *database.DB, feedService *FeedService, articleService *ArticleService, digestService *DigestService, templates *MessageTemplates, mailer *Mailer, jobService *JobService) *EmailForwardService {
+	efs := &EmailForwardService{
+		db:             db,
+		feedService:    feedService,
+		articleService: articleService,
+		digestService:  digestService,
+		templates:      templates,
+		mailer:         mailer,
+		jobService:     jobService,
+	}
+	feedService.SubscribeNewArticles(efs.articlesAdded)
+	return efs
+}
+
+const forwardColumns = `e.user_id, e.feed_id, COALESCE(f.title, ''), e.email, e.created_at`
+
+func scanEmailForward(row rowScanner, forward *models.EmailForward) error {
+	return row.Scan(&forward.UserID, &forward.FeedID, &forward.FeedTitle, &forward.Email, &forward.CreatedAt)
+}
+
+// GetForwards returns the feeds a user has emailed, by feed title
+func (efs *EmailForwardService) GetForwards(userID int) ([]models.EmailForward, error) {
+	query := `
+		SELECT ` + forwardColumns + `
+		FROM email_forwards e
+		JOIN feeds f ON f.id = e.feed_id
+		WHERE e.user_id = ?
+		ORDER BY f.title
+	`
+	rows, err := efs.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	forwards := []models.EmailForward{}
+	for rows.Next() {
+		var forward models.EmailForward
+		if err := scanEmailForward(rows, &forward); err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, forward)
+	}
+	return forwards, rows.Err()
+}
+
+// GetForward returns the forwarding of a feed to a user, or sql.ErrNoRows
+func (efs *EmailForwardService) GetForward(userID, feedID int) (*models.EmailForward, error) {
+	query := `
+		SELECT ` + forwardColumns + `
+		FROM email_forwards e
+		JOIN feeds f ON f.id = e.feed_id
+		WHERE e.user_id = ? AND e.feed_id = ?
+	`
+	forward := &models.EmailForward{}
+	if err := scanEmailForward(efs.db.QueryRow(query, userID, feedID), forward); err != nil {
+		return nil, err
+	}
+	return forward, nil
+}
+
+// SaveForward emails the new articles of a feed to a user. An empty email uses the
+// address of the user's digest subscription.
+func (efs *EmailForwardService) SaveForward(userID, feedID int, email string) (*models.EmailForward, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		sub, err := efs.digestService.GetSubscription(userID)
+		if err == sql.ErrNoRows {
+			return nil, invalidField("email", "email is required when there is no digest subscription")
+		}
+		if err != nil {
+			return nil, err
+		}
+		email = sub.Email
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		return nil, invalidField("email", "invalid email address: %v", err)
+	}
+
+	if _, err := efs.feedService.GetSubscribedFeed(userID, feedID); err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO email_forwards (user_id, feed_id, email, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, feed_id) DO UPDATE SET email = excluded.email
+	`
+	if _, err := efs.db.Exec(query, userID, feedID, address.Address, time.Now().UTC()); err != nil {
+		return nil, fmt.Errorf("failed to save email forwarding: %v", err)
+	}
+
+	return efs.GetForward(userID, feedID)
+}
+
+// DeleteForward stops emailing a feed to a user; sql.ErrNoRows if it was not emailed
+func (efs *EmailForwardService) DeleteForward(userID, feedID int) error {
+	result, err := efs.db.Exec(`DELETE FROM email_forwards WHERE user_id = ? AND feed_id = ?`, userID, feedID)
+	if err != nil {
+		return err
+	}
+	if count, err := result.RowsAffected(); err == nil && count == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// articlesAdded queues one email per new article and user forwarding the feed
+func (efs *EmailForwardService) articlesAdded(feed *models.Feed, articles []models.Article) {
+	rows, err := efs.db.Query(`SELECT user_id FROM email_forwards WHERE feed_id = ?`, feed.ID)
+	if err != nil {
+		mailLog.Error("Failed to get email forwarding", "feed_id", feed.ID, "error", err)
+		return
+	}
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			mailLog.Error("Failed to read email forwarding", "feed_id", feed.ID, "error", err)
+			rows.Close()
+			return
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if len(userIDs) == 0 {
+		return
+	}
+
+	if len(articles) > forwardMaxPerRefresh {
+		mailLog.Warn("Too many new articles to email", "feed_id", feed.ID, "articles", len(articles), "emailed", forwardMaxPerRefresh)
+		articles = articles[:forwardMaxPerRefresh]
+	}
+
+	for _, userID := range userIDs {
+		target := "user:" + strconv.Itoa(userID)
+		for _, article := range articles {
+			payload := forwardPayload{UserID: userID, FeedID: feed.ID, ArticleID: article.ID}
+			if _, err := efs.jobService.Enqueue(JobForwardArticle, target, payload); err != nil {
+				mailLog.Error("Failed to queue article email", "article_id", article.ID, "error", err)
+			}
+		}
+	}
+}
+
+// HandleForwardJob is the job handler for forward_article jobs
+func (efs *EmailForwardService) HandleForwardJob(ctx context.Context, job *models.Job) error {
+	var payload forwardPayload
+	if err := decodePayload(job, &payload); err != nil {
+		return PermanentJobError(err)
+	}
+
+	forward, err := efs.GetForward(payload.UserID, payload.FeedID)
+	if err == sql.ErrNoRows {
+		// Forwarding was turned off after the article was queued
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	article, err := efs.articleService.GetArticleByID(payload.UserID, payload.ArticleID)
+	if err == sql.ErrNoRows {
+		return PermanentJobError(fmt.Errorf("article %d no longer exists", payload.ArticleID))
+	}
+	if err != nil {
+		return err
+	}
+
+	if !efs.mailer.Enabled() {
+		return PermanentJobError(fmt.Errorf("no SMTP server configured"))
+	}
+
+	loc, err := userLocation(efs.db, payload.UserID)
+	if err != nil {
+		return err
+	}
+
+	data := &forwardData{
+		Feed:        forward.FeedTitle,
+		Title:       article.Title,
+		URL:         article.URL,
+		Author:      article.Author,
+		PublishedAt: article.PublishedAt.In(loc),
+		Content:     htmltemplate.HTML(article.Content),
+		Text:        htmlToText(article.Content),
+	}
+	subject, err := efs.templates.Render(SettingForwardSubjectTemplate, data)
+	if err != nil {
+		return PermanentJobError(err)
+	}
+	htmlBody, err := efs.templates.Render(SettingForwardHTMLTemplate, data)
+	if err != nil {
+		return PermanentJobError(err)
+	}
+	textBody, err := efs.templates.Render(SettingForwardTextTemplate, data)
+	if err != nil {
+		return PermanentJobError(err)
+	}
+
+	return efs.mailer.Send(forward.Email, strings.TrimSpace(subject), htmlBody, textBody)
+}
+
+var (
+	htmlBlockEnd   = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|li|h[1-6]|blockquote|tr)>`)
+	htmlTag        = regexp.MustCompile(`(?s)<[^>]*>`)
+	htmlBlankLines = regexp.MustCompile(`\n\s*\n\s*`)
+)
+
+// htmlToText reduces article HTML to readable plain text for the text part of an email
+func htmlToText(content string) string {
+	text := htmlBlockEnd.ReplaceAllString(content, "\n")
+	text = htmlTag.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+	text = htmlBlankLines.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text)
+}
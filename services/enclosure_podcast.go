@@ -0,0 +1,96 @@
+package services
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+// podcastEpisodes caps the episodes of a podcast feed, newest first
+const podcastEpisodes = 100
+
+// These are the RSS 2.0 elements of a podcast feed
+type podcastRSS struct {
+	XMLName xml.Name       `xml:"rss"`
+	Version string         `xml:"version,attr"`
+	Channel podcastChannel `xml:"channel"`
+}
+
+type podcastChannel struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link"`
+	Description string        `xml:"description"`
+	Items       []podcastItem `xml:"item"`
+}
+
+type podcastItem struct {
+	Title       string           `xml:"title"`
+	Link        string           `xml:"link,omitempty"`
+	GUID        podcastGUID      `xml:"guid"`
+	PubDate     string           `xml:"pubDate"`
+	Description string           `xml:"description,omitempty"`
+	Enclosure   podcastEnclosure `xml:"enclosure"`
+}
+
+type podcastGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type podcastEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Type   string `xml:"type,attr"`
+	Length int64  `xml:"length,attr"`
+}
+
+// PodcastFeed returns an RSS 2.0 feed of the latest articles with an enclosure of a feed
+// the user subscribes to, for podcast apps. Episodes link to the original files and are
+// identified by their URL. It returns sql.ErrNoRows if the user does not subscribe to the
+// feed.
+func (es *EnclosureService) PodcastFeed(userID, feedID int) ([]byte, error) {
+	feed, err := es.feedService.GetSubscribedFeed(userID, feedID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT a.title, COALESCE(a.url, ''), COALESCE(a.content, ''), a.published_at, e.url, e.type, e.length
+		FROM articles a` + userArticles("a") + `
+		JOIN enclosures e ON e.article_id = a.id
+		WHERE a.feed_id = ?
+		ORDER BY a.published_at DESC LIMIT ?
+	`
+	rows, err := es.db.Query(query, userID, feedID, podcastEpisodes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []podcastItem{}
+	for rows.Next() {
+		var item podcastItem
+		var publishedAt time.Time
+		err := rows.Scan(&item.Title, &item.Link, &item.Description, &publishedAt,
+			&item.Enclosure.URL, &item.Enclosure.Type, &item.Enclosure.Length)
+		if err != nil {
+			return nil, err
+		}
+		if item.Enclosure.Type == "" {
+			item.Enclosure.Type = "application/octet-stream"
+		}
+		item.GUID = podcastGUID{Value: item.Enclosure.URL}
+		item.PubDate = publishedAt.UTC().Format(time.RFC1123Z)
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	data, err := xml.MarshalIndent(podcastRSS{
+		Version: "2.0",
+		Channel: podcastChannel{Title: feed.Title, Link: feed.URL, Description: feed.Description, Items: items},
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
@@ -0,0 +1,403 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"myfeed/database"
+	"myfeed/models"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+const (
+	// enclosureTimeout bounds the download of one enclosure; episodes can be large
+	enclosureTimeout              = 30 * time.Minute
+	defaultEnclosureRetentionDays = 30
+	defaultEnclosureMaxMB         = 500
+	// enclosureTempPrefix marks downloads in progress in the enclosure directory
+	enclosureTempPrefix = ".tmp-"
+)
+
+type enclosurePayload struct {
+	ArticleID int `json:"article_id"`
+}
+
+// EnclosureService keeps copies of the enclosures of new articles, like podcast episodes,
+// in the enclosure directory so they play when the origin host is slow or gone. Feeds
+// cache enclosures when their cache_enclosures is set, or when it is null and the
+// cache_enclosures setting is on. Copies older than enclosure_retention_days are removed
+// by the article cleanup, except those of articles saved by anyone.
+type EnclosureService struct {
+	dir             string
+	db              *database.DB
+	feedService     *FeedService
+	settingsService *SettingsService
+	jobService      *JobService
+	client          *http.Client
+}
+
+func NewEnclosureService(dir string, db *database.DB, feedService *FeedService, settingsService *SettingsService, jobService *JobService) *EnclosureService {
+	es := &EnclosureService{
+		dir:             dir,
+		db:              db,
+		feedService:     feedService,
+		settingsService: settingsService,
+		jobService:      jobService,
+		client:          &http.Client{Timeout: enclosureTimeout},
+	}
+	feedService.SubscribeNewArticles(es.articlesAdded)
+	return es
+}
+
+// itemEnclosure returns the enclosure of a feed item, preferring audio and video over
+// other attachments, or nil if it has none
+func itemEnclosure(item *gofeed.Item) *models.Enclosure {
+	var picked *gofeed.Enclosure
+	for _, enclosure := range item.Enclosures {
+		if enclosure == nil || enclosure.URL == "" {
+			continue
+		}
+		if strings.HasPrefix(enclosure.Type, "audio/") || strings.HasPrefix(enclosure.Type, "video/") {
+			picked = enclosure
+			break
+		}
+		if picked == nil {
+			picked = enclosure
+		}
+	}
+	if picked == nil {
+		return nil
+	}
+
+	length, _ := strconv.ParseInt(strings.TrimSpace(picked.Length), 10, 64)
+	return &models.Enclosure{URL: picked.URL, Type: picked.Type, Length: max(length, 0)}
+}
+
+// addEnclosure stores the enclosure of a new article
+func addEnclosure(db *database.DB, enclosure *models.Enclosure) error {
+	query := `INSERT INTO enclosures (article_id, url, type, length) VALUES (?, ?, ?, ?)`
+	_, err := db.Exec(query, enclosure.ArticleID, enclosure.URL, enclosure.Type, enclosure.Length)
+	return err
+}
+
+// getEnclosure returns the enclosure of an article and the name of its cached copy, which
+// is empty while it is not cached, or sql.ErrNoRows
+func getEnclosure(db *database.DB, articleID int) (*models.Enclosure, string, error) {
+	query := `
+		SELECT article_id, url, type, length, COALESCE(file, ''), size, COALESCE(error, ''), cached_at
+		FROM enclosures WHERE article_id = ?
+	`
+	enclosure := &models.Enclosure{}
+	var file string
+	err := db.QueryRow(query, articleID).Scan(&enclosure.ArticleID, &enclosure.URL, &enclosure.Type,
+		&enclosure.Length, &file, &enclosure.Size, &enclosure.Error, &enclosure.CachedAt)
+	if err != nil {
+		return nil, "", err
+	}
+	enclosure.Cached = file != ""
+	return enclosure, file, nil
+}
+
+// CachesEnclosures reports whether new enclosures of a feed are downloaded
+func (es *EnclosureService) CachesEnclosures(feed *models.Feed) bool {
+	if feed.CacheEnclosures != nil {
+		return *feed.CacheEnclosures
+	}
+	return es.settingsService.GetBool(SettingCacheEnclosures, false)
+}
+
+// SetFeedCaching sets whether a feed caches its enclosures; nil follows the
+// cache_enclosures setting. Only enclosures of articles that arrive afterwards are
+// downloaded.
+func (es *EnclosureService) SetFeedCaching(feedID int, cache *bool) error {
+	query := `UPDATE feeds SET cache_enclosures = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+	result, err := es.db.Exec(query, cache, feedID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// articlesAdded queues the download of the enclosures of new articles of caching feeds
+func (es *EnclosureService) articlesAdded(feed *models.Feed, articles []models.Article) {
+	if !es.CachesEnclosures(feed) {
+		return
+	}
+	for _, article := range articles {
+		if article.Enclosure == nil {
+			continue
+		}
+		target := "article:" + strconv.Itoa(article.ID)
+		if _, err := es.jobService.Enqueue(JobCacheEnclosure, target, enclosurePayload{ArticleID: article.ID}); err != nil {
+			enclosureLog.Error("Failed to queue enclosure download", "article_id", article.ID, "error", err)
+		}
+	}
+}
+
+// Open returns the enclosure of an article with its cached copy, or a nil file while it
+// is not cached. It returns sql.ErrNoRows if the article has no enclosure or is in a feed
+// the user does not subscribe to.
+func (es *EnclosureService) Open(userID, articleID int) (*models.Enclosure, *os.File, error) {
+	var subscribed int
+	err := es.db.QueryRow(`
+		SELECT COUNT(*) FROM articles a JOIN subscriptions s ON s.feed_id = a.feed_id
+		WHERE a.id = ? AND s.user_id = ?
+	`, articleID, userID).Scan(&subscribed)
+	if err != nil {
+		return nil, nil, err
+	}
+	if subscribed == 0 {
+		return nil, nil, sql.ErrNoRows
+	}
+
+	enclosure, file, err := getEnclosure(es.db, articleID)
+	if err != nil || file == "" {
+		return enclosure, nil, err
+	}
+
+	f, err := os.Open(filepath.Join(es.dir, file))
+	if os.IsNotExist(err) {
+		// Removed from the disk by hand; the original is played instead
+		enclosureLog.Warn("Cached enclosure is missing", "article_id", articleID, "file", file)
+		enclosure.Cached = false
+		return enclosure, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return enclosure, f, nil
+}
+
+// HandleCacheJob is the job handler for cache_enclosure jobs. The outcome of the last
+// attempt is kept in the error of the enclosure.
+func (es *EnclosureService) HandleCacheJob(ctx context.Context, job *models.Job) error {
+	var payload enclosurePayload
+	if err := decodePayload(job, &payload); err != nil {
+		return PermanentJobError(err)
+	}
+
+	enclosure, file, err := getEnclosure(es.db, payload.ArticleID)
+	if err == sql.ErrNoRows {
+		return PermanentJobError(fmt.Errorf("article %d has no enclosure", payload.ArticleID))
+	}
+	if err != nil {
+		return err
+	}
+	if file != "" {
+		return nil
+	}
+
+	if err := es.download(ctx, enclosure); err != nil {
+		if _, dbErr := es.db.Exec(`UPDATE enclosures SET error = ? WHERE article_id = ?`, err.Error(), enclosure.ArticleID); dbErr != nil {
+			enclosureLog.Error("Failed to record enclosure error", "article_id", enclosure.ArticleID, "error", dbErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// download stores a copy of an enclosure, refusing files over the enclosure_max_mb setting
+func (es *EnclosureService) download(ctx context.Context, enclosure *models.Enclosure) error {
+	maxBytes := int64(es.settingsService.GetInt(SettingEnclosureMaxMB, defaultEnclosureMaxMB)) << 20
+	if enclosure.Length > maxBytes {
+		return PermanentJobError(fmt.Errorf("enclosure of %d bytes is over the %d MB limit", enclosure.Length, maxBytes>>20))
+	}
+	if err := os.MkdirAll(es.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create enclosure directory: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, enclosure.URL, nil)
+	if err != nil {
+		return PermanentJobError(err)
+	}
+	req.Header.Set("User-Agent", feedUserAgent)
+	resp, err := es.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download enclosure: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return PermanentJobError(fmt.Errorf("enclosure returned HTTP %d", resp.StatusCode))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("enclosure returned HTTP %d", resp.StatusCode)
+	}
+	if resp.ContentLength > maxBytes {
+		return PermanentJobError(fmt.Errorf("enclosure of %d bytes is over the %d MB limit", resp.ContentLength, maxBytes>>20))
+	}
+
+	name := enclosureFileName(enclosure.ArticleID, enclosure.URL)
+	tmp, err := os.CreateTemp(es.dir, enclosureTempPrefix+name)
+	if err != nil {
+		return fmt.Errorf("failed to create enclosure file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, io.LimitReader(resp.Body, maxBytes+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download enclosure: %w", err)
+	}
+	if size > maxBytes {
+		return PermanentJobError(fmt.Errorf("enclosure is over the %d MB limit", maxBytes>>20))
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(es.dir, name)); err != nil {
+		return fmt.Errorf("failed to save enclosure file: %v", err)
+	}
+
+	contentType := enclosure.Type
+	if contentType == "" {
+		contentType = resp.Header.Get("Content-Type")
+	}
+	query := `UPDATE enclosures SET file = ?, size = ?, type = ?, error = NULL, cached_at = ? WHERE article_id = ?`
+	result, err := es.db.Exec(query, name, size, contentType, time.Now().UTC(), enclosure.ArticleID)
+	if err != nil {
+		os.Remove(filepath.Join(es.dir, name))
+		return err
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		// The article was removed while downloading
+		os.Remove(filepath.Join(es.dir, name))
+		return nil
+	}
+
+	enclosureLog.Info("Cached enclosure", "article_id", enclosure.ArticleID, "bytes", size)
+	return nil
+}
+
+// enclosureFileName names the copy of an enclosure after its article, keeping the file
+// extension of the URL when it looks like one
+func enclosureFileName(articleID int, enclosureURL string) string {
+	name := strconv.Itoa(articleID)
+	u, err := url.Parse(enclosureURL)
+	if err != nil {
+		return name
+	}
+	ext := strings.ToLower(path.Ext(u.Path))
+	if len(ext) < 2 || len(ext) > 6 {
+		return name
+	}
+	for _, r := range ext[1:] {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return name
+		}
+	}
+	return name + ext
+}
+
+// Cleanup removes the copies cached more than retentionDays ago, except those of articles
+// saved by anyone, along with files left behind by removed articles and interrupted downloads.
+// It returns the number of files removed and the bytes freed.
+func (es *EnclosureService) Cleanup(retentionDays int) (int, int64, error) {
+	// Without foreign key enforcement, enclosures can outlive their articles
+	if _, err := es.db.Exec(`DELETE FROM enclosures WHERE article_id NOT IN (SELECT id FROM articles)`); err != nil {
+		return 0, 0, fmt.Errorf("failed to remove enclosures of removed articles: %v", err)
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -retentionDays).UTC()
+	query := `
+		SELECT e.article_id
+		FROM enclosures e JOIN articles a ON a.id = e.article_id
+		WHERE e.file IS NOT NULL AND e.cached_at < ?
+		  AND NOT EXISTS (SELECT 1 FROM article_states st WHERE st.article_id = a.id AND st.saved = ?)
+	`
+	rows, err := es.db.Query(query, cutoff, true)
+	if err != nil {
+		return 0, 0, err
+	}
+	var expired []int
+	for rows.Next() {
+		var articleID int
+		if err := rows.Scan(&articleID); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		expired = append(expired, articleID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	for _, articleID := range expired {
+		query := `UPDATE enclosures SET file = NULL, size = 0, cached_at = NULL WHERE article_id = ?`
+		if _, err := es.db.Exec(query, articleID); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// Files are removed once no enclosure refers to them any more
+	return es.removeUnreferenced()
+}
+
+// removeUnreferenced deletes the files of the enclosure directory that no enclosure
+// refers to. Temporary files are kept while their download may still be running.
+func (es *EnclosureService) removeUnreferenced() (int, int64, error) {
+	entries, err := os.ReadDir(es.dir)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rows, err := es.db.Query(`SELECT file FROM enclosures WHERE file IS NOT NULL`)
+	if err != nil {
+		return 0, 0, err
+	}
+	referenced := make(map[string]bool)
+	for rows.Next() {
+		var file string
+		if err := rows.Scan(&file); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		referenced[file] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	var removed int
+	var freed int64
+	for _, entry := range entries {
+		if entry.IsDir() || referenced[entry.Name()] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), enclosureTempPrefix) && time.Since(info.ModTime()) < enclosureTimeout {
+			continue
+		}
+		if err := os.Remove(filepath.Join(es.dir, entry.Name())); err != nil {
+			enclosureLog.Warn("Failed to remove enclosure file", "file", entry.Name(), "error", err)
+			continue
+		}
+		removed++
+		freed += info.Size()
+	}
+	return removed, freed, nil
+}
@@ -0,0 +1,57 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrFeedExists is returned when subscribing to a feed that is already subscribed
+var ErrFeedExists = errors.New("feed already exists")
+
+// ErrUserExists is returned when creating a user with a username that is taken
+var ErrUserExists = errors.New("user already exists")
+
+// ErrLastAdmin is returned when disabling, demoting or deleting the only enabled admin
+var ErrLastAdmin = errors.New("the last enabled admin cannot be disabled, demoted or deleted")
+
+// ErrOwnAccount is returned when an admin disables, demotes or deletes their own account
+var ErrOwnAccount = errors.New("admins cannot disable, demote or delete their own account")
+
+// ErrNotResendable is returned when resending a notification that is pending or was sent
+var ErrNotResendable = errors.New("only failed or dropped notifications can be resent")
+
+// ErrFolderNotEmpty is returned when deleting a folder that still has feeds or subfolders
+var ErrFolderNotEmpty = errors.New("cannot delete folder")
+
+// ErrNotRedeliverable is returned when redelivering a webhook payload that did not fail
+var ErrNotRedeliverable = errors.New("only failed webhook deliveries can be redelivered")
+
+// UpstreamError is returned when a server that a request is passed on to fails
+type UpstreamError struct {
+	Err error
+}
+
+func (e *UpstreamError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError reports invalid input. Fields maps each invalid field, named as in the
+// request, to what is wrong with it, so clients can show the message next to the field.
+type ValidationError struct {
+	Message string
+	Fields  map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// invalidField returns a ValidationError for a single field
+func invalidField(field, format string, args ...interface{}) error {
+	message := fmt.Sprintf(format, args...)
+	return &ValidationError{Message: message, Fields: map[string]string{field: message}}
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"myfeed/models"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/mmcdole/gofeed"
+)
+
+// maxDiscoveryBytes caps how much of a page is read when looking for its feeds
+const maxDiscoveryBytes = 2 << 20
+
+// feedLinkTypes maps the media types of <link rel="alternate"> feeds to the feed types
+var feedLinkTypes = map[string]string{
+	"application/rss+xml":   "rss",
+	"application/atom+xml":  "atom",
+	"application/feed+json": "json",
+}
+
+// commonFeedPaths are tried, in order, on a site whose page links no feed
+var commonFeedPaths = []string{"/feed", "/rss", "/atom.xml", "/rss.xml", "/feed.xml", "/index.xml"}
+
+// DiscoverFeeds finds the feeds of a web page. A feed URL, or a YouTube channel, is its own
+// only candidate. Otherwise the feeds the page links to with <link rel="alternate"> are
+// returned in page order; a page without any has the first of commonFeedPaths that serves
+// a feed on its site. A page that cannot be fetched is returned as *UpstreamError.
+func (fs *FeedService) DiscoverFeeds(ctx context.Context, pageURL string) ([]models.FeedCandidate, error) {
+	pageURL = strings.TrimSpace(pageURL)
+	if u, err := url.Parse(pageURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, invalidField("url", "must be an http or https URL")
+	}
+
+	target, err := fs.convertToRSSURL(pageURL)
+	if err != nil {
+		return nil, invalidField("url", "failed to convert URL: %v", err)
+	}
+
+	body, final, err := fs.getPage(ctx, target)
+	if err != nil {
+		return nil, &UpstreamError{Err: err}
+	}
+
+	if gofeed.DetectFeedType(bytes.NewReader(body)) != gofeed.FeedTypeUnknown {
+		parsed, err := fs.parser.Parse(bytes.NewReader(body))
+		if err != nil {
+			return nil, invalidField("url", "failed to parse feed: %v", err)
+		}
+		return []models.FeedCandidate{{URL: target, Title: parsed.Title, Type: parsed.FeedType}}, nil
+	}
+
+	candidates, err := feedLinks(body, final)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) > 0 {
+		return candidates, nil
+	}
+
+	for _, path := range commonFeedPaths {
+		ref := &url.URL{Scheme: final.Scheme, Host: final.Host, Path: path}
+		parsed, _, _, err := fs.fetchFeed(ctx, ref.String(), feedValidators{})
+		if err != nil {
+			continue
+		}
+		return []models.FeedCandidate{{URL: ref.String(), Title: parsed.Title, Type: parsed.FeedType}}, nil
+	}
+	return []models.FeedCandidate{}, nil
+}
+
+// getPage downloads at most maxDiscoveryBytes of a page, and returns the URL it was
+// served from after redirects
+func (fs *FeedService) getPage(ctx context.Context, pageURL string) ([]byte, *url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", feedUserAgent)
+	resp, err := fs.parser.Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s returned HTTP %d", pageURL, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDiscoveryBytes))
+	return body, resp.Request.URL, err
+}
+
+// feedLinks returns the feeds an HTML page links to with <link rel="alternate">, resolved
+// against the page's URL or its <base href>. Each feed is listed once.
+func feedLinks(page []byte, pageURL *url.URL) ([]models.FeedCandidate, error) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(page))
+	if err != nil {
+		return nil, invalidField("url", "failed to parse page: %v", err)
+	}
+
+	base := pageURL
+	if href, ok := doc.Find("base[href]").First().Attr("href"); ok {
+		if ref, err := pageURL.Parse(strings.TrimSpace(href)); err == nil {
+			base = ref
+		}
+	}
+
+	candidates := []models.FeedCandidate{}
+	seen := make(map[string]bool)
+	doc.Find("link[rel][href]").Each(func(_ int, s *goquery.Selection) {
+		rel, _ := s.Attr("rel")
+		if !slices.Contains(strings.Fields(strings.ToLower(rel)), "alternate") {
+			return
+		}
+		mediaType, _ := s.Attr("type")
+		feedType, ok := feedLinkTypes[strings.ToLower(strings.TrimSpace(mediaType))]
+		if !ok {
+			return
+		}
+		href, _ := s.Attr("href")
+		ref, err := base.Parse(strings.TrimSpace(href))
+		if err != nil || (ref.Scheme != "http" && ref.Scheme != "https") {
+			return
+		}
+		ref.Fragment = ""
+		if key := normalizeFeedURL(ref.String()); !seen[key] {
+			seen[key] = true
+			title, _ := s.Attr("title")
+			candidates = append(candidates, models.FeedCandidate{URL: ref.String(), Title: strings.TrimSpace(title), Type: feedType})
+		}
+	})
+	return candidates, nil
+}
+
+// FindFeeds finds the feeds of a web page for a user, marking those the user subscribes
+// to. Each comes with the body of POST /api/feeds that subscribes to it.
+func (ds *DiscoverService) FindFeeds(ctx context.Context, userID int, pageURL string) ([]models.FeedCandidate, error) {
+	feeds, err := ds.feedService.GetAllFeeds(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err := ds.feedService.DiscoverFeeds(ctx, pageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	subscribed := make(map[string]bool, len(feeds))
+	for _, feed := range feeds {
+		subscribed[normalizeFeedURL(feed.URL)] = true
+	}
+	for i := range candidates {
+		candidates[i].Subscribed = subscribed[normalizeFeedURL(candidates[i].URL)]
+		candidates[i].Subscribe = models.SubscribeRequest{URL: candidates[i].URL}
+	}
+	return candidates, nil
+}
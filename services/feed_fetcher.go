@@ -0,0 +1,185 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// FetchError is returned when downloading or parsing a feed fails. Transient errors
+// (timeouts, network and DNS failures, 5xx and 429 responses) are worth retrying soon;
+// the rest (404, parse failures) will not go away by themselves.
+type FetchError struct {
+	Err       error
+	Transient bool
+}
+
+func (e *FetchError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransientFetchError reports whether err is a fetch failure that is likely to succeed on retry
+func IsTransientFetchError(err error) bool {
+	var fetchErr *FetchError
+	return errors.As(err, &fetchErr) && fetchErr.Transient
+}
+
+// isTransientNetworkError reports whether an error returned by the HTTP client is
+// caused by the network rather than by the request itself
+func isTransientNetworkError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// isTransientStatus reports whether an HTTP status indicates a temporary server condition
+func isTransientStatus(statusCode int) bool {
+	return statusCode >= 500 || statusCode == http.StatusTooManyRequests || statusCode == http.StatusRequestTimeout
+}
+
+const feedUserAgent = "MyFeed/1.0 (+https://github.com/mikeloven/myfeed)"
+
+// feedValidators are the ETag and Last-Modified headers of the last response of a feed.
+// Sent back on the next request, they let the server answer 304 Not Modified without the
+// feed when nothing changed.
+type feedValidators struct {
+	ETag         string
+	LastModified string
+}
+
+// errFeedNotModified is returned by fetchFeed when the server answered 304 Not Modified
+var errFeedNotModified = errors.New("feed not modified")
+
+// fetchFeed downloads and parses a feed, making the request conditional on validators
+// from a previous fetch. Besides the parsed feed it returns the validators of the response
+// and the minimum delay the server asked for before the next request (Cache-Control,
+// Expires, Retry-After), which is also returned alongside HTTP errors such as 429 and 503.
+// An unchanged feed returns errFeedNotModified without being downloaded again.
+func (fs *FeedService) fetchFeed(ctx context.Context, url string, cached feedValidators) (*gofeed.Feed, feedValidators, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, cached, 0, &FetchError{Err: err}
+	}
+	req.Header.Set("User-Agent", feedUserAgent)
+	if cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+	if cached.LastModified != "" {
+		req.Header.Set("If-Modified-Since", cached.LastModified)
+	}
+
+	start := time.Now()
+	fetcherLog.DebugContext(ctx, "Fetching feed", "url", url)
+	resp, err := fs.parser.Client.Do(req)
+	if err != nil {
+		fetcherLog.DebugContext(ctx, "Feed request failed", "url", url, "error", err,
+			"duration", time.Since(start))
+		return nil, cached, 0, &FetchError{Err: err, Transient: isTransientNetworkError(err)}
+	}
+	defer resp.Body.Close()
+
+	hint := cacheHint(resp.Header, time.Now())
+	fetcherLog.DebugContext(ctx, "Feed responded", "url", url, "final_url", resp.Request.URL.String(),
+		"status", resp.StatusCode, "content_type", resp.Header.Get("Content-Type"),
+		"content_length", resp.ContentLength, "cache_hint", hint, "duration", time.Since(start))
+
+	if resp.StatusCode == http.StatusNotModified {
+		// A 304 may carry updated validators; the ones not repeated stay valid
+		validators := cached
+		if etag := resp.Header.Get("ETag"); etag != "" {
+			validators.ETag = etag
+		}
+		if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+			validators.LastModified = lastModified
+		}
+		return nil, validators, hint, errFeedNotModified
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, cached, hint, &FetchError{
+			Err: gofeed.HTTPError{
+				StatusCode: resp.StatusCode,
+				Status:     resp.Status,
+			},
+			Transient: isTransientStatus(resp.StatusCode),
+		}
+	}
+
+	parsedFeed, err := fs.parser.Parse(resp.Body)
+	if err != nil {
+		fetcherLog.DebugContext(ctx, "Feed parse failed", "url", url, "error", err,
+			"duration", time.Since(start))
+		var netErr net.Error
+		if errors.As(err, &netErr) {
+			// The connection failed while reading the body
+			return nil, cached, hint, &FetchError{Err: err, Transient: true}
+		}
+		return nil, cached, hint, &FetchError{Err: fmt.Errorf("failed to parse feed: %v", err)}
+	}
+
+	fetcherLog.DebugContext(ctx, "Parsed feed", "url", url, "type", parsedFeed.FeedType,
+		"version", parsedFeed.FeedVersion, "items", len(parsedFeed.Items), "duration", time.Since(start))
+	validators := feedValidators{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	return parsedFeed, validators, hint, nil
+}
+
+// cacheHint returns the longest delay requested by the caching headers of a response
+func cacheHint(header http.Header, now time.Time) time.Duration {
+	var hint time.Duration
+
+	maxAgeFound := false
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if value, ok := strings.CutPrefix(directive, "max-age="); ok {
+			if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+				hint = time.Duration(seconds) * time.Second
+				maxAgeFound = true
+			}
+		}
+	}
+
+	// max-age takes precedence over Expires
+	if !maxAgeFound {
+		if expires, err := http.ParseTime(header.Get("Expires")); err == nil && expires.After(now) {
+			hint = expires.Sub(now)
+		}
+	}
+
+	if retryAfter := retryAfterDelay(header.Get("Retry-After"), now); retryAfter > hint {
+		hint = retryAfter
+	}
+
+	return hint
+}
+
+// retryAfterDelay parses a Retry-After header given either in seconds or as an HTTP date
+func retryAfterDelay(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if retryAt, err := http.ParseTime(value); err == nil && retryAt.After(now) {
+		return retryAt.Sub(now)
+	}
+	return 0
+}
@@ -1,103 +1,206 @@
 package services
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io"
-	"log"
 	"myfeed/database"
 	"myfeed/models"
 	"net/http"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mmcdole/gofeed"
 )
 
 type FeedService struct {
-	db     *database.DB
-	parser *gofeed.Parser
+	db              *database.DB
+	parser          *gofeed.Parser
+	statsService    *FeedStatsService
+	jobService      *JobService
+	settingsService *SettingsService
+	// refreshes coalesces concurrent refreshes of the same feed
+	refreshes refreshFlights
+	// hosts limits the feeds of one host that are fetched at once
+	hosts hostSlots
+
+	mu                     sync.RWMutex
+	articleSubscribers     []func(feed *models.Feed, articles []models.Article)
+	articleProcessors      []func(article *models.Article)
+	feedSubscribers        []func(feed *models.Feed)
+	feedDeletedSubscribers []func(feedID int)
 }
 
-func NewFeedService(db *database.DB) *FeedService {
+func NewFeedService(db *database.DB, statsService *FeedStatsService, jobService *JobService, settingsService *SettingsService) *FeedService {
 	parser := gofeed.NewParser()
 	parser.Client = &http.Client{
 		Timeout: 30 * time.Second,
 	}
 	
 	return &FeedService{
-		db:     db,
-		parser: parser,
+		db:              db,
+		parser:          parser,
+		statsService:    statsService,
+		jobService:      jobService,
+		settingsService: settingsService,
 	}
 }
 
-func (fs *FeedService) AddFeed(url string, folderID *int) (*models.Feed, error) {
+// AddFeed subscribes a user to a feed, in folderID or without a folder. A feed another
+// user follows already is shared rather than fetched twice; ErrFeedExists is returned if
+// the user follows it already. The URL may also be a YouTube channel or a web page whose
+// feed DiscoverFeeds finds. ctx bounds fetching the feed.
+func (fs *FeedService) AddFeed(ctx context.Context, userID int, url string, folderID *int) (*models.Feed, error) {
 	url = strings.TrimSpace(url)
 	if url == "" {
-		return nil, fmt.Errorf("feed URL cannot be empty")
+		return nil, invalidField("url", "feed URL cannot be empty")
 	}
 
-	// Convert YouTube channel URL to RSS feed URL if needed
-	rssURL, err := fs.convertToRSSURL(url)
-	if err != nil {
-		return nil, fmt.Errorf("failed to convert URL: %v", err)
+	if folderID != nil {
+		if err := checkFolderOwner(fs.db, userID, *folderID); err != nil {
+			return nil, err
+		}
 	}
 
-	// Try to parse the feed first to validate it
-	parsedFeed, err := fs.parser.ParseURL(rssURL)
+	// Convert YouTube channel URL to RSS feed URL if needed
+	rssURL, err := fs.convertToRSSURL(url)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse feed: %v", err)
+		return nil, invalidField("url", "failed to convert URL: %v", err)
 	}
 
 	// Check if feed already exists (check both original URL and RSS URL)
-	existingFeed, err := fs.GetFeedByURL(rssURL)
-	if err == nil && existingFeed != nil {
-		return nil, fmt.Errorf("feed already exists")
+	for _, existingURL := range []string{rssURL, url} {
+		if existingFeed, err := fs.GetFeedByURL(existingURL); err == nil {
+			return fs.subscribe(userID, existingFeed.ID, folderID)
+		}
 	}
-	
-	// Also check original URL if different
-	if url != rssURL {
-		existingFeed, err := fs.GetFeedByURL(url)
-		if err == nil && existingFeed != nil {
-			return nil, fmt.Errorf("feed already exists")
+
+	// Try to parse the feed first to validate it. A web page that is no feed stands for
+	// the first feed it links to or its site serves at a common path.
+	parsedFeed, _, _, err := fs.fetchFeed(ctx, rssURL, feedValidators{})
+	if err != nil {
+		candidates, discoverErr := fs.DiscoverFeeds(ctx, url)
+		if discoverErr != nil || len(candidates) == 0 || candidates[0].URL == rssURL {
+			return nil, invalidField("url", "failed to parse feed: %v", err)
+		}
+		rssURL = candidates[0].URL
+		if existingFeed, err := fs.GetFeedByURL(rssURL); err == nil {
+			return fs.subscribe(userID, existingFeed.ID, folderID)
+		}
+		if parsedFeed, _, _, err = fs.fetchFeed(ctx, rssURL, feedValidators{}); err != nil {
+			return nil, invalidField("url", "failed to parse feed %s: %v", rssURL, err)
 		}
 	}
 
-	// Insert the feed using the RSS URL
+	// Insert the feed using the RSS URL. The initial refresh is queued below, so the
+	// scheduler's first pass is one minimum interval away.
 	query := `
-		INSERT INTO feeds (url, title, description, folder_id, updated_at)
+		INSERT INTO feeds (url, title, description, next_fetch_at, updated_at)
 		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
 	`
 	
-	result, err := fs.db.Exec(query, rssURL, parsedFeed.Title, parsedFeed.Description, folderID)
+	nextFetchAt := time.Now().Add(defaultRefreshInterval).UTC()
+	feedID, err := fs.db.Insert(query, rssURL, parsedFeed.Title, parsedFeed.Description, nextFetchAt)
 	if err != nil {
 		return nil, fmt.Errorf("failed to insert feed: %v", err)
 	}
 
-	feedID, err := result.LastInsertId()
+	// Fetch initial articles
+	if _, err := fs.EnqueueRefresh(int(feedID)); err != nil {
+		fetcherLog.Error("Failed to enqueue initial refresh", "feed_id", feedID, "error", err)
+	}
+	if feed, err := fs.GetFeedByID(int(feedID)); err == nil {
+		fs.notifyFeedAdded(feed)
+	}
+
+	return fs.subscribe(userID, int(feedID), folderID)
+}
+
+// subscribe adds a feed to the end of a user's folder and returns it as the user sees it
+func (fs *FeedService) subscribe(userID, feedID int, folderID *int) (*models.Feed, error) {
+	if _, err := fs.GetSubscribedFeed(userID, feedID); err == nil {
+		return nil, ErrFeedExists
+	}
+
+	position, err := nextFeedPosition(fs.db, userID, folderID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get feed ID: %v", err)
+		return nil, err
 	}
 
-	// Fetch initial articles
-	go fs.RefreshFeed(int(feedID))
+	query := `INSERT INTO subscriptions (user_id, feed_id, folder_id, position) VALUES (?, ?, ?, ?)`
+	if _, err := fs.db.Exec(query, userID, feedID, folderID, position); err != nil {
+		return nil, fmt.Errorf("failed to subscribe to feed: %v", err)
+	}
+
+	// The articles of a shared feed are all unread for the new subscriber
+	if err := fs.statsService.RecountUnread(userID, feedID); err != nil {
+		fetcherLog.Error("Failed to count unread articles", "feed_id", feedID, "error", err)
+	}
+
+	return fs.GetSubscribedFeed(userID, feedID)
+}
+
+// feedColumns lists the feeds columns (alias f) read by scanFeed, in scan order
+const feedColumns = `f.id, f.url, f.title, f.description, f.created_at, f.updated_at,
+		       f.last_fetch, f.health, f.error_count, f.next_fetch_at, f.paused, f.cache_enclosures, f.refresh_interval,
+		       f.fetch_full_content`
+
+// subscriptionColumns follows feedColumns when a feed is read with a user's subscription
+// (alias s), and is read by scanSubscribedFeed
+const subscriptionColumns = `s.folder_id, s.position, s.unread_count`
 
-	return fs.GetFeedByID(int(feedID))
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
 }
 
+// scanFeed reads feedColumns, followed by the extra destinations if any
+func scanFeed(row rowScanner, feed *models.Feed, extra ...interface{}) error {
+	return row.Scan(append([]interface{}{
+		&feed.ID, &feed.URL, &feed.Title, &feed.Description,
+		&feed.CreatedAt, &feed.UpdatedAt, &feed.LastFetch, &feed.Health, &feed.ErrorCount,
+		&feed.NextFetchAt, &feed.Paused, &feed.CacheEnclosures, &feed.RefreshInterval,
+		&feed.FetchFullContent,
+	}, extra...)...)
+}
+
+// scanSubscribedFeed reads feedColumns followed by subscriptionColumns
+func scanSubscribedFeed(row rowScanner, feed *models.Feed) error {
+	return scanFeed(row, feed, &feed.FolderID, &feed.Position, &feed.UnreadCount)
+}
+
+// nextFeedPosition returns the position after the last feed of a user's folder, or of the
+// user's feeds without a folder when folderID is nil
+func nextFeedPosition(db *database.DB, userID int, folderID *int) (int, error) {
+	query := `SELECT MAX(position) FROM subscriptions WHERE user_id = ? AND folder_id IS NULL`
+	args := []interface{}{userID}
+	if folderID != nil {
+		query = `SELECT MAX(position) FROM subscriptions WHERE user_id = ? AND folder_id = ?`
+		args = append(args, *folderID)
+	}
+
+	var maxPosition sql.NullInt64
+	if err := db.QueryRow(query, args...).Scan(&maxPosition); err != nil {
+		return 0, fmt.Errorf("failed to get feed position: %v", err)
+	}
+	if !maxPosition.Valid {
+		return 0, nil
+	}
+	return int(maxPosition.Int64) + 1, nil
+}
+
+// GetFeedByID returns a feed without the state of any user's subscription
 func (fs *FeedService) GetFeedByID(id int) (*models.Feed, error) {
 	query := `
-		SELECT id, url, title, description, folder_id, created_at, updated_at, 
-		       last_fetch, health, error_count
-		FROM feeds WHERE id = ?
+		SELECT ` + feedColumns + `
+		FROM feeds f WHERE f.id = ?
 	`
 	
 	feed := &models.Feed{}
-	err := fs.db.QueryRow(query, id).Scan(
-		&feed.ID, &feed.URL, &feed.Title, &feed.Description, &feed.FolderID,
-		&feed.CreatedAt, &feed.UpdatedAt, &feed.LastFetch, &feed.Health, &feed.ErrorCount,
-	)
+	err := scanFeed(fs.db.QueryRow(query, id), feed)
 	
 	if err != nil {
 		return nil, err
@@ -108,16 +211,12 @@ func (fs *FeedService) GetFeedByID(id int) (*models.Feed, error) {
 
 func (fs *FeedService) GetFeedByURL(url string) (*models.Feed, error) {
 	query := `
-		SELECT id, url, title, description, folder_id, created_at, updated_at, 
-		       last_fetch, health, error_count
-		FROM feeds WHERE url = ?
+		SELECT ` + feedColumns + `
+		FROM feeds f WHERE f.url = ?
 	`
 	
 	feed := &models.Feed{}
-	err := fs.db.QueryRow(query, url).Scan(
-		&feed.ID, &feed.URL, &feed.Title, &feed.Description, &feed.FolderID,
-		&feed.CreatedAt, &feed.UpdatedAt, &feed.LastFetch, &feed.Health, &feed.ErrorCount,
-	)
+	err := scanFeed(fs.db.QueryRow(query, url), feed)
 	
 	if err != nil {
 		return nil, err
@@ -126,14 +225,32 @@ func (fs *FeedService) GetFeedByURL(url string) (*models.Feed, error) {
 	return feed, nil
 }
 
-func (fs *FeedService) GetAllFeeds() ([]models.Feed, error) {
+// GetSubscribedFeed returns a feed as a user follows it, or sql.ErrNoRows if the user
+// does not
+func (fs *FeedService) GetSubscribedFeed(userID, id int) (*models.Feed, error) {
+	query := `
+		SELECT ` + feedColumns + `, ` + subscriptionColumns + `
+		FROM subscriptions s JOIN feeds f ON f.id = s.feed_id
+		WHERE s.user_id = ? AND s.feed_id = ?
+	`
+
+	feed := &models.Feed{}
+	if err := scanSubscribedFeed(fs.db.QueryRow(query, userID, id), feed); err != nil {
+		return nil, err
+	}
+	return feed, nil
+}
+
+// GetAllFeeds returns the feeds a user follows
+func (fs *FeedService) GetAllFeeds(userID int) ([]models.Feed, error) {
 	query := `
-		SELECT id, url, title, description, folder_id, created_at, updated_at, 
-		       last_fetch, health, error_count
-		FROM feeds ORDER BY title
+		SELECT ` + feedColumns + `, ` + subscriptionColumns + `
+		FROM subscriptions s JOIN feeds f ON f.id = s.feed_id
+		WHERE s.user_id = ?
+		ORDER BY s.position, f.title
 	`
 	
-	rows, err := fs.db.Query(query)
+	rows, err := fs.db.Query(query, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -142,10 +259,7 @@ func (fs *FeedService) GetAllFeeds() ([]models.Feed, error) {
 	var feeds []models.Feed
 	for rows.Next() {
 		feed := models.Feed{}
-		err := rows.Scan(
-			&feed.ID, &feed.URL, &feed.Title, &feed.Description, &feed.FolderID,
-			&feed.CreatedAt, &feed.UpdatedAt, &feed.LastFetch, &feed.Health, &feed.ErrorCount,
-		)
+		err := scanSubscribedFeed(rows, &feed)
 		if err != nil {
 			return nil, err
 		}
@@ -155,56 +269,336 @@ func (fs *FeedService) GetAllFeeds() ([]models.Feed, error) {
 	return feeds, nil
 }
 
-func (fs *FeedService) RefreshFeed(feedID int) error {
+// GetHealthTotals counts the feeds by health and returns the time of the latest fetch
+func (fs *FeedService) GetHealthTotals() (*models.FeedHealthTotals, error) {
+	rows, err := fs.db.Query(`SELECT health, paused, COUNT(*) FROM feeds GROUP BY health, paused`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := &models.FeedHealthTotals{}
+	for rows.Next() {
+		var health string
+		var paused bool
+		var count int
+		if err := rows.Scan(&health, &paused, &count); err != nil {
+			return nil, err
+		}
+
+		totals.Total += count
+		switch {
+		case paused:
+			totals.Paused += count
+		case health == "warning":
+			totals.Warning += count
+		case health == "error":
+			totals.Error += count
+		default:
+			totals.Healthy += count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Selecting the row rather than MAX() keeps the column type, so SQLite returns a time
+	query := `SELECT last_fetch FROM feeds WHERE last_fetch IS NOT NULL ORDER BY last_fetch DESC LIMIT 1`
+	err = fs.db.QueryRow(query).Scan(&totals.LastRefresh)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return totals, nil
+}
+
+// refreshPayload is the payload of a refresh_feed job
+type refreshPayload struct {
+	FeedID int `json:"feed_id"`
+}
+
+// EnqueueRefresh queues a refresh requested by the user, ahead of scheduled refreshes
+func (fs *FeedService) EnqueueRefresh(feedID int) (*models.Job, error) {
+	return fs.EnqueueRefreshAt(feedID, time.Now(), RefreshPriorityManual)
+}
+
+// EnqueueRefreshAt queues a background refresh of a feed that starts no earlier than runAt.
+// A refresh of the feed that is already waiting in the queue is reused instead.
+func (fs *FeedService) EnqueueRefreshAt(feedID int, runAt time.Time, priority int) (*models.Job, error) {
+	return fs.jobService.EnqueueUnique(JobRefreshFeed, feedTarget(feedID), refreshPayload{FeedID: feedID}, runAt, priority)
+}
+
+// feedTarget is the job target of work on a single feed
+func feedTarget(feedID int) string {
+	return fmt.Sprintf("feed:%d", feedID)
+}
+
+// RefreshResult describes the outcome of a feed refresh for the scheduler
+type RefreshResult struct {
+	// CacheHint is the minimum delay the server asked for before the next fetch
+	CacheHint time.Duration
+	// NotModified is set when the server reported the feed unchanged
+	NotModified bool
+	// Shared is set on the result handed to a refresh that waited for another refresh of
+	// the same feed, which records the outcome
+	Shared bool
+}
+
+// RefreshFeed fetches a feed and stores its new articles. The request is conditional on the
+// ETag and Last-Modified of the previous fetch, and a feed the server reports unchanged is
+// not parsed again. Cancelling ctx aborts the download; once the feed has been fetched its
+// articles are always stored completely. A refresh started while another of the same feed
+// runs waits for it and shares its result. When the feed's host already has
+// max_refreshes_per_host refreshes running, errHostBusy is returned without fetching.
+func (fs *FeedService) RefreshFeed(ctx context.Context, feedID int) (*RefreshResult, error) {
+	return fs.refreshes.do(ctx, feedID, func() (*RefreshResult, error) {
+		return fs.refreshFeed(ctx, feedID)
+	})
+}
+
+func (fs *FeedService) refreshFeed(ctx context.Context, feedID int) (*RefreshResult, error) {
 	feed, err := fs.GetFeedByID(feedID)
 	if err != nil {
-		return fmt.Errorf("failed to get feed: %v", err)
+		return nil, fmt.Errorf("failed to get feed: %w", err)
 	}
 
-	log.Printf("Refreshing feed: %s", feed.Title)
+	limit := fs.settingsService.GetInt(SettingMaxRefreshesPerHost, defaultMaxRefreshesPerHost)
+	release, ok := fs.hosts.tryAcquire(feedHost(feed.URL), limit)
+	if !ok {
+		return nil, errHostBusy
+	}
+	defer release()
+
+	fetcherLog.DebugContext(ctx, "Refreshing feed", "feed_id", feedID, "title", feed.Title)
+
+	var cached feedValidators
+	query := `SELECT COALESCE(etag, ''), COALESCE(last_modified, '') FROM feeds WHERE id = ?`
+	if err := fs.db.QueryRow(query, feedID).Scan(&cached.ETag, &cached.LastModified); err != nil {
+		return nil, fmt.Errorf("failed to get feed validators: %w", err)
+	}
 
-	parsedFeed, err := fs.parser.ParseURL(feed.URL)
+	parsedFeed, validators, hint, err := fs.fetchFeed(ctx, feed.URL, cached)
+	release()
+	result := &RefreshResult{CacheHint: hint}
+	if err == errFeedNotModified {
+		result.NotModified = true
+		updateQuery := `
+			UPDATE feeds
+			SET etag = ?, last_modified = ?, last_fetch = CURRENT_TIMESTAMP,
+			    health = 'healthy', error_count = 0
+			WHERE id = ?
+		`
+		if _, err := fs.db.Exec(updateQuery, validators.ETag, validators.LastModified, feedID); err != nil {
+			return result, fmt.Errorf("failed to update feed: %v", err)
+		}
+		fetcherLog.DebugContext(ctx, "Feed not modified", "feed_id", feedID, "title", feed.Title)
+		return result, nil
+	}
 	if err != nil {
-		fs.updateFeedError(feedID, err)
-		return fmt.Errorf("failed to parse feed: %v", err)
+		return result, fmt.Errorf("failed to fetch feed: %w", err)
 	}
 
-	// Update feed metadata
+	// Update feed metadata. The validators are stored with it, so a refresh that fails
+	// before this point fetches the whole feed again next time.
 	updateQuery := `
 		UPDATE feeds 
-		SET title = ?, description = ?, last_fetch = CURRENT_TIMESTAMP, 
+		SET title = ?, description = ?, etag = ?, last_modified = ?, last_fetch = CURRENT_TIMESTAMP, 
 		    health = 'healthy', error_count = 0, updated_at = CURRENT_TIMESTAMP
 		WHERE id = ?
 	`
 	
-	_, err = fs.db.Exec(updateQuery, parsedFeed.Title, parsedFeed.Description, feedID)
+	_, err = fs.db.Exec(updateQuery, parsedFeed.Title, parsedFeed.Description,
+		validators.ETag, validators.LastModified, feedID)
 	if err != nil {
-		return fmt.Errorf("failed to update feed: %v", err)
+		return result, fmt.Errorf("failed to update feed: %v", err)
 	}
 
-	// Add new articles
-	for _, item := range parsedFeed.Items {
-		err := fs.addArticle(feedID, item)
+	added := fs.storeItems(ctx, feed, parsedFeed.Items)
+	fetcherLog.DebugContext(ctx, "Refreshed feed", "feed_id", feedID, "title", feed.Title, "items", len(parsedFeed.Items), "added", added)
+	return result, nil
+}
+
+// storeItems stores the new items of a feed, fetched or pushed, and hands the new articles
+// to the subscribers. It returns how many were new.
+func (fs *FeedService) storeItems(ctx context.Context, feed *models.Feed, items []*gofeed.Item) int {
+	var added []models.Article
+	for _, item := range items {
+		article, err := fs.addArticle(feed.ID, item)
 		if err != nil {
-			log.Printf("Failed to add article %s: %v", item.Title, err)
+			fetcherLog.WarnContext(ctx, "Failed to add article", "feed_id", feed.ID, "title", item.Title, "error", err)
+			continue
+		}
+		if article != nil {
+			added = append(added, *article)
 		}
 	}
 
-	log.Printf("Successfully refreshed feed: %s (%d articles)", feed.Title, len(parsedFeed.Items))
+	// The first fetch of a feed imports its backlog, which is not news
+	if feed.LastFetch != nil && len(added) > 0 {
+		fs.notifyNewArticles(feed, added)
+	}
+	return len(added)
+}
+
+// PushItems stores the new items of a feed document pushed by a WebSub hub, as a refresh
+// would, and returns how many were new. The feed's metadata and refresh schedule are left
+// as they are, since pushes often carry only the new items. The items are stored once no
+// refresh of the feed is running, and refreshes wait for them in turn.
+func (fs *FeedService) PushItems(ctx context.Context, feedID int, body io.Reader) (int, error) {
+	feed, err := fs.GetFeedByID(feedID)
+	if err != nil {
+		return 0, err
+	}
+	parsedFeed, err := fs.parser.Parse(body)
+	if err != nil {
+		return 0, invalidField("body", "failed to parse feed: %v", err)
+	}
+	var added int
+	err = fs.refreshes.exclusive(ctx, feedID, func() {
+		added = fs.storeItems(ctx, feed, parsedFeed.Items)
+	})
+	return added, err
+}
+
+// SetPaused stops or resumes scheduled refreshes of a feed. A resumed feed is given a
+// fresh slot by the scheduler.
+func (fs *FeedService) SetPaused(feedID int, paused bool) error {
+	query := `UPDATE feeds SET paused = ?, next_fetch_at = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+	result, err := fs.db.Exec(query, paused, feedID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
 	return nil
 }
 
-func (fs *FeedService) addArticle(feedID int, item *gofeed.Item) error {
-	// Check if article already exists
-	var count int
-	checkQuery := `SELECT COUNT(*) FROM articles WHERE feed_id = ? AND url = ?`
-	err := fs.db.QueryRow(checkQuery, feedID, item.Link).Scan(&count)
+// SetRefreshInterval fixes the time between scheduled fetches of a feed, or with nil lets
+// the scheduler follow the feed's posting rate again. The feed is given a fresh slot within
+// its new interval.
+func (fs *FeedService) SetRefreshInterval(feedID int, interval *time.Duration) error {
+	var seconds interface{}
+	if interval != nil {
+		if *interval < minFeedRefreshInterval || *interval > maxFeedRefreshInterval {
+			return invalidField("refresh_interval", "must be between %d and %d seconds",
+				int(minFeedRefreshInterval.Seconds()), int(maxFeedRefreshInterval.Seconds()))
+		}
+		seconds = int(interval.Seconds())
+	}
+
+	query := `UPDATE feeds SET refresh_interval = ?, next_fetch_at = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+	result, err := fs.db.Exec(query, seconds, feedID)
 	if err != nil {
 		return err
 	}
-	
-	if count > 0 {
-		return nil // Article already exists
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetFetchFullContent sets whether the pages of a feed's new articles are downloaded for
+// their full content. Articles stored before are left as they are.
+func (fs *FeedService) SetFetchFullContent(feedID int, fetch bool) error {
+	query := `UPDATE feeds SET fetch_full_content = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+	result, err := fs.db.Exec(query, fetch, feedID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SubscribeNewArticles registers fn to be called with the articles stored by a refresh.
+// It is not called for the first fetch of a feed.
+func (fs *FeedService) SubscribeNewArticles(fn func(feed *models.Feed, articles []models.Article)) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.articleSubscribers = append(fs.articleSubscribers, fn)
+}
+
+// ProcessNewArticles registers fn to be called with every article as it is stored, also
+// on the first fetch of a feed, before the refresh goes on to the next one
+func (fs *FeedService) ProcessNewArticles(fn func(article *models.Article)) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.articleProcessors = append(fs.articleProcessors, fn)
+}
+
+// SubscribeFeedAdded registers fn to be called with every feed added to the database,
+// when the first user subscribes to it
+func (fs *FeedService) SubscribeFeedAdded(fn func(feed *models.Feed)) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.feedSubscribers = append(fs.feedSubscribers, fn)
+}
+
+func (fs *FeedService) notifyFeedAdded(feed *models.Feed) {
+	fs.mu.RLock()
+	subscribers := fs.feedSubscribers
+	fs.mu.RUnlock()
+
+	for _, fn := range subscribers {
+		fn(feed)
+	}
+}
+
+// SubscribeFeedDeleted registers fn to be called with the ID of every feed deleted from the
+// database, when its last subscriber unsubscribes
+func (fs *FeedService) SubscribeFeedDeleted(fn func(feedID int)) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.feedDeletedSubscribers = append(fs.feedDeletedSubscribers, fn)
+}
+
+func (fs *FeedService) notifyFeedDeleted(feedID int) {
+	fs.mu.RLock()
+	subscribers := fs.feedDeletedSubscribers
+	fs.mu.RUnlock()
+
+	for _, fn := range subscribers {
+		fn(feedID)
+	}
+}
+
+func (fs *FeedService) notifyNewArticles(feed *models.Feed, articles []models.Article) {
+	fs.mu.RLock()
+	subscribers := fs.articleSubscribers
+	fs.mu.RUnlock()
+
+	for _, fn := range subscribers {
+		fn(feed, articles)
+	}
+}
+
+// addArticle stores an item and returns the new article, or nil if it already exists.
+// Items are recognised by their GUID, so a changed link does not store them again, or by
+// their link when the feed gives no GUID.
+func (fs *FeedService) addArticle(feedID int, item *gofeed.Item) (*models.Article, error) {
+	exists, err := fs.articleExists(feedID, item)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, nil
 	}
 
 	publishedAt := time.Now()
@@ -216,22 +610,99 @@ func (fs *FeedService) addArticle(feedID int, item *gofeed.Item) error {
 	if item.Content != "" {
 		content = item.Content
 	}
+	content, truncated := limitContent(content, fs.settingsService.GetInt(SettingMaxArticleKB, defaultMaxArticleKB)<<10)
+	if truncated {
+		fetcherLog.Info("Truncated article content", "feed_id", feedID, "title", item.Title, "url", item.Link)
+	}
 
 	author := ""
 	if item.Author != nil {
 		author = item.Author.Name
 	}
 
+	articleURLHash := urlHash(item.Link)
+	story, err := storyHash(fs.db, item.Title, articleURLHash)
+	if err != nil {
+		return nil, err
+	}
+
 	insertQuery := `
-		INSERT INTO articles (feed_id, title, content, url, author, published_at)
-		VALUES (?, ?, ?, ?, ?, ?)
+		INSERT INTO articles (feed_id, title, content, url, author, published_at, content_truncated, dedup_hash, url_hash, guid)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	
-	_, err = fs.db.Exec(insertQuery, feedID, item.Title, content, item.Link, author, publishedAt)
-	return err
+	var guid *string
+	if item.GUID != "" {
+		guid = &item.GUID
+	}
+	articleID, err := fs.db.Insert(insertQuery, feedID, item.Title, content, item.Link, author, publishedAt, truncated, story, articleURLHash, guid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fs.statsService.RecordArticle(feedID, publishedAt); err != nil {
+		fetcherLog.Error("Failed to update feed stats", "feed_id", feedID, "error", err)
+	}
+
+	article := &models.Article{
+		ID:          int(articleID),
+		FeedID:      feedID,
+		Title:       item.Title,
+		Content:     content,
+		URL:         item.Link,
+		Author:      author,
+		PublishedAt: publishedAt,
+
+		ContentTruncated: truncated,
+	}
+	if enclosure := itemEnclosure(item); enclosure != nil && article.ID != 0 {
+		enclosure.ArticleID = article.ID
+		if err := addEnclosure(fs.db, enclosure); err != nil {
+			fetcherLog.Error("Failed to store enclosure", "feed_id", feedID, "article_id", article.ID, "error", err)
+		} else {
+			article.Enclosure = enclosure
+		}
+	}
+
+	if article.ID != 0 {
+		fs.mu.RLock()
+		processors := fs.articleProcessors
+		fs.mu.RUnlock()
+		for _, fn := range processors {
+			fn(article)
+		}
+	}
+	return article, nil
+}
+
+// articleExists reports whether a feed has an item already. An article stored before
+// GUIDs were kept is recognised by its link once, and takes the item's GUID.
+func (fs *FeedService) articleExists(feedID int, item *gofeed.Item) (bool, error) {
+	var count int
+	if item.GUID == "" {
+		err := fs.db.QueryRow(`SELECT COUNT(*) FROM articles WHERE feed_id = ? AND url = ?`, feedID, item.Link).Scan(&count)
+		return count > 0, err
+	}
+
+	err := fs.db.QueryRow(`SELECT COUNT(*) FROM articles WHERE feed_id = ? AND guid = ?`, feedID, item.GUID).Scan(&count)
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+
+	query := `
+		UPDATE articles SET guid = ?
+		WHERE id = (SELECT MIN(id) FROM articles WHERE feed_id = ? AND url = ? AND guid IS NULL)
+	`
+	result, err := fs.db.Exec(query, item.GUID, feedID, item.Link)
+	if err != nil {
+		return false, err
+	}
+	adopted, err := result.RowsAffected()
+	return adopted > 0, err
 }
 
-func (fs *FeedService) updateFeedError(feedID int, feedError error) {
+// RecordRefreshError counts a failed refresh against the health of a feed
+func (fs *FeedService) RecordRefreshError(feedID int, feedError error) {
 	updateQuery := `
 		UPDATE feeds 
 		SET health = CASE 
@@ -247,10 +718,10 @@ func (fs *FeedService) updateFeedError(feedID int, feedError error) {
 	
 	_, err := fs.db.Exec(updateQuery, feedID)
 	if err != nil {
-		log.Printf("Failed to update feed error status: %v", err)
+		fetcherLog.Error("Failed to update feed error status", "feed_id", feedID, "error", err)
 	}
 	
-	log.Printf("Feed %d error: %v", feedID, feedError)
+	fetcherLog.Warn("Feed refresh failed", "feed_id", feedID, "error", feedError)
 }
 
 // convertToRSSURL converts various URL formats to RSS feed URLs
@@ -368,21 +839,117 @@ func (fs *FeedService) getYouTubeChannelID(channelURL string) (string, error) {
 	return "", fmt.Errorf("could not find channel ID for %s", channelURL)
 }
 
-func (fs *FeedService) DeleteFeed(feedID int) error {
-	query := `DELETE FROM feeds WHERE id = ?`
-	result, err := fs.db.Exec(query, feedID)
+// DeleteFeed unsubscribes a user from a feed, forgetting which of its articles the user
+// read or saved. The feed and its articles are deleted with the last subscription.
+func (fs *FeedService) DeleteFeed(userID, feedID int) error {
+	var feedDeleted bool
+	err := fs.db.InTx(context.Background(), func(tx *database.Tx) error {
+		// A subscription another user adds meanwhile waits for the feed on PostgreSQL;
+		// SQLite runs one writing transaction at a time anyway
+		if fs.db.IsPostgreSQL() {
+			var id int
+			if err := tx.QueryRow(`SELECT id FROM feeds WHERE id = ? FOR UPDATE`, feedID).Scan(&id); err != nil {
+				return err
+			}
+		}
+
+		query := `DELETE FROM subscriptions WHERE user_id = ? AND feed_id = ?`
+		result, err := tx.Exec(query, userID, feedID)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return sql.ErrNoRows
+		}
+
+		// What the user kept of the feed goes with the subscription
+		for _, query := range []string{
+			`DELETE FROM article_states WHERE user_id = ? AND article_id IN (SELECT id FROM articles WHERE feed_id = ?)`,
+			`DELETE FROM email_forwards WHERE user_id = ? AND feed_id = ?`,
+			`DELETE FROM notification_rules WHERE user_id = ? AND feed_id = ?`,
+		} {
+			if _, err := tx.Exec(query, userID, feedID); err != nil {
+				return err
+			}
+		}
+
+		var subscribers int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM subscriptions WHERE feed_id = ?`, feedID).Scan(&subscribers); err != nil {
+			return err
+		}
+		if subscribers == 0 {
+			if _, err := tx.Exec(`DELETE FROM feeds WHERE id = ?`, feedID); err != nil {
+				return err
+			}
+			feedDeleted = true
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
+
+	fs.statsService.NotifyUnreadChanged()
+	if feedDeleted {
+		fs.notifyFeedDeleted(feedID)
+	}
+	return nil
+}
+
+// AdoptSharedData gives a user the feeds, folders and read and saved state of a database
+// from before feeds were subscribed to per user, when they belonged to everyone. It does
+// nothing once anyone has a subscription, and returns the number of feeds adopted.
+func (fs *FeedService) AdoptSharedData(userID int) (int, error) {
+	var adopted int64
+	err := fs.db.InTx(context.Background(), func(tx *database.Tx) error {
+		// An adoption running meanwhile waits, and then finds the subscriptions of this one.
+		// SQLite fails the later of two transactions that both read and then write instead.
+		if fs.db.IsPostgreSQL() {
+			if _, err := tx.Exec(`LOCK TABLE subscriptions IN EXCLUSIVE MODE`); err != nil {
+				return fmt.Errorf("failed to lock subscriptions: %v", err)
+			}
+		}
+
+		var subscriptions int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM subscriptions`).Scan(&subscriptions); err != nil {
+			return err
+		}
+		if subscriptions > 0 {
+			return nil
+		}
+
+		if _, err := tx.Exec(`UPDATE folders SET user_id = ? WHERE user_id IS NULL`, userID); err != nil {
+			return fmt.Errorf("failed to adopt folders: %v", err)
+		}
+		result, err := tx.Exec(`
+			INSERT INTO subscriptions (user_id, feed_id, folder_id, position, unread_count)
+			SELECT ?, id, folder_id, position, unread_count FROM feeds
+		`, userID)
+		if err != nil {
+			return fmt.Errorf("failed to adopt feeds: %v", err)
+		}
+		_, err = tx.Exec(`
+			INSERT INTO article_states (user_id, article_id, read, saved, read_at, saved_at)
+			SELECT ?, id, read, saved, read_at, saved_at FROM articles WHERE read = ? OR saved = ?
+		`, userID, true, true)
+		if err != nil {
+			return fmt.Errorf("failed to adopt article states: %v", err)
+		}
+
+		adopted, err = result.RowsAffected()
 		return err
+	})
+	if err != nil {
+		return 0, err
 	}
-	
-	if rowsAffected == 0 {
-		return sql.ErrNoRows
+	if adopted > 0 {
+		fs.statsService.NotifyUnreadChanged()
 	}
-	
-	return nil
+	return int(adopted), nil
 }
\ No newline at end of file
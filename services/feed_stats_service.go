@@ -0,0 +1,315 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"myfeed/database"
+	"myfeed/models"
+	"sync"
+	"time"
+)
+
+// FeedStatsService maintains the materialized feed_stats table and the denormalized
+// subscriptions.unread_count column so that the sidebar and scheduler never have to run
+// COUNT(*) scans over articles.
+type FeedStatsService struct {
+	db          *database.DB
+	mu          sync.RWMutex
+	subscribers []func()
+}
+
+func NewFeedStatsService(db *database.DB) *FeedStatsService {
+	return &FeedStatsService{db: db}
+}
+
+func (fss *FeedStatsService) ensureRow(feedID int) error {
+	query := `INSERT INTO feed_stats (feed_id) VALUES (?) ON CONFLICT (feed_id) DO NOTHING`
+	_, err := fss.db.Exec(query, feedID)
+	return err
+}
+
+// GetFeedStats returns the statistics of a feed. They are shared by its subscribers, so
+// UnreadCount is left for the caller to fill in.
+func (fss *FeedStatsService) GetFeedStats(feedID int) (*models.FeedStatistics, error) {
+	query := `
+		SELECT s.feed_id, s.article_count, s.first_article_at, s.last_article_at,
+		       s.avg_post_interval, s.opened_count, s.last_opened_at, s.updated_at
+		FROM feed_stats s
+		WHERE s.feed_id = ?
+	`
+
+	stats := &models.FeedStatistics{}
+	err := fss.db.QueryRow(query, feedID).Scan(
+		&stats.FeedID, &stats.ArticleCount, &stats.FirstArticleAt,
+		&stats.LastArticleAt, &stats.AvgPostInterval, &stats.OpenedCount, &stats.LastOpenedAt, &stats.UpdatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// GetAllFeedStats returns the statistics of every feed keyed by feed ID, without
+// UnreadCount like GetFeedStats
+func (fss *FeedStatsService) GetAllFeedStats() (map[int]*models.FeedStatistics, error) {
+	query := `
+		SELECT s.feed_id, s.article_count, s.first_article_at, s.last_article_at,
+		       s.avg_post_interval, s.opened_count, s.last_opened_at, s.updated_at
+		FROM feed_stats s
+	`
+
+	rows, err := fss.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statsByFeed := make(map[int]*models.FeedStatistics)
+	for rows.Next() {
+		stats := &models.FeedStatistics{}
+		err := rows.Scan(
+			&stats.FeedID, &stats.ArticleCount, &stats.FirstArticleAt,
+			&stats.LastArticleAt, &stats.AvgPostInterval, &stats.OpenedCount, &stats.LastOpenedAt, &stats.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		statsByFeed[stats.FeedID] = stats
+	}
+
+	return statsByFeed, rows.Err()
+}
+
+// RecordArticle updates the counters of a feed after a new article was stored, which is
+// unread for every subscriber. The average posting interval is derived from the
+// first/last publish dates so it stays correct regardless of the order in which items
+// are ingested. The counters are updated in SQL, so articles of a feed can be recorded
+// concurrently.
+func (fss *FeedStatsService) RecordArticle(feedID int, publishedAt time.Time) error {
+	if err := fss.ensureRow(feedID); err != nil {
+		return fmt.Errorf("failed to create feed stats: %v", err)
+	}
+
+	query := `
+		UPDATE feed_stats
+		SET article_count = article_count + 1,
+		    first_article_at = CASE WHEN first_article_at IS NULL OR first_article_at > ? THEN ? ELSE first_article_at END,
+		    last_article_at = CASE WHEN last_article_at IS NULL OR last_article_at < ? THEN ? ELSE last_article_at END,
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE feed_id = ?
+	`
+	_, err := fss.db.Exec(query, publishedAt, publishedAt, publishedAt, publishedAt, feedID)
+	if err != nil {
+		return err
+	}
+
+	stats, err := fss.GetFeedStats(feedID)
+	if err != nil {
+		return fmt.Errorf("failed to get feed stats: %v", err)
+	}
+	if stats.FirstArticleAt != nil && stats.LastArticleAt != nil {
+		// Skipped if another article was recorded meanwhile, which sets it from newer counts
+		interval := averageInterval(*stats.FirstArticleAt, *stats.LastArticleAt, stats.ArticleCount)
+		query := `UPDATE feed_stats SET avg_post_interval = ? WHERE feed_id = ? AND article_count = ?`
+		if _, err := fss.db.Exec(query, interval, feedID, stats.ArticleCount); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fss.db.Exec(`UPDATE subscriptions SET unread_count = unread_count + 1 WHERE feed_id = ?`, feedID); err != nil {
+		return err
+	}
+	fss.NotifyUnreadChanged()
+	return nil
+}
+
+// Subscribe registers fn to be called whenever unread counters change
+func (fss *FeedStatsService) Subscribe(fn func()) {
+	fss.mu.Lock()
+	defer fss.mu.Unlock()
+	fss.subscribers = append(fss.subscribers, fn)
+}
+
+// NotifyUnreadChanged tells subscribers that unread counters changed outside this
+// service, e.g. because a feed was deleted or moved to another folder
+func (fss *FeedStatsService) NotifyUnreadChanged() {
+	fss.mu.RLock()
+	subscribers := fss.subscribers
+	fss.mu.RUnlock()
+
+	for _, fn := range subscribers {
+		fn()
+	}
+}
+
+// AdjustUnread applies a read-state change to a user's unread counter of a feed
+func (fss *FeedStatsService) AdjustUnread(userID, feedID int, delta int) error {
+	query := `UPDATE subscriptions SET unread_count = unread_count + ? WHERE user_id = ? AND feed_id = ?`
+	if _, err := fss.db.Exec(query, delta, userID, feedID); err != nil {
+		return err
+	}
+	fss.NotifyUnreadChanged()
+	return nil
+}
+
+// RecordOpened counts an article of the feed being opened. The scheduler refreshes feeds
+// that are actually read ahead of the others.
+func (fss *FeedStatsService) RecordOpened(feedID int) error {
+	if err := fss.ensureRow(feedID); err != nil {
+		return fmt.Errorf("failed to create feed stats: %v", err)
+	}
+
+	query := `UPDATE feed_stats SET opened_count = opened_count + 1, last_opened_at = ? WHERE feed_id = ?`
+	_, err := fss.db.Exec(query, time.Now().UTC(), feedID)
+	return err
+}
+
+// ResetUnread zeroes a user's unread counter of one feed, or of every feed the user
+// follows when feedID is nil
+func (fss *FeedStatsService) ResetUnread(userID int, feedID *int) error {
+	query := `UPDATE subscriptions SET unread_count = 0 WHERE user_id = ?`
+	args := []interface{}{userID}
+
+	if feedID != nil {
+		query += " AND feed_id = ?"
+		args = append(args, *feedID)
+	}
+
+	if _, err := fss.db.Exec(query, args...); err != nil {
+		return err
+	}
+	fss.NotifyUnreadChanged()
+	return nil
+}
+
+// unreadCountQuery counts the articles of subscriptions.feed_id that subscriptions.user_id
+// has not read, for use in an UPDATE of subscriptions
+const unreadCountQuery = `(
+	SELECT COUNT(*) FROM articles a
+	WHERE a.feed_id = subscriptions.feed_id AND NOT EXISTS (
+		SELECT 1 FROM article_states st
+		WHERE st.user_id = subscriptions.user_id AND st.article_id = a.id AND st.read = true
+	)
+)`
+
+// RecountUnread rebuilds a user's unread counter of a feed from the articles table
+func (fss *FeedStatsService) RecountUnread(userID, feedID int) error {
+	query := `UPDATE subscriptions SET unread_count = ` + unreadCountQuery + ` WHERE user_id = ? AND feed_id = ?`
+	if _, err := fss.db.Exec(query, userID, feedID); err != nil {
+		return err
+	}
+	fss.NotifyUnreadChanged()
+	return nil
+}
+
+// Recalculate rebuilds the statistics of a feed and the unread counters of its
+// subscribers from the articles table
+func (fss *FeedStatsService) Recalculate(feedID int) error {
+	var articleCount int
+	err := fss.db.QueryRow(`SELECT COUNT(*) FROM articles WHERE feed_id = ?`, feedID).Scan(&articleCount)
+	if err != nil {
+		return fmt.Errorf("failed to count articles: %v", err)
+	}
+
+	first, err := fss.publishedBoundary(feedID, "ASC")
+	if err != nil {
+		return err
+	}
+	last, err := fss.publishedBoundary(feedID, "DESC")
+	if err != nil {
+		return err
+	}
+
+	if err := fss.ensureRow(feedID); err != nil {
+		return fmt.Errorf("failed to create feed stats: %v", err)
+	}
+
+	var interval int64
+	if first != nil && last != nil {
+		interval = averageInterval(*first, *last, articleCount)
+	}
+
+	query := `
+		UPDATE feed_stats
+		SET article_count = ?, first_article_at = ?, last_article_at = ?,
+		    avg_post_interval = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE feed_id = ?
+	`
+	_, err = fss.db.Exec(query, articleCount, first, last, interval, feedID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fss.db.Exec(`UPDATE subscriptions SET unread_count = `+unreadCountQuery+` WHERE feed_id = ?`, feedID); err != nil {
+		return err
+	}
+	fss.NotifyUnreadChanged()
+	return nil
+}
+
+// RecalculateAll rebuilds the statistics of every feed
+func (fss *FeedStatsService) RecalculateAll() error {
+	return fss.recalculateFeeds(`SELECT id FROM feeds`)
+}
+
+// RecalculateMissing builds statistics and unread counters for feeds that do not have a
+// feed_stats row yet, e.g. feeds created before the table existed
+func (fss *FeedStatsService) RecalculateMissing() error {
+	return fss.recalculateFeeds(`
+		SELECT f.id FROM feeds f
+		LEFT JOIN feed_stats s ON s.feed_id = f.id
+		WHERE s.feed_id IS NULL
+	`)
+}
+
+func (fss *FeedStatsService) recalculateFeeds(feedQuery string) error {
+	rows, err := fss.db.Query(feedQuery)
+	if err != nil {
+		return err
+	}
+
+	var feedIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		feedIDs = append(feedIDs, id)
+	}
+	rows.Close()
+
+	for _, feedID := range feedIDs {
+		if err := fss.Recalculate(feedID); err != nil {
+			return fmt.Errorf("failed to recalculate stats for feed %d: %v", feedID, err)
+		}
+	}
+
+	return nil
+}
+
+// publishedBoundary returns the earliest (ASC) or latest (DESC) publish date of a feed
+func (fss *FeedStatsService) publishedBoundary(feedID int, direction string) (*time.Time, error) {
+	query := `SELECT published_at FROM articles WHERE feed_id = ? ORDER BY published_at ` + direction + ` LIMIT 1`
+
+	var publishedAt time.Time
+	err := fss.db.QueryRow(query, feedID).Scan(&publishedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get publish date: %v", err)
+	}
+
+	return &publishedAt, nil
+}
+
+// averageInterval returns the mean number of seconds between posts
+func averageInterval(first, last time.Time, articleCount int) int64 {
+	if articleCount < 2 || !last.After(first) {
+		return 0
+	}
+	return int64(last.Sub(first).Seconds()) / int64(articleCount-1)
+}
@@ -5,37 +5,84 @@ import (
 	"fmt"
 	"myfeed/database"
 	"myfeed/models"
+	"sync"
+	"time"
 )
 
+// unreadWarmDelay is how long unread counters must stay unchanged before the cached
+// counts are rebuilt, so a burst of refreshes triggers a single rebuild at its end
+const unreadWarmDelay = 2 * time.Second
+
+// unreadWarmIdle is how long after they last asked for them the counts of a user are no
+// longer rebuilt ahead of time, so users who left or were deleted drop out
+const unreadWarmIdle = 24 * time.Hour
+
+// FolderService manages the folders of each user. Every method is scoped to one user;
+// folders of other users are treated as missing.
 type FolderService struct {
 	db *database.DB
+
+	// unreadMu guards the cached unread counts of each user. unreadGen is bumped on every
+	// change so a rebuild that raced with a change is discarded; warmUsers are the users
+	// whose counts are rebuilt after a change, with when they last asked for them.
+	unreadMu     sync.Mutex
+	unreadCounts map[int]*models.UnreadCounts
+	unreadGen    uint64
+	warmUsers    map[int]time.Time
+	warmTimer    *time.Timer
+}
+
+func NewFolderService(db *database.DB, statsService *FeedStatsService) *FolderService {
+	fs := &FolderService{
+		db:           db,
+		unreadCounts: make(map[int]*models.UnreadCounts),
+		warmUsers:    make(map[int]time.Time),
+	}
+	statsService.Subscribe(fs.invalidateUnreadCounts)
+	return fs
 }
 
-func NewFolderService(db *database.DB) *FolderService {
-	return &FolderService{db: db}
+// checkFolderOwner returns a validation error for folder_id unless the folder belongs to
+// the user
+func checkFolderOwner(db *database.DB, userID, folderID int) error {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM folders WHERE id = ? AND user_id = ?`, folderID, userID).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to check folder: %v", err)
+	}
+	if count == 0 {
+		return invalidField("folder_id", "folder not found")
+	}
+	return nil
 }
 
-func (fs *FolderService) CreateFolder(name string, parentID *int) (*models.Folder, error) {
+func (fs *FolderService) CreateFolder(userID int, name string, parentID *int) (*models.Folder, error) {
 	if name == "" {
-		return nil, fmt.Errorf("folder name cannot be empty")
+		return nil, invalidField("name", "folder name cannot be empty")
+	}
+
+	if parentID != nil {
+		if _, err := fs.GetFolderByID(userID, *parentID); err != nil {
+			return nil, invalidField("parent_id", "parent folder not found")
+		}
 	}
 
 	// Check if folder with same name exists at the same level
 	var count int
-	checkQuery := `SELECT COUNT(*) FROM folders WHERE name = ? AND parent_id IS ?`
-	err := fs.db.QueryRow(checkQuery, name, parentID).Scan(&count)
+	checkQuery := `SELECT COUNT(*) FROM folders WHERE user_id = ? AND name = ? AND parent_id IS ?`
+	err := fs.db.QueryRow(checkQuery, userID, name, parentID).Scan(&count)
 	if err != nil {
 		return nil, fmt.Errorf("failed to check folder existence: %v", err)
 	}
 	
 	if count > 0 {
-		return nil, fmt.Errorf("folder with name '%s' already exists", name)
+		return nil, invalidField("name", "folder with name '%s' already exists", name)
 	}
 
 	// Get the next position for this folder
 	var maxPosition sql.NullInt64
-	posQuery := `SELECT MAX(position) FROM folders WHERE parent_id IS ?`
-	err = fs.db.QueryRow(posQuery, parentID).Scan(&maxPosition)
+	posQuery := `SELECT MAX(position) FROM folders WHERE user_id = ? AND parent_id IS ?`
+	err = fs.db.QueryRow(posQuery, userID, parentID).Scan(&maxPosition)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get folder position: %v", err)
 	}
@@ -47,31 +94,52 @@ func (fs *FolderService) CreateFolder(name string, parentID *int) (*models.Folde
 
 	// Insert the folder
 	query := `
-		INSERT INTO folders (name, parent_id, position)
-		VALUES (?, ?, ?)
+		INSERT INTO folders (user_id, name, parent_id, position)
+		VALUES (?, ?, ?, ?)
 	`
 	
-	result, err := fs.db.Exec(query, name, parentID, position)
+	folderID, err := fs.db.Insert(query, userID, name, parentID, position)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create folder: %v", err)
 	}
 
-	folderID, err := result.LastInsertId()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get folder ID: %v", err)
+	fs.invalidateUnreadCounts()
+	return fs.GetFolderByID(userID, int(folderID))
+}
+
+// FindFolder returns the folder of the user with the given name directly under parentID,
+// or at the root when parentID is nil, or sql.ErrNoRows
+func (fs *FolderService) FindFolder(userID int, name string, parentID *int) (*models.Folder, error) {
+	query := `SELECT id FROM folders WHERE user_id = ? AND name = ? AND parent_id IS NULL`
+	args := []interface{}{userID, name}
+	if parentID != nil {
+		query = `SELECT id FROM folders WHERE user_id = ? AND name = ? AND parent_id = ?`
+		args = append(args, *parentID)
 	}
 
-	return fs.GetFolderByID(int(folderID))
+	var id int
+	if err := fs.db.QueryRow(query+` ORDER BY id LIMIT 1`, args...).Scan(&id); err != nil {
+		return nil, err
+	}
+	return fs.GetFolderByID(userID, id)
 }
 
-func (fs *FolderService) GetFolderByID(id int) (*models.Folder, error) {
+// folderOwner returns the user a folder belongs to, or sql.ErrNoRows
+func (fs *FolderService) folderOwner(folderID int) (int, error) {
+	var userID int
+	err := fs.db.QueryRow(`SELECT user_id FROM folders WHERE id = ? AND user_id IS NOT NULL`, folderID).Scan(&userID)
+	return userID, err
+}
+
+// GetFolderByID returns a folder of the user, or sql.ErrNoRows
+func (fs *FolderService) GetFolderByID(userID, id int) (*models.Folder, error) {
 	query := `
 		SELECT id, name, parent_id, position, created_at
-		FROM folders WHERE id = ?
+		FROM folders WHERE id = ? AND user_id = ?
 	`
 	
 	folder := &models.Folder{}
-	err := fs.db.QueryRow(query, id).Scan(
+	err := fs.db.QueryRow(query, id, userID).Scan(
 		&folder.ID, &folder.Name, &folder.ParentID, &folder.Position, &folder.CreatedAt,
 	)
 	
@@ -82,13 +150,13 @@ func (fs *FolderService) GetFolderByID(id int) (*models.Folder, error) {
 	return folder, nil
 }
 
-func (fs *FolderService) GetAllFolders() ([]models.Folder, error) {
+func (fs *FolderService) GetAllFolders(userID int) ([]models.Folder, error) {
 	query := `
 		SELECT id, name, parent_id, position, created_at
-		FROM folders ORDER BY parent_id, position, name
+		FROM folders WHERE user_id = ? ORDER BY parent_id, position, name
 	`
 	
-	rows, err := fs.db.Query(query)
+	rows, err := fs.db.Query(query, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -109,27 +177,28 @@ func (fs *FolderService) GetAllFolders() ([]models.Folder, error) {
 	return folders, nil
 }
 
-func (fs *FolderService) UpdateFolder(id int, name string) (*models.Folder, error) {
+// UpdateFolder renames a folder of the user, or returns sql.ErrNoRows if it does not exist
+func (fs *FolderService) UpdateFolder(userID, id int, name string) (*models.Folder, error) {
 	if name == "" {
-		return nil, fmt.Errorf("folder name cannot be empty")
+		return nil, invalidField("name", "folder name cannot be empty")
 	}
 
 	// Check if folder exists
-	existingFolder, err := fs.GetFolderByID(id)
+	existingFolder, err := fs.GetFolderByID(userID, id)
 	if err != nil {
-		return nil, fmt.Errorf("folder not found: %v", err)
+		return nil, err
 	}
 
 	// Check if another folder with same name exists at the same level
 	var count int
-	checkQuery := `SELECT COUNT(*) FROM folders WHERE name = ? AND parent_id IS ? AND id != ?`
-	err = fs.db.QueryRow(checkQuery, name, existingFolder.ParentID, id).Scan(&count)
+	checkQuery := `SELECT COUNT(*) FROM folders WHERE user_id = ? AND name = ? AND parent_id IS ? AND id != ?`
+	err = fs.db.QueryRow(checkQuery, userID, name, existingFolder.ParentID, id).Scan(&count)
 	if err != nil {
 		return nil, fmt.Errorf("failed to check folder existence: %v", err)
 	}
 	
 	if count > 0 {
-		return nil, fmt.Errorf("folder with name '%s' already exists", name)
+		return nil, invalidField("name", "folder with name '%s' already exists", name)
 	}
 
 	// Update the folder
@@ -139,20 +208,26 @@ func (fs *FolderService) UpdateFolder(id int, name string) (*models.Folder, erro
 		return nil, fmt.Errorf("failed to update folder: %v", err)
 	}
 
-	return fs.GetFolderByID(id)
+	return fs.GetFolderByID(userID, id)
 }
 
-func (fs *FolderService) DeleteFolder(id int) error {
+// DeleteFolder deletes an empty folder of the user. ErrFolderNotEmpty is returned while it
+// still has feeds or subfolders, sql.ErrNoRows if it does not exist.
+func (fs *FolderService) DeleteFolder(userID, id int) error {
+	if _, err := fs.GetFolderByID(userID, id); err != nil {
+		return err
+	}
+
 	// Check if folder has any feeds
 	var feedCount int
-	feedQuery := `SELECT COUNT(*) FROM feeds WHERE folder_id = ?`
+	feedQuery := `SELECT COUNT(*) FROM subscriptions WHERE folder_id = ?`
 	err := fs.db.QueryRow(feedQuery, id).Scan(&feedCount)
 	if err != nil {
 		return fmt.Errorf("failed to check folder feeds: %v", err)
 	}
 
 	if feedCount > 0 {
-		return fmt.Errorf("cannot delete folder: it contains %d feeds", feedCount)
+		return fmt.Errorf("%w: it contains %d feeds", ErrFolderNotEmpty, feedCount)
 	}
 
 	// Check if folder has any subfolders
@@ -164,7 +239,7 @@ func (fs *FolderService) DeleteFolder(id int) error {
 	}
 
 	if subfolderCount > 0 {
-		return fmt.Errorf("cannot delete folder: it contains %d subfolders", subfolderCount)
+		return fmt.Errorf("%w: it contains %d subfolders", ErrFolderNotEmpty, subfolderCount)
 	}
 
 	// Delete the folder
@@ -183,22 +258,37 @@ func (fs *FolderService) DeleteFolder(id int) error {
 		return sql.ErrNoRows
 	}
 
+	fs.invalidateUnreadCounts()
 	return nil
 }
 
-func (fs *FolderService) MoveFeedsToFolder(feedIDs []int, folderID *int) error {
+// MarkImported flags a folder as created by an OPML import so the maintenance job can
+// remove it again if it ends up empty
+func (fs *FolderService) MarkImported(id int) error {
+	_, err := fs.db.Exec(`UPDATE folders SET imported = ? WHERE id = ?`, true, id)
+	return err
+}
+
+// MoveFeedsToFolder moves feeds of the user into a folder, or out of every folder when
+// folderID is nil. sql.ErrNoRows is returned if the folder does not exist.
+func (fs *FolderService) MoveFeedsToFolder(userID int, feedIDs []int, folderID *int) error {
 	// Validate folder exists if folderID is provided
 	if folderID != nil {
-		_, err := fs.GetFolderByID(*folderID)
+		_, err := fs.GetFolderByID(userID, *folderID)
 		if err != nil {
-			return fmt.Errorf("target folder not found: %v", err)
+			return err
 		}
 	}
 
-	// Update feeds
-	query := `UPDATE feeds SET folder_id = ? WHERE id = ?`
-	for _, feedID := range feedIDs {
-		_, err := fs.db.Exec(query, folderID, feedID)
+	// Update feeds, appending them to the end of the target folder in the order given
+	position, err := nextFeedPosition(fs.db, userID, folderID)
+	if err != nil {
+		return err
+	}
+	defer fs.invalidateUnreadCounts()
+	query := `UPDATE subscriptions SET folder_id = ?, position = ? WHERE user_id = ? AND feed_id = ?`
+	for i, feedID := range feedIDs {
+		_, err := fs.db.Exec(query, folderID, position+i, userID, feedID)
 		if err != nil {
 			return fmt.Errorf("failed to move feed %d: %v", feedID, err)
 		}
@@ -207,31 +297,346 @@ func (fs *FolderService) MoveFeedsToFolder(feedIDs []int, folderID *int) error {
 	return nil
 }
 
-func (fs *FolderService) GetFeedsInFolder(folderID *int) ([]models.Feed, error) {
+// ReorderFeeds sets the manual order of the feeds in a folder, or of the feeds without a
+// folder when folderID is nil. feedIDs must list every feed of the folder exactly once.
+// sql.ErrNoRows is returned if the folder does not exist.
+func (fs *FolderService) ReorderFeeds(userID int, folderID *int, feedIDs []int) error {
+	if folderID != nil {
+		if _, err := fs.GetFolderByID(userID, *folderID); err != nil {
+			return err
+		}
+	}
+
+	query := `SELECT feed_id FROM subscriptions WHERE user_id = ? AND folder_id IS NULL`
+	args := []interface{}{userID}
+	if folderID != nil {
+		query = `SELECT feed_id FROM subscriptions WHERE user_id = ? AND folder_id = ?`
+		args = append(args, *folderID)
+	}
+	rows, err := fs.db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to get folder feeds: %v", err)
+	}
+	defer rows.Close()
+
+	inFolder := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		inFolder[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(feedIDs) != len(inFolder) {
+		return invalidField("feed_ids", "expected all %d feeds of the folder, got %d", len(inFolder), len(feedIDs))
+	}
+	seen := make(map[int]bool, len(feedIDs))
+	for _, id := range feedIDs {
+		if !inFolder[id] {
+			return invalidField("feed_ids", "feed %d is not in the folder", id)
+		}
+		if seen[id] {
+			return invalidField("feed_ids", "feed %d is listed twice", id)
+		}
+		seen[id] = true
+	}
+
+	update := `UPDATE subscriptions SET position = ? WHERE user_id = ? AND feed_id = ?`
+	for i, id := range feedIDs {
+		if _, err := fs.db.Exec(update, i, userID, id); err != nil {
+			return fmt.Errorf("failed to reorder feed %d: %v", id, err)
+		}
+	}
+
+	return nil
+}
+
+// GetFolderTree returns every folder of a user with its feeds, nested by parent, and the
+// user's feeds without a folder. Folders and feeds are read with a single query and
+// assembled in memory; folder unread counts include the feeds of nested subfolders.
+func (fs *FolderService) GetFolderTree(userID int) (*models.FolderTree, error) {
+	// The second branch adds the uncategorized feeds with NULL folder columns. Feeds are
+	// sorted by their manual position, then by title.
 	query := `
-		SELECT id, url, title, description, folder_id, created_at, updated_at, 
-		       last_fetch, health, error_count
-		FROM feeds WHERE folder_id IS ? ORDER BY title
+		SELECT fo.id, fo.name, fo.parent_id, fo.position, fo.created_at,
+		       f.id, f.title, f.url, f.health, f.error_count, s.unread_count, s.position
+		FROM folders fo
+		LEFT JOIN subscriptions s ON s.folder_id = fo.id
+		LEFT JOIN feeds f ON f.id = s.feed_id
+		WHERE fo.user_id = ?
+		UNION ALL
+		SELECT NULL, NULL, NULL, NULL, NULL,
+		       f.id, f.title, f.url, f.health, f.error_count, s.unread_count, s.position
+		FROM subscriptions s JOIN feeds f ON f.id = s.feed_id
+		WHERE s.user_id = ? AND s.folder_id IS NULL
+		ORDER BY 4, 2, 12, 7
 	`
-	
-	rows, err := fs.db.Query(query, folderID)
+
+	rows, err := fs.db.Query(query, userID, userID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var feeds []models.Feed
+	tree := &models.FolderTree{
+		Folders:       []*models.FolderNode{},
+		Uncategorized: []models.FeedSummary{},
+	}
+	nodes := make(map[int]*models.FolderNode)
+	var order []*models.FolderNode
 	for rows.Next() {
-		feed := models.Feed{}
-		err := rows.Scan(
-			&feed.ID, &feed.URL, &feed.Title, &feed.Description, &feed.FolderID,
-			&feed.CreatedAt, &feed.UpdatedAt, &feed.LastFetch, &feed.Health, &feed.ErrorCount,
-		)
-		if err != nil {
+		var folderID, position, feedID, errorCount, unreadCount, feedPosition sql.NullInt64
+		var name, title, url, health sql.NullString
+		var parentID *int
+		var createdAt sql.NullTime
+		if err := rows.Scan(&folderID, &name, &parentID, &position, &createdAt,
+			&feedID, &title, &url, &health, &errorCount, &unreadCount, &feedPosition); err != nil {
 			return nil, err
 		}
-		feeds = append(feeds, feed)
+
+		var feed *models.FeedSummary
+		if feedID.Valid {
+			feed = &models.FeedSummary{
+				ID:          int(feedID.Int64),
+				Title:       title.String,
+				URL:         url.String,
+				Health:      health.String,
+				ErrorCount:  int(errorCount.Int64),
+				UnreadCount: int(unreadCount.Int64),
+				Position:    int(feedPosition.Int64),
+			}
+		}
+
+		if !folderID.Valid {
+			if feed != nil {
+				tree.Uncategorized = append(tree.Uncategorized, *feed)
+			}
+			continue
+		}
+
+		node, ok := nodes[int(folderID.Int64)]
+		if !ok {
+			node = &models.FolderNode{
+				ID:        int(folderID.Int64),
+				Name:      name.String,
+				ParentID:  parentID,
+				Position:  int(position.Int64),
+				CreatedAt: createdAt.Time,
+				Feeds:     []models.FeedSummary{},
+				Children:  []*models.FolderNode{},
+			}
+			nodes[node.ID] = node
+			order = append(order, node)
+		}
+		if feed != nil {
+			node.Feeds = append(node.Feeds, *feed)
+			node.UnreadCount += feed.UnreadCount
+		}
 	}
-	
-	return feeds, nil
-}
\ No newline at end of file
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Folders whose parent is missing are left out, like everywhere else in the tree
+	for _, node := range order {
+		if node.ParentID == nil {
+			tree.Folders = append(tree.Folders, node)
+		} else if parent, ok := nodes[*node.ParentID]; ok {
+			parent.Children = append(parent.Children, node)
+		}
+	}
+
+	// Add every folder's own unread count to its ancestors, guarding against cycles
+	for _, node := range order {
+		own := 0
+		for _, feed := range node.Feeds {
+			own += feed.UnreadCount
+		}
+		visited := map[int]bool{node.ID: true}
+		for id := node.ParentID; id != nil && !visited[*id]; {
+			parent, ok := nodes[*id]
+			if !ok {
+				break
+			}
+			visited[*id] = true
+			parent.UnreadCount += own
+			id = parent.ParentID
+		}
+	}
+
+	return tree, nil
+}
+
+// GetFeedIDsInTree returns the feeds of a user's folder and of all its nested subfolders,
+// skipping paused feeds unless includePaused is set. sql.ErrNoRows is returned if the
+// folder does not exist.
+func (fs *FolderService) GetFeedIDsInTree(userID, folderID int, includePaused bool) ([]int, error) {
+	if _, err := fs.GetFolderByID(userID, folderID); err != nil {
+		return nil, err
+	}
+
+	folders, err := fs.GetAllFolders(userID)
+	if err != nil {
+		return nil, err
+	}
+	parents := make(map[int]*int, len(folders))
+	for _, folder := range folders {
+		parents[folder.ID] = folder.ParentID
+	}
+
+	query := `
+		SELECT s.feed_id, s.folder_id FROM subscriptions s JOIN feeds f ON f.id = s.feed_id
+		WHERE s.user_id = ? AND s.folder_id IS NOT NULL
+	`
+	args := []interface{}{userID}
+	if !includePaused {
+		query += " AND f.paused = ?"
+		args = append(args, false)
+	}
+
+	rows, err := fs.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var feedIDs []int
+	for rows.Next() {
+		var feedID int
+		var parentID *int
+		if err := rows.Scan(&feedID, &parentID); err != nil {
+			return nil, err
+		}
+
+		// Include the feed if the folder is among its ancestors, guarding against cycles
+		visited := make(map[int]bool)
+		for id := parentID; id != nil && !visited[*id]; id = parents[*id] {
+			if *id == folderID {
+				feedIDs = append(feedIDs, feedID)
+				break
+			}
+			visited[*id] = true
+		}
+	}
+
+	return feedIDs, rows.Err()
+}
+
+// GetUnreadCounts returns a user's unread totals per feed and per folder from the
+// denormalized subscriptions.unread_count column. Folder totals include the feeds of
+// nested subfolders. The counts are cached and rebuilt in the background after changes
+// settle; callers must not modify the result.
+func (fs *FolderService) GetUnreadCounts(userID int) (*models.UnreadCounts, error) {
+	fs.unreadMu.Lock()
+	counts, gen := fs.unreadCounts[userID], fs.unreadGen
+	fs.warmUsers[userID] = time.Now()
+	fs.unreadMu.Unlock()
+
+	if counts != nil {
+		return counts, nil
+	}
+	return fs.rebuildUnreadCounts(userID, gen)
+}
+
+// invalidateUnreadCounts drops the cached counts and schedules a rebuild
+func (fs *FolderService) invalidateUnreadCounts() {
+	fs.unreadMu.Lock()
+	defer fs.unreadMu.Unlock()
+
+	fs.unreadCounts = make(map[int]*models.UnreadCounts)
+	fs.unreadGen++
+	if fs.warmTimer == nil {
+		fs.warmTimer = time.AfterFunc(unreadWarmDelay, fs.warmUnreadCounts)
+	} else {
+		fs.warmTimer.Reset(unreadWarmDelay)
+	}
+}
+
+// warmUnreadCounts rebuilds the cache of the users who recently asked for their counts so
+// their next request does not pay for it, and forgets the others
+func (fs *FolderService) warmUnreadCounts() {
+	fs.unreadMu.Lock()
+	gen := fs.unreadGen
+	userIDs := make([]int, 0, len(fs.warmUsers))
+	for userID, askedAt := range fs.warmUsers {
+		if time.Since(askedAt) > unreadWarmIdle {
+			delete(fs.warmUsers, userID)
+			continue
+		}
+		userIDs = append(userIDs, userID)
+	}
+	fs.unreadMu.Unlock()
+
+	for _, userID := range userIDs {
+		fs.rebuildUnreadCounts(userID, gen)
+	}
+}
+
+// rebuildUnreadCounts computes a user's counts and caches them unless they changed since
+// gen
+func (fs *FolderService) rebuildUnreadCounts(userID int, gen uint64) (*models.UnreadCounts, error) {
+	counts, err := fs.computeUnreadCounts(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.unreadMu.Lock()
+	if fs.unreadGen == gen {
+		fs.unreadCounts[userID] = counts
+	}
+	fs.unreadMu.Unlock()
+
+	return counts, nil
+}
+
+func (fs *FolderService) computeUnreadCounts(userID int) (*models.UnreadCounts, error) {
+	folders, err := fs.GetAllFolders(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := fs.db.Query(`SELECT feed_id, folder_id, unread_count FROM subscriptions WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := &models.UnreadCounts{
+		Feeds:   make(map[int]int),
+		Folders: make(map[int]int),
+	}
+
+	parents := make(map[int]*int)
+	for _, folder := range folders {
+		parents[folder.ID] = folder.ParentID
+		counts.Folders[folder.ID] = 0
+	}
+
+	for rows.Next() {
+		var feedID, unread int
+		var folderID *int
+		if err := rows.Scan(&feedID, &folderID, &unread); err != nil {
+			return nil, err
+		}
+
+		counts.Feeds[feedID] = unread
+		counts.Total += unread
+		if folderID == nil {
+			counts.Uncategorized += unread
+			continue
+		}
+
+		// Add the feed's count to its folder and every ancestor, guarding against cycles
+		visited := make(map[int]bool)
+		for id := folderID; id != nil && !visited[*id]; id = parents[*id] {
+			visited[*id] = true
+			counts.Folders[*id] += unread
+		}
+	}
+
+	return counts, rows.Err()
+}
@@ -0,0 +1,173 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"myfeed/config"
+	"myfeed/database"
+	"myfeed/models"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	// healthCheckTimeout bounds every readiness check, so a hanging database cannot hang
+	// the probe as well
+	healthCheckTimeout = 5 * time.Second
+	// refreshAgeGrace is added to refresh_max_interval before the last successful refresh
+	// counts as too old, to allow for jitter and a congested queue
+	refreshAgeGrace = time.Hour
+	// dispatchGrace is how late the feed refresh dispatch may be before the scheduler
+	// counts as stalled
+	dispatchGrace = 2 * time.Minute
+)
+
+// HealthService runs the readiness checks behind /api/health/ready: database connectivity,
+// scheduler liveness, the age of the last successful refresh and free disk space
+type HealthService struct {
+	db               *database.DB
+	dataDir          string
+	minFreeBytes     uint64
+	maxRefreshAge    time.Duration // 0 derives it from refresh_max_interval
+	feedService      *FeedService
+	schedulerService *SchedulerService
+	settingsService  *SettingsService
+	jobService       *JobService
+}
+
+func NewHealthService(cfg config.HealthConfig, dataDir string, db *database.DB, feedService *FeedService, schedulerService *SchedulerService, settingsService *SettingsService, jobService *JobService) *HealthService {
+	return &HealthService{
+		db:               db,
+		dataDir:          dataDir,
+		minFreeBytes:     uint64(cfg.MinFreeMB) << 20,
+		maxRefreshAge:    cfg.RefreshAge(),
+		feedService:      feedService,
+		schedulerService: schedulerService,
+		settingsService:  settingsService,
+		jobService:       jobService,
+	}
+}
+
+// Check runs every check concurrently and reports degraded if any of them fails
+func (hs *HealthService) Check(ctx context.Context) *models.HealthReport {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	checks := map[string]func(context.Context) (string, string){
+		"database":  hs.checkDatabase,
+		"scheduler": hs.checkScheduler,
+		"refresh":   hs.checkRefresh,
+		"disk":      hs.checkDisk,
+	}
+
+	report := &models.HealthReport{
+		Status:    models.CheckOK,
+		Checks:    make(map[string]models.HealthCheck, len(checks)),
+		CheckedAt: time.Now().UTC(),
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) (string, string)) {
+			defer wg.Done()
+			start := time.Now()
+			status, detail := check(ctx)
+			if status == models.CheckOK && ctx.Err() != nil {
+				status, detail = models.CheckDegraded, "check timed out"
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = models.HealthCheck{
+				Status:     status,
+				Detail:     detail,
+				DurationMs: time.Since(start).Milliseconds(),
+			}
+			if status == models.CheckDegraded {
+				report.Status = models.CheckDegraded
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	return report
+}
+
+// checkDatabase runs a query against the schema, which a plain ping would not touch
+func (hs *HealthService) checkDatabase(ctx context.Context) (string, string) {
+	var count int
+	if err := hs.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM settings`).Scan(&count); err != nil {
+		return models.CheckDegraded, fmt.Sprintf("query failed: %v", err)
+	}
+	return models.CheckOK, fmt.Sprintf("%s reachable", hs.db.Engine())
+}
+
+// checkScheduler verifies that the feed refresh dispatch ran when its schedule says it
+// should have
+func (hs *HealthService) checkScheduler(ctx context.Context) (string, string) {
+	if hs.jobService.IsPaused() {
+		return models.CheckSkipped, "paused in maintenance mode"
+	}
+
+	spec := hs.settingsService.GetString(SettingRefreshSchedule, DefaultRefreshSchedule)
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		schedule, _ = cron.ParseStandard(DefaultRefreshSchedule)
+	}
+
+	lastDispatch := hs.schedulerService.LastDispatch()
+	due := schedule.Next(lastDispatch).Add(dispatchGrace)
+	if time.Now().After(due) {
+		return models.CheckDegraded, fmt.Sprintf("feed refresh dispatch has not run since %s",
+			lastDispatch.UTC().Format(time.RFC3339))
+	}
+	return models.CheckOK, fmt.Sprintf("last dispatch %s ago", time.Since(lastDispatch).Round(time.Second))
+}
+
+// checkRefresh verifies that some feed was fetched successfully within the longest
+// interval a feed may go without a fetch
+func (hs *HealthService) checkRefresh(ctx context.Context) (string, string) {
+	totals, err := hs.feedService.GetHealthTotals()
+	if err != nil {
+		return models.CheckDegraded, fmt.Sprintf("failed to get feed health: %v", err)
+	}
+	if totals.Total == totals.Paused {
+		return models.CheckSkipped, "no active feeds"
+	}
+
+	maxAge := hs.maxRefreshAge
+	if maxAge == 0 {
+		maxAge = hs.settingsService.GetDuration(SettingRefreshMaxInterval, defaultMaxRefreshInterval) + refreshAgeGrace
+	}
+	if totals.LastRefresh == nil {
+		if totals.Error == totals.Total-totals.Paused {
+			return models.CheckDegraded, "no feed has ever been refreshed successfully"
+		}
+		return models.CheckOK, "no feed refreshed yet"
+	}
+
+	age := time.Since(*totals.LastRefresh)
+	if age > maxAge {
+		return models.CheckDegraded, fmt.Sprintf("last successful refresh %s ago, more than %s",
+			age.Round(time.Second), maxAge)
+	}
+	return models.CheckOK, fmt.Sprintf("last successful refresh %s ago", age.Round(time.Second))
+}
+
+// checkDisk verifies that the data directory has room for the database to grow
+func (hs *HealthService) checkDisk(ctx context.Context) (string, string) {
+	free, ok, err := freeDiskSpace(hs.dataDir)
+	if err != nil {
+		return models.CheckDegraded, fmt.Sprintf("failed to get free space of %s: %v", hs.dataDir, err)
+	}
+	if !ok {
+		return models.CheckSkipped, "free space is not available on this platform"
+	}
+	if free < hs.minFreeBytes {
+		return models.CheckDegraded, fmt.Sprintf("%d MB free, less than %d MB", free>>20, hs.minFreeBytes>>20)
+	}
+	return models.CheckOK, fmt.Sprintf("%d MB free", free>>20)
+}
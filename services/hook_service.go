@@ -0,0 +1,188 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"myfeed/config"
+	"myfeed/models"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// hookOutputLimit caps the command output kept in the error of a failed hook run
+const hookOutputLimit = 2048
+
+// hookArticle is the JSON document a hook receives
+type hookArticle struct {
+	ID          int       `json:"id"`
+	FeedID      int       `json:"feed_id"`
+	FeedTitle   string    `json:"feed_title"`
+	FeedURL     string    `json:"feed_url"`
+	Title       string    `json:"title"`
+	URL         string    `json:"url"`
+	Author      string    `json:"author"`
+	Content     string    `json:"content"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+type hookPayload struct {
+	Hook    string      `json:"hook"`
+	Article hookArticle `json:"article"`
+}
+
+// HookService runs the hooks from the config file for new articles. Every run is a job, so
+// a failing command or unreachable URL is retried like other background work.
+type HookService struct {
+	hooks         []config.HookConfig
+	folderService *FolderService
+	jobService    *JobService
+	client        *http.Client
+}
+
+func NewHookService(hooks []config.HookConfig, feedService *FeedService, folderService *FolderService, jobService *JobService) *HookService {
+	hs := &HookService{
+		hooks:         hooks,
+		folderService: folderService,
+		jobService:    jobService,
+		client:        &http.Client{},
+	}
+	if len(hooks) > 0 {
+		feedService.SubscribeNewArticles(hs.articlesAdded)
+		for _, hook := range hooks {
+			hookLog.Info("Article hook enabled", "hook", hook.Name)
+		}
+	}
+	return hs
+}
+
+// articlesAdded queues a hook run for every new article matching a hook
+func (hs *HookService) articlesAdded(feed *models.Feed, articles []models.Article) {
+	folders := make(folderTrees)
+	for i := range hs.hooks {
+		hook := &hs.hooks[i]
+		if !hs.matchesFeed(folders, hook, feed.ID) {
+			continue
+		}
+
+		for j := range articles {
+			article := &articles[j]
+			if !articleMatchesKeywords(article, hook.Keywords) {
+				continue
+			}
+
+			payload := hookPayload{
+				Hook: hook.Name,
+				Article: hookArticle{
+					ID:          article.ID,
+					FeedID:      feed.ID,
+					FeedTitle:   feed.Title,
+					FeedURL:     feed.URL,
+					Title:       article.Title,
+					URL:         article.URL,
+					Author:      article.Author,
+					Content:     article.Content,
+					PublishedAt: article.PublishedAt,
+				},
+			}
+			if _, err := hs.jobService.Enqueue(JobRunHook, "hook:"+hook.Name, payload); err != nil {
+				hookLog.Error("Failed to queue hook", "hook", hook.Name, "article_id", article.ID, "error", err)
+			}
+		}
+	}
+}
+
+func (hs *HookService) matchesFeed(folders folderTrees, hook *config.HookConfig, feedID int) bool {
+	if len(hook.FeedIDs) > 0 {
+		found := false
+		for _, id := range hook.FeedIDs {
+			if id == feedID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if hook.FolderID == nil {
+		return true
+	}
+	// Folders belong to users; the hook follows the folder of whoever owns it
+	owner, err := hs.folderService.folderOwner(*hook.FolderID)
+	if err != nil {
+		hookLog.Error("Failed to get hook folder", "hook", hook.Name, "folder_id", *hook.FolderID, "error", err)
+		return false
+	}
+	return folders.contains(hs.folderService, owner, *hook.FolderID, feedID)
+}
+
+// HandleHookJob is the job handler for run_hook jobs
+func (hs *HookService) HandleHookJob(ctx context.Context, job *models.Job) error {
+	var payload hookPayload
+	if err := decodePayload(job, &payload); err != nil {
+		return PermanentJobError(err)
+	}
+
+	var hook *config.HookConfig
+	for i := range hs.hooks {
+		if hs.hooks[i].Name == payload.Hook {
+			hook = &hs.hooks[i]
+		}
+	}
+	if hook == nil {
+		return PermanentJobError(fmt.Errorf("hook %q is no longer configured", payload.Hook))
+	}
+
+	body, err := json.Marshal(payload.Article)
+	if err != nil {
+		return PermanentJobError(err)
+	}
+
+	timeout, _ := time.ParseDuration(hook.Timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if hook.URL != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+		if err != nil {
+			return PermanentJobError(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return doPush(hs.client, req)
+	}
+	return runHookCommand(ctx, hook, body)
+}
+
+// runHookCommand runs the command of a hook with the article JSON on stdin. The hook name is
+// passed in MYFEED_HOOK so one script can serve several hooks.
+func runHookCommand(ctx context.Context, hook *config.HookConfig, article []byte) error {
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(article)
+	cmd.Env = append(os.Environ(), "MYFEED_HOOK="+hook.Name)
+
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("hook %s timed out after %s", hook.Name, hook.Timeout)
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) && ctx.Err() == nil {
+		// The program could not be started, e.g. it does not exist; retrying will not help
+		return PermanentJobError(fmt.Errorf("hook %s: %v", hook.Name, err))
+	}
+
+	text := strings.TrimSpace(string(output))
+	if len(text) > hookOutputLimit {
+		text = text[len(text)-hookOutputLimit:]
+	}
+	return fmt.Errorf("hook %s failed: %v: %s", hook.Name, err, text)
+}
@@ -0,0 +1,245 @@
+package services
+
+import (
+	"database/sql"
+	"myfeed/metrics"
+	"myfeed/models"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyWindowSize is the number of recent observations quantiles are computed from
+	latencyWindowSize = 100
+)
+
+// latencyQuantiles are the quantiles reported for every latency summary
+var latencyQuantiles = []float64{0.5, 0.9, 0.99}
+
+// Job outcomes counted by the metrics endpoint
+const (
+	jobOutcomeDone     = "done"
+	jobOutcomeRetried  = "retried"
+	jobOutcomeFailed   = "failed"
+	jobOutcomeRequeued = "requeued"
+)
+
+type jobOutcomeKey struct {
+	jobType string
+	outcome string
+}
+
+// jobStats keeps the in-memory counters of the job queue since the process started
+type jobStats struct {
+	mu        sync.Mutex
+	processed map[jobOutcomeKey]uint64
+	waits     map[string]*metrics.Window
+	durations map[string]*metrics.Window
+}
+
+func newJobStats() *jobStats {
+	return &jobStats{
+		processed: make(map[jobOutcomeKey]uint64),
+		waits:     make(map[string]*metrics.Window),
+		durations: make(map[string]*metrics.Window),
+	}
+}
+
+// record counts a finished attempt. wait is how long the job sat in the queue after it
+// became due, duration how long the handler ran.
+func (s *jobStats) record(job *models.Job, outcome string, wait, duration time.Duration) {
+	s.mu.Lock()
+	s.processed[jobOutcomeKey{jobType: job.Type, outcome: outcome}]++
+	waits := windowFor(s.waits, job.Type)
+	durations := windowFor(s.durations, job.Type)
+	s.mu.Unlock()
+
+	if wait < 0 {
+		wait = 0
+	}
+	waits.Observe(wait.Seconds())
+	durations.Observe(duration.Seconds())
+}
+
+// windowFor returns the window stored under key, creating it if needed. Callers hold the lock.
+func windowFor[K comparable](windows map[K]*metrics.Window, key K) *metrics.Window {
+	win, exists := windows[key]
+	if !exists {
+		win = metrics.NewWindow(latencyWindowSize)
+		windows[key] = win
+	}
+	return win
+}
+
+// CollectMetrics writes the queue depth, processed job counters and queue latency to the
+// metrics endpoint
+func (js *JobService) CollectMetrics(w *metrics.Writer) {
+	counts, err := js.CountByStatus()
+	if err != nil {
+		metricsLog.Error("Failed to count jobs", "error", err)
+	}
+	for _, status := range []string{models.JobPending, models.JobRunning, models.JobDone, models.JobFailed} {
+		w.Gauge("myfeed_jobs", "Number of jobs in the queue by status.", float64(counts[status]), metrics.Label{Name: "status", Value: status})
+	}
+
+	due, oldestDueAt, err := js.dueBacklog()
+	if err != nil {
+		metricsLog.Error("Failed to get job backlog", "error", err)
+	}
+	var oldestDueAge float64
+	if oldestDueAt != nil {
+		oldestDueAge = time.Since(*oldestDueAt).Seconds()
+	}
+	w.Gauge("myfeed_jobs_due", "Number of pending jobs that are due and waiting for a worker.", float64(due))
+	w.Gauge("myfeed_jobs_oldest_due_age_seconds", "Time the oldest due job has been waiting for a worker, 0 if none.", oldestDueAge)
+
+	w.Gauge("myfeed_job_workers", "Configured number of job workers.", float64(js.Workers()))
+	var paused float64
+	if js.IsPaused() {
+		paused = 1
+	}
+	w.Gauge("myfeed_job_workers_paused", "Whether the job workers are paused (1) or running (0).", paused)
+
+	js.stats.mu.Lock()
+	keys := make([]jobOutcomeKey, 0, len(js.stats.processed))
+	for key := range js.stats.processed {
+		keys = append(keys, key)
+	}
+	processed := make(map[jobOutcomeKey]uint64, len(keys))
+	for _, key := range keys {
+		processed[key] = js.stats.processed[key]
+	}
+	jobTypes := make([]string, 0, len(js.stats.waits))
+	for jobType := range js.stats.waits {
+		jobTypes = append(jobTypes, jobType)
+	}
+	js.stats.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].jobType != keys[j].jobType {
+			return keys[i].jobType < keys[j].jobType
+		}
+		return keys[i].outcome < keys[j].outcome
+	})
+	for _, key := range keys {
+		w.Counter("myfeed_jobs_processed_total", "Total number of job attempts finished by this process, by type and outcome.", float64(processed[key]),
+			metrics.Label{Name: "type", Value: key.jobType}, metrics.Label{Name: "outcome", Value: key.outcome})
+	}
+
+	sort.Strings(jobTypes)
+	for _, jobType := range jobTypes {
+		js.stats.mu.Lock()
+		waits, durations := js.stats.waits[jobType], js.stats.durations[jobType]
+		js.stats.mu.Unlock()
+
+		label := metrics.Label{Name: "type", Value: jobType}
+		quantiles, sum, count := waits.Snapshot(latencyQuantiles...)
+		w.Summary("myfeed_job_wait_seconds", "Time jobs waited for a worker after becoming due.", quantiles, sum, count, label)
+		quantiles, sum, count = durations.Snapshot(latencyQuantiles...)
+		w.Summary("myfeed_job_duration_seconds", "Time spent running jobs.", quantiles, sum, count, label)
+	}
+}
+
+// dueBacklog returns the number of due pending jobs and the due time of the oldest one
+func (js *JobService) dueBacklog() (int, *time.Time, error) {
+	now := time.Now().UTC()
+
+	var due int
+	err := js.db.QueryRow(`SELECT COUNT(*) FROM jobs WHERE status = ? AND run_at <= ?`, models.JobPending, now).Scan(&due)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var oldest time.Time
+	query := `SELECT run_at FROM jobs WHERE status = ? AND run_at <= ? ORDER BY run_at LIMIT 1`
+	err = js.db.QueryRow(query, models.JobPending, now).Scan(&oldest)
+	if err == sql.ErrNoRows {
+		return due, nil, nil
+	}
+	if err != nil {
+		return due, nil, err
+	}
+	return due, &oldest, nil
+}
+
+// refreshStats keeps the recent refresh durations of every feed
+type refreshStats struct {
+	mu        sync.Mutex
+	latencies map[int]*metrics.Window
+}
+
+func (s *refreshStats) record(feedID int, duration time.Duration) {
+	s.mu.Lock()
+	if s.latencies == nil {
+		s.latencies = make(map[int]*metrics.Window)
+	}
+	win := windowFor(s.latencies, feedID)
+	s.mu.Unlock()
+
+	win.Observe(duration.Seconds())
+}
+
+// evict drops the durations of a deleted feed
+func (s *refreshStats) evict(feedID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.latencies, feedID)
+}
+
+// forget drops the durations of feeds that no longer exist but were not evicted, like
+// feeds removed from the database by hand
+func (s *refreshStats) forget(existing map[int]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for feedID := range s.latencies {
+		if !existing[feedID] {
+			delete(s.latencies, feedID)
+		}
+	}
+}
+
+// CollectMetrics writes the number of overdue feeds and the per-feed refresh latency to
+// the metrics endpoint
+func (ss *SchedulerService) CollectMetrics(w *metrics.Writer) {
+	var overdue int
+	query := `SELECT COUNT(*) FROM feeds WHERE paused = ? AND next_fetch_at <= ?`
+	if err := ss.db.QueryRow(query, false, time.Now().UTC()).Scan(&overdue); err != nil {
+		metricsLog.Error("Failed to count overdue feeds", "error", err)
+	}
+	w.Gauge("myfeed_feeds_overdue", "Number of unpaused feeds whose next fetch time has passed.", float64(overdue))
+	w.Counter("myfeed_refreshes_dispatched_total", "Total number of refreshes queued by the scheduler.", float64(ss.dispatched.Load()))
+
+	feedIDs, err := ss.feedIDs(`SELECT id FROM feeds`)
+	if err != nil {
+		metricsLog.Error("Failed to get feeds", "error", err)
+		return
+	}
+	existing := make(map[int]bool, len(feedIDs))
+	for _, feedID := range feedIDs {
+		existing[feedID] = true
+	}
+	ss.refreshes.forget(existing)
+
+	ss.refreshes.mu.Lock()
+	ids := make([]int, 0, len(ss.refreshes.latencies))
+	for feedID := range ss.refreshes.latencies {
+		ids = append(ids, feedID)
+	}
+	ss.refreshes.mu.Unlock()
+	sort.Ints(ids)
+
+	for _, feedID := range ids {
+		ss.refreshes.mu.Lock()
+		win := ss.refreshes.latencies[feedID]
+		ss.refreshes.mu.Unlock()
+		if win == nil {
+			continue
+		}
+
+		quantiles, sum, count := win.Snapshot(latencyQuantiles...)
+		w.Summary("myfeed_feed_refresh_duration_seconds", "Time spent fetching and storing a feed.", quantiles, sum, count,
+			metrics.Label{Name: "feed_id", Value: strconv.Itoa(feedID)})
+	}
+}
@@ -0,0 +1,650 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"myfeed/database"
+	"myfeed/models"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Job types
+const (
+	JobRefreshFeed      = "refresh_feed"
+	JobCleanupArticles  = "cleanup_articles"
+	JobRepairOrphans    = "repair_orphans"
+	JobCleanupSessions  = "cleanup_sessions"
+	JobImportOPML       = "import_opml"
+	JobAggregateStats   = "aggregate_stats"
+	JobSendDigests      = "send_digests"
+	JobBackup           = "backup"
+	JobSendNotification = "send_notification"
+	JobRunHook          = "run_hook"
+	JobSyncBookmark     = "sync_bookmark"
+	JobForwardArticle   = "forward_article"
+	JobCheckUpdate      = "check_update"
+	JobRefreshDirectory = "refresh_directory"
+	JobCacheEnclosure   = "cache_enclosure"
+	JobFetchContent     = "fetch_content"
+	JobDeliverWebhook   = "deliver_webhook"
+	JobWebSubSubscribe  = "websub_subscribe"
+)
+
+const (
+	minJobWorkers         = 2
+	maxDefaultJobWorkers  = 8
+	defaultJobMaxAttempts = 3
+	jobPollInterval       = time.Second
+	jobRetryBaseDelay     = 30 * time.Second
+)
+
+// permanentJobError marks a job failure that retrying cannot fix
+type permanentJobError struct {
+	err error
+}
+
+func (e *permanentJobError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentJobError) Unwrap() error {
+	return e.err
+}
+
+// PermanentJobError wraps err so the job is marked failed without further retries
+func PermanentJobError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentJobError{err: err}
+}
+
+// deferredJobError puts a job back in the queue for later without counting the attempt
+type deferredJobError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *deferredJobError) Error() string {
+	return e.err.Error()
+}
+
+func (e *deferredJobError) Unwrap() error {
+	return e.err
+}
+
+// DeferJob wraps err so the job runs again after delay, as if it had not been claimed,
+// for handlers that cannot start yet
+func DeferJob(err error, delay time.Duration) error {
+	return &deferredJobError{err: err, delay: delay}
+}
+
+// retryJobError retries a failed job after a delay chosen by its handler
+type retryJobError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryJobError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryJobError) Unwrap() error {
+	return e.err
+}
+
+// RetryJobAfter wraps err so that, if the job has attempts left, it is retried after
+// delay instead of the default backoff
+func RetryJobAfter(err error, delay time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &retryJobError{err: err, delay: delay}
+}
+
+// JobHandler executes a single job. Returning an error schedules a retry until the
+// job runs out of attempts.
+type JobHandler func(ctx context.Context, job *models.Job) error
+
+// JobService is a database-backed job queue with a pool of workers. Jobs survive
+// restarts: anything left running by a previous process is picked up again on Start.
+type JobService struct {
+	db       *database.DB
+	mu       sync.RWMutex
+	handlers map[string]JobHandler
+	wake     chan struct{}
+	stopping chan struct{}
+	paused   atomic.Bool
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	stats    *jobStats
+
+	// poolMu guards the worker pool; each running worker has its own quit channel
+	poolMu  sync.Mutex
+	workers int
+	quits   []chan struct{}
+	jobCtx  context.Context
+}
+
+// DefaultWorkerCount returns the configured worker count if it is set, otherwise the
+// number of CPUs bounded to a range that keeps small machines responsive
+func DefaultWorkerCount(configured int) int {
+	if configured > 0 {
+		return configured
+	}
+
+	workers := runtime.NumCPU()
+	if workers < minJobWorkers {
+		return minJobWorkers
+	}
+	if workers > maxDefaultJobWorkers {
+		return maxDefaultJobWorkers
+	}
+	return workers
+}
+
+func NewJobService(db *database.DB, workers int) *JobService {
+	return &JobService{
+		db:       db,
+		workers:  DefaultWorkerCount(workers),
+		handlers: make(map[string]JobHandler),
+		wake:     make(chan struct{}, 1),
+		stopping: make(chan struct{}),
+		stats:    newJobStats(),
+	}
+}
+
+const jobColumns = `id, type, target, payload, status, attempts, max_attempts, priority, last_error, result,
+		       run_at, started_at, finished_at, created_at`
+
+func scanJob(row rowScanner, job *models.Job) error {
+	err := row.Scan(
+		&job.ID, &job.Type, &job.Target, &job.Payload, &job.Status, &job.Attempts, &job.MaxAttempts, &job.Priority,
+		&job.LastError, &job.Result, &job.RunAt, &job.StartedAt, &job.FinishedAt, &job.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	if job.StartedAt != nil && job.FinishedAt != nil {
+		duration := job.FinishedAt.Sub(*job.StartedAt).Milliseconds()
+		job.DurationMs = &duration
+	}
+	return nil
+}
+
+// Register sets the handler for a job type. Handlers must be registered before Start.
+func (js *JobService) Register(jobType string, handler JobHandler) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.handlers[jobType] = handler
+}
+
+// Enqueue stores a job that is due immediately. target identifies what the job works on
+// (e.g. "feed:12") and may be empty.
+func (js *JobService) Enqueue(jobType, target string, payload interface{}) (*models.Job, error) {
+	return js.EnqueueAt(jobType, target, payload, time.Now())
+}
+
+// EnqueueAt stores a job that becomes due at runAt
+func (js *JobService) EnqueueAt(jobType, target string, payload interface{}, runAt time.Time) (*models.Job, error) {
+	return js.EnqueuePriority(jobType, target, payload, runAt, 0)
+}
+
+// EnqueuePriority stores a job that becomes due at runAt. When more jobs are due than
+// there are workers, jobs with a higher priority are claimed first.
+func (js *JobService) EnqueuePriority(jobType, target string, payload interface{}, runAt time.Time, priority int) (*models.Job, error) {
+	return js.enqueue(jobType, target, payload, runAt, priority, defaultJobMaxAttempts)
+}
+
+// EnqueueAttempts is Enqueue for jobs that may be tried maxAttempts times instead of
+// the default of 3
+func (js *JobService) EnqueueAttempts(jobType, target string, payload interface{}, maxAttempts int) (*models.Job, error) {
+	return js.enqueue(jobType, target, payload, time.Now(), 0, maxAttempts)
+}
+
+func (js *JobService) enqueue(jobType, target string, payload interface{}, runAt time.Time, priority, maxAttempts int) (*models.Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode job payload: %v", err)
+	}
+
+	var targetValue *string
+	if target != "" {
+		targetValue = &target
+	}
+
+	query := `
+		INSERT INTO jobs (type, target, payload, status, max_attempts, priority, run_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	jobID, err := js.db.Insert(query, jobType, targetValue, string(data), models.JobPending, maxAttempts, priority, runAt.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to enqueue job: %v", err)
+	}
+
+	js.notify()
+	return js.GetJob(int(jobID))
+}
+
+// EnqueueUnique is EnqueuePriority for jobs that must not pile up: if a job of the same
+// type and target is still pending, it is returned instead, moved up to the earlier
+// run time and the higher priority of the two.
+func (js *JobService) EnqueueUnique(jobType, target string, payload interface{}, runAt time.Time, priority int) (*models.Job, error) {
+	var jobID int
+	selectQuery := `SELECT id FROM jobs WHERE type = ? AND target = ? AND status = ? ORDER BY id LIMIT 1`
+	err := js.db.QueryRow(selectQuery, jobType, target, models.JobPending).Scan(&jobID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to check for a pending job: %v", err)
+	}
+
+	if err == nil {
+		runAt = runAt.UTC()
+		updateQuery := `
+			UPDATE jobs
+			SET priority = CASE WHEN priority < ? THEN ? ELSE priority END,
+			    run_at = CASE WHEN run_at > ? THEN ? ELSE run_at END
+			WHERE id = ? AND status = ?
+		`
+		result, err := js.db.Exec(updateQuery, priority, priority, runAt, runAt, jobID, models.JobPending)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update pending job: %v", err)
+		}
+		// The job may have been claimed in the meantime, in which case a new one is queued
+		if updated, _ := result.RowsAffected(); updated == 1 {
+			js.notify()
+			return js.GetJob(jobID)
+		}
+	}
+
+	return js.EnqueuePriority(jobType, target, payload, runAt, priority)
+}
+
+func (js *JobService) GetJob(id int) (*models.Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE id = ?`
+
+	job := &models.Job{}
+	if err := scanJob(js.db.QueryRow(query, id), job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// GetJobs returns the most recent jobs, optionally filtered by status and type
+func (js *JobService) GetJobs(status, jobType string, limit int) ([]models.Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE 1=1`
+	var args []interface{}
+
+	if status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	if jobType != "" {
+		query += " AND type = ?"
+		args = append(args, jobType)
+	}
+
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := js.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []models.Job
+	for rows.Next() {
+		var job models.Job
+		if err := scanJob(rows, &job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// SetResult stores the outcome of a job. Long-running handlers may call it repeatedly
+// to report progress while the job is still running.
+func (js *JobService) SetResult(jobID int, result interface{}) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("failed to encode job result: %v", err)
+	}
+
+	if _, err := js.db.Exec(`UPDATE jobs SET result = ? WHERE id = ?`, string(data), jobID); err != nil {
+		return fmt.Errorf("failed to save job result: %v", err)
+	}
+	return nil
+}
+
+// CountByStatus returns the number of jobs in each status
+func (js *JobService) CountByStatus() (map[string]int, error) {
+	rows, err := js.db.Query(`SELECT status, COUNT(*) FROM jobs GROUP BY status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+
+	return counts, rows.Err()
+}
+
+// PurgeFinished deletes completed and failed jobs that finished before the cutoff
+func (js *JobService) PurgeFinished(olderThan time.Duration) (int64, error) {
+	query := `DELETE FROM jobs WHERE status IN (?, ?) AND finished_at < ?`
+	result, err := js.db.Exec(query, models.JobDone, models.JobFailed, time.Now().Add(-olderThan).UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Start requeues jobs interrupted by a previous shutdown and launches the workers
+func (js *JobService) Start() error {
+	query := `UPDATE jobs SET status = ?, started_at = NULL WHERE status = ?`
+	result, err := js.db.Exec(query, models.JobPending, models.JobRunning)
+	if err != nil {
+		return fmt.Errorf("failed to requeue interrupted jobs: %v", err)
+	}
+	if requeued, _ := result.RowsAffected(); requeued > 0 {
+		jobLog.Info("Requeued jobs interrupted by the previous shutdown", "count", requeued)
+	}
+
+	// Jobs run with their own context so that stopping the workers does not
+	// interrupt running jobs until the shutdown deadline passes
+	jobCtx, cancel := context.WithCancel(context.Background())
+	js.cancel = cancel
+
+	js.poolMu.Lock()
+	js.jobCtx = jobCtx
+	js.resize()
+	js.poolMu.Unlock()
+
+	return nil
+}
+
+// SetWorkers changes the number of jobs processed concurrently. Surplus workers exit
+// after finishing their current job.
+func (js *JobService) SetWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	js.poolMu.Lock()
+	defer js.poolMu.Unlock()
+
+	js.workers = workers
+	if js.jobCtx != nil && !js.isStopping() {
+		js.resize()
+	}
+}
+
+// Workers returns the configured number of workers
+func (js *JobService) Workers() int {
+	js.poolMu.Lock()
+	defer js.poolMu.Unlock()
+	return js.workers
+}
+
+// resize starts or stops workers until the pool matches js.workers. Callers hold poolMu.
+func (js *JobService) resize() {
+	if len(js.quits) == js.workers {
+		return
+	}
+
+	for len(js.quits) < js.workers {
+		quit := make(chan struct{})
+		js.quits = append(js.quits, quit)
+		js.wg.Add(1)
+		go js.worker(js.jobCtx, quit)
+	}
+
+	for len(js.quits) > js.workers {
+		last := len(js.quits) - 1
+		close(js.quits[last])
+		js.quits = js.quits[:last]
+	}
+
+	jobLog.Info("Started job workers", "workers", js.workers)
+}
+
+// Stop stops claiming new jobs and waits for running jobs to finish. Jobs still running
+// when ctx is done are cancelled and put back in the queue.
+func (js *JobService) Stop(ctx context.Context) {
+	if js.cancel == nil {
+		return
+	}
+	close(js.stopping)
+
+	done := make(chan struct{})
+	go func() {
+		js.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		jobLog.Warn("Cancelling running jobs")
+		js.cancel()
+		<-done
+	}
+	js.cancel()
+}
+
+// SetPaused stops or resumes claiming jobs. Jobs that are already running finish normally
+// and queued jobs wait until the workers are resumed.
+func (js *JobService) SetPaused(paused bool) {
+	js.paused.Store(paused)
+	if !paused {
+		js.notify()
+	}
+}
+
+// IsPaused reports whether the workers are paused
+func (js *JobService) IsPaused() bool {
+	return js.paused.Load()
+}
+
+// notify wakes an idle worker without blocking if one is already awake
+func (js *JobService) notify() {
+	select {
+	case js.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (js *JobService) worker(ctx context.Context, quit chan struct{}) {
+	defer js.wg.Done()
+
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Drain the queue before waiting again
+		for !js.isStopping() && !js.paused.Load() && !isClosed(quit) {
+			job, err := js.claim()
+			if err != nil {
+				jobLog.Error("Failed to claim job", "error", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			js.run(ctx, job)
+		}
+
+		select {
+		case <-js.stopping:
+			return
+		case <-quit:
+			return
+		case <-js.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (js *JobService) isStopping() bool {
+	return isClosed(js.stopping)
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// claim marks the due job with the highest priority as running. The status check in the UPDATE makes the
+// claim safe when several workers (or processes) race for the same row.
+func (js *JobService) claim() (*models.Job, error) {
+	for {
+		var jobID int
+		selectQuery := `SELECT id FROM jobs WHERE status = ? AND run_at <= ? ORDER BY priority DESC, run_at, id LIMIT 1`
+		err := js.db.QueryRow(selectQuery, models.JobPending, time.Now().UTC()).Scan(&jobID)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		updateQuery := `
+			UPDATE jobs SET status = ?, attempts = attempts + 1, started_at = ?
+			WHERE id = ? AND status = ?
+		`
+		result, err := js.db.Exec(updateQuery, models.JobRunning, time.Now().UTC(), jobID, models.JobPending)
+		if err != nil {
+			return nil, err
+		}
+
+		claimed, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if claimed == 1 {
+			return js.GetJob(jobID)
+		}
+		// Another worker took it first; try the next one
+	}
+}
+
+func (js *JobService) run(ctx context.Context, job *models.Job) {
+	js.mu.RLock()
+	handler, exists := js.handlers[job.Type]
+	js.mu.RUnlock()
+
+	startedAt := time.Now()
+	var wait time.Duration
+	if job.StartedAt != nil {
+		wait = job.StartedAt.Sub(job.RunAt)
+	}
+
+	var err error
+	if !exists {
+		err = fmt.Errorf("no handler registered for job type %s", job.Type)
+	} else {
+		err = execute(ctx, handler, job)
+	}
+
+	outcome := jobOutcomeFailed
+	defer func() {
+		js.stats.record(job, outcome, wait, time.Since(startedAt))
+	}()
+
+	if err != nil && ctx.Err() != nil {
+		// Cancelled by shutdown; the attempt does not count
+		outcome = jobOutcomeRequeued
+		query := `UPDATE jobs SET status = ?, attempts = attempts - 1, started_at = NULL WHERE id = ?`
+		if _, err := js.db.Exec(query, models.JobPending, job.ID); err != nil {
+			jobLog.Error("Failed to requeue job", "job_id", job.ID, "error", err)
+		}
+		return
+	}
+
+	var deferred *deferredJobError
+	if errors.As(err, &deferred) {
+		outcome = jobOutcomeRequeued
+		jobLog.Debug("Job deferred", "job_id", job.ID, "type", job.Type, "delay", deferred.delay, "reason", err)
+		query := `UPDATE jobs SET status = ?, attempts = attempts - 1, started_at = NULL, run_at = ? WHERE id = ?`
+		if _, err := js.db.Exec(query, models.JobPending, time.Now().Add(deferred.delay).UTC(), job.ID); err != nil {
+			jobLog.Error("Failed to defer job", "job_id", job.ID, "error", err)
+		}
+		return
+	}
+
+	if err == nil {
+		outcome = jobOutcomeDone
+		query := `UPDATE jobs SET status = ?, last_error = NULL, finished_at = ? WHERE id = ?`
+		if _, err := js.db.Exec(query, models.JobDone, time.Now().UTC(), job.ID); err != nil {
+			jobLog.Error("Failed to mark job as done", "job_id", job.ID, "error", err)
+		}
+		return
+	}
+
+	var permanent *permanentJobError
+	if job.Attempts < job.MaxAttempts && exists && !errors.As(err, &permanent) {
+		outcome = jobOutcomeRetried
+		delay := jobRetryBaseDelay * time.Duration(job.Attempts*job.Attempts)
+		var retry *retryJobError
+		if errors.As(err, &retry) {
+			delay = retry.delay
+		}
+		jobLog.Warn("Job failed, retrying", "job_id", job.ID, "type", job.Type, "attempt", job.Attempts, "delay", delay, "error", err)
+
+		query := `UPDATE jobs SET status = ?, last_error = ?, run_at = ? WHERE id = ?`
+		if _, err := js.db.Exec(query, models.JobPending, err.Error(), time.Now().Add(delay).UTC(), job.ID); err != nil {
+			jobLog.Error("Failed to reschedule job", "job_id", job.ID, "error", err)
+		}
+		return
+	}
+
+	jobLog.Warn("Job failed permanently", "job_id", job.ID, "type", job.Type, "attempts", job.Attempts, "error", err)
+	query := `UPDATE jobs SET status = ?, last_error = ?, finished_at = ? WHERE id = ?`
+	if _, err := js.db.Exec(query, models.JobFailed, err.Error(), time.Now().UTC(), job.ID); err != nil {
+		jobLog.Error("Failed to mark job as failed", "job_id", job.ID, "error", err)
+	}
+}
+
+// execute runs a handler, turning a panic into a permanent failure so that one bad job
+// cannot take down the worker pool. The stack trace ends up in the job's last_error.
+func execute(ctx context.Context, handler JobHandler, job *models.Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			jobLog.Error("Job panicked", "job_id", job.ID, "type", job.Type, "panic", r, "stack", string(stack))
+			err = PermanentJobError(fmt.Errorf("panic: %v\n\n%s", r, stack))
+		}
+	}()
+
+	return handler(ctx, job)
+}
+
+// decodePayload unmarshals the JSON payload of a job into v
+func decodePayload(job *models.Job, v interface{}) error {
+	if err := json.Unmarshal([]byte(job.Payload), v); err != nil {
+		return fmt.Errorf("invalid payload for job %d: %v", job.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package services
+
+import "myfeed/logging"
+
+// fetcherComponent is the component of the fetcher log, which TraceFetches turns up
+const fetcherComponent = "fetcher"
+
+// Component loggers of the services
+var (
+	fetcherLog      = logging.For(fetcherComponent)
+	schedulerLog    = logging.For("scheduler")
+	jobLog          = logging.For("jobs")
+	cronLog         = logging.For("cron")
+	articleLog      = logging.For("articles")
+	authLog         = logging.For("auth")
+	opmlLog         = logging.For("opml")
+	notificationLog = logging.For("notifications")
+	mailLog         = logging.For("mail")
+	hookLog         = logging.For("hooks")
+	bookmarkLog     = logging.For("bookmarks")
+	backupLog       = logging.For("backup")
+	maintenanceLog  = logging.For("maintenance")
+	metricsLog      = logging.For("metrics")
+	updateLog       = logging.For("update")
+	discoverLog     = logging.For("discover")
+	enclosureLog    = logging.For("enclosures")
+	webhookLog      = logging.For("webhooks")
+	websubLog       = logging.For("websub")
+)
+
+// TraceFetches logs every feed download in detail, at debug level whatever the log level
+// is, to diagnose a misbehaving feed without the debug output of everything else
+func TraceFetches(on bool) {
+	logging.SetDebug(fetcherComponent, on)
+}
+
+// FetchesTraced reports whether TraceFetches is on
+func FetchesTraced() bool {
+	return logging.Debugging(fetcherComponent)
+}
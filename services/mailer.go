@@ -0,0 +1,176 @@
+package services
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"myfeed/config"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+)
+
+// mailTimeout bounds connecting to the SMTP server
+const mailTimeout = 30 * time.Second
+
+// Mailer sends mail through the SMTP server. The smtp_* settings override the server
+// from the config file and environment, so it can be changed without a restart.
+type Mailer struct {
+	cfg             config.SMTPConfig
+	settingsService *SettingsService
+}
+
+func NewMailer(cfg config.SMTPConfig, settingsService *SettingsService) *Mailer {
+	return &Mailer{
+		cfg:             cfg,
+		settingsService: settingsService,
+	}
+}
+
+// config returns the server configuration with the stored settings applied
+func (m *Mailer) config() config.SMTPConfig {
+	cfg := m.cfg
+	cfg.Host = m.settingsService.GetString(SettingSMTPHost, cfg.Host)
+	cfg.Port = m.settingsService.GetInt(SettingSMTPPort, cfg.Port)
+	cfg.TLS = m.settingsService.GetString(SettingSMTPTLS, cfg.TLS)
+	cfg.Username = m.settingsService.GetString(SettingSMTPUsername, cfg.Username)
+	cfg.Password = m.settingsService.GetString(SettingSMTPPassword, cfg.Password)
+	cfg.From = m.settingsService.GetString(SettingSMTPFrom, cfg.From)
+	if cfg.From == "" {
+		cfg.From = cfg.Username
+	}
+	return cfg
+}
+
+// Enabled reports whether a mail server is configured
+func (m *Mailer) Enabled() bool {
+	return m.config().Enabled()
+}
+
+// Send sends a message with an HTML and a plain text version to a single recipient.
+// textBody may be empty, in which case only the HTML version is sent.
+func (m *Mailer) Send(to, subject, htmlBody, textBody string) error {
+	cfg := m.config()
+	if !cfg.Enabled() {
+		return fmt.Errorf("no SMTP server configured")
+	}
+
+	msg, err := buildMessage(cfg.From, to, subject, htmlBody, textBody)
+	if err != nil {
+		return err
+	}
+
+	if err := deliver(cfg, to, msg); err != nil {
+		return fmt.Errorf("failed to send mail to %s: %v", to, err)
+	}
+	return nil
+}
+
+// buildMessage encodes a multipart/alternative message, plain text first so clients
+// that render HTML prefer the last part
+func buildMessage(from, to, subject, htmlBody, textBody string) ([]byte, error) {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+
+	parts := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", parts.Boundary())
+
+	bodies := []struct{ contentType, body string }{
+		{"text/plain; charset=UTF-8", textBody},
+		{"text/html; charset=UTF-8", htmlBody},
+	}
+	for _, part := range bodies {
+		if part.body == "" {
+			continue
+		}
+
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+// deliver connects to the server with the configured security mode and sends msg
+func deliver(cfg config.SMTPConfig, to string, msg []byte) error {
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	tlsConfig := &tls.Config{ServerName: cfg.Host}
+	dialer := &net.Dialer{Timeout: mailTimeout}
+
+	var conn net.Conn
+	var err error
+	if cfg.TLS == config.SMTPTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if cfg.TLS == config.SMTPStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("server does not support STARTTLS")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(cfg.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
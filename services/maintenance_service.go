@@ -0,0 +1,111 @@
+package services
+
+import (
+	"fmt"
+	"myfeed/database"
+)
+
+// RepairReport lists what a referential repair run fixed
+type RepairReport struct {
+	OrphanedArticles   int64 `json:"orphaned_articles"`
+	OrphanedStats      int64 `json:"orphaned_stats"`
+	OrphanedSessions   int64 `json:"orphaned_sessions"`
+	DetachedFeeds      int64 `json:"detached_feeds"`
+	DetachedFolders    int64 `json:"detached_folders"`
+	EmptyImportFolders int64 `json:"empty_import_folders"`
+}
+
+// Total returns the number of rows fixed across all checks
+func (r *RepairReport) Total() int64 {
+	return r.OrphanedArticles + r.OrphanedStats + r.OrphanedSessions +
+		r.DetachedFeeds + r.DetachedFolders + r.EmptyImportFolders
+}
+
+// MaintenanceService repairs data that foreign keys should have prevented but did not,
+// e.g. databases created before ON DELETE CASCADE was in place or SQLite connections
+// opened without foreign key enforcement
+type MaintenanceService struct {
+	db           *database.DB
+	statsService *FeedStatsService
+}
+
+func NewMaintenanceService(db *database.DB, statsService *FeedStatsService) *MaintenanceService {
+	return &MaintenanceService{
+		db:           db,
+		statsService: statsService,
+	}
+}
+
+// RepairOrphans removes rows that reference missing parents and empty folders left
+// behind by OPML imports
+func (ms *MaintenanceService) RepairOrphans() (*RepairReport, error) {
+	report := &RepairReport{}
+
+	steps := []struct {
+		name   string
+		query  string
+		result *int64
+	}{
+		{"articles of deleted feeds", `DELETE FROM articles WHERE feed_id NOT IN (SELECT id FROM feeds)`, &report.OrphanedArticles},
+		{"stats of deleted feeds", `DELETE FROM feed_stats WHERE feed_id NOT IN (SELECT id FROM feeds)`, &report.OrphanedStats},
+		{"sessions of deleted users", `DELETE FROM sessions WHERE user_id NOT IN (SELECT id FROM users)`, &report.OrphanedSessions},
+		{"feeds in deleted folders", `UPDATE subscriptions SET folder_id = NULL WHERE folder_id IS NOT NULL AND folder_id NOT IN (SELECT id FROM folders)`, &report.DetachedFeeds},
+		{"folders with deleted parents", `UPDATE folders SET parent_id = NULL WHERE parent_id IS NOT NULL AND parent_id NOT IN (SELECT id FROM folders)`, &report.DetachedFolders},
+	}
+
+	for _, step := range steps {
+		count, err := ms.execCount(step.query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to repair %s: %v", step.name, err)
+		}
+		*step.result = count
+	}
+
+	removed, err := ms.removeEmptyImportFolders()
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove empty import folders: %v", err)
+	}
+	report.EmptyImportFolders = removed
+
+	if report.OrphanedArticles > 0 {
+		if err := ms.statsService.RecalculateAll(); err != nil {
+			maintenanceLog.Error("Failed to recalculate feed stats after repair", "error", err)
+		}
+	}
+	if report.Total() > 0 {
+		ms.statsService.NotifyUnreadChanged()
+	}
+
+	return report, nil
+}
+
+// removeEmptyImportFolders deletes imported folders without feeds or subfolders. Removing
+// a leaf can leave its parent empty, so this repeats until nothing changes.
+func (ms *MaintenanceService) removeEmptyImportFolders() (int64, error) {
+	query := `
+		DELETE FROM folders
+		WHERE imported = ?
+		  AND id NOT IN (SELECT folder_id FROM subscriptions WHERE folder_id IS NOT NULL)
+		  AND id NOT IN (SELECT parent_id FROM folders WHERE parent_id IS NOT NULL)
+	`
+
+	var total int64
+	for {
+		count, err := ms.execCount(query, true)
+		if err != nil {
+			return total, err
+		}
+		if count == 0 {
+			return total, nil
+		}
+		total += count
+	}
+}
+
+func (ms *MaintenanceService) execCount(query string, args ...interface{}) (int64, error) {
+	result, err := ms.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// messageTemplate is the template of one kind of outgoing message, stored in the setting
+// of the same name. An empty setting uses the built-in template.
+type messageTemplate struct {
+	fallback string
+	html     bool               // parsed with html/template, which escapes the data for HTML
+	sample   func() interface{} // example data used for validation and previews
+}
+
+// messageTemplates lists the customizable templates by setting key
+var messageTemplates = map[string]messageTemplate{
+	SettingDigestSubjectTemplate:       {fallback: defaultDigestSubject, sample: sampleDigest},
+	SettingDigestHTMLTemplate:          {fallback: defaultDigestHTML, html: true, sample: sampleDigest},
+	SettingDigestTextTemplate:          {fallback: defaultDigestText, sample: sampleDigest},
+	SettingNotificationTitleTemplate:   {fallback: defaultNotificationTitle, sample: sampleNotification},
+	SettingNotificationMessageTemplate: {fallback: defaultNotificationMessage, sample: sampleNotification},
+	SettingForwardSubjectTemplate:      {fallback: defaultForwardSubject, sample: sampleForward},
+	SettingForwardHTMLTemplate:         {fallback: defaultForwardHTML, html: true, sample: sampleForward},
+	SettingForwardTextTemplate:         {fallback: defaultForwardText, sample: sampleForward},
+}
+
+type templateExecutor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+func (mt messageTemplate) parse(text string) (templateExecutor, error) {
+	if strings.TrimSpace(text) == "" {
+		text = mt.fallback
+	}
+	if mt.html {
+		tmpl, err := htmltemplate.New("message").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		return tmpl, nil
+	}
+	tmpl, err := texttemplate.New("message").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+func (mt messageTemplate) render(text string, data interface{}) (string, error) {
+	tmpl, err := mt.parse(text)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// validateMessageTemplate checks that a template parses and renders the sample data, so a
+// typo in a field name is rejected when saving rather than when the next digest goes out
+func validateMessageTemplate(key string) func(string) error {
+	return func(value string) error {
+		mt := messageTemplates[key]
+		_, err := mt.render(value, mt.sample())
+		return err
+	}
+}
+
+func sampleDigest() interface{} {
+	published := time.Date(2024, time.January, 2, 9, 30, 0, 0, time.UTC)
+	return &digestData{
+		Title: "MyFeed digest",
+		Since: published.Add(-24 * time.Hour),
+		Count: 3,
+		Folders: []*digestFolder{
+			{Name: "Tech", Feeds: []*digestFeed{{
+				Title: "Example Blog",
+				Articles: []digestArticle{
+					{Title: "Release notes", URL: "https://example.com/release", PublishedAt: published},
+					{Title: "A closer look at SQLite", URL: "https://example.com/sqlite", PublishedAt: published},
+				},
+			}}},
+			{Name: digestUnfiled, Feeds: []*digestFeed{{
+				Title:    "Example News",
+				Articles: []digestArticle{{Title: "Weather", URL: "https://example.com/weather", PublishedAt: published}},
+			}}},
+		},
+	}
+}
+
+func sampleNotification() interface{} {
+	return &notificationData{
+		Feed:   "Example Blog",
+		Folder: "Tech",
+		Count:  1,
+		Title:  "Release notes",
+		URL:    "https://example.com/release",
+	}
+}
+
+func sampleForward() interface{} {
+	return &forwardData{
+		Feed:        "Example Blog",
+		Title:       "Release notes",
+		URL:         "https://example.com/release",
+		Author:      "Jane Doe",
+		PublishedAt: time.Date(2024, time.January, 2, 9, 30, 0, 0, time.UTC),
+		Content:     "<p>The new release is <strong>out</strong>.</p>",
+		Text:        "The new release is out.",
+	}
+}
+
+// MessageTemplate describes a customizable template for the admin API
+type MessageTemplate struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"` // empty when the built-in template is used
+	Default string `json:"default"`
+	HTML    bool   `json:"html"`
+}
+
+// MessageTemplates renders outgoing emails and notifications from the templates stored in
+// the settings
+type MessageTemplates struct {
+	settingsService *SettingsService
+}
+
+func NewMessageTemplates(settingsService *SettingsService) *MessageTemplates {
+	return &MessageTemplates{settingsService: settingsService}
+}
+
+// List returns every customizable template with its current and built-in text
+func (m *MessageTemplates) List() []MessageTemplate {
+	list := make([]MessageTemplate, 0, len(messageTemplates))
+	for key, mt := range messageTemplates {
+		list = append(list, MessageTemplate{
+			Key:     key,
+			Value:   m.settingsService.GetString(key, ""),
+			Default: mt.fallback,
+			HTML:    mt.html,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+// Render renders the stored template of a setting. A stored template that fails on the
+// data is logged and the built-in template is used instead, so a message still goes out.
+func (m *MessageTemplates) Render(key string, data interface{}) (string, error) {
+	mt, ok := messageTemplates[key]
+	if !ok {
+		return "", fmt.Errorf("unknown template %q", key)
+	}
+
+	out, err := mt.render(m.settingsService.GetString(key, ""), data)
+	if err != nil {
+		mailLog.Warn("Failed to render template, using the built-in template", "template", key, "error", err)
+		return mt.render("", data)
+	}
+	return out, nil
+}
+
+// Preview renders a template with sample data. A nil text previews the stored template.
+func (m *MessageTemplates) Preview(key string, text *string) (string, error) {
+	mt, ok := messageTemplates[key]
+	if !ok {
+		return "", invalidField("key", "unknown template %q", key)
+	}
+	if text == nil {
+		stored := m.settingsService.GetString(key, "")
+		text = &stored
+	}
+	out, err := mt.render(*text, mt.sample())
+	if err != nil {
+		return "", invalidField("template", "%v", err)
+	}
+	return out, nil
+}
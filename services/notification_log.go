@@ -0,0 +1,165 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"myfeed/models"
+	"time"
+)
+
+const deliveryColumns = `d.id, d.user_id, d.target_id, t.name, t.provider, d.article_id, d.title, d.message, d.url,
+	d.status, d.error, d.attempts, d.created_at, d.updated_at`
+
+func scanDelivery(row rowScanner, d *models.NotificationDelivery) error {
+	return row.Scan(&d.ID, &d.UserID, &d.TargetID, &d.TargetName, &d.Provider, &d.ArticleID, &d.Title,
+		&d.Message, &d.URL, &d.Status, &d.Error, &d.Attempts, &d.CreatedAt, &d.UpdatedAt)
+}
+
+// DeliveryFilter selects entries of the delivery log
+type DeliveryFilter struct {
+	Status   string // empty for every status
+	TargetID *int
+	Limit    int
+	Offset   int
+}
+
+// GetDeliveries returns a user's delivery log, newest first
+func (ns *NotificationService) GetDeliveries(userID int, filter DeliveryFilter) ([]models.NotificationDelivery, error) {
+	query := `
+		SELECT ` + deliveryColumns + `
+		FROM notification_deliveries d
+		JOIN notification_targets t ON t.id = d.target_id
+		WHERE d.user_id = ?
+	`
+	args := []interface{}{userID}
+	if filter.Status != "" {
+		query += " AND d.status = ?"
+		args = append(args, filter.Status)
+	}
+	if filter.TargetID != nil {
+		query += " AND d.target_id = ?"
+		args = append(args, *filter.TargetID)
+	}
+
+	query += " ORDER BY d.id DESC LIMIT ? OFFSET ?"
+	args = append(args, filter.Limit, filter.Offset)
+
+	rows, err := ns.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []models.NotificationDelivery{}
+	for rows.Next() {
+		var d models.NotificationDelivery
+		if err := scanDelivery(rows, &d); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// GetDelivery returns an entry of a user's delivery log, or sql.ErrNoRows
+func (ns *NotificationService) GetDelivery(userID, id int) (*models.NotificationDelivery, error) {
+	query := `
+		SELECT ` + deliveryColumns + `
+		FROM notification_deliveries d
+		JOIN notification_targets t ON t.id = d.target_id
+		WHERE d.id = ? AND d.user_id = ?
+	`
+
+	d := &models.NotificationDelivery{}
+	if err := scanDelivery(ns.db.QueryRow(query, id, userID), d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Resend queues a failed or dropped notification again, as a new entry of the log
+func (ns *NotificationService) Resend(userID, id int) (*models.NotificationDelivery, error) {
+	d, err := ns.GetDelivery(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if d.Status != models.DeliveryFailed && d.Status != models.DeliveryDropped {
+		return nil, ErrNotResendable
+	}
+
+	n := Notification{Title: d.Title, Message: d.Message, URL: d.URL}
+	if d.ArticleID != nil {
+		n.ArticleID = *d.ArticleID
+	}
+	deliveryID, err := ns.queue(&models.NotificationTarget{ID: d.TargetID, UserID: d.UserID}, n)
+	if err != nil {
+		return nil, err
+	}
+	return ns.GetDelivery(userID, deliveryID)
+}
+
+// CleanupDeliveries removes delivery log entries older than the given number of days
+func (ns *NotificationService) CleanupDeliveries(days int) (int64, error) {
+	cutoff := time.Now().UTC().AddDate(0, 0, -days)
+	result, err := ns.db.Exec(`DELETE FROM notification_deliveries WHERE created_at < ?`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to clean up notification log: %v", err)
+	}
+	return result.RowsAffected()
+}
+
+// recordDelivery adds a notification to the delivery log and returns its ID
+func (ns *NotificationService) recordDelivery(target *models.NotificationTarget, n Notification, status string, reason error) (int, error) {
+	var articleID *int
+	if n.ArticleID != 0 {
+		articleID = &n.ArticleID
+	}
+	var errText *string
+	if reason != nil {
+		text := reason.Error()
+		errText = &text
+	}
+
+	now := time.Now().UTC()
+	query := `
+		INSERT INTO notification_deliveries (user_id, target_id, article_id, title, message, url, status, error, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	id, err := ns.db.Insert(query, target.UserID, target.ID, articleID, n.Title, n.Message, n.URL, status, errText, now, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record notification: %v", err)
+	}
+	return int(id), nil
+}
+
+// recordDropped logs notifications that are not sent at all
+func (ns *NotificationService) recordDropped(target *models.NotificationTarget, notifications []Notification, reason error) {
+	for _, n := range notifications {
+		if _, err := ns.recordDelivery(target, n, models.DeliveryDropped, reason); err != nil {
+			notificationLog.Error("Failed to record dropped notification", "target_id", target.ID, "error", err)
+		}
+	}
+}
+
+// recordAttempt stores the outcome of one attempt to push a logged notification. A failed
+// attempt the job queue will retry is logged as retrying.
+func (ns *NotificationService) recordAttempt(deliveryID int, job *models.Job, pushErr error) {
+	status := models.DeliverySent
+	var errText *string
+	if pushErr != nil {
+		text := pushErr.Error()
+		errText = &text
+
+		var permanent *permanentJobError
+		status = models.DeliveryFailed
+		if job != nil && job.Attempts < job.MaxAttempts && !errors.As(pushErr, &permanent) {
+			status = models.DeliveryRetrying
+		}
+	}
+
+	query := `UPDATE notification_deliveries SET status = ?, error = ?, attempts = attempts + 1, updated_at = ? WHERE id = ?`
+	if _, err := ns.db.Exec(query, status, errText, time.Now().UTC(), deliveryID); err != nil {
+		notificationLog.Error("Failed to record notification", "delivery_id", deliveryID, "error", err)
+	}
+}
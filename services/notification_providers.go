@@ -0,0 +1,336 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"myfeed/models"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Notification is a single push message. ArticleID is only used for the delivery log
+// and is 0 for summaries.
+type Notification struct {
+	Title     string
+	Message   string
+	URL       string
+	ArticleID int
+}
+
+// notificationProvider delivers notifications to one push service. cfg holds the
+// provider settings stored with the target.
+type notificationProvider interface {
+	// validate checks cfg and fills in defaults
+	validate(cfg map[string]string) error
+	send(ctx context.Context, client *http.Client, cfg map[string]string, n Notification) error
+}
+
+// notificationProviders lists the supported push services by name
+var notificationProviders = map[string]notificationProvider{
+	models.NotifyNtfy:     ntfyProvider{},
+	models.NotifyGotify:   gotifyProvider{},
+	models.NotifyPushover: pushoverProvider{},
+	models.NotifyWebhook:  webhookProvider{},
+	models.NotifyBrowser:  browserProvider{},
+}
+
+// notificationSecrets are the provider settings that are redacted in API responses
+var notificationSecrets = []string{"token", "user_key", "password", "headers"}
+
+// pushError is returned for a rejected push. Client errors (bad token, unknown topic)
+// are permanent; server errors and rate limiting are worth retrying.
+func pushError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err := fmt.Errorf("push rejected with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		return PermanentJobError(err)
+	}
+	return err
+}
+
+func doPush(client *http.Client, req *http.Request) error {
+	req.Header.Set("User-Agent", feedUserAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return pushError(resp)
+	}
+	return nil
+}
+
+func requireConfig(cfg map[string]string, keys ...string) error {
+	for _, key := range keys {
+		if strings.TrimSpace(cfg[key]) == "" {
+			return fmt.Errorf("%s is required", key)
+		}
+	}
+	return nil
+}
+
+func validateServerURL(value string) error {
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("server must be an http or https URL")
+	}
+	return nil
+}
+
+func validatePriority(value string, min, max int) error {
+	if value == "" {
+		return nil
+	}
+	priority, err := strconv.Atoi(value)
+	if err != nil || priority < min || priority > max {
+		return fmt.Errorf("priority must be between %d and %d", min, max)
+	}
+	return nil
+}
+
+// ntfyProvider publishes to an ntfy topic. Settings: server (default https://ntfy.sh),
+// topic, optional token and priority (1-5).
+type ntfyProvider struct{}
+
+func (ntfyProvider) validate(cfg map[string]string) error {
+	if cfg["server"] == "" {
+		cfg["server"] = "https://ntfy.sh"
+	}
+	if err := requireConfig(cfg, "topic"); err != nil {
+		return err
+	}
+	if err := validateServerURL(cfg["server"]); err != nil {
+		return err
+	}
+	return validatePriority(cfg["priority"], 1, 5)
+}
+
+func (ntfyProvider) send(ctx context.Context, client *http.Client, cfg map[string]string, n Notification) error {
+	endpoint := strings.TrimSuffix(cfg["server"], "/") + "/" + url.PathEscape(cfg["topic"])
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(n.Message))
+	if err != nil {
+		return PermanentJobError(err)
+	}
+
+	req.Header.Set("Title", n.Title)
+	if n.URL != "" {
+		req.Header.Set("Click", n.URL)
+	}
+	if cfg["priority"] != "" {
+		req.Header.Set("Priority", cfg["priority"])
+	}
+	if cfg["token"] != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg["token"])
+	}
+	return doPush(client, req)
+}
+
+// gotifyProvider posts to a Gotify server. Settings: server, token (an application
+// token) and optional priority (0-10).
+type gotifyProvider struct{}
+
+func (gotifyProvider) validate(cfg map[string]string) error {
+	if err := requireConfig(cfg, "server", "token"); err != nil {
+		return err
+	}
+	if err := validateServerURL(cfg["server"]); err != nil {
+		return err
+	}
+	return validatePriority(cfg["priority"], 0, 10)
+}
+
+func (gotifyProvider) send(ctx context.Context, client *http.Client, cfg map[string]string, n Notification) error {
+	message := map[string]interface{}{
+		"title":   n.Title,
+		"message": n.Message,
+	}
+	if priority, err := strconv.Atoi(cfg["priority"]); err == nil {
+		message["priority"] = priority
+	}
+	if n.URL != "" {
+		message["extras"] = map[string]interface{}{
+			"client::notification": map[string]interface{}{
+				"click": map[string]string{"url": n.URL},
+			},
+		}
+	}
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		return PermanentJobError(err)
+	}
+
+	endpoint := strings.TrimSuffix(cfg["server"], "/") + "/message"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return PermanentJobError(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", cfg["token"])
+	return doPush(client, req)
+}
+
+// pushoverProvider sends through the Pushover API. Settings: token (the application
+// token), user_key and optional priority (-2 to 2).
+type pushoverProvider struct{}
+
+const pushoverEndpoint = "https://api.pushover.net/1/messages.json"
+
+func (pushoverProvider) validate(cfg map[string]string) error {
+	if err := requireConfig(cfg, "token", "user_key"); err != nil {
+		return err
+	}
+	return validatePriority(cfg["priority"], -2, 2)
+}
+
+func (pushoverProvider) send(ctx context.Context, client *http.Client, cfg map[string]string, n Notification) error {
+	form := url.Values{
+		"token":   {cfg["token"]},
+		"user":    {cfg["user_key"]},
+		"title":   {n.Title},
+		"message": {n.Message},
+	}
+	if n.URL != "" {
+		form.Set("url", n.URL)
+	}
+	if cfg["priority"] != "" {
+		form.Set("priority", cfg["priority"])
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pushoverEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return PermanentJobError(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doPush(client, req)
+}
+
+// webhookProvider sends a request built from a Go template, so the payload can match what
+// IFTTT, Zapier, n8n or custom scripts expect. Settings: url, optional method (default
+// POST), body (a text/template over Title, Message and URL; defaults to a JSON object with
+// those fields) and headers (one "Name: value" per line, default Content-Type JSON).
+// The json template function quotes a value as a JSON string, e.g. {"text": {{json .Title}}}.
+type webhookProvider struct{}
+
+const defaultWebhookBody = `{"title": {{json .Title}}, "message": {{json .Message}}, "url": {{json .URL}}}`
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+func (webhookProvider) validate(cfg map[string]string) error {
+	if err := requireConfig(cfg, "url"); err != nil {
+		return err
+	}
+	if err := validateServerURL(cfg["url"]); err != nil {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+
+	cfg["method"] = strings.ToUpper(strings.TrimSpace(cfg["method"]))
+	switch cfg["method"] {
+	case "":
+		cfg["method"] = http.MethodPost
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodGet:
+	default:
+		return fmt.Errorf("method must be POST, PUT, PATCH or GET")
+	}
+
+	tmpl, err := webhookTemplate(cfg["body"])
+	if err != nil {
+		return fmt.Errorf("invalid body template: %v", err)
+	}
+	sample := Notification{Title: "Feed", Message: "Article", URL: "https://example.com/"}
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return fmt.Errorf("invalid body template: %v", err)
+	}
+	if _, err := parseWebhookHeaders(cfg["headers"]); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (webhookProvider) send(ctx context.Context, client *http.Client, cfg map[string]string, n Notification) error {
+	tmpl, err := webhookTemplate(cfg["body"])
+	if err != nil {
+		return PermanentJobError(err)
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, n); err != nil {
+		return PermanentJobError(fmt.Errorf("failed to render webhook body: %v", err))
+	}
+
+	headers, err := parseWebhookHeaders(cfg["headers"])
+	if err != nil {
+		return PermanentJobError(err)
+	}
+
+	method := cfg["method"]
+	if method == "" {
+		method = http.MethodPost
+	}
+	var reader io.Reader
+	if method != http.MethodGet {
+		reader = &body
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, cfg["url"], reader)
+	if err != nil {
+		return PermanentJobError(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	return doPush(client, req)
+}
+
+// browserProvider has no settings. Its notifications are published to the user's
+// NotificationStream by the notification service rather than sent over HTTP.
+type browserProvider struct{}
+
+func (browserProvider) validate(cfg map[string]string) error {
+	for key := range cfg {
+		delete(cfg, key)
+	}
+	return nil
+}
+
+func (browserProvider) send(ctx context.Context, client *http.Client, cfg map[string]string, n Notification) error {
+	return PermanentJobError(fmt.Errorf("browser notifications are published to the notification stream"))
+}
+
+func webhookTemplate(body string) (*template.Template, error) {
+	if strings.TrimSpace(body) == "" {
+		body = defaultWebhookBody
+	}
+	return template.New("webhook").Funcs(webhookFuncs).Option("missingkey=error").Parse(body)
+}
+
+// parseWebhookHeaders reads one "Name: value" header per line
+func parseWebhookHeaders(text string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid header line %q, expected \"Name: value\"", line)
+		}
+		headers[name] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
@@ -0,0 +1,261 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"myfeed/models"
+	"strings"
+	"time"
+)
+
+// heldSummaryLines caps the articles listed in a combined notification
+const heldSummaryLines = 10
+
+const preferencesColumns = `user_id, quiet_start, quiet_end, timezone, batch, updated_at`
+
+func scanNotificationPreferences(row rowScanner, prefs *models.NotificationPreferences) error {
+	return row.Scan(&prefs.UserID, &prefs.QuietStart, &prefs.QuietEnd, &prefs.Timezone, &prefs.Batch, &prefs.UpdatedAt)
+}
+
+// GetPreferences returns the quiet hours of a user; a user who never set them has none
+func (ns *NotificationService) GetPreferences(userID int) (*models.NotificationPreferences, error) {
+	query := `SELECT ` + preferencesColumns + ` FROM notification_preferences WHERE user_id = ?`
+
+	prefs := &models.NotificationPreferences{}
+	err := scanNotificationPreferences(ns.db.QueryRow(query, userID), prefs)
+	if err == sql.ErrNoRows {
+		return &models.NotificationPreferences{UserID: userID, Timezone: "UTC"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+// SavePreferences validates and stores the quiet hours of a user. Both ends of the window
+// must be set, or neither to disable quiet hours.
+func (ns *NotificationService) SavePreferences(prefs *models.NotificationPreferences) (*models.NotificationPreferences, error) {
+	prefs.QuietStart = strings.TrimSpace(prefs.QuietStart)
+	prefs.QuietEnd = strings.TrimSpace(prefs.QuietEnd)
+	if (prefs.QuietStart == "") != (prefs.QuietEnd == "") {
+		return nil, invalidField("quiet_end", "quiet_start and quiet_end must both be set or both be empty")
+	}
+	if prefs.QuietStart != "" {
+		start, err := parseClock(prefs.QuietStart)
+		if err != nil {
+			return nil, invalidField("quiet_start", "invalid quiet_start: %v", err)
+		}
+		end, err := parseClock(prefs.QuietEnd)
+		if err != nil {
+			return nil, invalidField("quiet_end", "invalid quiet_end: %v", err)
+		}
+		if start == end {
+			return nil, invalidField("quiet_end", "quiet_start and quiet_end must differ")
+		}
+	}
+
+	prefs.Timezone = strings.TrimSpace(prefs.Timezone)
+	if prefs.Timezone == "" {
+		prefs.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(prefs.Timezone); err != nil {
+		return nil, invalidField("timezone", "unknown timezone %q", prefs.Timezone)
+	}
+
+	query := `
+		INSERT INTO notification_preferences (user_id, quiet_start, quiet_end, timezone, batch, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET
+			quiet_start = excluded.quiet_start,
+			quiet_end = excluded.quiet_end,
+			timezone = excluded.timezone,
+			batch = excluded.batch,
+			updated_at = excluded.updated_at
+	`
+	_, err := ns.db.Exec(query, prefs.UserID, prefs.QuietStart, prefs.QuietEnd, prefs.Timezone, prefs.Batch, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to save notification preferences: %v", err)
+	}
+
+	return ns.GetPreferences(prefs.UserID)
+}
+
+// parseClock parses an "HH:MM" time of day into minutes since midnight
+func parseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("expected HH:MM, got %q", value)
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// inQuietHours reports whether now falls in the quiet hours of prefs
+func inQuietHours(prefs *models.NotificationPreferences, now time.Time) bool {
+	if prefs.QuietStart == "" {
+		return false
+	}
+	start, err := parseClock(prefs.QuietStart)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(prefs.QuietEnd)
+	if err != nil {
+		return false
+	}
+	loc, err := time.LoadLocation(prefs.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	if start > end {
+		// The window spans midnight
+		return minute >= start || minute < end
+	}
+	return start <= minute && minute < end
+}
+
+// userPreferences caches the quiet hours of users while one batch of articles is routed
+type userPreferences map[int]*models.NotificationPreferences
+
+func (ns *NotificationService) preferences(cache userPreferences, userID int) *models.NotificationPreferences {
+	prefs, cached := cache[userID]
+	if !cached {
+		var err error
+		if prefs, err = ns.GetPreferences(userID); err != nil {
+			notificationLog.Error("Failed to get notification preferences", "user_id", userID, "error", err)
+			prefs = &models.NotificationPreferences{UserID: userID}
+		}
+		cache[userID] = prefs
+	}
+	return prefs
+}
+
+// deliver queues notifications for a target unless its user is in quiet hours, in which
+// case they are held for a combined push or dropped, depending on the user's batch setting
+func (ns *NotificationService) deliver(cache userPreferences, target *models.NotificationTarget, notifications []Notification) {
+	if len(notifications) == 0 {
+		return
+	}
+
+	prefs := ns.preferences(cache, target.UserID)
+	if !inQuietHours(prefs, time.Now()) {
+		ns.enqueue(target, notifications)
+		return
+	}
+	if !prefs.Batch {
+		notificationLog.Info("Dropped notifications during quiet hours", "target_id", target.ID, "count", len(notifications))
+		ns.recordDropped(target, notifications, fmt.Errorf("quiet hours"))
+		return
+	}
+
+	query := `INSERT INTO held_notifications (user_id, target_id, title, message, url, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+	now := time.Now().UTC()
+	for _, n := range notifications {
+		if _, err := ns.db.Exec(query, target.UserID, target.ID, n.Title, n.Message, n.URL, now); err != nil {
+			notificationLog.Error("Failed to hold notification", "target_id", target.ID, "error", err)
+		}
+	}
+}
+
+type heldNotification struct {
+	id       int
+	targetID int
+	Notification
+}
+
+// FlushHeld queues one combined push per target for the notifications held for users whose
+// quiet hours have ended, and returns the number of pushes queued
+func (ns *NotificationService) FlushHeld() (int, error) {
+	rows, err := ns.db.Query(`SELECT DISTINCT user_id FROM held_notifications`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get held notifications: %v", err)
+	}
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+
+	now := time.Now()
+	flushed := 0
+	for _, userID := range userIDs {
+		prefs, err := ns.GetPreferences(userID)
+		if err != nil {
+			return flushed, err
+		}
+		if prefs.Batch && inQuietHours(prefs, now) {
+			continue
+		}
+
+		count, err := ns.flushUser(userID)
+		flushed += count
+		if err != nil {
+			return flushed, err
+		}
+	}
+
+	return flushed, nil
+}
+
+func (ns *NotificationService) flushUser(userID int) (int, error) {
+	query := `SELECT id, target_id, title, message, url FROM held_notifications WHERE user_id = ? ORDER BY id`
+	rows, err := ns.db.Query(query, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	byTarget := make(map[int][]Notification)
+	var targetIDs []int
+	lastID := 0
+	for rows.Next() {
+		var held heldNotification
+		if err := rows.Scan(&held.id, &held.targetID, &held.Title, &held.Message, &held.URL); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if _, seen := byTarget[held.targetID]; !seen {
+			targetIDs = append(targetIDs, held.targetID)
+		}
+		byTarget[held.targetID] = append(byTarget[held.targetID], held.Notification)
+		lastID = held.id
+	}
+	rows.Close()
+
+	for _, targetID := range targetIDs {
+		ns.enqueue(&models.NotificationTarget{ID: targetID, UserID: userID}, []Notification{combineNotifications(byTarget[targetID])})
+	}
+
+	// Notifications held while flushing have a higher ID and wait for the next run
+	if _, err := ns.db.Exec(`DELETE FROM held_notifications WHERE user_id = ? AND id <= ?`, userID, lastID); err != nil {
+		return len(targetIDs), fmt.Errorf("failed to remove held notifications: %v", err)
+	}
+	return len(targetIDs), nil
+}
+
+// combineNotifications merges held notifications into one push listing their articles
+func combineNotifications(held []Notification) Notification {
+	if len(held) == 1 {
+		return held[0]
+	}
+
+	lines := make([]string, 0, heldSummaryLines+1)
+	for i, n := range held {
+		if i == heldSummaryLines {
+			lines = append(lines, fmt.Sprintf("and %d more", len(held)-heldSummaryLines))
+			break
+		}
+		lines = append(lines, n.Title+": "+n.Message)
+	}
+
+	return Notification{
+		Title:   fmt.Sprintf("%d notifications during quiet hours", len(held)),
+		Message: strings.Join(lines, "\n"),
+	}
+}
@@ -0,0 +1,241 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"myfeed/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+const notificationRuleColumns = `id, user_id, name, feed_id, folder_id, keywords, target_ids, max_per_hour, enabled, created_at`
+
+func scanNotificationRule(row rowScanner, rule *models.NotificationRule) error {
+	var keywords, targetIDs string
+	err := row.Scan(&rule.ID, &rule.UserID, &rule.Name, &rule.FeedID, &rule.FolderID, &keywords,
+		&targetIDs, &rule.MaxPerHour, &rule.Enabled, &rule.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal([]byte(keywords), &rule.Keywords); err != nil {
+		return fmt.Errorf("invalid keywords of notification rule %d: %v", rule.ID, err)
+	}
+	if err := json.Unmarshal([]byte(targetIDs), &rule.TargetIDs); err != nil {
+		return fmt.Errorf("invalid targets of notification rule %d: %v", rule.ID, err)
+	}
+	if rule.Keywords == nil {
+		rule.Keywords = []string{}
+	}
+	if rule.TargetIDs == nil {
+		rule.TargetIDs = []int{}
+	}
+	return nil
+}
+
+func (ns *NotificationService) queryRules(query string, args ...interface{}) ([]models.NotificationRule, error) {
+	rows, err := ns.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []models.NotificationRule{}
+	for rows.Next() {
+		var rule models.NotificationRule
+		if err := scanNotificationRule(rows, &rule); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+// GetRules returns the notification rules of a user
+func (ns *NotificationService) GetRules(userID int) ([]models.NotificationRule, error) {
+	query := `SELECT ` + notificationRuleColumns + ` FROM notification_rules WHERE user_id = ? ORDER BY id`
+	return ns.queryRules(query, userID)
+}
+
+// GetRule returns a notification rule of a user, or sql.ErrNoRows
+func (ns *NotificationService) GetRule(userID, id int) (*models.NotificationRule, error) {
+	query := `SELECT ` + notificationRuleColumns + ` FROM notification_rules WHERE id = ? AND user_id = ?`
+
+	rule := &models.NotificationRule{}
+	if err := scanNotificationRule(ns.db.QueryRow(query, id, userID), rule); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// SaveRule validates and stores a notification rule. A rule without an ID is created;
+// otherwise the user's rule with that ID is replaced.
+func (ns *NotificationService) SaveRule(rule *models.NotificationRule) (*models.NotificationRule, error) {
+	if rule.ID != 0 {
+		if _, err := ns.GetRule(rule.UserID, rule.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	rule.Name = strings.TrimSpace(rule.Name)
+	if rule.Name == "" {
+		return nil, invalidField("name", "name is required")
+	}
+	if rule.MaxPerHour < 0 {
+		return nil, invalidField("max_per_hour", "max_per_hour must not be negative")
+	}
+	if rule.FeedID != nil {
+		if _, err := ns.feedService.GetSubscribedFeed(rule.UserID, *rule.FeedID); err != nil {
+			return nil, invalidField("feed_id", "feed not found")
+		}
+	}
+	if rule.FolderID != nil {
+		if _, err := ns.folderService.GetFolderByID(rule.UserID, *rule.FolderID); err != nil {
+			return nil, invalidField("folder_id", "folder not found")
+		}
+	}
+
+	if len(rule.TargetIDs) == 0 {
+		return nil, invalidField("target_ids", "at least one target is required")
+	}
+	seen := make(map[int]bool, len(rule.TargetIDs))
+	targetIDs := []int{}
+	for _, targetID := range rule.TargetIDs {
+		if seen[targetID] {
+			continue
+		}
+		if _, err := ns.GetTarget(rule.UserID, targetID); err != nil {
+			return nil, invalidField("target_ids", "notification target %d not found", targetID)
+		}
+		seen[targetID] = true
+		targetIDs = append(targetIDs, targetID)
+	}
+	rule.TargetIDs = targetIDs
+
+	keywords := []string{}
+	for _, keyword := range rule.Keywords {
+		if keyword = strings.TrimSpace(keyword); keyword != "" {
+			keywords = append(keywords, keyword)
+		}
+	}
+	rule.Keywords = keywords
+
+	keywordData, err := json.Marshal(rule.Keywords)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode keywords: %v", err)
+	}
+	targetData, err := json.Marshal(rule.TargetIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode targets: %v", err)
+	}
+
+	if rule.ID == 0 {
+		query := `
+			INSERT INTO notification_rules (user_id, name, feed_id, folder_id, keywords, target_ids, max_per_hour, enabled)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`
+		id, err := ns.db.Insert(query, rule.UserID, rule.Name, rule.FeedID, rule.FolderID,
+			string(keywordData), string(targetData), rule.MaxPerHour, rule.Enabled)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create notification rule: %v", err)
+		}
+		rule.ID = int(id)
+	} else {
+		query := `
+			UPDATE notification_rules
+			SET name = ?, feed_id = ?, folder_id = ?, keywords = ?, target_ids = ?, max_per_hour = ?, enabled = ?
+			WHERE id = ? AND user_id = ?
+		`
+		_, err := ns.db.Exec(query, rule.Name, rule.FeedID, rule.FolderID, string(keywordData),
+			string(targetData), rule.MaxPerHour, rule.Enabled, rule.ID, rule.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update notification rule: %v", err)
+		}
+	}
+
+	return ns.GetRule(rule.UserID, rule.ID)
+}
+
+// DeleteRule removes a notification rule of a user
+func (ns *NotificationService) DeleteRule(userID, id int) error {
+	result, err := ns.db.Exec(`DELETE FROM notification_rules WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return sql.ErrNoRows
+	}
+	ns.limiter.forget(id)
+	return nil
+}
+
+// ruleMatches reports whether an article of a feed is selected by a rule
+func (ns *NotificationService) ruleMatches(folders folderTrees, rule *models.NotificationRule, feedID int, article *models.Article) bool {
+	if rule.FeedID != nil && *rule.FeedID != feedID {
+		return false
+	}
+	if rule.FolderID != nil && !folders.contains(ns.folderService, rule.UserID, *rule.FolderID, feedID) {
+		return false
+	}
+	return articleMatchesKeywords(article, rule.Keywords)
+}
+
+type ruleTargetKey struct {
+	ruleID   int
+	targetID int
+}
+
+// ruleLimiter enforces the hourly caps of notification rules, separately for every target
+// of a rule. The counts live in memory, so a restart starts every rule with a fresh budget.
+type ruleLimiter struct {
+	mu   sync.Mutex
+	sent map[ruleTargetKey][]time.Time
+}
+
+// take reserves up to n notifications of a rule to a target and returns how many were granted
+func (rl *ruleLimiter) take(ruleID, targetID, maxPerHour, n int) int {
+	if maxPerHour <= 0 {
+		return n
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.sent == nil {
+		rl.sent = make(map[ruleTargetKey][]time.Time)
+	}
+
+	key := ruleTargetKey{ruleID: ruleID, targetID: targetID}
+	now := time.Now()
+	recent := rl.sent[key][:0]
+	for _, at := range rl.sent[key] {
+		if now.Sub(at) < time.Hour {
+			recent = append(recent, at)
+		}
+	}
+
+	granted := maxPerHour - len(recent)
+	if granted > n {
+		granted = n
+	}
+	if granted < 0 {
+		granted = 0
+	}
+	for i := 0; i < granted; i++ {
+		recent = append(recent, now)
+	}
+	rl.sent[key] = recent
+	return granted
+}
+
+func (rl *ruleLimiter) forget(ruleID int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for key := range rl.sent {
+		if key.ruleID == ruleID {
+			delete(rl.sent, key)
+		}
+	}
+}
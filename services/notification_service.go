@@ -0,0 +1,543 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"myfeed/config"
+	"myfeed/database"
+	"myfeed/models"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// notificationBatchLimit is the number of new articles of one refresh that are pushed
+	// individually; above it a single summary is pushed instead
+	notificationBatchLimit = 5
+	notificationTimeout    = 15 * time.Second
+)
+
+// Built-in notification templates, executed with a notificationData. Admins can replace
+// them through the notification_*_template settings.
+const (
+	defaultNotificationTitle   = `{{.Feed}}`
+	defaultNotificationMessage = `{{if eq .Count 1}}{{.Title}}{{else}}{{.Count}} new articles{{end}}`
+)
+
+// notificationData is available to the notification templates. Count is 1 for the push of
+// a single article; summaries have a Count above 1 and no Title or URL.
+type notificationData struct {
+	Feed   string
+	Folder string // empty for feeds that are not in a folder
+	Count  int
+	Title  string
+	URL    string
+}
+
+type notificationPayload struct {
+	TargetID   int    `json:"target_id"`
+	DeliveryID int    `json:"delivery_id,omitempty"`
+	Title      string `json:"title"`
+	Message    string `json:"message"`
+	URL        string `json:"url,omitempty"`
+}
+
+// NotificationService pushes newly ingested articles to the users' notification targets.
+// Every push goes through the job queue, so a push service that is briefly down is
+// retried without holding up the refresh.
+type NotificationService struct {
+	db            *database.DB
+	feedService   *FeedService
+	folderService *FolderService
+	jobService    *JobService
+	templates     *MessageTemplates
+	stream        *NotificationStream
+	client        *http.Client
+	limiter       ruleLimiter
+	// providers are the allowed providers; nil allows all
+	providers  map[string]bool
+	ntfyServer string
+}
+
+func NewNotificationService(cfg config.NotificationConfig, db *database.DB, feedService *FeedService, folderService *FolderService, jobService *JobService, templates *MessageTemplates, stream *NotificationStream) *NotificationService {
+	ns := &NotificationService{
+		db:            db,
+		feedService:   feedService,
+		folderService: folderService,
+		jobService:    jobService,
+		templates:     templates,
+		stream:        stream,
+		client:        &http.Client{Timeout: notificationTimeout},
+		ntfyServer:    cfg.NtfyServer,
+	}
+	if len(cfg.Providers) > 0 {
+		ns.providers = make(map[string]bool, len(cfg.Providers))
+		for _, name := range cfg.Providers {
+			if _, ok := notificationProviders[name]; !ok {
+				notificationLog.Warn("Ignoring unknown notification provider in the configuration", "provider", name)
+			}
+			ns.providers[name] = true
+		}
+	}
+	feedService.SubscribeNewArticles(ns.articlesAdded)
+	return ns
+}
+
+const notificationColumns = `id, user_id, name, provider, config, folder_id, keywords, enabled, created_at`
+
+func scanNotificationTarget(row rowScanner, target *models.NotificationTarget) error {
+	var config, keywords string
+	err := row.Scan(&target.ID, &target.UserID, &target.Name, &target.Provider, &config,
+		&target.FolderID, &keywords, &target.Enabled, &target.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal([]byte(config), &target.Config); err != nil {
+		return fmt.Errorf("invalid config of notification target %d: %v", target.ID, err)
+	}
+	if err := json.Unmarshal([]byte(keywords), &target.Keywords); err != nil {
+		return fmt.Errorf("invalid keywords of notification target %d: %v", target.ID, err)
+	}
+	if target.Config == nil {
+		target.Config = map[string]string{}
+	}
+	if target.Keywords == nil {
+		target.Keywords = []string{}
+	}
+	return nil
+}
+
+func (ns *NotificationService) queryTargets(query string, args ...interface{}) ([]models.NotificationTarget, error) {
+	rows, err := ns.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	targets := []models.NotificationTarget{}
+	for rows.Next() {
+		var target models.NotificationTarget
+		if err := scanNotificationTarget(rows, &target); err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+
+	return targets, rows.Err()
+}
+
+// GetTargets returns the notification targets of a user
+func (ns *NotificationService) GetTargets(userID int) ([]models.NotificationTarget, error) {
+	query := `SELECT ` + notificationColumns + ` FROM notification_targets WHERE user_id = ? ORDER BY id`
+	return ns.queryTargets(query, userID)
+}
+
+// GetTarget returns a notification target of a user, or sql.ErrNoRows
+func (ns *NotificationService) GetTarget(userID, id int) (*models.NotificationTarget, error) {
+	query := `SELECT ` + notificationColumns + ` FROM notification_targets WHERE id = ? AND user_id = ?`
+
+	target := &models.NotificationTarget{}
+	if err := scanNotificationTarget(ns.db.QueryRow(query, id, userID), target); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// SaveTarget validates and stores a notification target. A target without an ID is
+// created; otherwise the user's target with that ID is replaced. Secret settings sent
+// back as RedactedValue keep their stored value.
+func (ns *NotificationService) SaveTarget(target *models.NotificationTarget) (*models.NotificationTarget, error) {
+	if target.Config == nil {
+		target.Config = map[string]string{}
+	}
+
+	if target.ID != 0 {
+		existing, err := ns.GetTarget(target.UserID, target.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range notificationSecrets {
+			if target.Config[key] == RedactedValue {
+				target.Config[key] = existing.Config[key]
+			}
+		}
+	}
+
+	provider, ok := notificationProviders[target.Provider]
+	if !ok {
+		return nil, invalidField("provider", "unknown provider %q", target.Provider)
+	}
+	if !ns.ProviderAllowed(target.Provider) {
+		return nil, invalidField("provider", "provider %q is disabled on this server", target.Provider)
+	}
+	if target.Provider == models.NotifyNtfy && target.Config["server"] == "" {
+		target.Config["server"] = ns.ntfyServer
+	}
+	if err := provider.validate(target.Config); err != nil {
+		return nil, invalidField("config", "invalid %s settings: %v", target.Provider, err)
+	}
+
+	target.Name = strings.TrimSpace(target.Name)
+	if target.Name == "" {
+		target.Name = target.Provider
+	}
+	if target.FolderID != nil {
+		if _, err := ns.folderService.GetFolderByID(target.UserID, *target.FolderID); err != nil {
+			return nil, invalidField("folder_id", "folder not found")
+		}
+	}
+
+	keywords := []string{}
+	for _, keyword := range target.Keywords {
+		if keyword = strings.TrimSpace(keyword); keyword != "" {
+			keywords = append(keywords, keyword)
+		}
+	}
+	target.Keywords = keywords
+
+	config, err := json.Marshal(target.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode settings: %v", err)
+	}
+	keywordData, err := json.Marshal(target.Keywords)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode keywords: %v", err)
+	}
+
+	if target.ID == 0 {
+		query := `
+			INSERT INTO notification_targets (user_id, name, provider, config, folder_id, keywords, enabled)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`
+		id, err := ns.db.Insert(query, target.UserID, target.Name, target.Provider, string(config),
+			target.FolderID, string(keywordData), target.Enabled)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create notification target: %v", err)
+		}
+		target.ID = int(id)
+	} else {
+		query := `
+			UPDATE notification_targets
+			SET name = ?, provider = ?, config = ?, folder_id = ?, keywords = ?, enabled = ?
+			WHERE id = ? AND user_id = ?
+		`
+		_, err := ns.db.Exec(query, target.Name, target.Provider, string(config), target.FolderID,
+			string(keywordData), target.Enabled, target.ID, target.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update notification target: %v", err)
+		}
+	}
+
+	return ns.GetTarget(target.UserID, target.ID)
+}
+
+// DeleteTarget removes a notification target of a user
+func (ns *NotificationService) DeleteTarget(userID, id int) error {
+	result, err := ns.db.Exec(`DELETE FROM notification_targets WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ProviderAllowed reports whether the configuration allows targets of a provider
+func (ns *NotificationService) ProviderAllowed(name string) bool {
+	return ns.providers == nil || ns.providers[name]
+}
+
+// Test pushes a test notification to a target right away
+func (ns *NotificationService) Test(ctx context.Context, target *models.NotificationTarget) error {
+	n := Notification{
+		Title:   "MyFeed",
+		Message: fmt.Sprintf("Test notification for %s", target.Name),
+	}
+	deliveryID, err := ns.recordDelivery(target, n, models.DeliveryPending, nil)
+	if err != nil {
+		return err
+	}
+
+	err = ns.push(ctx, target, n)
+	ns.recordAttempt(deliveryID, nil, err)
+	return err
+}
+
+// RedactTarget replaces the secret settings of a target with RedactedValue
+func RedactTarget(target *models.NotificationTarget) *models.NotificationTarget {
+	redacted := *target
+	redacted.Config = make(map[string]string, len(target.Config))
+	for key, value := range target.Config {
+		redacted.Config[key] = value
+	}
+	for _, key := range notificationSecrets {
+		if redacted.Config[key] != "" {
+			redacted.Config[key] = RedactedValue
+		}
+	}
+	return &redacted
+}
+
+// HandleNotificationJob is the job handler for send_notification jobs
+func (ns *NotificationService) HandleNotificationJob(ctx context.Context, job *models.Job) error {
+	var payload notificationPayload
+	if err := decodePayload(job, &payload); err != nil {
+		return PermanentJobError(err)
+	}
+
+	query := `SELECT ` + notificationColumns + ` FROM notification_targets WHERE id = ?`
+	target := &models.NotificationTarget{}
+	err := scanNotificationTarget(ns.db.QueryRow(query, payload.TargetID), target)
+	if err == sql.ErrNoRows {
+		return nil // the target was deleted after the push was queued
+	}
+	if err != nil {
+		return err
+	}
+	if !target.Enabled {
+		if payload.DeliveryID != 0 {
+			ns.recordAttempt(payload.DeliveryID, job, PermanentJobError(fmt.Errorf("target is disabled")))
+		}
+		return nil
+	}
+
+	err = ns.push(ctx, target, Notification{
+		Title:   payload.Title,
+		Message: payload.Message,
+		URL:     payload.URL,
+	})
+	if payload.DeliveryID != 0 && ctx.Err() == nil {
+		ns.recordAttempt(payload.DeliveryID, job, err)
+	}
+	return err
+}
+
+func (ns *NotificationService) push(ctx context.Context, target *models.NotificationTarget, n Notification) error {
+	if target.Provider == models.NotifyBrowser {
+		if ns.stream.Publish(target.UserID, n) == 0 {
+			return PermanentJobError(fmt.Errorf("no browser or app is connected"))
+		}
+		return nil
+	}
+
+	provider, ok := notificationProviders[target.Provider]
+	if !ok {
+		return PermanentJobError(fmt.Errorf("unknown provider %q", target.Provider))
+	}
+	if !ns.ProviderAllowed(target.Provider) {
+		return PermanentJobError(fmt.Errorf("provider %q is disabled on this server", target.Provider))
+	}
+	return provider.send(ctx, ns.client, target.Config, n)
+}
+
+// articlesAdded queues pushes for the new articles of a feed to the targets of the users
+// subscribed to it. Targets that no rule uses get every article passing their own folder
+// and keyword filters; the others only get the articles one of their rules matches, within
+// the rule's hourly cap. An article is pushed to a target at most once. Users in quiet
+// hours get them held or dropped.
+func (ns *NotificationService) articlesAdded(feed *models.Feed, articles []models.Article) {
+	query := `
+		SELECT ` + notificationColumns + ` FROM notification_targets
+		WHERE enabled = ? AND user_id IN (SELECT user_id FROM subscriptions WHERE feed_id = ?)
+	`
+	targets, err := ns.queryTargets(query, true, feed.ID)
+	if err != nil {
+		notificationLog.Error("Failed to get notification targets", "error", err)
+		return
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	rules, err := ns.queryRules(`SELECT `+notificationRuleColumns+` FROM notification_rules WHERE enabled = ? ORDER BY id`, true)
+	if err != nil {
+		notificationLog.Error("Failed to get notification rules", "error", err)
+		return
+	}
+	rulesByTarget := make(map[int][]*models.NotificationRule)
+	for i := range rules {
+		for _, targetID := range rules[i].TargetIDs {
+			rulesByTarget[targetID] = append(rulesByTarget[targetID], &rules[i])
+		}
+	}
+
+	folders := make(folderTrees)
+	prefs := make(userPreferences)
+	folderNames := make(map[int]string)
+	for i := range targets {
+		target := &targets[i]
+		if target.FolderID != nil && !folders.contains(ns.folderService, target.UserID, *target.FolderID, feed.ID) {
+			continue
+		}
+
+		folder, ok := folderNames[target.UserID]
+		if !ok {
+			folder = ns.folderName(target.UserID, feed.ID)
+			folderNames[target.UserID] = folder
+		}
+
+		var candidates []models.Article
+		for _, article := range articles {
+			if articleMatchesKeywords(&article, target.Keywords) {
+				candidates = append(candidates, article)
+			}
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+
+		targetRules, routed := rulesByTarget[target.ID]
+		if !routed {
+			ns.deliver(prefs, target, ns.buildNotifications(feed, folder, candidates))
+			continue
+		}
+
+		// Each article is assigned to the first rule of the target that matches it
+		matchedByRule := make(map[int][]models.Article)
+		var matchedRules []*models.NotificationRule
+		for _, article := range candidates {
+			for _, rule := range targetRules {
+				if !ns.ruleMatches(folders, rule, feed.ID, &article) {
+					continue
+				}
+				if _, seen := matchedByRule[rule.ID]; !seen {
+					matchedRules = append(matchedRules, rule)
+				}
+				matchedByRule[rule.ID] = append(matchedByRule[rule.ID], article)
+				break
+			}
+		}
+
+		for _, rule := range matchedRules {
+			notifications := ns.buildNotifications(feed, folder, matchedByRule[rule.ID])
+			granted := ns.limiter.take(rule.ID, target.ID, rule.MaxPerHour, len(notifications))
+			if granted < len(notifications) {
+				notificationLog.Info("Notification rule reached its hourly cap", "rule_id", rule.ID,
+					"cap", rule.MaxPerHour, "target_id", target.ID, "dropped", len(notifications)-granted)
+				ns.recordDropped(target, notifications[granted:],
+					fmt.Errorf("rule %q reached its cap of %d per hour", rule.Name, rule.MaxPerHour))
+			}
+			ns.deliver(prefs, target, notifications[:granted])
+		}
+	}
+}
+
+// enqueue queues one send_notification job per notification
+func (ns *NotificationService) enqueue(target *models.NotificationTarget, notifications []Notification) {
+	for _, n := range notifications {
+		if _, err := ns.queue(target, n); err != nil {
+			notificationLog.Error("Failed to queue notification", "target_id", target.ID, "error", err)
+		}
+	}
+}
+
+// queue adds a notification to the delivery log and queues its push
+func (ns *NotificationService) queue(target *models.NotificationTarget, n Notification) (int, error) {
+	deliveryID, err := ns.recordDelivery(target, n, models.DeliveryPending, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	payload := notificationPayload{TargetID: target.ID, DeliveryID: deliveryID, Title: n.Title, Message: n.Message, URL: n.URL}
+	if _, err := ns.jobService.Enqueue(JobSendNotification, fmt.Sprintf("notification:%d", target.ID), payload); err != nil {
+		ns.recordAttempt(deliveryID, nil, err)
+		return 0, err
+	}
+	return deliveryID, nil
+}
+
+// folderTrees caches the feeds of folder trees while one batch of articles is routed
+type folderTrees map[int]map[int]bool
+
+// contains reports whether a feed is in a user's folder or one of its subfolders
+func (folders folderTrees) contains(folderService *FolderService, userID, folderID, feedID int) bool {
+	feeds, cached := folders[folderID]
+	if !cached {
+		feedIDs, err := folderService.GetFeedIDsInTree(userID, folderID, true)
+		if err != nil {
+			notificationLog.Error("Failed to get feeds of folder", "folder_id", folderID, "error", err)
+		}
+		feeds = make(map[int]bool, len(feedIDs))
+		for _, id := range feedIDs {
+			feeds[id] = true
+		}
+		folders[folderID] = feeds
+	}
+	return feeds[feedID]
+}
+
+// articleMatchesKeywords reports whether the title or content of an article contains one
+// of the keywords, ignoring case. An empty keyword list matches every article.
+func articleMatchesKeywords(article *models.Article, keywords []string) bool {
+	if len(keywords) == 0 {
+		return true
+	}
+
+	text := strings.ToLower(article.Title + "\n" + article.Content)
+	for _, keyword := range keywords {
+		if strings.Contains(text, strings.ToLower(keyword)) {
+			return true
+		}
+	}
+	return false
+}
+
+// buildNotifications turns the matched articles of one refresh into pushes: one per
+// article, or a single summary when there are more than notificationBatchLimit
+func (ns *NotificationService) buildNotifications(feed *models.Feed, folder string, articles []models.Article) []Notification {
+	if len(articles) > notificationBatchLimit {
+		return []Notification{ns.renderNotification(&notificationData{
+			Feed:   feed.Title,
+			Folder: folder,
+			Count:  len(articles),
+		}, 0)}
+	}
+
+	notifications := make([]Notification, 0, len(articles))
+	for _, article := range articles {
+		notifications = append(notifications, ns.renderNotification(&notificationData{
+			Feed:   feed.Title,
+			Folder: folder,
+			Count:  1,
+			Title:  article.Title,
+			URL:    article.URL,
+		}, article.ID))
+	}
+	return notifications
+}
+
+// renderNotification applies the notification templates
+func (ns *NotificationService) renderNotification(data *notificationData, articleID int) Notification {
+	n := Notification{URL: data.URL, ArticleID: articleID}
+
+	var err error
+	if n.Title, err = ns.templates.Render(SettingNotificationTitleTemplate, data); err != nil {
+		notificationLog.Error("Failed to render notification title", "error", err)
+		n.Title = data.Feed
+	}
+	if n.Message, err = ns.templates.Render(SettingNotificationMessageTemplate, data); err != nil {
+		notificationLog.Error("Failed to render notification message", "error", err)
+		n.Message = data.Title
+	}
+	n.Title = strings.TrimSpace(n.Title)
+	n.Message = strings.TrimSpace(n.Message)
+	return n
+}
+
+// folderName returns the name of the folder a user keeps a feed in, or "" for unfiled feeds
+func (ns *NotificationService) folderName(userID, feedID int) string {
+	feed, err := ns.feedService.GetSubscribedFeed(userID, feedID)
+	if err != nil || feed.FolderID == nil {
+		return ""
+	}
+	folder, err := ns.folderService.GetFolderByID(userID, *feed.FolderID)
+	if err != nil {
+		return ""
+	}
+	return folder.Name
+}
@@ -0,0 +1,81 @@
+package services
+
+import (
+	"sync"
+)
+
+// streamBuffer is the number of notifications queued for a slow subscriber before new
+// ones are dropped
+const streamBuffer = 16
+
+// NotificationStream fans out the notifications of browser targets to the connected
+// clients of each user, e.g. open browser tabs or a tray app listening on the SSE endpoint
+type NotificationStream struct {
+	mu          sync.Mutex
+	subscribers map[int]map[chan Notification]bool
+	closed      bool
+}
+
+func NewNotificationStream() *NotificationStream {
+	return &NotificationStream{subscribers: make(map[int]map[chan Notification]bool)}
+}
+
+// Subscribe registers a client of a user. The channel is closed when the returned cancel
+// function is called or the stream is closed.
+func (s *NotificationStream) Subscribe(userID int) (<-chan Notification, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch := make(chan Notification, streamBuffer)
+	if s.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if s.subscribers[userID] == nil {
+		s.subscribers[userID] = make(map[chan Notification]bool)
+	}
+	s.subscribers[userID][ch] = true
+
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.subscribers[userID][ch] {
+			delete(s.subscribers[userID], ch)
+			if len(s.subscribers[userID]) == 0 {
+				delete(s.subscribers, userID)
+			}
+			close(ch)
+		}
+	}
+}
+
+// Publish sends a notification to every connected client of a user and returns the
+// number of clients that received it
+func (s *NotificationStream) Publish(userID int, n Notification) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delivered := 0
+	for ch := range s.subscribers[userID] {
+		select {
+		case ch <- n:
+			delivered++
+		default:
+		}
+	}
+	return delivered
+}
+
+// Close disconnects every client, so open streams do not hold up a server shutdown
+func (s *NotificationStream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for userID, channels := range s.subscribers {
+		for ch := range channels {
+			close(ch)
+		}
+		delete(s.subscribers, userID)
+	}
+}
@@ -1,9 +1,12 @@
 package services
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
-	"log"
+	"io"
 	"myfeed/database"
 	"myfeed/models"
 	"time"
@@ -12,61 +15,177 @@ import (
 )
 
 type OPMLService struct {
-	db            *database.DB
-	feedService   *FeedService
-	folderService *FolderService
+	db              *database.DB
+	feedService     *FeedService
+	folderService   *FolderService
+	settingsService *SettingsService
+	jobService      *JobService
 }
 
-func NewOPMLService(db *database.DB, feedService *FeedService, folderService *FolderService) *OPMLService {
+func NewOPMLService(db *database.DB, feedService *FeedService, folderService *FolderService, settingsService *SettingsService, jobService *JobService) *OPMLService {
 	return &OPMLService{
-		db:            db,
-		feedService:   feedService,
-		folderService: folderService,
+		db:              db,
+		feedService:     feedService,
+		folderService:   folderService,
+		settingsService: settingsService,
+		jobService:      jobService,
 	}
 }
 
-// ImportResult holds the results of an OPML import operation
+// ImportResult holds the results of an OPML import operation. While the import is
+// running ProcessedFeeds counts up to TotalFeeds. MergedFolders counts the folders of the
+// file that already existed and were reused.
 type ImportResult struct {
-	TotalFeeds    int      `json:"total_feeds"`
-	ImportedFeeds int      `json:"imported_feeds"`
-	SkippedFeeds  int      `json:"skipped_feeds"`
-	Errors        []string `json:"errors,omitempty"`
+	TotalFeeds     int      `json:"total_feeds"`
+	ProcessedFeeds int      `json:"processed_feeds"`
+	ImportedFeeds  int      `json:"imported_feeds"`
+	SkippedFeeds   int      `json:"skipped_feeds"`
+	CreatedFolders int      `json:"created_folders"`
+	MergedFolders  int      `json:"merged_folders"`
+	Errors         []string `json:"errors,omitempty"`
 }
 
-// ImportOPML imports feeds from OPML data
-func (os *OPMLService) ImportOPML(opmlData []byte) (*ImportResult, error) {
-	var doc opml.OPML
-	if err := xml.Unmarshal(opmlData, &doc); err != nil {
-		return nil, fmt.Errorf("failed to parse OPML: %v", err)
+// importPayload is the payload of an import_opml job
+type importPayload struct {
+	UserID int    `json:"user_id"`
+	OPML   string `json:"opml"`
+}
+
+// StartImport validates the OPML data and queues it for import into a user's feeds in the
+// background. Adding a feed fetches it, so large files would not finish within a single
+// request.
+func (os *OPMLService) StartImport(userID int, opmlData []byte) (*models.Job, error) {
+	doc, err := parseOPML(opmlData)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := os.jobService.Enqueue(JobImportOPML, "", importPayload{UserID: userID, OPML: string(opmlData)})
+	if err != nil {
+		return nil, err
+	}
+
+	// Report the total right away so progress is known before a worker picks the job up
+	result := &ImportResult{TotalFeeds: countFeeds(doc.Body.Outlines), Errors: make([]string, 0)}
+	if err := os.jobService.SetResult(job.ID, result); err != nil {
+		opmlLog.Error("Failed to save import progress", "job_id", job.ID, "error", err)
+	}
+
+	return job, nil
+}
+
+// HandleImportJob is the job handler for import_opml jobs. Progress is saved as the job
+// result after every feed. An import stopped by shutdown is queued again; importing the
+// feeds that were done already once more only skips them.
+func (os *OPMLService) HandleImportJob(ctx context.Context, job *models.Job) error {
+	var payload importPayload
+	if err := decodePayload(job, &payload); err != nil {
+		return PermanentJobError(err)
+	}
+
+	_, err := os.ImportOPML(ctx, payload.UserID, []byte(payload.OPML), func(result *ImportResult) {
+		if err := os.jobService.SetResult(job.ID, result); err != nil {
+			opmlLog.Error("Failed to save import progress", "job_id", job.ID, "error", err)
+		}
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return PermanentJobError(err)
+}
+
+// GetImport returns an import job of a user and its current result. sql.ErrNoRows is
+// returned if the job does not exist or is not an import of the user.
+func (os *OPMLService) GetImport(userID, jobID int) (*models.Job, *ImportResult, error) {
+	job, err := os.jobService.GetJob(jobID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if job.Type != JobImportOPML {
+		return nil, nil, sql.ErrNoRows
+	}
+	var payload importPayload
+	if err := decodePayload(job, &payload); err != nil || payload.UserID != userID {
+		return nil, nil, sql.ErrNoRows
+	}
+
+	result := &ImportResult{Errors: make([]string, 0)}
+	if job.Result != nil {
+		if err := json.Unmarshal([]byte(*job.Result), result); err != nil {
+			return nil, nil, fmt.Errorf("invalid result for job %d: %v", job.ID, err)
+		}
+	}
+
+	return job, result, nil
+}
+
+// ImportOPML subscribes a user to the feeds of OPML data. Folders are merged into the
+// user's folders with the same name at the same place in the tree, so importing a file
+// again only adds what is new. progress, if not nil, is called after every feed with the
+// result so far. Cancelling ctx stops the import between feeds and returns ctx.Err().
+func (os *OPMLService) ImportOPML(ctx context.Context, userID int, opmlData []byte, progress func(*ImportResult)) (*ImportResult, error) {
+	doc, err := parseOPML(opmlData)
+	if err != nil {
+		return nil, err
 	}
 
 	result := &ImportResult{
-		Errors: make([]string, 0),
+		TotalFeeds: countFeeds(doc.Body.Outlines),
+		Errors:     make([]string, 0),
 	}
 
 	// Process the outline structure
 	for _, outline := range doc.Body.Outlines {
-		os.processOutline(&outline, 0, result)
+		os.processOutline(ctx, userID, &outline, 0, result, progress)
+	}
+	if ctx.Err() != nil {
+		opmlLog.Info("OPML import stopped", "processed", result.ProcessedFeeds, "total", result.TotalFeeds)
+		return result, ctx.Err()
 	}
 
-	log.Printf("OPML import completed: %d total, %d imported, %d skipped", 
-		result.TotalFeeds, result.ImportedFeeds, result.SkippedFeeds)
+	opmlLog.Info("OPML import completed", "total", result.TotalFeeds,
+		"imported", result.ImportedFeeds, "skipped", result.SkippedFeeds)
+
+	if progress != nil {
+		progress(result)
+	}
 
 	return result, nil
 }
 
-// processOutline recursively processes OPML outline elements
-func (os *OPMLService) processOutline(outline *opml.Outline, parentFolderID int, result *ImportResult) {
+func parseOPML(opmlData []byte) (*opml.OPML, error) {
+	var doc opml.OPML
+	if err := xml.Unmarshal(opmlData, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse OPML: %v", err)
+	}
+	return &doc, nil
+}
+
+// countFeeds returns the number of feed outlines processOutline will visit
+func countFeeds(outlines []opml.Outline) int {
+	count := 0
+	for _, outline := range outlines {
+		if outline.XMLURL != "" {
+			count++
+		} else if outline.Text != "" || outline.Title != "" {
+			count += countFeeds(outline.Outlines)
+		}
+	}
+	return count
+}
+
+// processOutline recursively processes OPML outline elements, or does nothing once ctx
+// is done
+func (os *OPMLService) processOutline(ctx context.Context, userID int, outline *opml.Outline, parentFolderID int, result *ImportResult, progress func(*ImportResult)) {
+	if ctx.Err() != nil {
+		return
+	}
+
 	// If this outline has an XML URL, it's a feed
 	if outline.XMLURL != "" {
-		result.TotalFeeds++
-		
-		// Check if feed already exists
-		existingFeed, err := os.feedService.GetFeedByURL(outline.XMLURL)
-		if err == nil && existingFeed != nil {
-			result.SkippedFeeds++
-			log.Printf("Skipping existing feed: %s", outline.XMLURL)
-			return
+		result.ProcessedFeeds++
+		if progress != nil {
+			defer progress(result)
 		}
 
 		// Add the feed using the feed service
@@ -75,13 +194,21 @@ func (os *OPMLService) processOutline(outline *opml.Outline, parentFolderID int,
 			folderID = &parentFolderID
 		}
 
-		_, err = os.feedService.AddFeed(outline.XMLURL, folderID)
-		if err != nil {
+		_, err := os.feedService.AddFeed(ctx, userID, outline.XMLURL, folderID)
+		if ctx.Err() != nil {
+			// Stopped while adding it; the feed is done when the import runs again
+			result.ProcessedFeeds--
+			return
+		}
+		if err == ErrFeedExists {
+			result.SkippedFeeds++
+			opmlLog.Debug("Skipping existing feed", "url", outline.XMLURL)
+		} else if err != nil {
 			result.Errors = append(result.Errors, fmt.Sprintf("Failed to add feed %s: %v", outline.XMLURL, err))
-			log.Printf("Failed to add feed %s: %v", outline.XMLURL, err)
+			opmlLog.Warn("Failed to add feed", "url", outline.XMLURL, "error", err)
 		} else {
 			result.ImportedFeeds++
-			log.Printf("Imported feed: %s", outline.XMLURL)
+			opmlLog.Debug("Imported feed", "url", outline.XMLURL)
 		}
 	} else if outline.Text != "" || outline.Title != "" {
 		// This is a folder/category
@@ -90,145 +217,235 @@ func (os *OPMLService) processOutline(outline *opml.Outline, parentFolderID int,
 			folderName = outline.Text
 		}
 
-		// Create the folder
 		var parentID *int
 		if parentFolderID > 0 {
 			parentID = &parentFolderID
 		}
 
-		folder, err := os.folderService.CreateFolder(folderName, parentID)
+		// Reuse a folder of the same name at the same level, or else create it
+		folder, err := os.folderService.FindFolder(userID, folderName, parentID)
+		if err == nil {
+			result.MergedFolders++
+			opmlLog.Debug("Merging into existing folder", "folder", folderName)
+		} else if err == sql.ErrNoRows {
+			folder, err = os.folderService.CreateFolder(userID, folderName, parentID)
+			if err == nil {
+				result.CreatedFolders++
+				opmlLog.Debug("Created folder", "folder", folderName)
+				if err := os.folderService.MarkImported(folder.ID); err != nil {
+					opmlLog.Error("Failed to mark folder as imported", "folder", folderName, "error", err)
+				}
+			}
+		}
 		if err != nil {
 			result.Errors = append(result.Errors, fmt.Sprintf("Failed to create folder %s: %v", folderName, err))
-			log.Printf("Failed to create folder %s: %v", folderName, err)
+			opmlLog.Warn("Failed to create folder", "folder", folderName, "error", err)
 			// Continue with parent folder ID for child outlines
-			folderID := parentFolderID
-			// Process child outlines with parent folder ID
-			for _, childOutline := range outline.Outlines {
-				os.processOutline(&childOutline, folderID, result)
-			}
-		} else {
-			log.Printf("Created folder: %s", folderName)
-			// Process child outlines with new folder ID
 			for _, childOutline := range outline.Outlines {
-				os.processOutline(&childOutline, folder.ID, result)
+				os.processOutline(ctx, userID, &childOutline, parentFolderID, result, progress)
 			}
+			return
+		}
+
+		for _, childOutline := range outline.Outlines {
+			os.processOutline(ctx, userID, &childOutline, folder.ID, result, progress)
 		}
 	}
 }
 
-// ExportOPML exports all feeds to OPML format
-func (os *OPMLService) ExportOPML() ([]byte, error) {
-	// Get all folders and feeds
-	folders, err := os.folderService.GetAllFolders()
+// OPMLExport holds the folders and feeds of an export, loaded from the database and ready
+// to be written by WriteTo
+type OPMLExport struct {
+	title         string
+	createdAt     time.Time
+	rootID        int // the exported folder, or 0 for everything
+	folders       []models.Folder
+	feedsByFolder map[int][]*models.Feed
+	unfiled       []*models.Feed
+}
+
+// ExportOPML loads every folder and feed of a user to export, or with a folderID only that
+// folder with its feeds and subfolders. Nothing is encoded yet, so a failure can still be
+// reported before the first byte of the document is written. sql.ErrNoRows is returned if
+// the folder is not one of the user's.
+func (os *OPMLService) ExportOPML(userID int, folderID *int) (*OPMLExport, error) {
+	if folderID != nil {
+		if _, err := os.folderService.GetFolderByID(userID, *folderID); err != nil {
+			return nil, err
+		}
+	}
+
+	folders, err := os.folderService.GetAllFolders(userID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get folders: %v", err)
 	}
 
-	feeds, err := os.feedService.GetAllFeeds()
+	feeds, err := os.feedService.GetAllFeeds(userID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get feeds: %v", err)
 	}
 
-	// Create OPML document
-	doc := opml.OPML{
-		Version: "2.0",
-		Head: opml.Head{
-			Title:        "MyFeed Export",
-			DateCreated:  time.Now().Format(time.RFC1123Z),
-			DateModified: time.Now().Format(time.RFC1123Z),
-			OwnerName:    "MyFeed",
-		},
-		Body: opml.Body{
-			Outlines: make([]opml.Outline, 0),
-		},
+	export := &OPMLExport{
+		title:         os.settingsService.GetString(SettingAppTitle, "MyFeed"),
+		createdAt:     time.Now(),
+		folders:       folders,
+		feedsByFolder: make(map[int][]*models.Feed),
 	}
-
-	// Create a map for quick folder lookup
-	folderMap := make(map[int]*models.Folder)
-	for i := range folders {
-		folderMap[folders[i].ID] = &folders[i]
+	if folderID != nil {
+		export.rootID = *folderID
+		export.folders = folderSubtree(folders, *folderID)
 	}
 
-	// Group feeds by folder
-	feedsByFolder := make(map[int][]*models.Feed)
-	feedsWithoutFolder := make([]*models.Feed, 0)
-
+	inExport := make(map[int]bool, len(export.folders))
+	for _, folder := range export.folders {
+		inExport[folder.ID] = true
+	}
 	for i := range feeds {
 		feed := &feeds[i]
 		if feed.FolderID != nil && *feed.FolderID > 0 {
-			feedsByFolder[*feed.FolderID] = append(feedsByFolder[*feed.FolderID], feed)
-		} else {
-			feedsWithoutFolder = append(feedsWithoutFolder, feed)
+			if inExport[*feed.FolderID] {
+				export.feedsByFolder[*feed.FolderID] = append(export.feedsByFolder[*feed.FolderID], feed)
+			}
+		} else if folderID == nil {
+			export.unfiled = append(export.unfiled, feed)
 		}
 	}
+	return export, nil
+}
 
-	// Add root-level folders and their feeds
-	rootFolders := make([]*models.Folder, 0)
-	for i := range folders {
-		folder := &folders[i]
-		if folder.ParentID == nil || *folder.ParentID == 0 {
-			rootFolders = append(rootFolders, folder)
+// folderSubtree returns the folder rootID and all folders below it
+func folderSubtree(folders []models.Folder, rootID int) []models.Folder {
+	included := map[int]bool{rootID: true}
+	for added := true; added; {
+		added = false
+		for _, folder := range folders {
+			if !included[folder.ID] && folder.ParentID != nil && included[*folder.ParentID] {
+				included[folder.ID] = true
+				added = true
+			}
 		}
 	}
 
-	// Process root folders
-	for _, folder := range rootFolders {
-		outline := os.createFolderOutline(folder, folderMap, feedsByFolder)
-		doc.Body.Outlines = append(doc.Body.Outlines, outline)
+	var subtree []models.Folder
+	for _, folder := range folders {
+		if included[folder.ID] {
+			subtree = append(subtree, folder)
+		}
 	}
+	return subtree
+}
 
-	// Add feeds without folders
-	for _, feed := range feedsWithoutFolder {
-		outline := opml.Outline{
-			Type:        "rss",
-			Title:       feed.Title,
-			Text:        feed.Title,
-			XMLURL:      feed.URL,
-			Description: feed.Description,
-		}
-		doc.Body.Outlines = append(doc.Body.Outlines, outline)
+// isRoot reports whether a folder is written at the top of the document
+func (e *OPMLExport) isRoot(folder *models.Folder) bool {
+	if e.rootID != 0 {
+		return folder.ID == e.rootID
 	}
+	return folder.ParentID == nil || *folder.ParentID == 0
+}
 
-	// Marshal to XML
-	xmlData, err := xml.MarshalIndent(doc, "", "  ")
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal OPML: %v", err)
+// WriteTo encodes the export as an OPML 2.0 document outline by outline, so the document
+// is never held in memory as a whole. Folders become outlines containing their feeds and
+// subfolders; feeds without a folder follow the root folders.
+func (e *OPMLExport) WriteTo(w io.Writer) (int64, error) {
+	counter := &countingWriter{w: w}
+	if _, err := io.WriteString(counter, xml.Header); err != nil {
+		return counter.n, err
 	}
 
-	// Add XML header
-	result := []byte(xml.Header + string(xmlData))
-	return result, nil
-}
+	enc := xml.NewEncoder(counter)
+	enc.Indent("", "  ")
 
-// createFolderOutline recursively creates OPML outline for a folder and its contents
-func (os *OPMLService) createFolderOutline(folder *models.Folder, folderMap map[int]*models.Folder, feedsByFolder map[int][]*models.Feed) opml.Outline {
-	outline := opml.Outline{
-		Title:    folder.Name,
-		Text:     folder.Name,
-		Outlines: make([]opml.Outline, 0),
-	}
-
-	// Add feeds in this folder
-	if feeds, exists := feedsByFolder[folder.ID]; exists {
-		for _, feed := range feeds {
-			feedOutline := opml.Outline{
-				Type:        "rss",
-				Title:       feed.Title,
-				Text:        feed.Title,
-				XMLURL:      feed.URL,
-				Description: feed.Description,
+	root := xml.StartElement{
+		Name: xml.Name{Local: "opml"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "version"}, Value: "2.0"}},
+	}
+	head := opml.Head{
+		Title:        e.title + " Export",
+		DateCreated:  e.createdAt.Format(time.RFC1123Z),
+		DateModified: e.createdAt.Format(time.RFC1123Z),
+		OwnerName:    e.title,
+	}
+	body := xml.StartElement{Name: xml.Name{Local: "body"}}
+
+	if err := enc.EncodeToken(root); err != nil {
+		return counter.n, err
+	}
+	if err := enc.EncodeElement(head, xml.StartElement{Name: xml.Name{Local: "head"}}); err != nil {
+		return counter.n, err
+	}
+	if err := enc.EncodeToken(body); err != nil {
+		return counter.n, err
+	}
+	for i := range e.folders {
+		folder := &e.folders[i]
+		if e.isRoot(folder) {
+			if err := e.writeFolder(enc, folder); err != nil {
+				return counter.n, err
 			}
-			outline.Outlines = append(outline.Outlines, feedOutline)
 		}
 	}
+	for _, feed := range e.unfiled {
+		if err := writeFeedOutline(enc, feed); err != nil {
+			return counter.n, err
+		}
+	}
+	if err := enc.EncodeToken(body.End()); err != nil {
+		return counter.n, err
+	}
+	if err := enc.EncodeToken(root.End()); err != nil {
+		return counter.n, err
+	}
+	err := enc.Flush()
+	return counter.n, err
+}
 
-	// Add child folders
-	for _, childFolder := range folderMap {
-		if childFolder.ParentID != nil && *childFolder.ParentID == folder.ID {
-			childOutline := os.createFolderOutline(childFolder, folderMap, feedsByFolder)
-			outline.Outlines = append(outline.Outlines, childOutline)
+// writeFolder writes the outline of a folder with its feeds and, recursively, its subfolders
+func (e *OPMLExport) writeFolder(enc *xml.Encoder, folder *models.Folder) error {
+	outline := xml.StartElement{
+		Name: xml.Name{Local: "outline"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "text"}, Value: folder.Name},
+			{Name: xml.Name{Local: "title"}, Value: folder.Name},
+		},
+	}
+	if err := enc.EncodeToken(outline); err != nil {
+		return err
+	}
+	for _, feed := range e.feedsByFolder[folder.ID] {
+		if err := writeFeedOutline(enc, feed); err != nil {
+			return err
 		}
 	}
+	for i := range e.folders {
+		child := &e.folders[i]
+		if child.ParentID != nil && *child.ParentID == folder.ID {
+			if err := e.writeFolder(enc, child); err != nil {
+				return err
+			}
+		}
+	}
+	return enc.EncodeToken(outline.End())
+}
 
-	return outline
-}
\ No newline at end of file
+func writeFeedOutline(enc *xml.Encoder, feed *models.Feed) error {
+	outline := opml.Outline{
+		Type:        "rss",
+		Title:       feed.Title,
+		Text:        feed.Title,
+		XMLURL:      feed.URL,
+		Description: feed.Description,
+	}
+	return enc.EncodeElement(outline, xml.StartElement{Name: xml.Name{Local: "outline"}})
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,328 @@
+package services
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// A4 in points, with the margin around the text
+const (
+	pdfPageWidth  = 595.28
+	pdfPageHeight = 841.89
+	pdfMargin     = 56.0
+)
+
+// pdfFont is one of the standard fonts every PDF reader ships, so nothing is embedded.
+// Text is encoded in WinAnsiEncoding (Windows-1252); other characters print as "?".
+type pdfFont struct {
+	name     string
+	resource string
+	// widths of the ASCII characters from space to tilde, in thousandths of the font size
+	widths [95]int
+	// other is the width assumed for characters beyond ASCII
+	other int
+}
+
+var pdfHelvetica = &pdfFont{
+	name:     "Helvetica",
+	resource: "F1",
+	widths: [95]int{
+		278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+		556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+		1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+		667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+		333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+		556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+	},
+	other: 556,
+}
+
+var pdfHelveticaBold = &pdfFont{
+	name:     "Helvetica-Bold",
+	resource: "F2",
+	widths: [95]int{
+		278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+		556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+		975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+		667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+		333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+		611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+	},
+	other: 611,
+}
+
+// pdfWideCharacters are the Windows-1252 characters far from the average width
+var pdfWideCharacters = map[byte]int{
+	0x85: 1000,           // ellipsis
+	0x89: 1000,           // per mille
+	0x97: 1000,           // em dash
+	0x99: 1000,           // trade mark
+	0x91: 222, 0x92: 222, // single quotes
+	0x93: 333, 0x94: 333, // double quotes
+	0x95: 350, // bullet
+	0xA0: 278, // no-break space
+}
+
+// encode converts text to the bytes of the font encoding
+func (f *pdfFont) encode(text string) []byte {
+	encoded := make([]byte, 0, len(text))
+	for _, r := range text {
+		b, ok := charmap.Windows1252.EncodeRune(r)
+		if !ok || b < 0x20 {
+			b = '?'
+		}
+		encoded = append(encoded, b)
+	}
+	return encoded
+}
+
+// width returns the width of text in points at the given font size
+func (f *pdfFont) width(text string, size float64) float64 {
+	var units int
+	for _, b := range f.encode(text) {
+		switch {
+		case b >= 0x20 && b <= 0x7E:
+			units += f.widths[b-0x20]
+		case pdfWideCharacters[b] != 0:
+			units += pdfWideCharacters[b]
+		default:
+			units += f.other
+		}
+	}
+	return float64(units) * size / 1000
+}
+
+// pdfStyle is how a run of text is set
+type pdfStyle struct {
+	font    *pdfFont
+	size    float64
+	leading float64 // distance between the baselines of wrapped lines
+	gray    float64 // 0 is black
+}
+
+// pdfPage collects the drawing operators and link annotations of one page
+type pdfPage struct {
+	content bytes.Buffer
+	links   []string
+}
+
+// pdfDocument lays out text from the top of A4 pages down, starting a new page when the
+// current one is full
+type pdfDocument struct {
+	title string
+	pages []*pdfPage
+	y     float64 // baseline of the next line on the last page
+}
+
+func newPDFDocument(title string) *pdfDocument {
+	d := &pdfDocument{title: title}
+	d.newPage()
+	return d
+}
+
+func (d *pdfDocument) newPage() {
+	d.pages = append(d.pages, &pdfPage{})
+	d.y = pdfPageHeight - pdfMargin
+}
+
+func (d *pdfDocument) page() *pdfPage {
+	return d.pages[len(d.pages)-1]
+}
+
+// textWidth is the width available to text between the margins
+func (d *pdfDocument) textWidth() float64 {
+	return pdfPageWidth - 2*pdfMargin
+}
+
+// space moves the next line down, or to the next page. It is dropped at the top of a page.
+func (d *pdfDocument) space(points float64) {
+	if d.y == pdfPageHeight-pdfMargin {
+		return
+	}
+	d.y -= points
+	if d.y < pdfMargin {
+		d.newPage()
+	}
+}
+
+// paragraph sets text wrapped at word boundaries. Words too long for a line are split.
+func (d *pdfDocument) paragraph(text string, style pdfStyle) {
+	for _, line := range wrapPDFText(text, style.font, style.size, d.textWidth()) {
+		d.line(line, style, "")
+	}
+}
+
+// link sets a single line of text that opens url when clicked
+func (d *pdfDocument) link(text, url string, style pdfStyle) {
+	d.line(fitPDFText(text, style.font, style.size, d.textWidth()), style, url)
+}
+
+// line sets one line at the left margin, making it a link when url is set
+func (d *pdfDocument) line(text string, style pdfStyle, url string) {
+	if d.y-style.size < pdfMargin {
+		d.newPage()
+	}
+	d.y -= style.size
+	page := d.page()
+	page.text(pdfMargin, d.y, text, style)
+	if url != "" {
+		width := style.font.width(text, style.size)
+		page.links = append(page.links, fmt.Sprintf("<< /Type /Annot /Subtype /Link /Border [0 0 0] /Rect [%.2f %.2f %.2f %.2f] /A << /S /URI /URI %s >> >>",
+			pdfMargin, d.y-2, pdfMargin+width, d.y+style.size, pdfString([]byte(url))))
+	}
+	d.y -= style.leading - style.size
+}
+
+// rule draws a thin horizontal line across the text width
+func (d *pdfDocument) rule() {
+	d.space(6)
+	fmt.Fprintf(&d.page().content, "0.75 G 0.5 w %.2f %.2f m %.2f %.2f l S\n", pdfMargin, d.y, pdfPageWidth-pdfMargin, d.y)
+	d.space(12)
+}
+
+// footer sets a line below the text of every page, left aligned and right aligned parts
+// given by the page number and the page count
+func (d *pdfDocument) footer(style pdfStyle, text func(page, pages int) (left, right string)) {
+	y := pdfMargin / 2
+	for i, page := range d.pages {
+		left, right := text(i+1, len(d.pages))
+		rightWidth := style.font.width(right, style.size)
+		left = fitPDFText(left, style.font, style.size, d.textWidth()-rightWidth-12)
+		page.text(pdfMargin, y, left, style)
+		page.text(pdfPageWidth-pdfMargin-rightWidth, y, right, style)
+	}
+}
+
+func (p *pdfPage) text(x, y float64, text string, style pdfStyle) {
+	fmt.Fprintf(&p.content, "BT /%s %.1f Tf %.2f g %.2f %.2f Td %s Tj ET\n",
+		style.font.resource, style.size, style.gray, x, y, pdfString(style.font.encode(text)))
+}
+
+// wrapPDFText breaks text into lines no wider than width
+func wrapPDFText(text string, font *pdfFont, size, width float64) []string {
+	var lines []string
+	var line string
+	for _, word := range strings.Fields(text) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if font.width(candidate, size) <= width {
+			line = candidate
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+		// A word wider than the line, like a long URL, is split wherever it has to be
+		line = ""
+		for _, r := range word {
+			if line != "" && font.width(line+string(r), size) > width {
+				lines = append(lines, line)
+				line = ""
+			}
+			line += string(r)
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// fitPDFText shortens text with an ellipsis until it is no wider than width
+func fitPDFText(text string, font *pdfFont, size, width float64) string {
+	if font.width(text, size) <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 && font.width(string(runes)+"…", size) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "…"
+}
+
+// pdfString writes bytes as a PDF literal string
+func pdfString(b []byte) string {
+	var s strings.Builder
+	s.WriteByte('(')
+	for _, c := range b {
+		if c == '(' || c == ')' || c == '\\' {
+			s.WriteByte('\\')
+		}
+		s.WriteByte(c)
+	}
+	s.WriteByte(')')
+	return s.String()
+}
+
+// pdfTextString writes text for the document information as UTF-16, which readers show
+// whatever the characters are
+func pdfTextString(text string) string {
+	var s strings.Builder
+	s.WriteString("<FEFF")
+	for _, unit := range utf16.Encode([]rune(text)) {
+		fmt.Fprintf(&s, "%04X", unit)
+	}
+	s.WriteString(">")
+	return s.String()
+}
+
+// Bytes writes the document as PDF 1.4 with compressed page contents
+func (d *pdfDocument) Bytes() ([]byte, error) {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xE2\xE3\xCF\xD3\n")
+
+	// Objects 1 to 5 are fixed; each page then takes two, its dictionary and its content
+	const firstPage = 6
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	for _, font := range []*pdfFont{pdfHelvetica, pdfHelveticaBold} {
+		object(fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", font.name))
+	}
+	object(fmt.Sprintf("<< /Title %s /Producer (MyFeed) /CreationDate (D:%s) >>",
+		pdfTextString(d.title), time.Now().UTC().Format("20060102150405Z")))
+
+	for i, page := range d.pages {
+		annotations := ""
+		if len(page.links) > 0 {
+			annotations = " /Annots [" + strings.Join(page.links, " ") + "]"
+		}
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R%s >>",
+			pdfPageWidth, pdfPageHeight, firstPage+2*i+1, annotations))
+
+		var content bytes.Buffer
+		zw := zlib.NewWriter(&content)
+		if _, err := zw.Write(page.content.Bytes()); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		object(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", content.Len(), content.Bytes()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes(), nil
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+const (
+	// minParagraphLength is the length below which text blocks are ignored when looking
+	// for the body of a page, like captions and bylines
+	minParagraphLength = 25
+	// minReadableLength is the least text an extracted body must have; less means the
+	// page is not an article or is rendered by scripts
+	minReadableLength = 250
+)
+
+var (
+	// unlikelyCandidates and maybeCandidates match the class and id of page furniture
+	// and of the containers that usually hold the body, as in Mozilla's Readability
+	unlikelyCandidates = regexp.MustCompile(`(?i)-ad-|ai2html|banner|breadcrumbs|combx|comment|community|cover-wrap|disqus|extra|footer|gdpr|header|legends|menu|related|remark|replies|rss|shoutbox|sidebar|skyscraper|social|sponsor|supplemental|ad-break|agegate|pagination|pager|popup|yom-remote|cookie|newsletter|share`)
+	maybeCandidates    = regexp.MustCompile(`(?i)and|article|body|column|content|main|shadow`)
+	positiveClass      = regexp.MustCompile(`(?i)article|body|content|entry|hentry|h-entry|main|page|pagination|post|text|blog|story`)
+	negativeClass      = regexp.MustCompile(`(?i)-ad-|hidden|^hid$| hid$| hid |^hid |banner|combx|comment|com-|contact|foot|footer|footnote|gdpr|masthead|media|meta|outbrain|promo|related|scroll|share|shoutbox|sidebar|skyscraper|sponsor|shopping|tags|tool|widget`)
+)
+
+// strippedElements never belong to the readable body of a page
+const strippedElements = "script, style, noscript, template, iframe, object, embed, form, input, button, select, textarea, nav, aside, svg, canvas, link, meta"
+
+// keptAttributes are the attributes left on the extracted body; the rest, including
+// styles and event handlers, are dropped
+var keptAttributes = map[string]bool{
+	"href": true, "src": true, "alt": true, "title": true, "colspan": true, "rowspan": true,
+}
+
+// errNotReadable is returned for pages without a recognizable article body
+var errNotReadable = errors.New("no readable content found")
+
+// extractReadable returns the HTML of the main text of a page, without navigation, ads and
+// comments, in the manner of Mozilla's Readability: blocks of text score their parent
+// and grandparent by their length and commas, weighed by class names and link density,
+// and the best container is kept with the siblings that score close to it. Relative links
+// and images are resolved against pageURL.
+func extractReadable(r io.Reader, pageURL *url.URL) (string, error) {
+	doc, err := goquery.NewDocumentFromReader(r)
+	if err != nil {
+		return "", err
+	}
+
+	doc.Find(strippedElements).Remove()
+	doc.Find("*").Each(func(_ int, s *goquery.Selection) {
+		if s.Is("html, body, article, main") {
+			return
+		}
+		match := s.AttrOr("class", "") + " " + s.AttrOr("id", "")
+		if unlikelyCandidates.MatchString(match) && !maybeCandidates.MatchString(match) {
+			s.Remove()
+		}
+	})
+
+	scores := make(map[*html.Node]float64)
+	var candidates []*goquery.Selection
+	score := func(s *goquery.Selection, points float64) {
+		node := s.Get(0)
+		if _, ok := scores[node]; !ok {
+			scores[node] = classWeight(s)
+			if s.Is("div, article, main, section") {
+				scores[node] += 5
+			}
+			candidates = append(candidates, s)
+		}
+		scores[node] += points
+	}
+
+	doc.Find("p, pre, td, blockquote, li").Each(func(_ int, s *goquery.Selection) {
+		text := strings.TrimSpace(s.Text())
+		if len(text) < minParagraphLength {
+			return
+		}
+		points := 1 + float64(strings.Count(text, ",")) + math.Min(float64(len(text)/100), 3)
+		if parent := s.Parent(); parent.Length() > 0 && !parent.Is("html") {
+			score(parent, points)
+			if grandparent := parent.Parent(); grandparent.Length() > 0 && !grandparent.Is("html") {
+				score(grandparent, points/2)
+			}
+		}
+	})
+
+	var top *goquery.Selection
+	var topScore float64
+	for _, candidate := range candidates {
+		node := candidate.Get(0)
+		scores[node] *= 1 - linkDensity(candidate)
+		if top == nil || scores[node] > topScore {
+			top, topScore = candidate, scores[node]
+		}
+	}
+	if top == nil {
+		return "", errNotReadable
+	}
+
+	// Siblings that score well, or paragraphs of text, are part of the same article
+	threshold := math.Max(10, topScore*0.2)
+	var body strings.Builder
+	textLength := 0
+	top.Parent().Children().Each(func(_ int, sibling *goquery.Selection) {
+		keep := sibling.Get(0) == top.Get(0)
+		if s, ok := scores[sibling.Get(0)]; ok && s >= threshold {
+			keep = true
+		}
+		if sibling.Is("p") {
+			text := strings.TrimSpace(sibling.Text())
+			keep = keep || (len(text) > 80 && linkDensity(sibling) < 0.25)
+		}
+		if !keep {
+			return
+		}
+		textLength += len(strings.TrimSpace(sibling.Text()))
+		cleanReadable(sibling, pageURL)
+		if h, err := goquery.OuterHtml(sibling); err == nil {
+			body.WriteString(h)
+		}
+	})
+
+	if textLength < minReadableLength {
+		return "", errNotReadable
+	}
+	return strings.TrimSpace(body.String()), nil
+}
+
+// classWeight scores an element by whether its class and id look like content
+func classWeight(s *goquery.Selection) float64 {
+	weight := 0.0
+	for _, name := range []string{s.AttrOr("class", ""), s.AttrOr("id", "")} {
+		if name == "" {
+			continue
+		}
+		if negativeClass.MatchString(name) {
+			weight -= 25
+		}
+		if positiveClass.MatchString(name) {
+			weight += 25
+		}
+	}
+	return weight
+}
+
+// linkDensity is the share of an element's text that is inside links
+func linkDensity(s *goquery.Selection) float64 {
+	length := len(strings.TrimSpace(s.Text()))
+	if length == 0 {
+		return 0
+	}
+	linked := 0
+	s.Find("a").Each(func(_ int, a *goquery.Selection) {
+		linked += len(strings.TrimSpace(a.Text()))
+	})
+	return float64(linked) / float64(length)
+}
+
+// cleanReadable drops the attributes of an extracted element and its descendants except
+// keptAttributes, and makes links and image sources absolute
+func cleanReadable(s *goquery.Selection, pageURL *url.URL) {
+	s.Find("*").AddSelection(s).Each(func(_ int, e *goquery.Selection) {
+		node := e.Get(0)
+		kept := node.Attr[:0]
+		for _, attr := range node.Attr {
+			if !keptAttributes[attr.Key] {
+				continue
+			}
+			if attr.Key == "href" || attr.Key == "src" {
+				ref, err := url.Parse(strings.TrimSpace(attr.Val))
+				if err != nil || ref.Scheme == "javascript" {
+					continue
+				}
+				attr.Val = pageURL.ResolveReference(ref).String()
+			}
+			kept = append(kept, attr)
+		}
+		node.Attr = kept
+	})
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMaxRefreshesPerHost is how many feeds of one host are fetched at once unless
+	// the max_refreshes_per_host setting says otherwise
+	defaultMaxRefreshesPerHost = 2
+	// hostBusyDelay is the least time a refresh waiting for a busy host is put back for
+	hostBusyDelay = 10 * time.Second
+)
+
+// errHostBusy is returned by RefreshFeed when the feed's host already has as many
+// refreshes running as max_refreshes_per_host allows
+var errHostBusy = errors.New("too many refreshes of the feed's host are running")
+
+// refreshFlights coalesces concurrent refreshes of the same feed: while one runs, the
+// others wait for it and share its outcome instead of fetching the feed again. Other work
+// that stores articles of a feed, like a WebSub push, runs exclusively: it waits for the
+// running refresh, and refreshes started meanwhile wait for it in turn.
+type refreshFlights struct {
+	mu      sync.Mutex
+	running map[int]*refreshFlight
+}
+
+type refreshFlight struct {
+	done      chan struct{}
+	exclusive bool
+	result    *RefreshResult
+	err       error
+}
+
+// do runs refresh for a feed, or waits for the refresh of it that is already running and
+// returns a copy of its result with Shared set
+func (rf *refreshFlights) do(ctx context.Context, feedID int, refresh func() (*RefreshResult, error)) (*RefreshResult, error) {
+	for {
+		rf.mu.Lock()
+		flight := rf.running[feedID]
+		if flight == nil {
+			break
+		}
+		if err := rf.wait(ctx, flight); err != nil {
+			return nil, err
+		}
+		if flight.exclusive {
+			continue
+		}
+		if flight.result == nil {
+			return nil, flight.err
+		}
+		shared := *flight.result
+		shared.Shared = true
+		return &shared, flight.err
+	}
+	flight := rf.start(feedID, false)
+	defer rf.finish(feedID, flight)
+	flight.result, flight.err = refresh()
+	return flight.result, flight.err
+}
+
+// exclusive runs fn once no refresh of the feed is running, and keeps refreshes of it
+// waiting until fn returns
+func (rf *refreshFlights) exclusive(ctx context.Context, feedID int, fn func()) error {
+	for {
+		rf.mu.Lock()
+		flight := rf.running[feedID]
+		if flight == nil {
+			break
+		}
+		if err := rf.wait(ctx, flight); err != nil {
+			return err
+		}
+	}
+	flight := rf.start(feedID, true)
+	defer rf.finish(feedID, flight)
+	fn()
+	return nil
+}
+
+// wait unlocks rf, which the caller locked, and waits for flight to finish
+func (rf *refreshFlights) wait(ctx context.Context, flight *refreshFlight) error {
+	rf.mu.Unlock()
+	select {
+	case <-flight.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// start records a flight of a feed and unlocks rf, which the caller locked
+func (rf *refreshFlights) start(feedID int, exclusive bool) *refreshFlight {
+	if rf.running == nil {
+		rf.running = make(map[int]*refreshFlight)
+	}
+	flight := &refreshFlight{done: make(chan struct{}), exclusive: exclusive}
+	rf.running[feedID] = flight
+	rf.mu.Unlock()
+	return flight
+}
+
+func (rf *refreshFlights) finish(feedID int, flight *refreshFlight) {
+	rf.mu.Lock()
+	delete(rf.running, feedID)
+	rf.mu.Unlock()
+	close(flight.done)
+}
+
+// hostSlots limits how many feeds of the same host are fetched at once, so a host with
+// many feeds is not flooded with requests when they fall due together
+type hostSlots struct {
+	mu    sync.Mutex
+	inUse map[string]int
+}
+
+// tryAcquire takes one of the limit slots of a host without waiting, and returns the
+// function giving it back. Feeds without a host are not limited.
+func (hs *hostSlots) tryAcquire(host string, limit int) (func(), bool) {
+	if host == "" {
+		return func() {}, true
+	}
+
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if hs.inUse[host] >= limit {
+		return nil, false
+	}
+	if hs.inUse == nil {
+		hs.inUse = make(map[string]int)
+	}
+	hs.inUse[host]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			hs.mu.Lock()
+			defer hs.mu.Unlock()
+			if hs.inUse[host]--; hs.inUse[host] <= 0 {
+				delete(hs.inUse, host)
+			}
+		})
+	}, true
+}
@@ -0,0 +1,341 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"myfeed/database"
+	"myfeed/models"
+	"regexp"
+	"strings"
+)
+
+// maxTagLength caps the tags set by rules
+const maxTagLength = 64
+
+// RuleService applies the users' rules to articles as they are stored: articles whose
+// title, content or author match a rule's conditions are marked read or saved, deleted
+// or tagged for the rule's user.
+type RuleService struct {
+	db             *database.DB
+	feedService    *FeedService
+	folderService  *FolderService
+	articleService *ArticleService
+	statsService   *FeedStatsService
+}
+
+func NewRuleService(db *database.DB, feedService *FeedService, folderService *FolderService, articleService *ArticleService, statsService *FeedStatsService) *RuleService {
+	rs := &RuleService{
+		db:             db,
+		feedService:    feedService,
+		folderService:  folderService,
+		articleService: articleService,
+		statsService:   statsService,
+	}
+	feedService.ProcessNewArticles(rs.articleAdded)
+	return rs
+}
+
+const ruleColumns = `id, user_id, name, feed_id, folder_id, match_mode, conditions, actions, enabled, created_at`
+
+func scanRule(row rowScanner, rule *models.Rule) error {
+	var conditions, actions string
+	err := row.Scan(&rule.ID, &rule.UserID, &rule.Name, &rule.FeedID, &rule.FolderID, &rule.Match,
+		&conditions, &actions, &rule.Enabled, &rule.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal([]byte(conditions), &rule.Conditions); err != nil {
+		return fmt.Errorf("invalid conditions of rule %d: %v", rule.ID, err)
+	}
+	if err := json.Unmarshal([]byte(actions), &rule.Actions); err != nil {
+		return fmt.Errorf("invalid actions of rule %d: %v", rule.ID, err)
+	}
+	return nil
+}
+
+func (rs *RuleService) queryRules(query string, args ...interface{}) ([]models.Rule, error) {
+	rows, err := rs.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []models.Rule{}
+	for rows.Next() {
+		var rule models.Rule
+		if err := scanRule(rows, &rule); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+// GetRules returns the rules of a user in the order they are applied
+func (rs *RuleService) GetRules(userID int) ([]models.Rule, error) {
+	return rs.queryRules(`SELECT `+ruleColumns+` FROM rules WHERE user_id = ? ORDER BY id`, userID)
+}
+
+// GetRule returns a rule of a user, or sql.ErrNoRows
+func (rs *RuleService) GetRule(userID, id int) (*models.Rule, error) {
+	query := `SELECT ` + ruleColumns + ` FROM rules WHERE id = ? AND user_id = ?`
+
+	rule := &models.Rule{}
+	if err := scanRule(rs.db.QueryRow(query, id, userID), rule); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// SaveRule validates and stores a rule. A rule without an ID is created; otherwise the
+// user's rule with that ID is replaced. Rules only apply to articles stored afterwards.
+func (rs *RuleService) SaveRule(rule *models.Rule) (*models.Rule, error) {
+	if rule.ID != 0 {
+		if _, err := rs.GetRule(rule.UserID, rule.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	rule.Name = strings.TrimSpace(rule.Name)
+	if rule.Name == "" {
+		return nil, invalidField("name", "name is required")
+	}
+	if rule.Match == "" {
+		rule.Match = "all"
+	}
+	if rule.Match != "all" && rule.Match != "any" {
+		return nil, invalidField("match", "must be all or any")
+	}
+	if rule.FeedID != nil {
+		if _, err := rs.feedService.GetSubscribedFeed(rule.UserID, *rule.FeedID); err != nil {
+			return nil, invalidField("feed_id", "feed not found")
+		}
+	}
+	if rule.FolderID != nil {
+		if _, err := rs.folderService.GetFolderByID(rule.UserID, *rule.FolderID); err != nil {
+			return nil, invalidField("folder_id", "folder not found")
+		}
+	}
+
+	if len(rule.Conditions) == 0 {
+		return nil, invalidField("conditions", "at least one condition is required")
+	}
+	for i := range rule.Conditions {
+		condition := &rule.Conditions[i]
+		switch condition.Field {
+		case models.RuleFieldTitle, models.RuleFieldContent, models.RuleFieldAuthor, models.RuleFieldAny:
+		default:
+			return nil, invalidField("conditions", "condition %d: field must be title, content, author or any", i+1)
+		}
+		if condition.Value == "" {
+			return nil, invalidField("conditions", "condition %d: value is required", i+1)
+		}
+		switch condition.Operator {
+		case models.RuleContains:
+		case models.RuleMatches:
+			if _, err := regexp.Compile(condition.Value); err != nil {
+				return nil, invalidField("conditions", "condition %d: invalid regular expression: %v", i+1, err)
+			}
+		default:
+			return nil, invalidField("conditions", "condition %d: operator must be contains or matches", i+1)
+		}
+	}
+
+	if len(rule.Actions) == 0 {
+		return nil, invalidField("actions", "at least one action is required")
+	}
+	for i := range rule.Actions {
+		action := &rule.Actions[i]
+		switch action.Type {
+		case models.RuleMarkRead, models.RuleMarkSaved, models.RuleDelete:
+			action.Tag = ""
+		case models.RuleTag:
+			action.Tag = strings.TrimSpace(action.Tag)
+			if action.Tag == "" || len(action.Tag) > maxTagLength {
+				return nil, invalidField("actions", "action %d: tag must be 1 to %d characters", i+1, maxTagLength)
+			}
+		default:
+			return nil, invalidField("actions", "action %d: type must be mark_read, mark_saved, delete or tag", i+1)
+		}
+	}
+
+	conditionData, err := json.Marshal(rule.Conditions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode conditions: %v", err)
+	}
+	actionData, err := json.Marshal(rule.Actions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode actions: %v", err)
+	}
+
+	if rule.ID == 0 {
+		query := `
+			INSERT INTO rules (user_id, name, feed_id, folder_id, match_mode, conditions, actions, enabled)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`
+		id, err := rs.db.Insert(query, rule.UserID, rule.Name, rule.FeedID, rule.FolderID, rule.Match,
+			string(conditionData), string(actionData), rule.Enabled)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create rule: %v", err)
+		}
+		rule.ID = int(id)
+	} else {
+		query := `
+			UPDATE rules
+			SET name = ?, feed_id = ?, folder_id = ?, match_mode = ?, conditions = ?, actions = ?, enabled = ?
+			WHERE id = ? AND user_id = ?
+		`
+		_, err := rs.db.Exec(query, rule.Name, rule.FeedID, rule.FolderID, rule.Match, string(conditionData),
+			string(actionData), rule.Enabled, rule.ID, rule.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update rule: %v", err)
+		}
+	}
+
+	return rs.GetRule(rule.UserID, rule.ID)
+}
+
+// DeleteRule removes a rule of a user. What it did to articles stays.
+func (rs *RuleService) DeleteRule(userID, id int) error {
+	result, err := rs.db.Exec(`DELETE FROM rules WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ruleEffects are the actions of all of a user's rules matching an article
+type ruleEffects struct {
+	read, saved, hidden bool
+	tags                []string
+}
+
+// articleAdded applies the enabled rules of the users subscribed to the feed of a new
+// article. Every matching rule applies, in order, for the user it belongs to.
+func (rs *RuleService) articleAdded(article *models.Article) {
+	query := `
+		SELECT ` + ruleColumns + ` FROM rules
+		WHERE enabled = ? AND user_id IN (SELECT user_id FROM subscriptions WHERE feed_id = ?)
+		ORDER BY user_id, id
+	`
+	rules, err := rs.queryRules(query, true, article.FeedID)
+	if err != nil {
+		articleLog.Error("Failed to get rules", "error", err)
+		return
+	}
+	if len(rules) == 0 {
+		return
+	}
+
+	text := map[string]string{
+		models.RuleFieldTitle:   article.Title,
+		models.RuleFieldContent: htmlToText(article.Content),
+		models.RuleFieldAuthor:  article.Author,
+	}
+	text[models.RuleFieldAny] = text[models.RuleFieldTitle] + "\n" + text[models.RuleFieldContent] + "\n" + text[models.RuleFieldAuthor]
+
+	folders := make(folderTrees)
+	effects := make(map[int]*ruleEffects)
+	var users []int
+	for i := range rules {
+		rule := &rules[i]
+		if rule.FeedID != nil && *rule.FeedID != article.FeedID {
+			continue
+		}
+		if rule.FolderID != nil && !folders.contains(rs.folderService, rule.UserID, *rule.FolderID, article.FeedID) {
+			continue
+		}
+		if !ruleMatches(rule, text) {
+			continue
+		}
+
+		effect, ok := effects[rule.UserID]
+		if !ok {
+			effect = &ruleEffects{}
+			effects[rule.UserID] = effect
+			users = append(users, rule.UserID)
+		}
+		for _, action := range rule.Actions {
+			switch action.Type {
+			case models.RuleMarkRead:
+				effect.read = true
+			case models.RuleMarkSaved:
+				effect.saved = true
+			case models.RuleDelete:
+				effect.read, effect.hidden = true, true
+			case models.RuleTag:
+				effect.tags = append(effect.tags, action.Tag)
+			}
+		}
+	}
+
+	for _, userID := range users {
+		if err := rs.apply(userID, article, effects[userID]); err != nil {
+			articleLog.Error("Failed to apply rules", "user_id", userID, "article_id", article.ID, "error", err)
+		}
+	}
+}
+
+// ruleMatches reports whether an article, as text by rule field, meets the conditions of
+// a rule. A condition with an invalid regular expression never matches.
+func ruleMatches(rule *models.Rule, text map[string]string) bool {
+	for _, condition := range rule.Conditions {
+		var matched bool
+		switch condition.Operator {
+		case models.RuleContains:
+			matched = strings.Contains(strings.ToLower(text[condition.Field]), strings.ToLower(condition.Value))
+		case models.RuleMatches:
+			pattern, err := regexp.Compile(condition.Value)
+			matched = err == nil && pattern.MatchString(text[condition.Field])
+		}
+		if condition.Negate {
+			matched = !matched
+		}
+
+		if matched && rule.Match == "any" {
+			return true
+		}
+		if !matched && rule.Match != "any" {
+			return false
+		}
+	}
+	return rule.Match != "any"
+}
+
+// apply stores the effects of a user's rules on a new article. Marking it read takes it
+// off the unread counter, which counted it when it was stored.
+func (rs *RuleService) apply(userID int, article *models.Article, effect *ruleEffects) error {
+	if effect.read {
+		query := `
+			INSERT INTO article_states (user_id, article_id, read, hidden) VALUES (?, ?, ?, ?)
+			ON CONFLICT (user_id, article_id) DO UPDATE SET read = excluded.read, hidden = excluded.hidden
+		`
+		if _, err := rs.db.Exec(query, userID, article.ID, true, effect.hidden); err != nil {
+			return err
+		}
+		if err := rs.statsService.AdjustUnread(userID, article.FeedID, -1); err != nil {
+			return err
+		}
+	}
+	if effect.saved && !effect.hidden {
+		if err := rs.articleService.MarkAsSaved(userID, article.ID, true); err != nil {
+			return err
+		}
+	}
+	for _, tag := range effect.tags {
+		query := `
+			INSERT INTO article_tags (user_id, article_id, tag) VALUES (?, ?, ?)
+			ON CONFLICT (user_id, article_id, tag) DO NOTHING
+		`
+		if _, err := rs.db.Exec(query, userID, article.ID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,390 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"myfeed/database"
+	"myfeed/models"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultRefreshSchedule is how often due feeds are dispatched unless the refresh_schedule
+// setting says otherwise
+const DefaultRefreshSchedule = "@every 1m"
+
+const (
+	// defaultRefreshInterval is the shortest time between two scheduled fetches of a feed
+	defaultRefreshInterval = 15 * time.Minute
+	// defaultMaxRefreshInterval is the longest time a feed goes without being fetched
+	defaultMaxRefreshInterval = 24 * time.Hour
+	// minFeedRefreshInterval and maxFeedRefreshInterval bound the refresh interval set on
+	// a single feed, which overrides both settings
+	minFeedRefreshInterval = time.Minute
+	maxFeedRefreshInterval = 30 * 24 * time.Hour
+	// postingIntervalMultiplier scales a feed's average posting interval into its fetch interval
+	postingIntervalMultiplier = 5
+	// jitterFraction is the share of the interval by which a fetch is moved earlier or later,
+	// so feeds added together drift apart instead of being fetched in lockstep
+	jitterFraction = 0.1
+	// dispatchSpread is the window over which feeds that are due in the same tick are started
+	dispatchSpread = time.Minute
+	// activeFeedWindow and engagedFeedWindow are how recently an article of a feed must have
+	// been opened for its refreshes to be prioritized
+	activeFeedWindow  = 7 * 24 * time.Hour
+	engagedFeedWindow = 30 * 24 * time.Hour
+)
+
+// Refresh job priorities. When the queue is congested, feeds whose articles are read
+// are refreshed before subscriptions nobody opens.
+const (
+	RefreshPriorityIdle    = 0 // no article opened within engagedFeedWindow
+	RefreshPriorityEngaged = 1 // an article opened within engagedFeedWindow
+	RefreshPriorityActive  = 2 // an article opened within activeFeedWindow
+	RefreshPriorityManual  = 3 // requested by the user
+)
+
+// SchedulerService decides when each feed is fetched next. Feeds that post rarely are
+// polled rarely: the fetch interval follows the average posting interval, bounded by the
+// refresh_interval and refresh_max_interval settings, unless the feed has a refresh
+// interval of its own.
+type SchedulerService struct {
+	db                *database.DB
+	feedService       *FeedService
+	statsService      *FeedStatsService
+	settingsService   *SettingsService
+	deadLetterService *DeadLetterService
+	refreshes         refreshStats
+	dispatched        atomic.Int64
+	// lastDispatch is when DispatchDue last completed (Unix nanoseconds); it starts at the
+	// construction time so a fresh process is not reported as stalled
+	lastDispatch atomic.Int64
+}
+
+func NewSchedulerService(db *database.DB, feedService *FeedService, statsService *FeedStatsService, settingsService *SettingsService, deadLetterService *DeadLetterService) *SchedulerService {
+	ss := &SchedulerService{
+		db:                db,
+		feedService:       feedService,
+		statsService:      statsService,
+		settingsService:   settingsService,
+		deadLetterService: deadLetterService,
+	}
+	ss.lastDispatch.Store(time.Now().UnixNano())
+	feedService.SubscribeFeedDeleted(ss.refreshes.evict)
+	return ss
+}
+
+// LastDispatch returns when due feeds were last dispatched, or when the service started
+func (ss *SchedulerService) LastDispatch() time.Time {
+	return time.Unix(0, ss.lastDispatch.Load())
+}
+
+// NextInterval returns how long to wait before fetching a feed again
+func (ss *SchedulerService) NextInterval(feedID int) time.Duration {
+	if interval, ok := ss.feedInterval(feedID); ok {
+		return interval
+	}
+
+	minInterval := ss.settingsService.GetDuration(SettingRefreshInterval, defaultRefreshInterval)
+	maxInterval := ss.settingsService.GetDuration(SettingRefreshMaxInterval, defaultMaxRefreshInterval)
+
+	var avgPostInterval int64
+	if stats, err := ss.statsService.GetFeedStats(feedID); err == nil {
+		avgPostInterval = stats.AvgPostInterval
+	}
+
+	return fetchInterval(time.Duration(avgPostInterval)*time.Second, minInterval, maxInterval)
+}
+
+// feedInterval returns the refresh interval set on a feed, if it has one
+func (ss *SchedulerService) feedInterval(feedID int) (time.Duration, bool) {
+	var seconds sql.NullInt64
+	err := ss.db.QueryRow(`SELECT refresh_interval FROM feeds WHERE id = ?`, feedID).Scan(&seconds)
+	if err != nil || !seconds.Valid || seconds.Int64 <= 0 {
+		return 0, false
+	}
+	return time.Duration(seconds.Int64) * time.Second, true
+}
+
+// fetchInterval scales the average posting interval and clamps it to [min, max].
+// Feeds without enough history are fetched at the minimum interval.
+func fetchInterval(avgPostInterval, minInterval, maxInterval time.Duration) time.Duration {
+	if maxInterval < minInterval {
+		maxInterval = minInterval
+	}
+	if avgPostInterval <= 0 {
+		return minInterval
+	}
+
+	interval := avgPostInterval * postingIntervalMultiplier
+	if interval < minInterval {
+		return minInterval
+	}
+	if interval > maxInterval {
+		return maxInterval
+	}
+	return interval
+}
+
+// jitter returns a random offset within ±jitterFraction of interval
+func jitter(interval time.Duration) time.Duration {
+	spread := int64(float64(interval) * jitterFraction)
+	if spread <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(2*spread+1) - spread)
+}
+
+// backoffInterval doubles the minimum interval for every consecutive error, capped at max
+func backoffInterval(errorCount int, minInterval, maxInterval time.Duration) time.Duration {
+	interval := minInterval
+	for i := 1; i < errorCount && interval < maxInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxInterval {
+		return maxInterval
+	}
+	return interval
+}
+
+// ScheduleNext sets the next fetch time of a feed from its current statistics
+func (ss *SchedulerService) ScheduleNext(feedID int) (time.Time, error) {
+	return ss.scheduleAt(feedID, ss.NextInterval(feedID))
+}
+
+func (ss *SchedulerService) scheduleAt(feedID int, interval time.Duration) (time.Time, error) {
+	nextFetchAt := time.Now().Add(interval + jitter(interval)).UTC()
+	_, err := ss.db.Exec(`UPDATE feeds SET next_fetch_at = ? WHERE id = ?`, nextFetchAt, feedID)
+	return nextFetchAt, err
+}
+
+// scheduleAfterRefresh combines the posting interval, the error backoff and the server's
+// caching hints into the next fetch time: whichever asks for the longest wait wins,
+// bounded by the maximum interval. A feed with its own refresh interval backs off from
+// that interval, and a longer one than the maximum raises the bound.
+func (ss *SchedulerService) scheduleAfterRefresh(feedID int, result *RefreshResult, refreshErr error) error {
+	minInterval := ss.settingsService.GetDuration(SettingRefreshInterval, defaultRefreshInterval)
+	maxInterval := ss.settingsService.GetDuration(SettingRefreshMaxInterval, defaultMaxRefreshInterval)
+	interval := ss.NextInterval(feedID)
+	if feedInterval, ok := ss.feedInterval(feedID); ok {
+		minInterval = feedInterval
+		if feedInterval > maxInterval {
+			maxInterval = feedInterval
+		}
+	}
+
+	if refreshErr != nil {
+		var errorCount int
+		if err := ss.db.QueryRow(`SELECT error_count FROM feeds WHERE id = ?`, feedID).Scan(&errorCount); err != nil {
+			return err
+		}
+		if backoff := backoffInterval(errorCount, minInterval, maxInterval); backoff > interval {
+			interval = backoff
+		}
+	}
+
+	if result != nil && result.CacheHint > interval {
+		interval = result.CacheHint
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+
+	_, err := ss.scheduleAt(feedID, interval)
+	return err
+}
+
+// HandleRefreshJob is the job handler for refresh_feed jobs. It refreshes the feed and
+// reschedules it from the outcome.
+func (ss *SchedulerService) HandleRefreshJob(ctx context.Context, job *models.Job) error {
+	var payload refreshPayload
+	if err := decodePayload(job, &payload); err != nil {
+		return err
+	}
+
+	startedAt := time.Now()
+	result, err := ss.feedService.RefreshFeed(ctx, payload.FeedID)
+
+	// Interrupted by shutdown: the job queue puts the job back, nothing to record
+	if ctx.Err() != nil {
+		return err
+	}
+	// Feeds of a busy host wait their turn without holding up a worker
+	if errors.Is(err, errHostBusy) {
+		return DeferJob(err, hostBusyDelay+time.Duration(rand.Int63n(int64(hostBusyDelay))))
+	}
+	if result == nil {
+		// The feed could not be loaded; there is nothing to retry if it was deleted
+		if errors.Is(err, sql.ErrNoRows) {
+			return PermanentJobError(err)
+		}
+		return err
+	}
+	// Another job refreshed the feed meanwhile and has recorded the outcome
+	if result.Shared {
+		return nil
+	}
+	ss.refreshes.record(payload.FeedID, time.Since(startedAt))
+
+	// Transient failures are retried shortly by the job queue without affecting the
+	// feed's health; only the last attempt counts as an error
+	if err != nil && IsTransientFetchError(err) && job.Attempts < job.MaxAttempts {
+		schedulerLog.Info("Transient error refreshing feed, retrying", "feed_id", payload.FeedID, "attempt", job.Attempts, "error", err)
+		return err
+	}
+
+	if err != nil {
+		ss.feedService.RecordRefreshError(payload.FeedID, err)
+
+		// A feed that keeps failing is paused instead of being retried forever
+		deadLettered, dlErr := ss.deadLetterService.CheckFeed(payload.FeedID, err)
+		if dlErr != nil {
+			schedulerLog.Error("Failed to check feed for dead-lettering", "feed_id", payload.FeedID, "error", dlErr)
+		}
+		if deadLettered {
+			return PermanentJobError(err)
+		}
+	}
+
+	if scheduleErr := ss.scheduleAfterRefresh(payload.FeedID, result, err); scheduleErr != nil {
+		schedulerLog.Error("Failed to schedule next fetch", "feed_id", payload.FeedID, "error", scheduleErr)
+	}
+
+	// The scheduler owns the next attempt, so the job itself is not retried
+	if err != nil {
+		return PermanentJobError(err)
+	}
+	return nil
+}
+
+// DispatchDue queues a refresh for every unpaused feed whose next fetch time has passed and
+// provisionally schedules its following fetch, so a slow queue never dispatches a feed twice.
+// Feeds that have never been scheduled are spread over the minimum interval instead of
+// all being fetched at once, and due feeds start at random points of the next minute.
+// Refreshes are queued with a priority derived from how recently the feed was read.
+func (ss *SchedulerService) DispatchDue() (int, error) {
+	if err := ss.scheduleUnscheduled(); err != nil {
+		return 0, err
+	}
+
+	dueFeeds, err := ss.dueFeeds()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get due feeds: %v", err)
+	}
+
+	dispatched := 0
+	for _, due := range dueFeeds {
+		feedID := due.feedID
+		// The schedule only moves on once the refresh is queued, so a feed whose job could
+		// not be queued is tried again on the next pass. Queueing is unique per feed, so a
+		// failure to schedule does not queue the refresh twice.
+		runAt := time.Now().Add(time.Duration(rand.Int63n(int64(dispatchSpread))))
+		if _, err := ss.feedService.EnqueueRefreshAt(feedID, runAt, due.priority); err != nil {
+			schedulerLog.Error("Failed to enqueue refresh", "feed_id", feedID, "error", err)
+			continue
+		}
+		if _, err := ss.ScheduleNext(feedID); err != nil {
+			schedulerLog.Error("Failed to schedule next fetch", "feed_id", feedID, "error", err)
+		}
+		dispatched++
+		ss.dispatched.Add(1)
+	}
+
+	ss.lastDispatch.Store(time.Now().UnixNano())
+	return dispatched, nil
+}
+
+type dueFeed struct {
+	feedID   int
+	priority int
+}
+
+// dueFeeds returns the feeds to dispatch, most engaged first
+func (ss *SchedulerService) dueFeeds() ([]dueFeed, error) {
+	now := time.Now().UTC()
+	query := fmt.Sprintf(`
+		SELECT f.id,
+		       CASE WHEN s.last_opened_at >= ? THEN %d
+		            WHEN s.last_opened_at >= ? THEN %d
+		            ELSE %d END AS priority
+		FROM feeds f
+		LEFT JOIN feed_stats s ON s.feed_id = f.id
+		WHERE f.paused = ? AND f.next_fetch_at <= ?
+		ORDER BY priority DESC, f.next_fetch_at
+	`, RefreshPriorityActive, RefreshPriorityEngaged, RefreshPriorityIdle)
+
+	rows, err := ss.db.Query(query, now.Add(-activeFeedWindow), now.Add(-engagedFeedWindow), false, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dueFeeds []dueFeed
+	for rows.Next() {
+		var due dueFeed
+		if err := rows.Scan(&due.feedID, &due.priority); err != nil {
+			return nil, err
+		}
+		dueFeeds = append(dueFeeds, due)
+	}
+
+	return dueFeeds, rows.Err()
+}
+
+// scheduleUnscheduled gives feeds without a next fetch time a random slot within the
+// minimum interval, or within their own refresh interval when it is shorter
+func (ss *SchedulerService) scheduleUnscheduled() error {
+	window := ss.settingsService.GetDuration(SettingRefreshInterval, defaultRefreshInterval)
+	rows, err := ss.db.Query(`SELECT id, refresh_interval FROM feeds WHERE next_fetch_at IS NULL`)
+	if err != nil {
+		return fmt.Errorf("failed to get unscheduled feeds: %v", err)
+	}
+	windows := make(map[int]time.Duration)
+	for rows.Next() {
+		var feedID int
+		var seconds sql.NullInt64
+		if err := rows.Scan(&feedID, &seconds); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to get unscheduled feeds: %v", err)
+		}
+		windows[feedID] = window
+		if interval := time.Duration(seconds.Int64) * time.Second; seconds.Valid && interval > 0 && interval < window {
+			windows[feedID] = interval
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to get unscheduled feeds: %v", err)
+	}
+
+	for feedID, feedWindow := range windows {
+		nextFetchAt := time.Now().Add(time.Duration(rand.Int63n(int64(feedWindow)))).UTC()
+		if _, err := ss.db.Exec(`UPDATE feeds SET next_fetch_at = ? WHERE id = ?`, nextFetchAt, feedID); err != nil {
+			return fmt.Errorf("failed to schedule feed %d: %v", feedID, err)
+		}
+	}
+
+	return nil
+}
+
+func (ss *SchedulerService) feedIDs(query string, args ...interface{}) ([]int, error) {
+	rows, err := ss.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var feedIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		feedIDs = append(feedIDs, id)
+	}
+
+	return feedIDs, rows.Err()
+}
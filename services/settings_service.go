@@ -0,0 +1,371 @@
+package services
+
+import (
+	"fmt"
+	"myfeed/config"
+	"myfeed/logging"
+	"myfeed/database"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Setting keys stored in the settings table
+const (
+	SettingAppTitle               = "app_title"
+	SettingArticlesPerPage        = "articles_per_page"
+	SettingCleanupAfterDays       = "cleanup_after_days"
+	SettingRefreshInterval        = "refresh_interval"
+	SettingRefreshMaxInterval     = "refresh_max_interval"
+	SettingMaintenanceMode        = "maintenance_mode"
+	SettingMaxConcurrentRefreshes = "max_concurrent_refreshes"
+	SettingMaxRefreshesPerHost    = "max_refreshes_per_host"
+	SettingBackupEnabled          = "backup_enabled"
+	SettingBackupKeep             = "backup_keep"
+	SettingBackupIncludeSettings  = "backup_include_settings"
+	SettingNotificationLogDays    = "notification_log_days"
+	SettingMaxArticleKB           = "max_article_kb"
+	SettingLogLevel               = "log_level"
+	SettingFetchTrace             = "fetch_trace"
+	SettingUpdateCheck            = "update_check"
+	SettingDirectoryURL           = "directory_url"
+	SettingCacheEnclosures        = "cache_enclosures"
+	SettingEnclosureRetentionDays = "enclosure_retention_days"
+	SettingEnclosureMaxMB         = "enclosure_max_mb"
+
+	// Outgoing mail server; empty values fall back to the config file and environment
+	SettingSMTPHost     = "smtp_host"
+	SettingSMTPPort     = "smtp_port"
+	SettingSMTPTLS      = "smtp_tls"
+	SettingSMTPUsername = "smtp_username"
+	SettingSMTPPassword = "smtp_password"
+	SettingSMTPFrom     = "smtp_from"
+
+	// Bookmark manager for saved articles; empty values fall back to the config file and environment
+	SettingBookmarkService = "bookmark_service"
+	SettingBookmarkURL     = "bookmark_url"
+	SettingBookmarkToken   = "bookmark_token"
+	SettingBookmarkTags    = "bookmark_tags"
+
+	// Templates of outgoing messages; empty values use the built-in templates
+	SettingDigestSubjectTemplate       = "digest_subject_template"
+	SettingDigestHTMLTemplate          = "digest_html_template"
+	SettingDigestTextTemplate          = "digest_text_template"
+	SettingNotificationTitleTemplate   = "notification_title_template"
+	SettingNotificationMessageTemplate = "notification_message_template"
+	SettingForwardSubjectTemplate      = "forward_subject_template"
+	SettingForwardHTMLTemplate         = "forward_html_template"
+	SettingForwardTextTemplate         = "forward_text_template"
+
+	// Cron expressions of the recurring background tasks
+	SettingRefreshSchedule        = "refresh_schedule"
+	SettingCleanupSchedule        = "cleanup_schedule"
+	SettingRepairSchedule         = "repair_schedule"
+	SettingSessionCleanupSchedule = "session_cleanup_schedule"
+	SettingStatsSchedule          = "stats_schedule"
+	SettingDigestSchedule         = "digest_schedule"
+	SettingBackupSchedule         = "backup_schedule"
+)
+
+// settingValidators lists every writable setting together with its validation rule
+var settingValidators = map[string]func(value string) error{
+	SettingAppTitle: func(value string) error {
+		if strings.TrimSpace(value) == "" {
+			return fmt.Errorf("must not be empty")
+		}
+		return nil
+	},
+	SettingArticlesPerPage:        validateIntRange(1, 200),
+	SettingCleanupAfterDays:       validateIntRange(1, 3650),
+	SettingRefreshInterval:        validateDurationRange(time.Minute, 24*time.Hour),
+	SettingRefreshMaxInterval:     validateDurationRange(time.Hour, 30*24*time.Hour),
+	SettingMaintenanceMode:        validateBool,
+	SettingMaxConcurrentRefreshes: validateIntRange(1, 64),
+	SettingMaxRefreshesPerHost:    validateIntRange(1, 64),
+	SettingBackupEnabled:          validateBool,
+	SettingBackupKeep:             validateIntRange(1, 365),
+	SettingBackupIncludeSettings:  validateBool,
+	SettingNotificationLogDays:    validateIntRange(1, 365),
+	SettingMaxArticleKB:           validateIntRange(16, 10240),
+	SettingLogLevel:               optional(validateOneOf(logging.Levels...)),
+	SettingFetchTrace:             validateBool,
+	SettingUpdateCheck:            validateBool,
+	SettingDirectoryURL:           optional(validateServerURL),
+	SettingCacheEnclosures:        validateBool,
+	SettingEnclosureRetentionDays: validateIntRange(1, 3650),
+	SettingEnclosureMaxMB:         validateIntRange(1, 10240),
+
+	SettingSMTPHost:     validateAny,
+	SettingSMTPPort:     optional(validateIntRange(1, 65535)),
+	SettingSMTPTLS:      optional(validateOneOf(config.SMTPStartTLS, config.SMTPTLS, config.SMTPNoTLS)),
+	SettingSMTPUsername: validateAny,
+	SettingSMTPPassword: validateAny,
+	SettingSMTPFrom:     optional(validateEmail),
+
+	SettingBookmarkService: optional(validateOneOf(config.BookmarkLinkding, config.BookmarkShaarli)),
+	SettingBookmarkURL:     optional(validateServerURL),
+	SettingBookmarkToken:   validateAny,
+	SettingBookmarkTags:    validateAny,
+
+	SettingDigestSubjectTemplate:       validateMessageTemplate(SettingDigestSubjectTemplate),
+	SettingDigestHTMLTemplate:          validateMessageTemplate(SettingDigestHTMLTemplate),
+	SettingDigestTextTemplate:          validateMessageTemplate(SettingDigestTextTemplate),
+	SettingNotificationTitleTemplate:   validateMessageTemplate(SettingNotificationTitleTemplate),
+	SettingNotificationMessageTemplate: validateMessageTemplate(SettingNotificationMessageTemplate),
+	SettingForwardSubjectTemplate:      validateMessageTemplate(SettingForwardSubjectTemplate),
+	SettingForwardHTMLTemplate:         validateMessageTemplate(SettingForwardHTMLTemplate),
+	SettingForwardTextTemplate:         validateMessageTemplate(SettingForwardTextTemplate),
+
+	SettingRefreshSchedule:        validateCronSpec,
+	SettingCleanupSchedule:        validateCronSpec,
+	SettingRepairSchedule:         validateCronSpec,
+	SettingSessionCleanupSchedule: validateCronSpec,
+	SettingStatsSchedule:          validateCronSpec,
+	SettingDigestSchedule:         validateCronSpec,
+	SettingBackupSchedule:         validateCronSpec,
+}
+
+// secretSettings are never returned by the API; RedactedValue is shown instead
+var secretSettings = map[string]bool{
+	SettingSMTPPassword:  true,
+	SettingBookmarkToken: true,
+}
+
+// RedactedValue replaces secret settings in API responses. Submitting it back leaves the
+// stored value unchanged.
+const RedactedValue = "********"
+
+// RedactSecrets replaces the value of every non-empty secret setting with RedactedValue
+func RedactSecrets(settings map[string]string) map[string]string {
+	for key := range secretSettings {
+		if settings[key] != "" {
+			settings[key] = RedactedValue
+		}
+	}
+	return settings
+}
+
+type SettingsService struct {
+	db          *database.DB
+	mu          sync.RWMutex
+	subscribers []func(changed map[string]string)
+}
+
+func NewSettingsService(db *database.DB) *SettingsService {
+	return &SettingsService{db: db}
+}
+
+// GetAll returns every stored setting
+func (ss *SettingsService) GetAll() (map[string]string, error) {
+	rows, err := ss.db.Query(`SELECT key, value FROM settings ORDER BY key`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	settings := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		settings[key] = value
+	}
+
+	return settings, rows.Err()
+}
+
+func (ss *SettingsService) Get(key string) (string, error) {
+	var value string
+	err := ss.db.QueryRow(`SELECT value FROM settings WHERE key = ?`, key).Scan(&value)
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// GetString returns the setting value, or fallback if it is missing
+func (ss *SettingsService) GetString(key, fallback string) string {
+	value, err := ss.Get(key)
+	if err != nil || value == "" {
+		return fallback
+	}
+	return value
+}
+
+// GetInt returns the setting parsed as an integer, or fallback if it is missing or invalid
+func (ss *SettingsService) GetInt(key string, fallback int) int {
+	value, err := ss.Get(key)
+	if err != nil {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback
+	}
+	return parsed
+}
+
+// GetBool returns the setting parsed as a boolean, or fallback if it is missing or invalid
+func (ss *SettingsService) GetBool(key string, fallback bool) bool {
+	value, err := ss.Get(key)
+	if err != nil {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fallback
+	}
+	return parsed
+}
+
+// GetDuration returns the setting parsed as a duration, or fallback if it is missing or invalid
+func (ss *SettingsService) GetDuration(key string, fallback time.Duration) time.Duration {
+	value, err := ss.Get(key)
+	if err != nil {
+		return fallback
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fallback
+	}
+	return parsed
+}
+
+// Subscribe registers fn to be called with the changed settings after every successful update
+func (ss *SettingsService) Subscribe(fn func(changed map[string]string)) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.subscribers = append(ss.subscribers, fn)
+}
+
+// Set validates and stores a single setting
+func (ss *SettingsService) Set(key, value string) error {
+	return ss.Update(map[string]string{key: value})
+}
+
+// Update validates all given settings and stores them only if every value is valid
+func (ss *SettingsService) Update(settings map[string]string) error {
+	invalid := &ValidationError{Fields: map[string]string{}}
+	for key, value := range settings {
+		if secretSettings[key] && value == RedactedValue {
+			delete(settings, key)
+			continue
+		}
+		validate, exists := settingValidators[key]
+		if !exists {
+			invalid.Fields[key] = "unknown setting"
+			invalid.Message = fmt.Sprintf("unknown setting '%s'", key)
+			continue
+		}
+		if err := validate(value); err != nil {
+			invalid.Fields[key] = err.Error()
+			invalid.Message = fmt.Sprintf("invalid value for %s: %v", key, err)
+		}
+	}
+	if len(invalid.Fields) == 1 {
+		return invalid
+	}
+	if len(invalid.Fields) > 1 {
+		invalid.Message = fmt.Sprintf("%d settings are invalid", len(invalid.Fields))
+		return invalid
+	}
+
+	query := `
+		INSERT INTO settings (key, value) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value
+	`
+	for key, value := range settings {
+		if _, err := ss.db.Exec(query, key, value); err != nil {
+			return fmt.Errorf("failed to save setting %s: %v", key, err)
+		}
+	}
+
+	ss.mu.RLock()
+	subscribers := ss.subscribers
+	ss.mu.RUnlock()
+	for _, notify := range subscribers {
+		notify(settings)
+	}
+
+	return nil
+}
+
+func validateIntRange(min, max int) func(string) error {
+	return func(value string) error {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("must be a whole number")
+		}
+		if parsed < min || parsed > max {
+			return fmt.Errorf("must be between %d and %d", min, max)
+		}
+		return nil
+	}
+}
+
+func validateDurationRange(min, max time.Duration) func(string) error {
+	return func(value string) error {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("must be a duration such as 15m or 1h")
+		}
+		if parsed < min || parsed > max {
+			return fmt.Errorf("must be between %s and %s", min, max)
+		}
+		return nil
+	}
+}
+
+func validateAny(value string) error {
+	return nil
+}
+
+// optional accepts an empty value, which clears the setting, in addition to what validate accepts
+func optional(validate func(string) error) func(string) error {
+	return func(value string) error {
+		if value == "" {
+			return nil
+		}
+		return validate(value)
+	}
+}
+
+func validateOneOf(allowed ...string) func(string) error {
+	return func(value string) error {
+		for _, candidate := range allowed {
+			if value == candidate {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(allowed, ", "))
+	}
+}
+
+func validateEmail(value string) error {
+	if _, err := mail.ParseAddress(value); err != nil {
+		return fmt.Errorf("must be an email address")
+	}
+	return nil
+}
+
+func validateBool(value string) error {
+	if _, err := strconv.ParseBool(value); err != nil {
+		return fmt.Errorf("must be true or false")
+	}
+	return nil
+}
+
+func validateCronSpec(value string) error {
+	if _, err := cron.ParseStandard(value); err != nil {
+		return fmt.Errorf("must be a cron expression such as \"0 2 * * *\" or \"@every 5m\"")
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package services
+
+import (
+	"fmt"
+	"myfeed/database"
+	"myfeed/models"
+	"time"
+)
+
+const (
+	// statsDayFormat is the format of stats_history.day
+	statsDayFormat = "2006-01-02"
+	// statsBackfillDays bounds how far back a single aggregation run goes
+	statsBackfillDays = 30
+)
+
+// StatsHistoryService rolls the articles table up into daily per-feed counts so trend
+// queries read a handful of rows instead of scanning every article. Only finished days
+// are aggregated; counts are rewritten when a day is aggregated again.
+type StatsHistoryService struct {
+	db *database.DB
+}
+
+func NewStatsHistoryService(db *database.DB) *StatsHistoryService {
+	return &StatsHistoryService{db: db}
+}
+
+// dailyCounts holds the activity of one feed on one day
+type dailyCounts struct {
+	ingested int
+	read     int
+	saved    int
+}
+
+// Aggregate rolls up every day since the last aggregated one, up to yesterday (UTC),
+// and returns the number of days processed
+func (shs *StatsHistoryService) Aggregate() (int, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	start := today.AddDate(0, 0, -statsBackfillDays)
+
+	var lastDay *string
+	if err := shs.db.QueryRow(`SELECT MAX(day) FROM stats_history`).Scan(&lastDay); err != nil {
+		return 0, fmt.Errorf("failed to get last aggregated day: %v", err)
+	}
+	if lastDay != nil {
+		if day, err := time.Parse(statsDayFormat, *lastDay); err == nil && day.AddDate(0, 0, 1).After(start) {
+			start = day.AddDate(0, 0, 1)
+		}
+	}
+
+	days := 0
+	for day := start; day.Before(today); day = day.AddDate(0, 0, 1) {
+		if err := shs.AggregateDay(day); err != nil {
+			return days, err
+		}
+		days++
+	}
+
+	return days, nil
+}
+
+// AggregateDay stores the counts of the UTC day containing day
+func (shs *StatsHistoryService) AggregateDay(day time.Time) error {
+	from := day.UTC().Truncate(24 * time.Hour)
+	to := from.AddDate(0, 0, 1)
+
+	counts := make(map[int]*dailyCounts)
+	// Reads and saves are counted over every user's state of the articles
+	columns := []struct {
+		column string
+		table  string
+		set    func(c *dailyCounts, n int)
+	}{
+		{"a.created_at", "articles a", func(c *dailyCounts, n int) { c.ingested = n }},
+		{"st.read_at", "article_states st JOIN articles a ON a.id = st.article_id", func(c *dailyCounts, n int) { c.read = n }},
+		{"st.saved_at", "article_states st JOIN articles a ON a.id = st.article_id", func(c *dailyCounts, n int) { c.saved = n }},
+	}
+
+	for _, col := range columns {
+		query := `SELECT a.feed_id, COUNT(*) FROM ` + col.table + ` WHERE ` + col.column + ` >= ? AND ` + col.column + ` < ? GROUP BY a.feed_id`
+		if err := shs.countByFeed(query, from, to, func(feedID, n int) {
+			if counts[feedID] == nil {
+				counts[feedID] = &dailyCounts{}
+			}
+			col.set(counts[feedID], n)
+		}); err != nil {
+			return fmt.Errorf("failed to count %s: %v", col.column, err)
+		}
+	}
+
+	query := `
+		INSERT INTO stats_history (day, feed_id, articles_ingested, articles_read, articles_saved)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (day, feed_id) DO UPDATE SET
+			articles_ingested = excluded.articles_ingested,
+			articles_read = excluded.articles_read,
+			articles_saved = excluded.articles_saved
+	`
+	dayKey := from.Format(statsDayFormat)
+	for feedID, c := range counts {
+		if _, err := shs.db.Exec(query, dayKey, feedID, c.ingested, c.read, c.saved); err != nil {
+			return fmt.Errorf("failed to store statistics for feed %d on %s: %v", feedID, dayKey, err)
+		}
+	}
+
+	return nil
+}
+
+func (shs *StatsHistoryService) countByFeed(query string, from, to time.Time, fn func(feedID, count int)) error {
+	rows, err := shs.db.Query(query, from, to)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var feedID, count int
+		if err := rows.Scan(&feedID, &count); err != nil {
+			return err
+		}
+		fn(feedID, count)
+	}
+
+	return rows.Err()
+}
+
+// GetHistory returns the daily counts of the last days days, oldest first, for one feed
+// or summed over the feeds the user subscribes to when feedID is nil. Days without
+// activity are omitted. Feeds are shared, so reads and saves are those of all their
+// subscribers.
+func (shs *StatsHistoryService) GetHistory(userID int, feedID *int, days int) ([]models.DailyStats, error) {
+	since := time.Now().UTC().AddDate(0, 0, -days).Format(statsDayFormat)
+
+	query := `
+		SELECT day, SUM(articles_ingested), SUM(articles_read), SUM(articles_saved)
+		FROM stats_history
+		WHERE day >= ? AND feed_id IN (SELECT feed_id FROM subscriptions WHERE user_id = ?)
+	`
+	args := []interface{}{since, userID}
+
+	if feedID != nil {
+		query += " AND feed_id = ?"
+		args = append(args, *feedID)
+	}
+	query += " GROUP BY day ORDER BY day"
+
+	rows, err := shs.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := make([]models.DailyStats, 0)
+	for rows.Next() {
+		var stats models.DailyStats
+		if err := rows.Scan(&stats.Day, &stats.ArticlesIngested, &stats.ArticlesRead, &stats.ArticlesSaved); err != nil {
+			return nil, err
+		}
+		history = append(history, stats)
+	}
+
+	return history, rows.Err()
+}
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"myfeed/database"
+	"myfeed/models"
+	"time"
+)
+
+// SystemService gathers the overview an operator needs on one screen: what is running,
+// for how long, how large the data is and whether refreshes and backups keep up
+type SystemService struct {
+	db               *database.DB
+	startedAt        time.Time
+	feedService      *FeedService
+	schedulerService *SchedulerService
+	jobService       *JobService
+	backupService    *BackupService
+	updateService    *UpdateService
+}
+
+func NewSystemService(db *database.DB, feedService *FeedService, schedulerService *SchedulerService, jobService *JobService, backupService *BackupService, updateService *UpdateService) *SystemService {
+	return &SystemService{
+		db:               db,
+		startedAt:        time.Now(),
+		feedService:      feedService,
+		schedulerService: schedulerService,
+		jobService:       jobService,
+		backupService:    backupService,
+		updateService:    updateService,
+	}
+}
+
+// GetSystemInfo returns the overview, listing the topFeeds feeds with the most articles
+func (ss *SystemService) GetSystemInfo(ctx context.Context, topFeeds int) (*models.SystemInfo, error) {
+	now := time.Now()
+	info := &models.SystemInfo{
+		Build:         GetBuildInfo(),
+		Update:        ss.updateService.Status(),
+		StartedAt:     ss.startedAt.UTC(),
+		UptimeSeconds: int64(now.Sub(ss.startedAt).Seconds()),
+		GeneratedAt:   now.UTC(),
+	}
+
+	health := ss.db.Health()
+	info.Database = models.SystemDatabase{
+		Engine:     health.Engine,
+		ErrorCount: health.ErrorCount,
+		RetryCount: health.RetryCount,
+	}
+	size, err := ss.db.Size(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database size: %w", err)
+	}
+	info.Database.SizeBytes = size
+	if info.Database.SchemaVersion, err = ss.db.SchemaVersion(); err != nil {
+		return nil, fmt.Errorf("failed to get schema version: %w", err)
+	}
+
+	counts, err := ss.getCounts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count rows: %w", err)
+	}
+	info.Counts = *counts
+
+	if info.Feeds, err = ss.feedService.GetHealthTotals(); err != nil {
+		return nil, fmt.Errorf("failed to get feed health: %w", err)
+	}
+	if info.TopFeeds, err = ss.getTopFeeds(ctx, topFeeds); err != nil {
+		return nil, fmt.Errorf("failed to get article counts: %w", err)
+	}
+
+	jobs, err := ss.jobService.CountByStatus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to count jobs: %w", err)
+	}
+	info.Scheduler = models.SchedulerStatus{
+		Paused:       ss.jobService.IsPaused(),
+		Workers:      ss.jobService.Workers(),
+		LastDispatch: ss.schedulerService.LastDispatch().UTC(),
+		Jobs:         jobs,
+	}
+
+	backups, err := ss.backupService.ListBackups()
+	if err != nil {
+		return nil, err
+	}
+	info.Backups = models.BackupStatus{Enabled: ss.backupService.Enabled(), Count: len(backups)}
+	if len(backups) > 0 {
+		info.Backups.LastBackup = &backups[0].CreatedAt
+	}
+
+	return info, nil
+}
+
+func (ss *SystemService) getCounts(ctx context.Context) (*models.SystemCounts, error) {
+	query := `
+		SELECT (SELECT COUNT(*) FROM users),
+		       (SELECT COUNT(*) FROM folders),
+		       (SELECT COUNT(*) FROM feeds),
+		       (SELECT COUNT(*) FROM articles),
+		       (SELECT COALESCE(SUM(unread_count), 0) FROM subscriptions),
+		       (SELECT COUNT(*) FROM article_states WHERE saved = true)
+	`
+	counts := &models.SystemCounts{}
+	err := ss.db.QueryRowContext(ctx, query).Scan(&counts.Users, &counts.Folders, &counts.Feeds,
+		&counts.Articles, &counts.Unread, &counts.Saved)
+	return counts, err
+}
+
+// getTopFeeds returns the feeds with the most stored articles, as counted by feed_stats
+func (ss *SystemService) getTopFeeds(ctx context.Context, limit int) ([]models.FeedArticleCount, error) {
+	query := `
+		SELECT f.id, f.title, COALESCE(s.article_count, 0) AS article_count
+		FROM feeds f
+		LEFT JOIN feed_stats s ON s.feed_id = f.id
+		ORDER BY article_count DESC, f.id
+		LIMIT ?
+	`
+	rows, err := ss.db.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	feeds := []models.FeedArticleCount{}
+	for rows.Next() {
+		var feed models.FeedArticleCount
+		if err := rows.Scan(&feed.FeedID, &feed.Title, &feed.ArticleCount); err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, feed)
+	}
+	return feeds, rows.Err()
+}
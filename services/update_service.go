@@ -0,0 +1,112 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"myfeed/models"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// latestReleaseURL is the GitHub API endpoint of the newest published release
+	latestReleaseURL = "https://api.github.com/repos/mikeloven/myfeed/releases/latest"
+	updateTimeout    = 15 * time.Second
+)
+
+// UpdateService checks once a day whether a newer release of MyFeed is published on
+// GitHub, for the admin dashboard. The update_check setting switches it off, in which case
+// no request leaves the server.
+type UpdateService struct {
+	settingsService *SettingsService
+	client          *http.Client
+
+	mu     sync.Mutex
+	status models.UpdateStatus
+}
+
+func NewUpdateService(settingsService *SettingsService) *UpdateService {
+	return &UpdateService{
+		settingsService: settingsService,
+		client:          &http.Client{Timeout: updateTimeout},
+	}
+}
+
+// Enabled reports whether the update_check setting allows checking
+func (us *UpdateService) Enabled() bool {
+	return us.settingsService.GetBool(SettingUpdateCheck, true)
+}
+
+// Status returns the outcome of the last check
+func (us *UpdateService) Status() models.UpdateStatus {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	status := us.status
+	status.Enabled = us.Enabled()
+	return status
+}
+
+// Check looks up the latest release and records whether it is newer than this build.
+// Failures are recorded as well, so the dashboard shows why no result is available.
+func (us *UpdateService) Check(ctx context.Context) error {
+	if !us.Enabled() {
+		return nil
+	}
+
+	latest, url, err := us.fetchLatest(ctx)
+	now := time.Now().UTC()
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.status.CheckedAt = &now
+	if err != nil {
+		us.status.Error = err.Error()
+		return err
+	}
+	current := GetBuildInfo().Version
+	us.status = models.UpdateStatus{
+		CheckedAt:     &now,
+		LatestVersion: latest,
+		ReleaseURL:    url,
+		Available:     isNewerRelease(latest, current),
+	}
+	if us.status.Available {
+		updateLog.Info("A newer release is available", "current", current, "latest", latest, "url", url)
+	}
+	return nil
+}
+
+// fetchLatest returns the tag and page of the newest release, or empty values while none
+// has been published
+func (us *UpdateService) fetchLatest(ctx context.Context) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, latestReleaseURL, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", feedUserAgent)
+	resp, err := us.client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to check for updates: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("failed to check for updates: GitHub answered %s", resp.Status)
+	}
+
+	var release struct {
+		TagName string `json:"tag_name"`
+		HTMLURL string `json:"html_url"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&release); err != nil {
+		return "", "", fmt.Errorf("failed to read the latest release: %v", err)
+	}
+	return release.TagName, release.HTMLURL, nil
+}
@@ -0,0 +1,145 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"myfeed/models"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// minPasswordLength is the shortest password accepted for a user
+const minPasswordLength = 6
+
+// GetUsers lists all users by username
+func (as *AuthService) GetUsers() ([]models.User, error) {
+	rows, err := as.db.Query(`SELECT ` + userColumns + ` FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		var user models.User
+		if err := scanUser(rows, &user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// AddUser creates a user for an admin, returning ErrUserExists if the username is taken
+func (as *AuthService) AddUser(username, password string, isAdmin bool) (*models.User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, invalidField("username", "username is required")
+	}
+	if len(password) < minPasswordLength {
+		return nil, invalidField("password", "password must be at least %d characters long", minPasswordLength)
+	}
+	return as.CreateUser(username, password, isAdmin)
+}
+
+// UpdateUser disables or enables a user and grants or revokes admin rights, for the admin
+// with ID adminID; nil leaves a field as it is. Disabling a user ends their sessions. An
+// admin cannot change their own account this way, and the last enabled admin stays one.
+func (as *AuthService) UpdateUser(adminID, id int, disabled, isAdmin *bool) (*models.User, error) {
+	user, err := as.GetUserByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if disabled == nil {
+		disabled = &user.Disabled
+	}
+	if isAdmin == nil {
+		isAdmin = &user.IsAdmin
+	}
+	if *disabled == user.Disabled && *isAdmin == user.IsAdmin {
+		return user, nil
+	}
+
+	if id == adminID {
+		return nil, ErrOwnAccount
+	}
+	if user.IsAdmin && !user.Disabled && (*disabled || !*isAdmin) {
+		if err := as.checkOtherAdmin(id); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := as.db.Exec(`UPDATE users SET disabled = ?, is_admin = ? WHERE id = ?`, *disabled, *isAdmin, id); err != nil {
+		return nil, fmt.Errorf("failed to update user: %v", err)
+	}
+	if *disabled {
+		if _, err := as.db.Exec(`DELETE FROM sessions WHERE user_id = ?`, id); err != nil {
+			return nil, fmt.Errorf("failed to end sessions: %v", err)
+		}
+	}
+	return as.GetUserByID(id)
+}
+
+// DeleteUser removes a user with their subscriptions, folders and everything else of
+// theirs. Feeds nobody else follows stay until the next repair.
+func (as *AuthService) DeleteUser(adminID, id int) error {
+	user, err := as.GetUserByID(id)
+	if err != nil {
+		return err
+	}
+	if id == adminID {
+		return ErrOwnAccount
+	}
+	if user.IsAdmin && !user.Disabled {
+		if err := as.checkOtherAdmin(id); err != nil {
+			return err
+		}
+	}
+
+	result, err := as.db.Exec(`DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %v", err)
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ResetPassword sets a new password for a user and ends their sessions, for an admin who
+// does not know the current one
+func (as *AuthService) ResetPassword(id int, password string) error {
+	if _, err := as.GetUserByID(id); err != nil {
+		return err
+	}
+	if len(password) < minPasswordLength {
+		return invalidField("password", "password must be at least %d characters long", minPasswordLength)
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %v", err)
+	}
+	if _, err := as.db.Exec(`UPDATE users SET password = ? WHERE id = ?`, string(hashedPassword), id); err != nil {
+		return fmt.Errorf("failed to update password: %v", err)
+	}
+	if _, err := as.db.Exec(`DELETE FROM sessions WHERE user_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to end sessions: %v", err)
+	}
+	return nil
+}
+
+// checkOtherAdmin returns ErrLastAdmin unless an enabled admin other than the user with
+// ID id exists
+func (as *AuthService) checkOtherAdmin(id int) error {
+	var count int
+	query := `SELECT COUNT(*) FROM users WHERE is_admin = ? AND COALESCE(disabled, false) = ? AND id <> ?`
+	if err := as.db.QueryRow(query, true, false, id).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrLastAdmin
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package services
+
+import (
+	"myfeed/models"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Build stamps, set at build time with
+// -ldflags "-X myfeed/services.Version=v1.2.3 -X myfeed/services.Commit=... -X myfeed/services.BuildDate=2024-05-01T12:00:00Z".
+// Builds without them report the module version, which is "(devel)" for builds from a
+// checkout, and the VCS revision the Go toolchain records.
+var (
+	Version   = ""
+	Commit    = ""
+	BuildDate = ""
+)
+
+// GetBuildInfo identifies the running binary
+func GetBuildInfo() models.BuildInfo {
+	info := models.BuildInfo{Version: Version, Revision: Commit, GoVersion: runtime.Version()}
+	if t, err := time.Parse(time.RFC3339, BuildDate); err == nil {
+		info.BuildDate = &t
+	}
+
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if info.Version == "" {
+		info.Version = build.Main.Version
+	}
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if info.Revision == "" {
+				info.Revision = setting.Value
+			}
+		case "vcs.time":
+			if t, err := time.Parse(time.RFC3339, setting.Value); err == nil {
+				info.RevisionTime = &t
+			}
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+// parseRelease splits a release version like "v1.2.3" into its numbers. Pre-releases and
+// development builds, like "v1.3.0-rc.1" or "(devel)", are not releases.
+func parseRelease(version string) ([3]int, bool) {
+	var parts [3]int
+	fields := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	if len(fields) != 3 {
+		return parts, false
+	}
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return parts, false
+		}
+		parts[i] = n
+	}
+	return parts, true
+}
+
+// isNewerRelease reports whether latest is a later release than current. Nothing is newer
+// than a build that is not a release, since it cannot be placed among them.
+func isNewerRelease(latest, current string) bool {
+	l, ok := parseRelease(latest)
+	if !ok {
+		return false
+	}
+	c, ok := parseRelease(current)
+	if !ok {
+		return false
+	}
+	for i := range l {
+		if l[i] != c[i] {
+			return l[i] > c[i]
+		}
+	}
+	return false
+}
@@ -0,0 +1,515 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"myfeed/database"
+	"myfeed/models"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// webhookTimeout bounds one POST to a webhook
+	webhookTimeout = 15 * time.Second
+	// webhookMaxAttempts and webhookRetryBaseDelay give failed deliveries about an hour
+	// to go through: the delay doubles from 30 seconds after every attempt
+	webhookMaxAttempts    = 8
+	webhookRetryBaseDelay = 30 * time.Second
+)
+
+// Events sent to webhooks, in the event field of the payload and the X-MyFeed-Event header
+const (
+	webhookEventArticle = "article.created"
+	webhookEventTest    = "test"
+)
+
+// webhookPayload is the JSON document POSTed to a webhook
+type webhookPayload struct {
+	Event   string       `json:"event"`
+	Webhook string       `json:"webhook"`
+	Article *hookArticle `json:"article,omitempty"`
+}
+
+type webhookJobPayload struct {
+	DeliveryID int `json:"delivery_id"`
+}
+
+// WebhookService POSTs new articles to the webhooks of the users subscribed to their feed.
+// Every delivery is logged and sent by a job, retried with exponential backoff while the
+// receiving server fails.
+type WebhookService struct {
+	db            *database.DB
+	feedService   *FeedService
+	folderService *FolderService
+	jobService    *JobService
+	client        *http.Client
+}
+
+func NewWebhookService(db *database.DB, feedService *FeedService, folderService *FolderService, jobService *JobService) *WebhookService {
+	ws := &WebhookService{
+		db:            db,
+		feedService:   feedService,
+		folderService: folderService,
+		jobService:    jobService,
+		client:        &http.Client{Timeout: webhookTimeout},
+	}
+	feedService.SubscribeNewArticles(ws.articlesAdded)
+	return ws
+}
+
+const webhookColumns = `id, user_id, name, url, secret, feed_id, folder_id, keywords, enabled, created_at`
+
+func scanWebhook(row rowScanner, webhook *models.Webhook) error {
+	var keywords string
+	err := row.Scan(&webhook.ID, &webhook.UserID, &webhook.Name, &webhook.URL, &webhook.Secret,
+		&webhook.FeedID, &webhook.FolderID, &keywords, &webhook.Enabled, &webhook.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal([]byte(keywords), &webhook.Keywords); err != nil {
+		return fmt.Errorf("invalid keywords of webhook %d: %v", webhook.ID, err)
+	}
+	if webhook.Keywords == nil {
+		webhook.Keywords = []string{}
+	}
+	return nil
+}
+
+func (ws *WebhookService) queryWebhooks(query string, args ...interface{}) ([]models.Webhook, error) {
+	rows, err := ws.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []models.Webhook{}
+	for rows.Next() {
+		var webhook models.Webhook
+		if err := scanWebhook(rows, &webhook); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+// GetWebhooks returns the webhooks of a user
+func (ws *WebhookService) GetWebhooks(userID int) ([]models.Webhook, error) {
+	return ws.queryWebhooks(`SELECT `+webhookColumns+` FROM webhooks WHERE user_id = ? ORDER BY id`, userID)
+}
+
+// GetWebhook returns a webhook of a user, or sql.ErrNoRows
+func (ws *WebhookService) GetWebhook(userID, id int) (*models.Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks WHERE id = ? AND user_id = ?`
+
+	webhook := &models.Webhook{}
+	if err := scanWebhook(ws.db.QueryRow(query, id, userID), webhook); err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// SaveWebhook validates and stores a webhook. A webhook without an ID is created;
+// otherwise the user's webhook with that ID is replaced. A secret sent back as
+// RedactedValue keeps its stored value.
+func (ws *WebhookService) SaveWebhook(webhook *models.Webhook) (*models.Webhook, error) {
+	if webhook.ID != 0 {
+		existing, err := ws.GetWebhook(webhook.UserID, webhook.ID)
+		if err != nil {
+			return nil, err
+		}
+		if webhook.Secret == RedactedValue {
+			webhook.Secret = existing.Secret
+		}
+	}
+
+	webhook.URL = strings.TrimSpace(webhook.URL)
+	parsed, err := url.Parse(webhook.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, invalidField("url", "must be an http or https URL")
+	}
+
+	webhook.Name = strings.TrimSpace(webhook.Name)
+	if webhook.Name == "" {
+		webhook.Name = parsed.Host
+	}
+	if webhook.FeedID != nil {
+		if _, err := ws.feedService.GetSubscribedFeed(webhook.UserID, *webhook.FeedID); err != nil {
+			return nil, invalidField("feed_id", "feed not found")
+		}
+	}
+	if webhook.FolderID != nil {
+		if _, err := ws.folderService.GetFolderByID(webhook.UserID, *webhook.FolderID); err != nil {
+			return nil, invalidField("folder_id", "folder not found")
+		}
+	}
+
+	keywords := []string{}
+	for _, keyword := range webhook.Keywords {
+		if keyword = strings.TrimSpace(keyword); keyword != "" {
+			keywords = append(keywords, keyword)
+		}
+	}
+	webhook.Keywords = keywords
+	keywordData, err := json.Marshal(webhook.Keywords)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode keywords: %v", err)
+	}
+
+	if webhook.ID == 0 {
+		query := `
+			INSERT INTO webhooks (user_id, name, url, secret, feed_id, folder_id, keywords, enabled)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`
+		id, err := ws.db.Insert(query, webhook.UserID, webhook.Name, webhook.URL, webhook.Secret,
+			webhook.FeedID, webhook.FolderID, string(keywordData), webhook.Enabled)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create webhook: %v", err)
+		}
+		webhook.ID = int(id)
+	} else {
+		query := `
+			UPDATE webhooks
+			SET name = ?, url = ?, secret = ?, feed_id = ?, folder_id = ?, keywords = ?, enabled = ?
+			WHERE id = ? AND user_id = ?
+		`
+		_, err := ws.db.Exec(query, webhook.Name, webhook.URL, webhook.Secret, webhook.FeedID,
+			webhook.FolderID, string(keywordData), webhook.Enabled, webhook.ID, webhook.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update webhook: %v", err)
+		}
+	}
+
+	return ws.GetWebhook(webhook.UserID, webhook.ID)
+}
+
+// DeleteWebhook removes a webhook of a user with its delivery log
+func (ws *WebhookService) DeleteWebhook(userID, id int) error {
+	result, err := ws.db.Exec(`DELETE FROM webhooks WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RedactWebhook replaces the secret of a webhook with RedactedValue
+func RedactWebhook(webhook *models.Webhook) *models.Webhook {
+	redacted := *webhook
+	if redacted.Secret != "" {
+		redacted.Secret = RedactedValue
+	}
+	return &redacted
+}
+
+// Test POSTs a test event to a webhook right away. A webhook that cannot be reached or
+// rejects it is an *UpstreamError.
+func (ws *WebhookService) Test(ctx context.Context, webhook *models.Webhook) (*models.WebhookDelivery, error) {
+	body, err := json.Marshal(webhookPayload{Event: webhookEventTest, Webhook: webhook.Name})
+	if err != nil {
+		return nil, err
+	}
+	deliveryID, err := ws.recordDelivery(webhook, nil, body)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := ws.post(ctx, webhook, deliveryID, webhookEventTest, body)
+	ws.recordAttempt(deliveryID, nil, status, err)
+	if err != nil {
+		return nil, &UpstreamError{Err: err}
+	}
+	return ws.GetDelivery(webhook.UserID, deliveryID)
+}
+
+// articlesAdded queues a delivery of every new article of a feed to each enabled webhook
+// of the users subscribed to it whose filters the article passes
+func (ws *WebhookService) articlesAdded(feed *models.Feed, articles []models.Article) {
+	query := `
+		SELECT ` + webhookColumns + ` FROM webhooks
+		WHERE enabled = ? AND user_id IN (SELECT user_id FROM subscriptions WHERE feed_id = ?)
+		ORDER BY id
+	`
+	webhooks, err := ws.queryWebhooks(query, true, feed.ID)
+	if err != nil {
+		webhookLog.Error("Failed to get webhooks", "error", err)
+		return
+	}
+
+	folders := make(folderTrees)
+	for i := range webhooks {
+		webhook := &webhooks[i]
+		if webhook.FeedID != nil && *webhook.FeedID != feed.ID {
+			continue
+		}
+		if webhook.FolderID != nil && !folders.contains(ws.folderService, webhook.UserID, *webhook.FolderID, feed.ID) {
+			continue
+		}
+
+		for j := range articles {
+			article := &articles[j]
+			if article.ID == 0 || !articleMatchesKeywords(article, webhook.Keywords) {
+				continue
+			}
+
+			body, err := json.Marshal(webhookPayload{
+				Event:   webhookEventArticle,
+				Webhook: webhook.Name,
+				Article: &hookArticle{
+					ID:          article.ID,
+					FeedID:      feed.ID,
+					FeedTitle:   feed.Title,
+					FeedURL:     feed.URL,
+					Title:       article.Title,
+					URL:         article.URL,
+					Author:      article.Author,
+					Content:     article.Content,
+					PublishedAt: article.PublishedAt,
+				},
+			})
+			if err != nil {
+				webhookLog.Error("Failed to encode webhook payload", "article_id", article.ID, "error", err)
+				continue
+			}
+			if _, err := ws.queue(webhook, &article.ID, body); err != nil {
+				webhookLog.Error("Failed to queue webhook", "webhook_id", webhook.ID, "article_id", article.ID, "error", err)
+			}
+		}
+	}
+}
+
+// queue logs a delivery of a payload to a webhook and queues the job that sends it
+func (ws *WebhookService) queue(webhook *models.Webhook, articleID *int, body []byte) (int, error) {
+	deliveryID, err := ws.recordDelivery(webhook, articleID, body)
+	if err != nil {
+		return 0, err
+	}
+	target := "webhook:" + strconv.Itoa(webhook.ID)
+	if _, err := ws.jobService.EnqueueAttempts(JobDeliverWebhook, target, webhookJobPayload{DeliveryID: deliveryID}, webhookMaxAttempts); err != nil {
+		return 0, err
+	}
+	return deliveryID, nil
+}
+
+// HandleDeliverJob is the job handler for deliver_webhook jobs
+func (ws *WebhookService) HandleDeliverJob(ctx context.Context, job *models.Job) error {
+	var payload webhookJobPayload
+	if err := decodePayload(job, &payload); err != nil {
+		return PermanentJobError(err)
+	}
+
+	var body string
+	var webhookID int
+	err := ws.db.QueryRow(`SELECT payload, webhook_id FROM webhook_deliveries WHERE id = ?`, payload.DeliveryID).Scan(&body, &webhookID)
+	webhook := &models.Webhook{}
+	if err == nil {
+		err = scanWebhook(ws.db.QueryRow(`SELECT `+webhookColumns+` FROM webhooks WHERE id = ?`, webhookID), webhook)
+	}
+	if err == sql.ErrNoRows {
+		return nil // the webhook was deleted, or the delivery cleaned up, after it was queued
+	}
+	if err != nil {
+		return err
+	}
+	if !webhook.Enabled {
+		ws.recordAttempt(payload.DeliveryID, job, nil, PermanentJobError(fmt.Errorf("webhook is disabled")))
+		return nil
+	}
+
+	// Redeliveries of tests are sent as tests again
+	var event webhookPayload
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		return PermanentJobError(fmt.Errorf("invalid payload of webhook delivery %d: %v", payload.DeliveryID, err))
+	}
+
+	status, err := ws.post(ctx, webhook, payload.DeliveryID, event.Event, []byte(body))
+	if ctx.Err() == nil {
+		ws.recordAttempt(payload.DeliveryID, job, status, err)
+	}
+	if err != nil {
+		return RetryJobAfter(err, webhookRetryBaseDelay<<(job.Attempts-1))
+	}
+	return nil
+}
+
+// post sends a payload to a webhook, signed with its secret if it has one, and returns
+// the HTTP status the server answered with, if any. Rejections with a 4xx status other
+// than 408 and 429 are permanent.
+func (ws *WebhookService) post(ctx context.Context, webhook *models.Webhook, deliveryID int, event string, body []byte) (*int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, PermanentJobError(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", feedUserAgent)
+	req.Header.Set("X-MyFeed-Event", event)
+	req.Header.Set("X-MyFeed-Delivery", strconv.Itoa(deliveryID))
+	if webhook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(webhook.Secret))
+		mac.Write(body)
+		req.Header.Set("X-MyFeed-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	status := resp.StatusCode
+	if status >= 200 && status < 300 {
+		return &status, nil
+	}
+	text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("webhook returned %s: %s", resp.Status, strings.TrimSpace(string(text)))
+	if status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests {
+		return &status, PermanentJobError(err)
+	}
+	return &status, err
+}
+
+const webhookDeliveryColumns = `d.id, d.user_id, d.webhook_id, w.name, d.article_id, d.payload, d.status,
+	d.response_status, d.error, d.attempts, d.created_at, d.updated_at`
+
+func scanWebhookDelivery(row rowScanner, d *models.WebhookDelivery) error {
+	return row.Scan(&d.ID, &d.UserID, &d.WebhookID, &d.WebhookName, &d.ArticleID, &d.Payload, &d.Status,
+		&d.ResponseStatus, &d.Error, &d.Attempts, &d.CreatedAt, &d.UpdatedAt)
+}
+
+// GetDeliveries returns a user's webhook delivery log, newest first. filter.TargetID
+// selects the deliveries of one webhook.
+func (ws *WebhookService) GetDeliveries(userID int, filter DeliveryFilter) ([]models.WebhookDelivery, error) {
+	query := `
+		SELECT ` + webhookDeliveryColumns + `
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.user_id = ?
+	`
+	args := []interface{}{userID}
+	if filter.Status != "" {
+		query += " AND d.status = ?"
+		args = append(args, filter.Status)
+	}
+	if filter.TargetID != nil {
+		query += " AND d.webhook_id = ?"
+		args = append(args, *filter.TargetID)
+	}
+
+	query += " ORDER BY d.id DESC LIMIT ? OFFSET ?"
+	args = append(args, filter.Limit, filter.Offset)
+
+	rows, err := ws.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []models.WebhookDelivery{}
+	for rows.Next() {
+		var d models.WebhookDelivery
+		if err := scanWebhookDelivery(rows, &d); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// GetDelivery returns an entry of a user's webhook delivery log, or sql.ErrNoRows
+func (ws *WebhookService) GetDelivery(userID, id int) (*models.WebhookDelivery, error) {
+	query := `
+		SELECT ` + webhookDeliveryColumns + `
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.id = ? AND d.user_id = ?
+	`
+
+	d := &models.WebhookDelivery{}
+	if err := scanWebhookDelivery(ws.db.QueryRow(query, id, userID), d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Redeliver queues the payload of a failed delivery again, as a new entry of the log
+func (ws *WebhookService) Redeliver(userID, id int) (*models.WebhookDelivery, error) {
+	d, err := ws.GetDelivery(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if d.Status != models.DeliveryFailed {
+		return nil, ErrNotRedeliverable
+	}
+
+	deliveryID, err := ws.queue(&models.Webhook{ID: d.WebhookID, UserID: d.UserID}, d.ArticleID, []byte(d.Payload))
+	if err != nil {
+		return nil, err
+	}
+	return ws.GetDelivery(userID, deliveryID)
+}
+
+// CleanupDeliveries removes webhook delivery log entries older than the given number of days
+func (ws *WebhookService) CleanupDeliveries(days int) (int64, error) {
+	cutoff := time.Now().UTC().AddDate(0, 0, -days)
+	result, err := ws.db.Exec(`DELETE FROM webhook_deliveries WHERE created_at < ?`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to clean up webhook log: %v", err)
+	}
+	return result.RowsAffected()
+}
+
+// recordDelivery adds a pending delivery to the log and returns its ID
+func (ws *WebhookService) recordDelivery(webhook *models.Webhook, articleID *int, body []byte) (int, error) {
+	now := time.Now().UTC()
+	query := `
+		INSERT INTO webhook_deliveries (user_id, webhook_id, article_id, payload, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	id, err := ws.db.Insert(query, webhook.UserID, webhook.ID, articleID, string(body), models.DeliveryPending, now, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record webhook delivery: %v", err)
+	}
+	return int(id), nil
+}
+
+// recordAttempt stores the outcome of one attempt to deliver a logged payload. A failed
+// attempt the job queue will retry is logged as retrying.
+func (ws *WebhookService) recordAttempt(deliveryID int, job *models.Job, responseStatus *int, postErr error) {
+	status := models.DeliverySent
+	var errText *string
+	if postErr != nil {
+		text := postErr.Error()
+		errText = &text
+
+		var permanent *permanentJobError
+		status = models.DeliveryFailed
+		if job != nil && job.Attempts < job.MaxAttempts && !errors.As(postErr, &permanent) {
+			status = models.DeliveryRetrying
+		}
+	}
+
+	query := `
+		UPDATE webhook_deliveries SET status = ?, response_status = ?, error = ?, attempts = attempts + 1, updated_at = ?
+		WHERE id = ?
+	`
+	if _, err := ws.db.Exec(query, status, responseStatus, errText, time.Now().UTC(), deliveryID); err != nil {
+		webhookLog.Error("Failed to record webhook delivery", "delivery_id", deliveryID, "error", err)
+	}
+}
@@ -0,0 +1,484 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"myfeed/database"
+	"myfeed/models"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// websubTimeout bounds the download of a feed for its hub and the request to the hub
+	websubTimeout = 30 * time.Second
+	// maxHubDiscoveryBytes caps the part of a feed read to find its hub
+	maxHubDiscoveryBytes = 2 << 20
+	// websubRenewBefore is how long before its lease ends a subscription is renewed
+	websubRenewBefore = 24 * time.Hour
+	// websubRetryAfter is how long feeds without a working subscription wait before their
+	// hub is looked up again
+	websubRetryAfter = 7 * 24 * time.Hour
+)
+
+// States of a WebSub subscription
+const (
+	websubPending = "pending"
+	websubActive  = "active"
+	websubDenied  = "denied"
+	websubFailed  = "failed"
+	websubNone    = "none"
+)
+
+type websubPayload struct {
+	FeedID int `json:"feed_id"`
+}
+
+// WebSubService subscribes feeds that name a WebSub (PubSubHubbub) hub at that hub, so new
+// items are pushed to the callback endpoint as soon as they are published. Polling goes on
+// as usual, so a hub that stops pushing only delays items until the next refresh. It needs
+// the public URL of the app for the callback; without one it does nothing.
+type WebSubService struct {
+	db          *database.DB
+	feedService *FeedService
+	jobService  *JobService
+	publicURL   string
+	client      *http.Client
+}
+
+func NewWebSubService(publicURL string, db *database.DB, feedService *FeedService, jobService *JobService) *WebSubService {
+	ws := &WebSubService{
+		db:          db,
+		feedService: feedService,
+		jobService:  jobService,
+		publicURL:   publicURL,
+		client:      &http.Client{Timeout: websubTimeout},
+	}
+	if ws.Enabled() {
+		feedService.SubscribeFeedAdded(ws.feedAdded)
+	}
+	return ws
+}
+
+// Enabled reports whether the app has a public URL hubs can call back
+func (ws *WebSubService) Enabled() bool {
+	return ws.publicURL != ""
+}
+
+// feedAdded queues the hub subscription of a new feed
+func (ws *WebSubService) feedAdded(feed *models.Feed) {
+	ws.enqueue(feed.ID)
+}
+
+func (ws *WebSubService) enqueue(feedID int) {
+	_, err := ws.jobService.EnqueueUnique(JobWebSubSubscribe, feedTarget(feedID), websubPayload{FeedID: feedID}, time.Now(), 0)
+	if err != nil {
+		websubLog.Error("Failed to queue hub subscription", "feed_id", feedID, "error", err)
+	}
+}
+
+// callbackURL is where the hub of a feed verifies the subscription and pushes items
+func (ws *WebSubService) callbackURL(feedID int) string {
+	return ws.publicURL + "/api/websub/callback/" + strconv.Itoa(feedID)
+}
+
+// HandleSubscribeJob looks up the hub of a feed and asks it for a subscription. The hub
+// confirms it later through Verify. Feeds without a hub are recorded as such.
+func (ws *WebSubService) HandleSubscribeJob(ctx context.Context, job *models.Job) error {
+	var payload websubPayload
+	if err := decodePayload(job, &payload); err != nil {
+		return PermanentJobError(err)
+	}
+	feed, err := ws.feedService.GetFeedByID(payload.FeedID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	hub, topic, err := ws.discoverHub(ctx, feed.URL)
+	if err != nil {
+		return err
+	}
+	if hub == "" {
+		return ws.saveState(feed.ID, "", "", websubNone, nil)
+	}
+
+	secret, err := ws.secret(feed.ID)
+	if err != nil {
+		return err
+	}
+	query := `
+		INSERT INTO websub_subscriptions (feed_id, hub, topic, secret, state, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (feed_id) DO UPDATE SET hub = excluded.hub, topic = excluded.topic,
+			secret = excluded.secret, state = excluded.state, error = NULL, updated_at = excluded.updated_at
+	`
+	if _, err := ws.db.Exec(query, feed.ID, hub, topic, secret, websubPending, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to save subscription: %v", err)
+	}
+
+	if err := ws.subscribe(ctx, feed.ID, hub, topic, secret); err != nil {
+		if saveErr := ws.saveState(feed.ID, hub, topic, websubFailed, err); saveErr != nil {
+			websubLog.Error("Failed to record hub subscription", "feed_id", feed.ID, "error", saveErr)
+		}
+		return err
+	}
+	websubLog.Info("Requested hub subscription", "feed_id", feed.ID, "hub", hub, "topic", topic)
+	return nil
+}
+
+// secret returns the secret of a feed's subscription, made up on the first subscription
+func (ws *WebSubService) secret(feedID int) (string, error) {
+	var secret string
+	err := ws.db.QueryRow(`SELECT secret FROM websub_subscriptions WHERE feed_id = ?`, feedID).Scan(&secret)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if secret != "" {
+		return secret, nil
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %v", err)
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// saveState records the state of a feed's subscription with the reason it is not active
+func (ws *WebSubService) saveState(feedID int, hub, topic, state string, reason error) error {
+	var errText *string
+	if reason != nil {
+		text := reason.Error()
+		errText = &text
+	}
+	query := `
+		INSERT INTO websub_subscriptions (feed_id, hub, topic, state, error, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (feed_id) DO UPDATE SET hub = excluded.hub, topic = excluded.topic,
+			state = excluded.state, error = excluded.error, updated_at = excluded.updated_at
+	`
+	_, err := ws.db.Exec(query, feedID, hub, topic, state, errText, time.Now().UTC())
+	return err
+}
+
+// subscribe sends a subscription request to a hub. Rejections with a 4xx status are
+// permanent.
+func (ws *WebSubService) subscribe(ctx context.Context, feedID int, hub, topic, secret string) error {
+	form := url.Values{
+		"hub.callback": {ws.callbackURL(feedID)},
+		"hub.mode":     {"subscribe"},
+		"hub.topic":    {topic},
+		"hub.secret":   {secret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hub, strings.NewReader(form.Encode()))
+	if err != nil {
+		return PermanentJobError(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", feedUserAgent)
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach hub: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("hub returned %s: %s", resp.Status, strings.TrimSpace(string(text)))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		return PermanentJobError(err)
+	}
+	return err
+}
+
+// discoverHub downloads a feed and returns the hub it names, from the Link header or its
+// own links, with the topic to subscribe to: the feed's self link, or its URL. The hub is
+// "" if the feed names none.
+func (ws *WebSubService) discoverHub(ctx context.Context, feedURL string) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedURL, nil)
+	if err != nil {
+		return "", "", PermanentJobError(err)
+	}
+	req.Header.Set("User-Agent", feedUserAgent)
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to download feed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("feed returned %s", resp.Status)
+	}
+
+	hub, self := headerLinks(resp.Header.Values("Link"))
+	if hub == "" || self == "" {
+		feedHub, feedSelf := hubFeedLinks(io.LimitReader(resp.Body, maxHubDiscoveryBytes))
+		if hub == "" {
+			hub = feedHub
+		}
+		if self == "" {
+			self = feedSelf
+		}
+	}
+	if hub == "" {
+		return "", "", nil
+	}
+
+	base := resp.Request.URL
+	hubURL, err := base.Parse(hub)
+	if err != nil || (hubURL.Scheme != "http" && hubURL.Scheme != "https") {
+		return "", "", PermanentJobError(fmt.Errorf("invalid hub %q", hub))
+	}
+	topic := feedURL
+	if self != "" {
+		if selfURL, err := base.Parse(self); err == nil {
+			topic = selfURL.String()
+		}
+	}
+	return hubURL.String(), topic, nil
+}
+
+// headerLinks returns the hub and self links of Link headers, like
+// `<https://hub.example.com/>; rel="hub"`
+func headerLinks(headers []string) (hub, self string) {
+	for _, header := range headers {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			target = target[1 : len(target)-1]
+			for _, param := range parts[1:] {
+				name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if !strings.EqualFold(name, "rel") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(value, `"`)) {
+					switch {
+					case strings.EqualFold(rel, "hub") && hub == "":
+						hub = target
+					case strings.EqualFold(rel, "self") && self == "":
+						self = target
+					}
+				}
+			}
+		}
+	}
+	return hub, self
+}
+
+// hubFeedLinks returns the hub and self links of an RSS or Atom feed, which come before its
+// items
+func hubFeedLinks(r io.Reader) (hub, self string) {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return hub, self
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "item", "entry":
+			return hub, self
+		case "link":
+			var rel, href string
+			for _, attr := range start.Attr {
+				switch attr.Name.Local {
+				case "rel":
+					rel = attr.Value
+				case "href":
+					href = attr.Value
+				}
+			}
+			switch {
+			case href == "":
+			case rel == "hub" && hub == "":
+				hub = href
+			case rel == "self" && self == "":
+				self = href
+			}
+		}
+	}
+}
+
+// Verify answers a hub checking a subscription request of a feed, with the hub.* query
+// parameters of its request: a pending subscription to the topic that was requested is
+// confirmed and the challenge returned, a denial is recorded. Anything else returns
+// sql.ErrNoRows, which the hub takes as a refusal. The topic is the public feed URL, so
+// only a subscription that was just requested can be confirmed; otherwise anyone could
+// move the end of its lease.
+func (ws *WebSubService) Verify(feedID int, params url.Values) (string, error) {
+	mode, topic := params.Get("hub.mode"), params.Get("hub.topic")
+	challenge, leaseSeconds := params.Get("hub.challenge"), params.Get("hub.lease_seconds")
+
+	var subTopic, state string
+	err := ws.db.QueryRow(`SELECT topic, state FROM websub_subscriptions WHERE feed_id = ?`, feedID).Scan(&subTopic, &state)
+	if err != nil {
+		return "", err
+	}
+	if topic != subTopic {
+		return "", sql.ErrNoRows
+	}
+
+	now := time.Now().UTC()
+	switch mode {
+	case "subscribe":
+		if state != websubPending {
+			return "", sql.ErrNoRows
+		}
+		if challenge == "" {
+			return "", invalidField("hub.challenge", "challenge is required")
+		}
+		var leaseExpires *time.Time
+		if seconds, err := strconv.Atoi(leaseSeconds); err == nil && seconds > 0 {
+			expires := now.Add(time.Duration(seconds) * time.Second)
+			leaseExpires = &expires
+		}
+		query := `
+			UPDATE websub_subscriptions SET state = ?, lease_expires_at = ?, error = NULL, updated_at = ?
+			WHERE feed_id = ? AND state = ?
+		`
+		result, err := ws.db.Exec(query, websubActive, leaseExpires, now, feedID, websubPending)
+		if err != nil {
+			return "", err
+		}
+		if confirmed, err := result.RowsAffected(); err != nil || confirmed == 0 {
+			return "", sql.ErrNoRows
+		}
+		websubLog.Info("Hub subscription active", "feed_id", feedID, "lease_seconds", leaseSeconds)
+		return challenge, nil
+	case "denied":
+		query := `UPDATE websub_subscriptions SET state = ?, error = ?, updated_at = ? WHERE feed_id = ?`
+		reason := params.Get("hub.reason")
+		if _, err := ws.db.Exec(query, websubDenied, reason, now, feedID); err != nil {
+			return "", err
+		}
+		websubLog.Warn("Hub denied subscription", "feed_id", feedID, "reason", reason)
+		return "", nil
+	}
+	return "", sql.ErrNoRows
+}
+
+// Push stores the new items of a feed pushed by its hub, and returns how many were new.
+// The body must be signed with the subscription's secret in the X-Hub-Signature header;
+// unsigned or wrongly signed content is dropped without an error, as WebSub asks, so that
+// a forger learns nothing. Feeds without an active subscription return sql.ErrNoRows; a
+// subscription being renewed stays active until its lease ends.
+func (ws *WebSubService) Push(ctx context.Context, feedID int, signature string, body []byte) (int, error) {
+	var secret, state string
+	var leaseExpires *time.Time
+	query := `SELECT secret, state, lease_expires_at FROM websub_subscriptions WHERE feed_id = ?`
+	err := ws.db.QueryRow(query, feedID).Scan(&secret, &state, &leaseExpires)
+	if err != nil {
+		return 0, err
+	}
+	renewing := state == websubPending && leaseExpires != nil && leaseExpires.After(time.Now())
+	if state != websubActive && !renewing {
+		return 0, sql.ErrNoRows
+	}
+	if !validHubSignature(secret, signature, body) {
+		websubLog.Warn("Dropped push with an invalid signature", "feed_id", feedID)
+		return 0, nil
+	}
+
+	added, err := ws.feedService.PushItems(ctx, feedID, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	websubLog.Debug("Received push", "feed_id", feedID, "added", added)
+	return added, nil
+}
+
+// validHubSignature checks an X-Hub-Signature header like "sha256=<hex>", the HMAC of the
+// body with the secret
+func validHubSignature(secret, signature string, body []byte) bool {
+	method, sum, ok := strings.Cut(signature, "=")
+	if !ok {
+		return false
+	}
+	var newHash func() hash.Hash
+	switch strings.ToLower(method) {
+	case "sha1":
+		newHash = sha1.New
+	case "sha256":
+		newHash = sha256.New
+	case "sha384":
+		newHash = sha512.New384
+	case "sha512":
+		newHash = sha512.New
+	default:
+		return false
+	}
+	expected, err := hex.DecodeString(sum)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// RenewDue queues a hub subscription for feeds that have never looked for a hub, whose
+// lease ends within a day, or that had no working subscription for a week. It returns how
+// many were queued.
+func (ws *WebSubService) RenewDue() (int, error) {
+	if !ws.Enabled() {
+		return 0, nil
+	}
+	now := time.Now().UTC()
+	query := `
+		SELECT f.id FROM feeds f
+		LEFT JOIN websub_subscriptions w ON w.feed_id = f.id
+		WHERE f.paused = ? AND (
+			w.feed_id IS NULL
+			OR (w.state = ? AND w.lease_expires_at IS NOT NULL AND w.lease_expires_at <= ?)
+			OR (w.state IN (?, ?, ?, ?) AND w.updated_at <= ?)
+		)
+	`
+	rows, err := ws.db.Query(query, false, websubActive, now.Add(websubRenewBefore),
+		websubPending, websubNone, websubDenied, websubFailed, now.Add(-websubRetryAfter))
+	if err != nil {
+		return 0, err
+	}
+	var feedIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		feedIDs = append(feedIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range feedIDs {
+		ws.enqueue(id)
+	}
+	return len(feedIDs), nil
+}